@@ -0,0 +1,26 @@
+#!/bin/bash
+
+# Build release binaries of amppkg, stamped with the version, commit, and build
+# date (see packager/version), into dist/<os>_<arch>/amppkg.
+#
+# Run from a git checkout. The build date is the commit time, so that the same
+# commit always produces the same binary. To build only some platforms:
+#    PLATFORMS="linux/amd64" ./build.sh
+
+set -e
+
+PLATFORMS=${PLATFORMS:-"linux/amd64 linux/arm64 darwin/amd64"}
+
+pkg=github.com/ampproject/amppackager/packager/version
+version=$(git describe --tags --always --dirty)
+commit=$(git rev-parse HEAD)
+date=$(TZ=UTC git show -s --format=%cd --date=format-local:%Y-%m-%dT%H:%M:%SZ HEAD)
+ldflags="-X $pkg.Version=$version -X $pkg.Commit=$commit -X $pkg.BuildDate=$date"
+
+for platform in $PLATFORMS; do
+  os=${platform%/*}
+  arch=${platform#*/}
+  echo "Building amppkg $version for $os/$arch"
+  CGO_ENABLED=0 GOOS=$os GOARCH=$arch go build -mod=vendor -trimpath \
+    -ldflags "$ldflags" -o "dist/${os}_${arch}/amppkg" ./cmd/amppkg
+done
@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/pkg/errors"
+
+	"github.com/ampproject/amppackager/packager/certcache"
+	"github.com/ampproject/amppackager/packager/certloader"
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// Checks that a cert chain and key are suitable for signing exchanges, before
+// deploying them, printing each problem found along with how to fix it. Runs
+// the same checks as the server does at startup, plus those that the server
+// tolerates in development mode or handles on its own.
+func checkCert(args []string) error {
+	flags := flag.NewFlagSet("checkcert", flag.ExitOnError)
+	certFile := flags.String("cert", "", "Path to the PEM cert chain, leaf first.")
+	keyFile := flags.String("key", "", "Path to the PEM private key.")
+	domains := flags.String("domain", "", "Comma-separated domains that the cert must cover, i.e. each URLSet.Sign.Domain.")
+	checkOCSP := flags.Bool("ocsp", true, "Whether to fetch an OCSP response from the CA, as the server would.")
+	flags.Parse(args)
+	if *certFile == "" || *keyFile == "" || *domains == "" {
+		return errors.New("must specify -cert, -key, and -domain")
+	}
+	var domainList []string
+	for _, domain := range strings.Split(*domains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domainList = append(domainList, domain)
+		}
+	}
+
+	certPem, err := ioutil.ReadFile(*certFile)
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", *certFile)
+	}
+	certs, err := signedexchange.ParseCertificates(certPem)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s", *certFile)
+	}
+	key, err := certloader.LoadKeyFromFile(&util.Config{KeyFile: *keyFile})
+	if err != nil {
+		return err
+	}
+	if len(certs) > 0 {
+		// As at startup, a chain of only the leaf is completed via AIA.
+		certs, err = certloader.CompleteCertChain(certs, &http.Client{Timeout: 60 * time.Second})
+		if err != nil {
+			return errors.Wrapf(err, "completing the cert chain in %s", *certFile)
+		}
+	}
+
+	if err := util.CheckCertChainComplete(certs); err != nil {
+		fmt.Println("WARNING:", err)
+	}
+	problems := util.CheckCertificate(certs, key, domainList, time.Now())
+	if *checkOCSP && len(problems) == 0 {
+		if _, err := certcache.FetchOCSP(certs, util.DefaultDeadlines.OCSP); err != nil {
+			problems = append(problems, errors.Wrap(err, "Fetching OCSP failed (see the log above); the server can't start until the CA's responder provides one"))
+		}
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("PROBLEM:", problem)
+		}
+		return errors.Errorf("%s is not suitable for signing exchanges; found %d problem(s)", *certFile, len(problems))
+	}
+	fmt.Printf("%s and %s are suitable for signing exchanges for %s, until %s.\n",
+		*certFile, *keyFile, strings.Join(domainList, ", "), certs[0].NotAfter.UTC())
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ampproject/amppackager/packager/certcache"
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// For -dev: generates an in-memory key and self-signed SXG cert covering each
+// URLSet.Sign.Domain (and localhost, for the development TLS server), so that
+// packaging can be tried out without obtaining a real cert. Its OCSP responses
+// are generated, and cached in a temp dir, so as not to clobber OCSPCache.
+func loadDevCertHandler(config *util.Config) (certcache.Reloadable, crypto.PrivateKey, error) {
+	domains := []string{}
+	for _, urlSet := range config.URLSet {
+		if urlSet.Sign.Domain != "" {
+			domains = append(domains, urlSet.Sign.Domain)
+		}
+	}
+	domains = append(domains, "localhost")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "generating key")
+	}
+	cert, err := util.CreateSelfSignedSXGCertificate(key, domains, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	ocspDir, err := ioutil.TempDir("", "amppkg-dev")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "creating OCSP cache dir")
+	}
+	certCache := certcache.New([]*x509.Certificate{cert}, nil, domains, "", "", filepath.Join(ocspDir, "ocsp"),
+		fakeOCSPResponder{key: key}.Respond)
+	if err := certCache.Init(); err != nil {
+		return nil, nil, errors.Wrap(err, "initializing cert cache")
+	}
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	log.Printf("Generated a self-signed SXG cert for %v. Browsers reject it, unless launched with e.g.:\n", domains)
+	log.Printf("  chrome --user-data-dir=/tmp/udd --ignore-certificate-errors-spki-list=%s\n",
+		base64.StdEncoding.EncodeToString(spki[:]))
+	return certCache, key, nil
+}
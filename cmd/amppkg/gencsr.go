@@ -0,0 +1,86 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// Generates a P-256 key and a CSR for an SXG cert, as stock openssl makes it
+// awkward to request the CanSignHttpExchanges extension.
+func genCSR(args []string) error {
+	flags := flag.NewFlagSet("gencsr", flag.ExitOnError)
+	domains := flags.String("domains", "", "Comma-separated domains for the cert to cover, e.g. \"example.com,www.example.com\".")
+	keyOut := flags.String("keyout", "privkey.pem", "Path to write the new private key to. Must not exist.")
+	csrOut := flags.String("csrout", "cert.csr", "Path to write the CSR to. Must not exist.")
+	flags.Parse(args)
+	if *domains == "" {
+		return errors.New("must specify -domains")
+	}
+	var domainList []string
+	for _, domain := range strings.Split(*domains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domainList = append(domainList, domain)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "generating key")
+	}
+	csr, err := util.CreateSXGCertificateRequest(key, domainList)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "encoding key")
+	}
+	if err := writeNewPEM(*keyOut, 0600, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}); err != nil {
+		return err
+	}
+	if err := writeNewPEM(*csrOut, 0644, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote the private key to %s and the CSR to %s.\n", *keyOut, *csrOut)
+	fmt.Println("Submit the CSR to a CA that issues SXG certs, and set KeyFile (and, for ACME, CSRFile) in amppkg.toml. Keep the key secret, and don't use it for TLS.")
+	return nil
+}
+
+// Writes the PEM block to a new file at path, failing rather than overwriting
+// an existing one.
+func writeNewPEM(path string, perm os.FileMode, block *pem.Block) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", path)
+	}
+	if err := pem.Encode(file, block); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "writing %s", path)
+	}
+	return errors.Wrapf(file.Close(), "closing %s", path)
+}
@@ -18,30 +18,58 @@
 package main
 
 import (
-	"crypto/ecdsa"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/ampproject/amppackager/packager/admin"
+	"github.com/ampproject/amppackager/packager/allowlist"
 	"github.com/ampproject/amppackager/packager/certcache"
 	"github.com/ampproject/amppackager/packager/certloader"
 	"github.com/ampproject/amppackager/packager/healthz"
+	"github.com/ampproject/amppackager/packager/metrics"
 	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/popularity"
 	"github.com/ampproject/amppackager/packager/rtv"
+	"github.com/ampproject/amppackager/packager/selfcheck"
+	"github.com/ampproject/amppackager/packager/serverless"
 	"github.com/ampproject/amppackager/packager/signer"
+	"github.com/ampproject/amppackager/packager/urlmatch"
 	"github.com/ampproject/amppackager/packager/util"
 	"github.com/ampproject/amppackager/packager/validitymap"
+	"github.com/ampproject/amppackager/packager/version"
 )
 
 var flagConfig = flag.String("config", "amppkg.toml", "Path to the config toml file.")
 var flagDevelopment = flag.Bool("development", false, "True if this is a development server.")
+var flagDev = flag.Bool("dev", false, "Sign with an in-memory self-signed cert rather than CertFile and KeyFile, for trying out packaging locally. Implies -development.")
 var flagInvalidCert = flag.Bool("invalidcert", false, "True if invalid certificate intentionally used in production.")
+var flagProfile = flag.String("profile", "", "The name of the config [Profile.*] section to apply, e.g. \"staging\".")
+var flagVersion = flag.Bool("version", false, "Print the version of this build, and exit.")
+var flagValidateConfig = flag.Bool("validateconfig", false, "Validate the config file, print any warnings, and exit.")
+
+// Subcommands, run as `amppkg <name> [flags]`, each with its own flags.
+// Without one, amppkg runs the server.
+var subcommands = map[string]func(args []string) error{
+	"checkcert": checkCert,
+	"gencsr":    genCSR,
+}
 
 // IMPORTANT: do not turn on this flag for now, it's still under development.
 var flagAutoRenewCert = flag.Bool("autorenewcert", false, "True if amppackager is to attempt cert auto-renewal.")
@@ -61,11 +89,126 @@ func (this logIntercept) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 	// TODO(twifkak): Separate the typical weblog from the detailed error log.
 }
 
+// Loads the cert and key (and NextCert or SecondaryCert, if configured) from
+// the files named in config, and starts maintaining their OCSP responses.
+// Called at startup, and again whenever a reload is requested via the admin
+// endpoint.
+func loadCertHandler(config *util.Config) (certcache.Reloadable, crypto.PrivateKey, error) {
+	if config.NextCert != nil && *flagAutoRenewCert {
+		return nil, nil, errors.New("NextCert cannot be used with --autorenewcert")
+	}
+	key, err := certloader.LoadKey(config)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "loading key")
+	}
+	certCache, err := loadCertCache(config, key, *flagAutoRenewCert)
+	if err != nil {
+		return nil, nil, err
+	}
+	if secondaryConfig := config.ForSecondaryCert(); secondaryConfig != nil {
+		secondaryKey, err := certloader.LoadKey(secondaryConfig)
+		if err != nil {
+			certCache.Stop()
+			return nil, nil, errors.Wrap(err, "loading SecondaryCert key")
+		}
+		secondaryCertCache, err := loadCertCache(secondaryConfig, secondaryKey, false)
+		if err != nil {
+			certCache.Stop()
+			return nil, nil, errors.Wrap(err, "loading SecondaryCert")
+		}
+		log.Printf("Serving both %s and %s; URLSets with DualSign are signed with both.\n", config.CertFile, secondaryConfig.CertFile)
+		return certcache.NewDual(certCache, key, secondaryCertCache, secondaryKey), key, nil
+	}
+	nextConfig := config.ForNextCert()
+	if nextConfig == nil {
+		return certCache, key, nil
+	}
+	nextKey, err := certloader.LoadKey(nextConfig)
+	if err != nil {
+		certCache.Stop()
+		return nil, nil, errors.Wrap(err, "loading NextCert key")
+	}
+	nextCertCache, err := loadCertCache(nextConfig, nextKey, false)
+	if err != nil {
+		certCache.Stop()
+		return nil, nil, errors.Wrap(err, "loading NextCert")
+	}
+	log.Printf("Serving both %s and %s; signing will switch to the latter at %v.\n", config.CertFile, nextConfig.CertFile, config.NextCert.SwitchTime)
+	rotating := certcache.NewRotating(certCache, key, nextCertCache, nextKey, config.NextCert.SwitchTime)
+	if overlap := config.NextCert.DualSignOverlapDuration(); overlap > 0 {
+		log.Printf("Signing with both for %v either side of the switch.\n", overlap)
+		rotating.DualSignWithin(overlap)
+	}
+	return rotating, key, nil
+}
+
+func loadCertCache(config *util.Config, key crypto.PrivateKey, autoRenewCert bool) (*certcache.CertCache, error) {
+	var responder certcache.OCSPResponder = nil
+	if *flagDevelopment {
+		// Key is guaranteed to be a crypto.Signer by certloader.LoadKey.
+		responder = fakeOCSPResponder{key: key.(crypto.Signer)}.Respond
+	}
+	certCache, err := certcache.PopulateCertCache(config, key, responder, *flagDevelopment || *flagInvalidCert, autoRenewCert)
+	if err != nil {
+		return nil, errors.Wrap(err, "building cert cache")
+	}
+	if err = certCache.Init(); err != nil {
+		if *flagDevelopment {
+			fmt.Println("WARNING:", err)
+		} else {
+			return nil, errors.Wrap(err, "initializing cert cache")
+		}
+	}
+	return certCache, nil
+}
+
 // Exposes an HTTP server. Don't run this on the open internet, for at least two reasons:
 //  - It exposes an API that allows people to sign any URL as any other URL.
 //  - It is in cleartext.
+// How long to let the requests in flight finish, on SIGINT or SIGTERM.
+const shutdownTimeout = 30 * time.Second
+
+// Runs serve until it fails, in which case this exits, or until SIGINT or
+// SIGTERM, after which this returns once the requests in flight finish, so
+// that main's deferred cleanup runs.
+func serveUntilShutdown(server *http.Server, serve func() error) {
+	idle := make(chan struct{})
+	go func() {
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+		log.Println("Shutting down on", <-shutdown)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("Error shutting down:", err)
+		}
+		close(idle)
+	}()
+	if err := serve(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-idle
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			if err := subcommand(os.Args[2:]); err != nil {
+				die(err)
+			}
+			return
+		}
+	}
 	flag.Parse()
+	buildInfo := version.Get()
+	if *flagVersion {
+		fmt.Println(buildInfo)
+		return
+	}
+	log.Println("Starting", buildInfo)
+	if *flagDev {
+		*flagDevelopment = true
+	}
 	if *flagConfig == "" {
 		die("must specify --config")
 	}
@@ -73,40 +216,76 @@ func main() {
 	if err != nil {
 		die(errors.Wrapf(err, "reading config at %s", *flagConfig))
 	}
-	config, err := util.ReadConfig(configBytes)
+	readConfig := util.ReadConfigProfile
+	if *flagDev {
+		readConfig = util.ReadDevConfigProfile
+	}
+	config, err := readConfig(configBytes, *flagProfile)
 	if err != nil {
 		die(errors.Wrapf(err, "parsing config at %s", *flagConfig))
 	}
+	if *flagProfile != "" {
+		log.Printf("Using config profile %q, with cert %s.\n", *flagProfile, config.CertFile)
+	}
+	for i, urlSet := range config.URLSet {
+		if urlSet.FetchTLS != nil && urlSet.FetchTLS.InsecureSkipVerify {
+			if !*flagDevelopment {
+				die(errors.Errorf("URLSet.%d.FetchTLS.InsecureSkipVerify requires -development", i))
+			}
+			log.Printf("WARNING: Not verifying origin certs for URLSet.%d.\n", i)
+		}
+	}
+	warnings := config.Warnings()
+	if serverless.IsLambda() && !strings.HasPrefix(filepath.Clean(config.OCSPCache), os.TempDir()+string(filepath.Separator)) {
+		// Lambda's filesystem is read-only, except for the temp dir,
+		// which isn't shared between instances; each fetches its own
+		// OCSP response on cold start.
+		warnings = append(warnings, fmt.Sprintf("OCSPCache %s is outside %s, so is likely unwritable on Lambda", config.OCSPCache, os.TempDir()))
+	}
+	for _, warning := range warnings {
+		log.Println("WARNING:", warning)
+	}
+	if *flagValidateConfig {
+		fmt.Printf("%s: valid, with %d warning(s)\n", *flagConfig, len(warnings))
+		return
+	}
+
+	if config.ErrorPageTemplate != "" {
+		if err := util.LoadErrorPageTemplate(config.ErrorPageTemplate); err != nil {
+			die(errors.Wrap(err, "loading ErrorPageTemplate"))
+		}
+	}
+	if config.JSONErrors {
+		util.UseJSONErrors()
+	}
 
 	validityMap, err := validitymap.New()
 	if err != nil {
 		die(errors.Wrap(err, "building validity map"))
 	}
 
-	key, err := certloader.LoadKeyFromFile(config)
+	certHandler, err := certcache.NewReloadable(func() (certcache.Reloadable, crypto.PrivateKey, error) {
+		if *flagDev {
+			return loadDevCertHandler(config)
+		}
+		return loadCertHandler(config)
+	}, config.MaxSignatureDuration())
 	if err != nil {
-		die(errors.Wrap(err, "loading key file"))
+		die(err)
 	}
+	// The signer gets the latest key from certHandler; this initial one is
+	// only used for development-mode TLS.
+	_, key := certHandler.GetLatestCertAndKey()
 
-	var responder certcache.OCSPResponder = nil
-	if *flagDevelopment {
-		// Key is guaranteed to be ECDSA by signedexchange.ParsePrivateKey. This may change in future versions of SXG.
-		responder = fakeOCSPResponder{key: key.(*ecdsa.PrivateKey)}.Respond
-	}
-	certCache, err := certcache.PopulateCertCache(config, key, responder, *flagDevelopment || *flagInvalidCert, *flagAutoRenewCert)
-	if err != nil {
-		die(errors.Wrap(err, "building cert cache"))
-	}
+	// Alert on this well before it reaches zero, at which point browsers
+	// stop accepting SXGs. Signing stops shortly before then.
+	metrics.NewGauge("amppkg_cert_expiry_seconds", func() int64 {
+		return certcache.SecondsUntilExpiry(certHandler, util.SystemClock{})
+	})
 
-	if err = certCache.Init(); err != nil {
-		if *flagDevelopment {
-			fmt.Println("WARNING:", err)
-		} else {
-			die(errors.Wrap(err, "initializing cert cache"))
-		}
-        }
+	expvar.Publish("amppkg_build_info", expvar.Func(func() interface{} { return buildInfo }))
 
-	healthz, err := healthz.New(certCache)
+	healthz, err := healthz.New(certHandler)
 	if err != nil {
 		die(errors.Wrap(err, "building healthz"))
 	}
@@ -126,24 +305,169 @@ func main() {
 		}
 	}
 
-	signer, err := signer.New(certCache, key, config.URLSet, rtvCache, certCache.IsHealthy,
-		overrideBaseURL, /*requireHeaders=*/!*flagDevelopment, config.ForwardedRequestHeaders)
+	signer, err := signer.New(certHandler, key, config.URLSet, rtvCache, certHandler.IsHealthy,
+		overrideBaseURL, /*requireHeaders=*/!*flagDevelopment, config.ForwardedRequestHeaders, config.ReadOnlyChecker(util.SystemClock{}),
+		config.SignatureDuration(), config.CertURLBaseURL())
 	if err != nil {
 		die(errors.Wrap(err, "building signer"))
 	}
+	signer.LimitOriginRequests(config.MaxOriginRequests)
+	signer.UseFetchPool(config.FetchPoolSettings())
+	signer.LimitFetchHeaders(config.MaxFetchHeaderBytes, config.MaxFetchHeaders)
+	signer.IdentifyFetches(config.FetchUserAgent, config.FetchFrom)
+	if config.CoalesceFetches {
+		signer.CoalesceFetches()
+	}
+	signer.BlockPrivateFetches(config.AllowedFetchIPNets())
+	signer.ResolveFetchHosts(config.FetchHostIPs(), config.DNSCacheDuration())
+	signer.UseMIRecordSize(config.MIRecordSize)
+	signer.LimitExchangeSize(config.MaxSXGSize)
+	signer.LimitConcurrentSigning(config.SigningWorkers, config.SigningQueueDepth)
+	if config.VerifySignedExchanges {
+		signer.VerifyExchanges()
+	}
+	if config.WebBundles {
+		signer.ServeWebBundles()
+	}
+	fetchAllowlists := make([]urlmatch.HostAllowlist, len(config.URLSet))
+	for i, urlSet := range config.URLSet {
+		if urlSet.FetchAllowlist == nil {
+			continue
+		}
+		var source allowlist.Source
+		if urlSet.FetchAllowlist.DNSTXT != "" {
+			source = allowlist.DNSTXT(urlSet.FetchAllowlist.DNSTXT)
+		} else {
+			source = allowlist.HTTP(urlSet.FetchAllowlist.URL, &http.Client{Timeout: 1 * time.Minute})
+		}
+		hosts, err := allowlist.New(source, urlSet.FetchAllowlist.RefreshDuration())
+		if err != nil {
+			die(errors.Wrapf(err, "reading URLSet.%d.FetchAllowlist", i))
+		}
+		hosts.StartCron()
+		defer hosts.StopCron()
+		fetchAllowlists[i] = hosts
+	}
+	signer.UseFetchAllowlists(fetchAllowlists)
+	signer.UseValidityMap(validityMap)
+	if config.ResignableExchanges > 0 {
+		signer.RememberExchanges(config.ResignableExchanges)
+	}
+	if config.SignatureCacheBytes > 0 {
+		signer.CacheSignatures(config.SignatureCacheBytes)
+	}
+	if config.SignatureCacheFile != "" {
+		// A missing or corrupt snapshot only costs a cold cache.
+		if loaded, err := signer.LoadSignatures(config.SignatureCacheFile); err != nil {
+			log.Printf("Error restoring signature cache from %s: %+v\n", config.SignatureCacheFile, err)
+		} else {
+			log.Printf("Restored %d signed exchanges from %s\n", loaded, config.SignatureCacheFile)
+		}
+		saveSignatures := func() {
+			if err := signer.SaveSignatures(config.SignatureCacheFile); err != nil {
+				log.Printf("Error saving signature cache to %s: %+v\n", config.SignatureCacheFile, err)
+			}
+		}
+		stopSaving, saved := make(chan struct{}), make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(util.SignatureCacheSaveInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					saveSignatures()
+				case <-stopSaving:
+					// Save once more, so that the next start restores
+					// everything signed up to shutdown.
+					saveSignatures()
+					close(saved)
+					return
+				}
+			}
+		}()
+		defer func() {
+			close(stopSaving)
+			<-saved
+		}()
+	}
+	var popularURLs *popularity.Tracker
+	if config.PopularURLs > 0 {
+		// Weigh requests by recency on the scale of a signature lifetime.
+		popularURLs = popularity.New(config.PopularURLs, config.SignatureDuration())
+		signer.TrackPopularity(popularURLs)
+	}
+
+	// The metrics and version reveal internals such as memory usage, the
+	// command line, and the exact build, so they're served only with the
+	// admin token.
+	var adminHandler, metricsHandler, versionHandler http.Handler = nil, nil, nil
+	if config.AdminTokenFile != "" {
+		token, err := ioutil.ReadFile(config.AdminTokenFile)
+		if err != nil {
+			die(errors.Wrapf(err, "reading admin token at %s", config.AdminTokenFile))
+		}
+		adminAPI, err := admin.New(strings.TrimSpace(string(token)), certHandler, certHandler.Reload, popularURLs, http.HandlerFunc(signer.ServeRefetch))
+		if err != nil {
+			die(errors.Wrap(err, "building admin handler"))
+		}
+		adminHandler, metricsHandler, versionHandler = adminAPI, adminAPI.Protect(metrics.Handler()), adminAPI.Protect(version.Handler())
+	}
+
+	// Disabled routes respond 404, as if they didn't exist.
+	var certChainHandler, signerHandler, validityHandler, healthzHandler http.Handler = certHandler, signer, validityMap, healthz
+	if config.IsRouteDisabled(util.CertRoute) {
+		certChainHandler = nil
+	}
+	if config.IsRouteDisabled(util.DocRoute) {
+		signerHandler = nil
+	}
+	if config.IsRouteDisabled(util.ValidityRoute) {
+		validityHandler = nil
+	}
+	if config.IsRouteDisabled(util.HealthzRoute) {
+		healthzHandler = nil
+	}
+	if config.IsRouteDisabled(util.MetricsRoute) {
+		metricsHandler = nil
+	}
+	if config.IsRouteDisabled(util.VersionRoute) {
+		versionHandler = nil
+	}
+	if config.IsRouteDisabled(util.AdminRoute) {
+		adminHandler = nil
+	}
+	if serverless.IsLambda() && !config.LambdaPrivateRoutes {
+		log.Println("Disabling the private routes under Lambda, as LambdaPrivateRoutes is unset:", util.PrivateRoutes)
+		signerHandler, metricsHandler, versionHandler, adminHandler = nil, nil, nil, nil
+	}
 
 	// TODO(twifkak): Make log output configurable.
 
+	// Don't use DefaultServeMux, per
+	// https://blog.cloudflare.com/exposing-go-on-the-internet/.
+	handler := logIntercept{mux.New(mux.Handlers{
+		CertCache:   certChainHandler,
+		Signer:      signerHandler,
+		ValidityMap: validityHandler,
+		Healthz:     healthzHandler,
+		Metrics:     metricsHandler,
+		Admin:       adminHandler,
+		Version:     versionHandler,
+	})}
+
+	if serverless.IsLambda() {
+		log.Println("Serving Lambda invocations")
+		die(serverless.ServeLambda(handler))
+	}
+
 	addr := ""
 	if config.LocalOnly {
 		addr = "localhost"
 	}
 	addr += fmt.Sprint(":", config.Port)
 	server := http.Server{
-		Addr: addr,
-		// Don't use DefaultServeMux, per
-		// https://blog.cloudflare.com/exposing-go-on-the-internet/.
-		Handler:           logIntercept{mux.New(certCache, signer, validityMap, healthz)},
+		Addr:              addr,
+		Handler:           handler,
 		ReadTimeout:       10 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
 		// If needing to stream the response, disable WriteTimeout and
@@ -157,6 +481,32 @@ func main() {
 
 	// TODO(twifkak): Add monitoring (e.g. per the above Cloudflare blog).
 
+	if config.SelfCheck != nil {
+		client := &http.Client{Timeout: 1 * time.Minute}
+		baseURL := &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", config.Port)}
+		if *flagDevelopment {
+			// The development server's TLS cert isn't trusted.
+			baseURL.Scheme = "https"
+			client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		}
+		if config.SelfCheck.Public {
+			baseURL = nil
+		}
+		// Sample among the URLs with unexpired signatures, i.e. those
+		// signed recently.
+		prober := selfcheck.New(baseURL, client, func() []string {
+			signed := []string{}
+			for _, u := range popularURLs.Top(config.PopularURLs) {
+				if u.Expires != nil && u.Expires.After(time.Now()) {
+					signed = append(signed, u.Sign)
+				}
+			}
+			return signed
+		}, config.SelfCheck.Samples(), config.SelfCheck.IntervalDuration())
+		prober.StartCron()
+		defer prober.StopCron()
+	}
+
 	log.Println("Serving on port", config.Port)
 
 	// TCP keep-alive timeout on ListenAndServe is 3 minutes. To shorten,
@@ -164,11 +514,25 @@ func main() {
 
 	if *flagDevelopment {
 		log.Println("WARNING: Running in development, using SXG key for TLS. This won't work in production.")
-		log.Fatal(server.ListenAndServeTLS(config.CertFile, config.KeyFile))
+		// Use the already-loaded key rather than re-reading KeyFile, as
+		// it may be encrypted.
+		certs := []*x509.Certificate{certHandler.GetLatestCert()}
+		if !*flagDev {
+			certs, err = certloader.LoadCertsFromFile(config, true)
+			if err != nil {
+				die(errors.Wrap(err, "loading cert file"))
+			}
+		}
+		tlsCert := tls.Certificate{PrivateKey: key}
+		for _, cert := range certs {
+			tlsCert.Certificate = append(tlsCert.Certificate, cert.Raw)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{tlsCert}}
+		serveUntilShutdown(&server, func() error { return server.ListenAndServeTLS("", "") })
 	} else if *flagInvalidCert {
 		log.Println("WARNING: Running in production without valid signing certificate. Signed exchanges will not be valid.")
-		log.Fatal(server.ListenAndServe())
+		serveUntilShutdown(&server, server.ListenAndServe)
 	} else {
-		log.Fatal(server.ListenAndServe())
+		serveUntilShutdown(&server, server.ListenAndServe)
 	}
 }
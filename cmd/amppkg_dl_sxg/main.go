@@ -14,6 +14,7 @@ import (
 	"strconv"
 
 	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/ampproject/amppackager/packager/accept"
 	"github.com/pkg/errors"
 )
 
@@ -72,7 +73,7 @@ func getCert(url string) ([]byte, error) {
 	if resp.StatusCode != 200 {
 		return nil, errors.Errorf("cert-url response error: %s", resp.Status)
 	}
-	if contentType := resp.Header.Get("Content-Type"); contentType != "application/cert-chain+cbor" {
+	if contentType := resp.Header.Get("Content-Type"); contentType != accept.CertChainContentType {
 		return nil, errors.Errorf("invalid content-type of cert-url: %s", contentType)
 	}
 	defer resp.Body.Close()
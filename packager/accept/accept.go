@@ -3,20 +3,48 @@ package accept
 import (
 	"log"
 	"mime"
+	"strconv"
 	"strings"
 
 	"github.com/WICG/webpackage/go/signedexchange/version"
 	"github.com/ampproject/amppackager/packager/util"
 )
 
-// The SXG version that packager can produce. In the future, it may need to be
-// able to produce multiple versions.
+// The newest SXG version that packager can produce, and the one it prefers.
 const AcceptedSxgVersion = "b3"
 
-// The Content-Type for the SXG version that the signer produces.
+// The SXG versions that packager can produce, newest first, mapped to their
+// enums in the signedexchange library.
+var SupportedSxgVersions = []string{"b3", "b2", "b1"}
+
+var sxgVersions = map[string]version.Version{
+	"b1": version.Version1b1,
+	"b2": version.Version1b2,
+	"b3": version.Version1b3,
+}
+
+// The Content-Type for the SXG version that the signer prefers.
 const SxgContentType = "application/signed-exchange;v=" + AcceptedSxgVersion
 
-// The enum of the SXG version that the signer produces, for passing to the
+// The Content-Type for the given SXG version.
+func ContentType(v string) string {
+	return "application/signed-exchange;v=" + v
+}
+
+// The enum of the given supported SXG version, for passing to the
+// signedexchange library.
+func LibraryVersion(v string) version.Version {
+	return sxgVersions[v]
+}
+
+// The Content-Type of the cert chain referenced by the cert-url of the SXGs
+// that the signer produces. b3 (and later) user agents only accept the CBOR
+// cert-chain format
+// (https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#cert-chain-format),
+// not the older TLS 1.3 Certificate message format.
+const CertChainContentType = "application/cert-chain+cbor"
+
+// The enum of the SXG version that the signer prefers, for passing to the
 // signedexchange library.
 var SxgVersion = version.Version1b3
 
@@ -52,30 +80,55 @@ func tokenize(accept string) []string {
 	return tokens
 }
 
-// Determine whether a version specified by the accept header matches the
-// version of signed exchange output by the packager
-func hasMatchingSxgVersion(versions []string) bool {
-	for _, version := range versions {
-		if version == AcceptedSxgVersion {
-			return true
+// The rank of the version among SupportedSxgVersions, with newer versions
+// ranked higher, or -1 if unsupported.
+func versionRank(v string) int {
+	for i, supported := range SupportedSxgVersions {
+		if v == supported {
+			return len(SupportedSxgVersions) - i
 		}
 	}
-	return false
+	return -1
 }
 
-// True if the given Accept header is one that the packager can satisfy. It
-// must contain application/signed-exchange;v=$V so that the packager knows
-// whether or not it can supply the correct version. "" and "*/*" are not
-// satisfiable, for this reason.
-func CanSatisfy(accept string) bool {
-	types := tokenize(accept)
-	for _, mediaRange := range types {
+// Returns the SXG version to produce for the given Accept header: of those
+// supported by both, the one with the highest q-value, breaking ties in favor
+// of the newest. The header must contain application/signed-exchange;v=$V so
+// that the packager knows whether or not it can supply the correct version;
+// "" and "*/*" are not satisfiable, for this reason. If none is found,
+// returns "", and whether the header lists application/signed-exchange at
+// all, to distinguish clients that don't want an SXG from those that want a
+// version the packager can't produce.
+func NegotiateVersion(accept string) (v string, sxgRequested bool) {
+	bestQ, bestRank := 0.0, -1
+	for _, mediaRange := range tokenize(accept) {
 		mediatype, params, err := mime.ParseMediaType(mediaRange)
-		if err == nil && mediatype == "application/signed-exchange" {
-			if hasMatchingSxgVersion(strings.Split(params["v"], ",")) {
-				return true
+		if err != nil || mediatype != "application/signed-exchange" {
+			continue
+		}
+		sxgRequested = true
+		q := 1.0
+		if param, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(param, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		for _, candidate := range strings.Split(params["v"], ",") {
+			rank := versionRank(candidate)
+			if rank > 0 && (q > bestQ || q == bestQ && rank > bestRank) {
+				v, bestQ, bestRank = candidate, q, rank
 			}
 		}
 	}
-	return false
+	return v, sxgRequested
+}
+
+// True if the given Accept header is one that the packager can satisfy, per
+// NegotiateVersion.
+func CanSatisfy(accept string) bool {
+	v, _ := NegotiateVersion(accept)
+	return v != ""
 }
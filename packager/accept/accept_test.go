@@ -10,11 +10,14 @@ func TestCanSatisfy(t *testing.T) {
 	assert.False(t, CanSatisfy(""))
 	assert.False(t, CanSatisfy("*/*"))
 	assert.False(t, CanSatisfy("image/jpeg;v=b3"))
-	assert.False(t, CanSatisfy(`application/signed-exchange;v=b2`))
-	assert.False(t, CanSatisfy(`application/signed-exchange;v="b1,b2"`))
-	assert.False(t, CanSatisfy(`application/signed-exchange;x="y,application/signed-exchange;v=b3,z";v=b1`))
+	assert.False(t, CanSatisfy(`application/signed-exchange;v=b0`))
+	assert.False(t, CanSatisfy(`application/signed-exchange;v="b0,b4"`))
+	assert.False(t, CanSatisfy(`application/signed-exchange;v=b3;q=0`))
+	assert.False(t, CanSatisfy(`application/signed-exchange;x="y,application/signed-exchange;v=b3,z";v=b0`))
 
 	assert.True(t, CanSatisfy(`application/signed-exchange;v=b3`))
+	assert.True(t, CanSatisfy(`application/signed-exchange;v=b2`))
+	assert.True(t, CanSatisfy(`application/signed-exchange;v="b0,b1"`))
 	assert.True(t, CanSatisfy(`application/signed-exchange;v="b3"`))
 	assert.True(t, CanSatisfy(`application/signed-exchange;v="b2,b3,b4"`))
 	assert.True(t, CanSatisfy(`application/signed-exchange;v=b3;q=0.8`))
@@ -25,3 +28,27 @@ func TestCanSatisfy(t *testing.T) {
 	assert.True(t, CanSatisfy("*/* \t,\t application/signed-exchange;v=b3"))
 	assert.True(t, CanSatisfy(`application/signed-exchange;x="a,b";v="b3"`))
 }
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, test := range []struct {
+		accept       string
+		v            string
+		sxgRequested bool
+	}{
+		{"", "", false},
+		{"text/html,*/*", "", false},
+		{`application/signed-exchange;v=b0`, "", true},
+		{`application/signed-exchange;v=b3;q=0`, "", true},
+		{`application/signed-exchange;v="b1,b2,b3"`, "b3", true},
+		{`application/signed-exchange;v="b1,b2"`, "b2", true},
+		{`application/signed-exchange;v=b1`, "b1", true},
+		{`application/signed-exchange;v=b2;q=0.9,application/signed-exchange;v="b3,b4";q=0.8`, "b2", true},
+		{`application/signed-exchange;v=b2,application/signed-exchange;v=b3;q=0.8`, "b2", true},
+		{`application/signed-exchange;v=b1;q=0.5,application/signed-exchange;v=b3;q=0.5`, "b3", true},
+		{`application/signed-exchange;v=b3;q=x,application/signed-exchange;v=b1`, "b1", true},
+	} {
+		v, sxgRequested := NegotiateVersion(test.accept)
+		assert.Equal(t, test.v, v, test.accept)
+		assert.Equal(t, test.sxgRequested, sxgRequested, test.accept)
+	}
+}
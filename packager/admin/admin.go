@@ -0,0 +1,208 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Serves the endpoints under util.AdminPathPrefix, for use by fleet
+// monitoring and deployment tooling. All require a bearer token.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ampproject/amppackager/packager/accept"
+	"github.com/ampproject/amppackager/packager/certcache"
+	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/popularity"
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// The number of URLs returned by popular-urls, absent a limit parameter.
+const defaultPopularURLsLimit = 100
+
+type Admin struct {
+	token       []byte
+	certs       certcache.CertDescriber
+	reloadCerts func() error
+	popularity  *popularity.Tracker
+	// Serves /priv/doc requests, bypassing caches.
+	repackage http.Handler
+}
+
+// Requests must include the header "Authorization: Bearer <token>". If
+// reloadCerts, popularity, or repackage is nil, the reload-certs,
+// popular-urls, or repackage endpoint, respectively, responds 404.
+func New(token string, certs certcache.CertDescriber, reloadCerts func() error, popularity *popularity.Tracker, repackage http.Handler) (*Admin, error) {
+	if token == "" {
+		return nil, errors.New("admin token must not be empty")
+	}
+	return &Admin{[]byte(token), certs, reloadCerts, popularity, repackage}, nil
+}
+
+// Responds 405 unless req.Method is one of the given methods.
+func allowMethods(resp http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	resp.Header().Set("Allow", strings.Join(methods, ", "))
+	util.WriteErrorPage(resp, req, http.StatusMethodNotAllowed, "")
+	return false
+}
+
+func (this *Admin) isAuthorized(req *http.Request) bool {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), this.token) == 1
+}
+
+// Responds 401 and returns false if req lacks the admin token.
+func (this *Admin) authorize(resp http.ResponseWriter, req *http.Request) bool {
+	resp.Header().Set("Cache-Control", "no-store")
+	if !this.isAuthorized(req) {
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		util.NewHTTPError(http.StatusUnauthorized, "Missing or invalid admin token").LogAndRespond(resp, req)
+		return false
+	}
+	return true
+}
+
+// Wraps a handler outside util.AdminPathPrefix, such as that of
+// util.MetricsPath, so that it requires the same bearer token.
+func (this *Admin) Protect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if this.authorize(resp, req) {
+			handler.ServeHTTP(resp, req)
+		}
+	})
+}
+
+func (this *Admin) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !this.authorize(resp, req) {
+		return
+	}
+	switch mux.Params(req)["adminPath"] {
+	case "certs":
+		if allowMethods(resp, req, http.MethodGet, http.MethodHead) {
+			this.serveCerts(resp, req)
+		}
+	case "reload-certs":
+		if this.reloadCerts == nil {
+			util.WriteErrorPage(resp, req, http.StatusNotFound, "")
+		} else if allowMethods(resp, req, http.MethodPost) {
+			this.serveReloadCerts(resp, req)
+		}
+	case "popular-urls":
+		if this.popularity == nil {
+			util.WriteErrorPage(resp, req, http.StatusNotFound, "")
+		} else if allowMethods(resp, req, http.MethodGet, http.MethodHead) {
+			this.servePopularURLs(resp, req)
+		}
+	case "repackage":
+		if this.repackage == nil {
+			util.WriteErrorPage(resp, req, http.StatusNotFound, "")
+		} else if allowMethods(resp, req, http.MethodPost) {
+			this.serveRepackage(resp, req)
+		}
+	default:
+		util.WriteErrorPage(resp, req, http.StatusNotFound, "")
+	}
+}
+
+func (this *Admin) serveCerts(resp http.ResponseWriter, req *http.Request) {
+	writeJSON(resp, req, http.StatusOK, struct {
+		Certs []certcache.CertInfo `json:"certs"`
+	}{this.certs.DescribeCerts()})
+}
+
+// Responds with the newly loaded certs on success, or the error on failure.
+func (this *Admin) serveReloadCerts(resp http.ResponseWriter, req *http.Request) {
+	if err := this.reloadCerts(); err != nil {
+		log.Printf("Cert reload requested via admin endpoint failed: %+v\n", err)
+		writeJSON(resp, req, http.StatusInternalServerError, struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+	log.Println("Certs reloaded via admin endpoint.")
+	this.serveCerts(resp, req)
+}
+
+// Responds with the most requested URLs, most popular first, for use by a
+// re-signer in deciding which signatures to refresh.
+func (this *Admin) servePopularURLs(resp http.ResponseWriter, req *http.Request) {
+	limit := defaultPopularURLsLimit
+	if param := req.FormValue("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 {
+			util.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer").LogAndRespond(resp, req)
+			return
+		}
+	}
+	writeJSON(resp, req, http.StatusOK, struct {
+		URLs []popularity.URL `json:"urls"`
+	}{this.popularity.Top(limit)})
+}
+
+// Packages the given URL afresh, as /priv/doc would with the same fetch and
+// sign params, and responds with the SXG (or the unsigned document, if it
+// can't be signed), e.g. for pushing to caches right after a publisher
+// corrects a live article.
+func (this *Admin) serveRepackage(resp http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		util.NewHTTPError(http.StatusBadRequest, "Form input parsing failed: ", err).LogAndRespond(resp, req)
+		return
+	}
+	query := url.Values{}
+	for _, param := range []string{"fetch", "sign"} {
+		if values, ok := req.Form[param]; ok {
+			query[param] = values
+		}
+	}
+	docReq, err := http.NewRequest(http.MethodGet, "/priv/doc?"+query.Encode(), nil)
+	if err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error building request: ", err).LogAndRespond(resp, req)
+		return
+	}
+	docReq = docReq.WithContext(req.Context())
+	docReq.Host = req.Host
+	docReq.RemoteAddr = req.RemoteAddr
+	docReq.Header.Set("Accept", "application/signed-exchange;v="+accept.AcceptedSxgVersion)
+	docReq.Header.Set("AMP-Cache-Transform", "any")
+	id := util.RequestID(req)
+	docReq.Header.Set(util.RequestIDHeader, id)
+	log.Printf("Repackage of %q requested via admin endpoint (request ID %q).\n", req.FormValue("sign"), id)
+	this.repackage.ServeHTTP(resp, docReq)
+}
+
+func writeJSON(resp http.ResponseWriter, req *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error encoding JSON: ", err).LogAndRespond(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(body)
+}
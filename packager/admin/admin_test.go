@@ -0,0 +1,248 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/accept"
+	"github.com/ampproject/amppackager/packager/certcache"
+	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/popularity"
+	"github.com/pkg/errors"
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeCertDescriber []certcache.CertInfo
+
+func (this fakeCertDescriber) DescribeCerts() []certcache.CertInfo {
+	return this
+}
+
+var notAfter = time.Date(2019, time.August, 1, 0, 0, 0, 0, time.UTC)
+
+func handler(t *testing.T) http.Handler {
+	return handlerWithReload(t, nil)
+}
+
+func handlerWithReload(t *testing.T, reloadCerts func() error) http.Handler {
+	return handlerWith(t, reloadCerts, nil)
+}
+
+func handlerWith(t *testing.T, reloadCerts func() error, popularity *popularity.Tracker) http.Handler {
+	admin, err := New("s3cret", fakeCertDescriber{{
+		Subject:    "CN=example.com",
+		SANs:       []string{"example.com", "www.example.com"},
+		Serial:     "1234",
+		NotAfter:   notAfter,
+		OCSPStatus: "good",
+		CertURL:    "/amppkg/cert/abc",
+	}}, reloadCerts, popularity, nil)
+	require.NoError(t, err)
+	return mux.New(mux.Handlers{Admin: admin})
+}
+
+func TestEmptyToken(t *testing.T) {
+	_, err := New("", fakeCertDescriber{}, nil, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestCerts(t *testing.T) {
+	resp := pkgt.GetH(t, handler(t), "/priv-amppkg/certs", http.Header{"Authorization": {"Bearer s3cret"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	var body struct {
+		Certs []map[string]interface{} `json:"certs"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Len(t, body.Certs, 1)
+	assert.Equal(t, "CN=example.com", body.Certs[0]["subject"])
+	assert.Equal(t, []interface{}{"example.com", "www.example.com"}, body.Certs[0]["sans"])
+	assert.Equal(t, "1234", body.Certs[0]["serial"])
+	assert.Equal(t, "2019-08-01T00:00:00Z", body.Certs[0]["notAfter"])
+	assert.Equal(t, "good", body.Certs[0]["ocspStatus"])
+	assert.Equal(t, "/amppkg/cert/abc", body.Certs[0]["certURL"])
+	assert.NotContains(t, body.Certs[0], "ocspNextUpdate")
+}
+
+func TestCertsUnauthorized(t *testing.T) {
+	for _, auth := range []string{"", "Bearer wrong", "s3cret", "Basic s3cret"} {
+		resp := pkgt.GetH(t, handler(t), "/priv-amppkg/certs", http.Header{"Authorization": {auth}})
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "auth: %q", auth)
+		assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestUnknownAdminPath(t *testing.T) {
+	resp := pkgt.GetH(t, handler(t), "/priv-amppkg/bogus", http.Header{"Authorization": {"Bearer s3cret"}})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdminDisabled(t *testing.T) {
+	resp := pkgt.GetH(t, mux.New(mux.Handlers{}), "/priv-amppkg/certs", http.Header{"Authorization": {"Bearer s3cret"}})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestProtect(t *testing.T) {
+	admin, err := New("s3cret", fakeCertDescriber{}, nil, nil, nil)
+	require.NoError(t, err)
+	handler := mux.New(mux.Handlers{Metrics: admin.Protect(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("{}"))
+	}))})
+
+	resp := pkgt.GetH(t, handler, "/metrics", http.Header{"Authorization": {"Bearer s3cret"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	for _, auth := range []string{"", "Bearer wrong"} {
+		resp := pkgt.GetH(t, handler, "/metrics", http.Header{"Authorization": {auth}})
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "auth: %q", auth)
+		assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func post(t *testing.T, handler http.Handler, target string, headers http.Header) *http.Response {
+	return pkgt.GetBHH(t, handler, target, "", strings.NewReader(""), headers)
+}
+
+func TestReloadCerts(t *testing.T) {
+	reloaded := false
+	handler := handlerWithReload(t, func() error {
+		reloaded = true
+		return nil
+	})
+	resp := post(t, handler, "/priv-amppkg/reload-certs", http.Header{"Authorization": {"Bearer s3cret"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, reloaded)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var body struct {
+		Certs []map[string]interface{} `json:"certs"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Len(t, body.Certs, 1)
+	assert.Equal(t, "CN=example.com", body.Certs[0]["subject"])
+}
+
+func TestReloadCertsFailure(t *testing.T) {
+	handler := handlerWithReload(t, func() error {
+		return errors.New("key does not match cert")
+	})
+	resp := post(t, handler, "/priv-amppkg/reload-certs", http.Header{"Authorization": {"Bearer s3cret"}})
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "key does not match cert", body["error"])
+}
+
+func TestReloadCertsRequiresPost(t *testing.T) {
+	reloaded := false
+	handler := handlerWithReload(t, func() error {
+		reloaded = true
+		return nil
+	})
+	resp := pkgt.GetH(t, handler, "/priv-amppkg/reload-certs", http.Header{"Authorization": {"Bearer s3cret"}})
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "POST", resp.Header.Get("Allow"))
+	assert.False(t, reloaded)
+}
+
+func TestReloadCertsUnauthorized(t *testing.T) {
+	reloaded := false
+	handler := handlerWithReload(t, func() error {
+		reloaded = true
+		return nil
+	})
+	resp := post(t, handler, "/priv-amppkg/reload-certs", http.Header{"Authorization": {"Bearer wrong"}})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.False(t, reloaded)
+}
+
+func TestReloadCertsDisabled(t *testing.T) {
+	resp := post(t, handler(t), "/priv-amppkg/reload-certs", http.Header{"Authorization": {"Bearer s3cret"}})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPostOutsideAdmin(t *testing.T) {
+	resp := post(t, handler(t), "/healthz", http.Header{})
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestPopularURLs(t *testing.T) {
+	tracker := popularity.New(10, time.Hour)
+	tracker.Record("", "https://example.com/a")
+	tracker.Record("", "https://example.com/b")
+	tracker.Record("", "https://example.com/b")
+	handler := handlerWith(t, nil, tracker)
+
+	resp := pkgt.GetH(t, handler, "/priv-amppkg/popular-urls?limit=1", http.Header{"Authorization": {"Bearer s3cret"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body struct {
+		URLs []popularity.URL `json:"urls"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Len(t, body.URLs, 1)
+	assert.Equal(t, "https://example.com/b", body.URLs[0].Sign)
+
+	resp = pkgt.GetH(t, handler, "/priv-amppkg/popular-urls?limit=0", http.Header{"Authorization": {"Bearer s3cret"}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPopularURLsDisabled(t *testing.T) {
+	resp := pkgt.GetH(t, handler(t), "/priv-amppkg/popular-urls", http.Header{"Authorization": {"Bearer s3cret"}})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestRepackage(t *testing.T) {
+	var docReq *http.Request
+	admin, err := New("s3cret", fakeCertDescriber{}, nil, nil, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		docReq = req
+		resp.Header().Set("Content-Type", "application/signed-exchange;v=b3")
+		resp.Write([]byte("sxg"))
+	}))
+	require.NoError(t, err)
+	handler := mux.New(mux.Handlers{Admin: admin})
+
+	resp := post(t, handler, "/priv-amppkg/repackage?sign="+url.QueryEscape("https://example.com/amp/a")+"&extra=1", http.Header{"Authorization": {"Bearer s3cret"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "sxg", string(body))
+	require.NotNil(t, docReq)
+	assert.Equal(t, http.MethodGet, docReq.Method)
+	assert.Equal(t, "/priv/doc?sign="+url.QueryEscape("https://example.com/amp/a"), docReq.URL.String())
+	assert.Equal(t, "application/signed-exchange;v="+accept.AcceptedSxgVersion, docReq.Header.Get("Accept"))
+	assert.Equal(t, "any", docReq.Header.Get("AMP-Cache-Transform"))
+
+	resp = pkgt.GetH(t, handler, "/priv-amppkg/repackage?sign="+url.QueryEscape("https://example.com/amp/a"), http.Header{"Authorization": {"Bearer s3cret"}})
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestRepackageDisabled(t *testing.T) {
+	resp := post(t, handler(t), "/priv-amppkg/repackage?sign="+url.QueryEscape("https://example.com/amp/a"), http.Header{"Authorization": {"Bearer s3cret"}})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Maintains a list of hosts eligible for fetching, read from a DNS TXT record
+// or an HTTP endpoint and refreshed periodically, so that publishers can add
+// properties to a URLSet without redeploying the packager's config.
+package allowlist
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The most hosts a source may list. Guards against a misconfigured endpoint
+// returning something that isn't a host list.
+const maxHosts = 10000
+
+// The most bytes read from an HTTP source.
+const maxBodyLength = 1 << 20
+
+// A place to read the list of eligible hosts from.
+type Source interface {
+	// Returns the hosts currently listed, as they would appear in the
+	// host component of a URL, including any port.
+	Hosts() ([]string, error)
+	// Describes the source, for logging.
+	String() string
+}
+
+// a var for testing purposes
+var lookupTXT = net.LookupTXT
+
+type dnsTXTSource struct {
+	name string
+}
+
+// Returns a Source that reads hosts from the TXT records of the given DNS
+// name. Each record may list several hosts, separated by spaces or commas.
+func DNSTXT(name string) Source {
+	return &dnsTXTSource{name}
+}
+
+func (this *dnsTXTSource) Hosts() ([]string, error) {
+	records, err := lookupTXT(this.name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "looking up TXT %s", this.name)
+	}
+	hosts := []string{}
+	for _, record := range records {
+		hosts = append(hosts, strings.FieldsFunc(record, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
+	return hosts, nil
+}
+
+func (this *dnsTXTSource) String() string {
+	return "TXT " + this.name
+}
+
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+// Returns a Source that reads hosts from the body of a GET to the given URL,
+// one per line. Blank lines and lines starting with # are ignored.
+func HTTP(url string, client *http.Client) Source {
+	return &httpSource{url, client}
+}
+
+func (this *httpSource) Hosts() ([]string, error) {
+	resp, err := this.client.Get(this.url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching %s", this.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("fetching %s: status %d", this.url, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxBodyLength))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", this.url)
+	}
+	hosts := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	return hosts, nil
+}
+
+func (this *httpSource) String() string {
+	return this.url
+}
+
+type Allowlist struct {
+	source   Source
+	interval time.Duration
+	lk       sync.RWMutex
+	hosts    map[string]bool
+	stop     chan struct{}
+}
+
+// New returns an Allowlist populated from source, or an error if it couldn't
+// be read. To have it refresh every interval, call StartCron().
+func New(source Source, interval time.Duration) (*Allowlist, error) {
+	a := &Allowlist{source: source, interval: interval, hosts: map[string]bool{}, stop: make(chan struct{})}
+	if err := a.refresh(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// StartCron starts a cron job to re-read the source every interval. If a read
+// fails, the previous list stays in effect.
+func (this *Allowlist) StartCron() {
+	go func() {
+		ticker := time.NewTicker(this.interval)
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := this.refresh(); err != nil {
+					log.Printf("Error refreshing allowlist from %s: %+v\n", this.source, err)
+				}
+			case <-this.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// StopCron stops the cron job, if started. It doesn't block, and may be
+// called more than once.
+func (this *Allowlist) StopCron() {
+	select {
+	// this.stop is only ever closed, so this matches only if it already was.
+	case <-this.stop:
+	default:
+		close(this.stop)
+	}
+}
+
+// Returns true iff host is listed. Hosts are compared case-insensitively.
+func (this *Allowlist) Contains(host string) bool {
+	this.lk.RLock()
+	defer this.lk.RUnlock()
+	return this.hosts[strings.ToLower(host)]
+}
+
+// refresh replaces the list with the source's current contents.
+func (this *Allowlist) refresh() error {
+	list, err := this.source.Hosts()
+	if err != nil {
+		return err
+	}
+	if len(list) > maxHosts {
+		return errors.Errorf("%s lists %d hosts; at most %d are allowed", this.source, len(list), maxHosts)
+	}
+	hosts := make(map[string]bool, len(list))
+	for _, host := range list {
+		hosts[strings.ToLower(host)] = true
+	}
+	this.lk.Lock()
+	defer this.lk.Unlock()
+	this.hosts = hosts
+	return nil
+}
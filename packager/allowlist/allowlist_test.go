@@ -0,0 +1,120 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allowlist
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSource struct {
+	hosts []string
+	err   error
+}
+
+func (this *fakeSource) Hosts() ([]string, error) { return this.hosts, this.err }
+func (this *fakeSource) String() string           { return "fake" }
+
+func TestContains(t *testing.T) {
+	list, err := New(&fakeSource{hosts: []string{"a.example.com", "B.example.com:8080"}}, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, list.Contains("a.example.com"))
+	assert.True(t, list.Contains("A.Example.com"))
+	assert.True(t, list.Contains("b.example.com:8080"))
+	assert.False(t, list.Contains("b.example.com"))
+	assert.False(t, list.Contains("example.com"))
+}
+
+func TestNewError(t *testing.T) {
+	_, err := New(&fakeSource{err: errors.New("unreachable")}, time.Hour)
+	assert.EqualError(t, err, "unreachable")
+}
+
+func TestRefreshKeepsListOnError(t *testing.T) {
+	source := &fakeSource{hosts: []string{"a.example.com"}}
+	list, err := New(source, time.Hour)
+	require.NoError(t, err)
+
+	source.hosts = []string{"b.example.com"}
+	require.NoError(t, list.refresh())
+	assert.False(t, list.Contains("a.example.com"))
+	assert.True(t, list.Contains("b.example.com"))
+
+	source.err = errors.New("unreachable")
+	assert.Error(t, list.refresh())
+	assert.True(t, list.Contains("b.example.com"))
+
+	source.err = nil
+	source.hosts = make([]string, maxHosts+1)
+	assert.Error(t, list.refresh())
+	assert.True(t, list.Contains("b.example.com"))
+}
+
+func TestStopCronDoesntBlock(t *testing.T) {
+	list, err := New(&fakeSource{hosts: []string{"a.example.com"}}, time.Hour)
+	require.NoError(t, err)
+
+	// Neither blocks, even though the cron job was never started.
+	list.StopCron()
+	list.StopCron()
+
+	list, err = New(&fakeSource{hosts: []string{"a.example.com"}}, time.Hour)
+	require.NoError(t, err)
+	list.StartCron()
+	list.StopCron()
+	list.StopCron()
+}
+
+func TestDNSTXT(t *testing.T) {
+	defer func(orig func(string) ([]string, error)) { lookupTXT = orig }(lookupTXT)
+	lookupTXT = func(name string) ([]string, error) {
+		if name != "_amppkg.example.com" {
+			return nil, errors.Errorf("no such host %s", name)
+		}
+		return []string{"a.example.com b.example.com", "c.example.com,d.example.com"}, nil
+	}
+
+	hosts, err := DNSTXT("_amppkg.example.com").Hosts()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"}, hosts)
+
+	_, err = DNSTXT("other.example.com").Hosts()
+	assert.EqualError(t, err, "looking up TXT other.example.com: no such host other.example.com")
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/hosts.txt" {
+			http.NotFound(resp, req)
+			return
+		}
+		fmt.Fprint(resp, "# Properties\na.example.com\n\n  b.example.com  \n")
+	}))
+	defer server.Close()
+
+	hosts, err := HTTP(server.URL+"/hosts.txt", server.Client()).Hosts()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, hosts)
+
+	_, err = HTTP(server.URL+"/missing", server.Client()).Hosts()
+	assert.EqualError(t, err, fmt.Sprintf("fetching %s/missing: status 404", server.URL))
+}
@@ -26,13 +26,16 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/ampproject/amppackager/packager/accept"
 	"github.com/ampproject/amppackager/packager/certfetcher"
 	"github.com/ampproject/amppackager/packager/certloader"
 	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/retry"
 	"github.com/ampproject/amppackager/packager/util"
 	"github.com/pkg/errors"
 	"github.com/pquerna/cachecontrol"
@@ -54,6 +57,14 @@ const maxOCSPResponseBytes = 1024 * 1024
 // How often to check if OCSP stapling needs updating.
 const ocspCheckInterval = 1 * time.Hour
 
+// The max-age of the util.CurrentCertAlias response.
+const currentCertMaxAgeSecs = 60
+
+// The maximum age of an OCSP response that browsers accept in a cert chain
+// for SXGs, per
+// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.6.
+const maxOCSPAge = 7 * 24 * time.Hour
+
 // How often to check if certs needs updating.
 const certCheckInterval = 24 * time.Hour
 
@@ -69,6 +80,12 @@ const maxOCSPTries = 10
 // TODO(banaag): make 2 days renewal grace period configurable in toml.
 const certRenewalInterval = 8 * 24 * time.Hour
 
+// The format of the on-disk OCSP cache. Bump this whenever the format changes,
+// so that a cache written by another version of the packager is invalidated
+// rather than misinterpreted. Version 1 is a raw DER-encoded OCSP response,
+// which is also what was written before versioning was introduced.
+const ocspCacheFormatVersion = 1
+
 type OCSPResponder func(*x509.Certificate) ([]byte, error)
 
 type CertHandler interface {
@@ -89,6 +106,14 @@ type CertCache struct {
 	ocspUpdateAfterMu sync.RWMutex
 	ocspUpdateAfter   time.Time
 	stop              chan struct{}
+	// The lifetime of the background goroutines; canceled by Stop, so that
+	// they don't hang on slow external services at shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The background goroutines, which Stop waits for.
+	running sync.WaitGroup
+	// The deadline and retries of each OCSP request.
+	ocspRetry retry.Policy
 	// TODO(twifkak): Implement a registry of Updateable instances which can be configured in the toml.
 	ocspFile     Updateable
 	ocspFilePath string
@@ -103,6 +128,16 @@ type CertCache struct {
 	NewCertFile string
 	// Is CertCache initialized to do cert renewal or OCSP refreshes?
 	isInitialized bool
+	clock         util.Clock
+	// If set, or if the cert is must-staple, an OCSP response older than
+	// maxOCSPAge is unhealthy even before its NextUpdate, so that neither it
+	// nor SXGs that depend on it (and so would fail verification) are
+	// served.
+	requireFreshOCSP bool
+	// If set, the cert chain is written to this directory whenever it
+	// changes.
+	certChainDir        string
+	writtenCertChainSum []byte
 
 	// "Virtual methods", exposed for testing.
 	// Given a certificate, returns the OCSP responder URL for that cert.
@@ -126,6 +161,7 @@ func New(certs []*x509.Certificate, certFetcher *certfetcher.CertFetcher, domain
 	if len(certs) > 0 && certs[0] != nil {
 		certName = util.CertName(certs[0])
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &CertCache{
 		certName:        certName,
 		certs:           certs,
@@ -143,8 +179,19 @@ func New(certs []*x509.Certificate, certFetcher *certfetcher.CertFetcher, domain
 		ocspFile:     &Chained{first: &InMemory{}, second: &LocalFile{path: ocspCache}},
 		ocspFilePath: ocspCache,
 		stop:         make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		// Per sleevi #5 (see maintainOCSP), back off exponentially
+		// between retries, up to 10 minutes.
+		ocspRetry: retry.Policy{
+			Timeout:        util.DefaultDeadlines.OCSP,
+			MaxAttempts:    maxOCSPTries,
+			InitialBackoff: 1 * time.Minute,
+			MaxBackoff:     10 * time.Minute,
+		},
 		generateOCSPResponse: generateOCSPResponse,
-		client:       http.Client{Timeout: 60 * time.Second},
+		// Requests are bounded by the deadline of ocspRetry instead.
+		client:       http.Client{},
 		extractOCSPServer: func(cert *x509.Certificate) (string, error) {
 			if cert == nil || len(cert.OCSPServer) < 1 {
 				return "", errors.New("Cert missing OCSPServer.")
@@ -164,17 +211,23 @@ func New(certs []*x509.Certificate, certFetcher *certfetcher.CertFetcher, domain
 		CertFile:      certFile,
 		NewCertFile:   newCertFile,
 		isInitialized: false,
+		clock:         util.SystemClock{},
 	}
 }
 
 func (this *CertCache) Init() error {
+	if err := checkCacheFormat(this.ocspFilePath, ocspCacheFormatVersion, 1); err != nil {
+		return errors.Wrap(err, "checking OCSP cache format")
+	}
+
 	this.updateCertIfNecessary()
 
 	// Prime the OCSP disk and memory cache, so we can start serving immediately.
-	_, _, err := this.readOCSP(true)
+	ocsp, _, err := this.readOCSP(true)
 	if err != nil {
 		return errors.Wrap(err, "initializing CertCache")
 	}
+	this.writeCertChain(ocsp)
 	// Update OCSP in the background, per sleevi requirements:
 	// 3. Refreshes the response, in the background, with sufficient time before expiration.
 	//    A rule of thumb would be to fetch at notBefore + (notAfter -
@@ -183,10 +236,12 @@ func (this *CertCache) Init() error {
 	//    like the OCSP responder giving you junk, but also sufficient time
 	//    to raise an alert if something has gone really wrong.
 	// 7. The ability to serve old responses while fetching new responses.
+	this.running.Add(1)
 	go this.maintainOCSP()
 
 	if this.certFetcher != nil {
 		// Update Certs in the background.
+		this.running.Add(1)
 		go this.maintainCerts()
 	}
 
@@ -195,7 +250,8 @@ func (this *CertCache) Init() error {
 	return nil
 }
 
-// Stop stops the goroutines spawned in Init, which are automatically updating the certificate and the OCSP response.
+// Stop stops the goroutines spawned in Init, which are automatically updating the certificate and the OCSP response,
+// and waits for any fetch or retry in progress to end.
 // It returns true if the call actually stops them, false if they have already been stopped.
 func (this *CertCache) Stop() bool {
 	select {
@@ -204,6 +260,8 @@ func (this *CertCache) Stop() bool {
 		return false
 	default:
 		close(this.stop)
+		this.cancel()
+		this.running.Wait()
 		return true
 	}
 }
@@ -223,7 +281,7 @@ func (this *CertCache) GetLatestCert() *x509.Certificate {
 		return nil
 	}
 
-	d, err := util.GetDurationToExpiry(this.getCert(), time.Now())
+	d, err := util.GetDurationToExpiry(this.getCert(), this.clock.Now())
 	if err != nil {
 		// Current cert is already invalid. Check if renewal is available.
 		log.Println("Current cert is expired, attempting to renew: ", err)
@@ -273,38 +331,47 @@ func (this *CertCache) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	// RLock for the certName
 	this.certsMu.RLock()
 	defer this.certsMu.RUnlock()
-	if params["certName"] == this.certName {
+	isAlias := params["certName"] == util.CurrentCertAlias
+	if params["certName"] == this.certName || isAlias {
 		// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.3
 		// This content-type is not standard, but included to reduce
 		// the chance that faulty user agents employ content sniffing.
-		resp.Header().Set("Content-Type", "application/cert-chain+cbor")
+		resp.Header().Set("Content-Type", accept.CertChainContentType)
 		// Instruct the intermediary to reload this cert-chain at the
 		// OCSP midpoint, in case it cannot parse it.
 		ocsp, _, err := this.readOCSP(false)
 		if err != nil {
-			util.NewHTTPError(http.StatusInternalServerError, "Error reading OCSP: ", err).LogAndRespond(resp)
+			util.NewHTTPError(http.StatusInternalServerError, "Error reading OCSP: ", err).LogAndRespond(resp, req)
 			return
 		}
 		midpoint, err := this.ocspMidpoint(ocsp, this.findIssuer())
 		if err != nil {
-			util.NewHTTPError(http.StatusInternalServerError, "Error computing OCSP midpoint: ", err).LogAndRespond(resp)
+			util.NewHTTPError(http.StatusInternalServerError, "Error computing OCSP midpoint: ", err).LogAndRespond(resp, req)
 			return
 		}
 		// int is large enough to represent 24855 days in seconds.
-		expiry := int(midpoint.Sub(time.Now()).Seconds())
+		expiry := int(midpoint.Sub(this.clock.Now()).Seconds())
 		if expiry < 0 {
 			expiry = 0
 		}
+		if isAlias {
+			// The alias changes on rotation, so shouldn't be cached
+			// for long. Point to the stable URL of this chain.
+			if expiry > currentCertMaxAgeSecs {
+				expiry = currentCertMaxAgeSecs
+			}
+			resp.Header().Set("Content-Location", util.CertURLPrefix+"/"+url.PathEscape(this.certName))
+		}
 		resp.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(expiry))
 		resp.Header().Set("X-Content-Type-Options", "nosniff")
 		cbor, err := this.createCertChainCBOR(ocsp)
 		if err != nil {
-			util.NewHTTPError(http.StatusInternalServerError, "Error building cert chain: ", err).LogAndRespond(resp)
+			util.NewHTTPError(http.StatusInternalServerError, "Error building cert chain: ", err).LogAndRespond(resp, req)
 			return
 		}
 		http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(cbor))
 	} else {
-		http.NotFound(resp, req)
+		util.WriteErrorPage(resp, req, http.StatusNotFound, "")
 	}
 }
 
@@ -332,27 +399,37 @@ func (this *CertCache) isHealthy(ocspResp []byte) error {
 	if ocspResp == nil {
 		return errors.New("OCSP response not yet fetched.")
 	}
+	// Read once, as the certs may be cleared concurrently, e.g. on expiry.
+	cert := this.getCert()
+	if cert == nil {
+		return errors.New("No cert loaded.")
+	}
 	issuer := this.findIssuer()
 	if issuer == nil {
 		return errors.New("Cannot find issuer certificate in CertFile.")
 	}
-	resp, err := ocsp.ParseResponseForCert(ocspResp, this.getCert(), issuer)
+	resp, err := ocsp.ParseResponseForCert(ocspResp, cert, issuer)
 	if err != nil {
 		return errors.Wrap(err, "Error parsing OCSP response")
 	}
-	if resp.NextUpdate.Before(time.Now()) {
+	if resp.NextUpdate.Before(this.clock.Now()) {
 		return errors.Errorf("Cached OCSP is stale, NextUpdate: %v", resp.NextUpdate)
 	}
+	if this.requireFreshOCSP || util.HasMustStaple(cert) {
+		if resp.ThisUpdate.Add(maxOCSPAge).Before(this.clock.Now()) {
+			return errors.Errorf("Cached OCSP is older than %v, ThisUpdate: %v", maxOCSPAge, resp.ThisUpdate)
+		}
+	}
 	return nil
 }
 
-func (this *CertCache) readOCSPHelper(numTries int, exhaustedRetries bool) ([]byte, time.Time, error) {
+func (this *CertCache) readOCSPHelper(ctx context.Context, numTries int, exhaustedRetries bool) ([]byte, time.Time, error) {
 	var ocspUpdateAfter time.Time
 
 	this.certsMu.RLock()
 	defer this.certsMu.RUnlock()
-	ocsp, err := this.ocspFile.Read(context.Background(), this.shouldUpdateOCSP, func(orig []byte) []byte {
-		return this.fetchOCSP(orig, this.certs, &ocspUpdateAfter, numTries > 0)
+	ocsp, err := this.ocspFile.Read(ctx, this.shouldUpdateOCSP, func(orig []byte) []byte {
+		return this.fetchOCSP(ctx, orig, this.certs, &ocspUpdateAfter, numTries > 0)
 	})
 	if err != nil {
 		if exhaustedRetries {
@@ -379,34 +456,43 @@ func (this *CertCache) readOCSPHelper(numTries int, exhaustedRetries bool) ([]by
 	return ocsp, ocspUpdateAfter, nil
 }
 
+// Returned by a readOCSP attempt if the OCSP response is still due for an
+// update, so that it's retried.
+var errOCSPNeedsUpdate = errors.New("OCSP response needs update")
+
 // Returns the OCSP response and expiry, refreshing if necessary.
 func (this *CertCache) readOCSP(allowRetries bool) ([]byte, time.Time, error) {
 	var ocspUpdateAfter time.Time
-	var err error
-	var maxTries int
-
 	ocsp := []byte(nil)
-	waitTimeInMinutes := 1
+
+	policy := this.ocspRetry
+	// Retries happen in the background, and end on Stop. Otherwise, the
+	// read is on behalf of a request, which should be served from cache
+	// even after Stop, e.g. by a ReloadableCertHandler serving a
+	// previous cert.
+	ctx := context.Background()
 	if !allowRetries || this.certFetcher == nil {
 		// If certFetcher is nil, that means we are not auto-renewing so don't retry OCSP.
-		maxTries = 1
+		policy.MaxAttempts = 1
 	} else {
-		maxTries = maxOCSPTries
+		ctx = this.ctx
 	}
 
-	for numTries := 0; numTries < maxTries; {
-		ocsp, ocspUpdateAfter, err = this.readOCSPHelper(numTries, numTries >= maxTries - 1)
+	err := policy.Do(ctx, func(ctx context.Context, numTries int) error {
+		var err error
+		ocsp, ocspUpdateAfter, err = this.readOCSPHelper(ctx, numTries, numTries >= policy.MaxAttempts-1)
 		if err != nil {
-			return nil, ocspUpdateAfter, err
-		}
-		if !this.shouldUpdateOCSP(ocsp) {
-			break;
+			return retry.Permanent(err)
 		}
-		// Wait only if are not on our last try.
-		if numTries < maxTries - 1 {
-			waitTimeInMinutes = waitForSpecifiedTime(waitTimeInMinutes, numTries)
+		if this.shouldUpdateOCSP(ocsp) {
+			return errOCSPNeedsUpdate
 		}
-		numTries++
+		return nil
+	})
+	// If the update didn't succeed, then serve the existing response
+	// for as long as it's valid.
+	if err != nil && err != errOCSPNeedsUpdate {
+		return nil, ocspUpdateAfter, err
 	}
 	this.ocspUpdateAfterMu.Lock()
 	defer this.ocspUpdateAfterMu.Unlock()
@@ -419,25 +505,10 @@ func (this *CertCache) readOCSP(allowRetries bool) ([]byte, time.Time, error) {
 
 }
 
-// Print # of retries, wait for specified time and returned updated wait time.
-func waitForSpecifiedTime(waitTimeInMinutes int, numRetries int) int {
-	log.Printf("Retrying OCSP server: retry #%d\n", numRetries)
-	// Wait using exponential backoff.
-	log.Printf("Waiting for %d minute(s)\n", waitTimeInMinutes)
-	waitTimeDuration := time.Duration(waitTimeInMinutes) * time.Minute
-	// For exponential backoff.
-	newWaitTimeInMinutes := 2 * waitTimeInMinutes
-	if newWaitTimeInMinutes > 10 {
-		// Cap the wait time at 10 minutes.
-		newWaitTimeInMinutes = 10
-	}
-	time.Sleep(waitTimeDuration)
-	return newWaitTimeInMinutes
-}
-
 // Checks for OCSP updates every hour. Terminates only when stop receives
 // a message.
 func (this *CertCache) maintainOCSP() {
+	defer this.running.Done()
 	// Only make one request per ocspCheckInterval, to minimize the impact
 	// on OCSP servers that are buckling under load, per sleevi requirement:
 	// 5. As with any system doing background requests on a remote server,
@@ -451,9 +522,11 @@ func (this *CertCache) maintainOCSP() {
 	for {
 		select {
 		case <-ticker.C:
-			_, _, err := this.readOCSP(true)
+			ocsp, _, err := this.readOCSP(true)
 			if err != nil {
 				log.Println("Warning: OCSP update failed. Cached response may expire:", err)
+			} else {
+				this.writeCertChain(ocsp)
 			}
 		case <-this.stop:
 			ticker.Stop()
@@ -481,7 +554,7 @@ func (this *CertCache) shouldUpdateOCSP(ocsp []byte) bool {
 		log.Println("Error computing OCSP midpoint:", err)
 		return true
 	}
-	if time.Now().After(midpoint) {
+	if this.clock.Now().After(midpoint) {
 		// TODO(twifkak): Use a logging framework with support for debug-only statements.
 		log.Println("Updating OCSP; after midpoint: ", midpoint)
 		return true
@@ -493,7 +566,7 @@ func (this *CertCache) shouldUpdateOCSP(ocsp []byte) bool {
 	//    possible, and observe HTTP cache semantics."
 	this.ocspUpdateAfterMu.RLock()
 	defer this.ocspUpdateAfterMu.RUnlock()
-	if time.Now().After(this.ocspUpdateAfter) {
+	if this.clock.Now().After(this.ocspUpdateAfter) {
 		// TODO(twifkak): Use a logging framework with support for debug-only statements.
 		log.Println("Updating OCSP; expired by HTTP cache headers: ", this.ocspUpdateAfter)
 		return true
@@ -543,7 +616,7 @@ func (this *CertCache) findIssuerUsingCerts(certs []*x509.Certificate) *x509.Cer
 }
 
 // Queries the OCSP responder for this cert and return the OCSP response.
-func (this *CertCache) fetchOCSP(orig []byte, certs []*x509.Certificate, ocspUpdateAfter *time.Time, isRetry bool) []byte {
+func (this *CertCache) fetchOCSP(ctx context.Context, orig []byte, certs []*x509.Certificate, ocspUpdateAfter *time.Time, isRetry bool) []byte {
 	issuer := this.findIssuerUsingCerts(certs)
 	if issuer == nil {
 		log.Println("Cannot find issuer certificate in CertFile.")
@@ -597,7 +670,7 @@ func (this *CertCache) fetchOCSP(orig []byte, certs []*x509.Certificate, ocspUpd
 		httpReq.Header.Set("Content-Type", "application/ocsp-request")
 	}
 
-	httpResp, err := this.client.Do(httpReq)
+	httpResp, err := this.client.Do(httpReq.WithContext(ctx))
 	if err != nil {
 		log.Println("Error issuing OCSP request:", err)
 		return orig
@@ -630,11 +703,11 @@ func (this *CertCache) fetchOCSP(orig []byte, certs []*x509.Certificate, ocspUpd
 		log.Println("Invalid OCSP status:", resp.Status)
 		return orig
 	}
-	if resp.ThisUpdate.After(time.Now()) {
+	if resp.ThisUpdate.After(this.clock.Now()) {
 		log.Println("OCSP thisUpdate in the future:", resp.ThisUpdate)
 		return orig
 	}
-	if resp.NextUpdate.Before(time.Now()) {
+	if resp.NextUpdate.Before(this.clock.Now()) {
 		log.Println("OCSP nextUpdate in the past:", resp.NextUpdate)
 		return orig
 	}
@@ -648,9 +721,32 @@ func (this *CertCache) fetchOCSP(orig []byte, certs []*x509.Certificate, ocspUpd
 	return respBytes
 }
 
+// Fetches an OCSP response for the cert chain from its CA, as the packager
+// would, returning an error if none that the packager would accept is
+// available. For checking a cert before deploying it; the reason for the
+// failure is logged.
+func FetchOCSP(certs []*x509.Certificate, timeout time.Duration) ([]byte, error) {
+	this := New(certs, nil, nil, "", "", "", nil)
+	defer this.Stop()
+	ctx, cancel := context.WithTimeout(this.ctx, timeout)
+	defer cancel()
+	var ocspUpdateAfter time.Time
+	ocsp := this.fetchOCSP(ctx, nil, certs, &ocspUpdateAfter, false)
+	if ocsp == nil {
+		// As readOCSP does on retries, fall back to POST, for CAs
+		// that mishandle GET.
+		ocsp = this.fetchOCSP(ctx, nil, certs, &ocspUpdateAfter, true)
+	}
+	if ocsp == nil {
+		return nil, errors.New("No valid OCSP response available")
+	}
+	return ocsp, nil
+}
+
 // Checks for cert updates every certCheckInterval hours. Terminates only when stop
 // receives a message.
 func (this *CertCache) maintainCerts() {
+	defer this.running.Done()
 	// Only make one request per certCheckInterval, to minimize the impact
 	// on servers that are buckling under load.
 	ticker := time.NewTicker(certCheckInterval)
@@ -666,6 +762,13 @@ func (this *CertCache) maintainCerts() {
 	}
 }
 
+// Returns true iff the cert cache serves a cert chain under the given name.
+func (this *CertCache) hasCertName(certName string) bool {
+	this.certsMu.RLock()
+	defer this.certsMu.RUnlock()
+	return certName == this.certName
+}
+
 // Returns true iff cert cache contains at least 1 cert.
 func (this *CertCache) hasCert() bool {
 	this.certsMu.RLock()
@@ -750,7 +853,7 @@ func (this *CertCache) updateCertIfNecessary() {
 	d := time.Duration(0)
 	err := errors.New("")
 	if this.hasCert() {
-		d, err = util.GetDurationToExpiry(this.getCert(), time.Now())
+		d, err = util.GetDurationToExpiry(this.getCert(), this.clock.Now())
 	}
 	if err != nil {
 		this.renewedCertsMu.Lock()
@@ -804,7 +907,9 @@ func (this *CertCache) updateCertIfNecessary() {
 
 			ocsp, _, errorOCSP := this.readOCSP(true)
 			if errorOCSP != nil {
-				newOCSP := this.fetchOCSP(ocsp, this.renewedCerts, &ocspUpdateAfter, false)
+				ctx, cancel := context.WithTimeout(this.ctx, this.ocspRetry.Timeout)
+				newOCSP := this.fetchOCSP(ctx, ocsp, this.renewedCerts, &ocspUpdateAfter, false)
+				cancel()
 				// Check if newOCSP != ocsp and that there are no errors, health-wise with new ocsp.
 				if !bytes.Equal(newOCSP, ocsp) && this.isHealthy(newOCSP) == nil {
 					// We were able to fetch new OCSP with renewal cert, time to switch to new certs.
@@ -818,7 +923,7 @@ func (this *CertCache) updateCertIfNecessary() {
 
 func (this *CertCache) doesCertNeedReloading() bool {
 	if !this.hasCert() { return true }
-	d, err := util.GetDurationToExpiry(this.getCert(), time.Now())
+	d, err := util.GetDurationToExpiry(this.getCert(), this.clock.Now())
 	return err != nil || d < certRenewalInterval
 }
 
@@ -865,24 +970,67 @@ func PopulateCertCache(config *util.Config, key crypto.PrivateKey, generateOCSPR
 
 	certs, err := certloader.LoadCertsFromFile(config, developmentMode)
 	if err != nil {
-		log.Println(errors.Wrap(err, "Can't load cert file"))
+		if !autoRenewCert {
+			// Fail fast: without auto-renewal there is no way to obtain a
+			// usable cert, and browsers would reject any SXGs signed with
+			// this one anyway.
+			return nil, errors.Wrap(err, "Can't load cert file")
+		}
+		log.Println(errors.Wrap(err, "Can't load cert file; will attempt to fetch a new one"))
 		certs = nil
 	}
-	domain := ""
-	for _, urlSet := range config.URLSet {
-		domain = urlSet.Sign.Domain
-		if certs != nil {
-			if err := util.CertificateMatches(certs[0], key, domain); err != nil {
+	if certs != nil {
+		certs, err = certloader.CompleteCertChain(certs, &http.Client{Timeout: 60 * time.Second})
+		if err != nil {
+			return nil, errors.Wrapf(err, "completing the cert chain in %s", config.CertFile)
+		}
+		if err := util.CheckCertChainOrder(certs); err != nil {
+			if !developmentMode {
 				return nil, errors.Wrapf(err, "checking %s", config.CertFile)
 			}
+			log.Println("WARNING:", err)
+		}
+		if err := util.CheckCertChainComplete(certs); err != nil {
+			log.Println("WARNING:", err)
+		}
+	}
+	if certs != nil {
+		domains := make([]string, len(config.URLSet))
+		for i, urlSet := range config.URLSet {
+			domains[i] = urlSet.Sign.Domain
+		}
+		if uncovered := util.UncoveredDomains(certs[0], domains); len(uncovered) > 0 {
+			return nil, errors.Errorf("%s does not cover URLSet.Sign.Domain(s) [%s]; its subjectAltNames are [%s]",
+				config.CertFile, strings.Join(uncovered, ", "), strings.Join(certs[0].DNSNames, ", "))
+		}
+	}
+	if certs != nil && config.CT != nil {
+		if err := util.CheckEmbeddedSCTs(certs[0], config.CT.LogIDs, config.CT.MinSCTs); err != nil {
+			if config.CT.Enforce && !developmentMode {
+				return nil, errors.Wrapf(err, "checking CT for %s", config.CertFile)
+			}
+			log.Printf("WARNING: %s: %s; Chrome will likely reject its SXGs.\n", config.CertFile, err)
 		}
 	}
+	if certs != nil {
+		if err := util.KeyMatchesCertificate(certs[0], key); err != nil {
+			return nil, errors.Wrapf(err, "checking %s matches %s", config.KeyFile, config.CertFile)
+		}
+	}
+	domain := ""
+	for _, urlSet := range config.URLSet {
+		domain = urlSet.Sign.Domain
+	}
 
 	certFetcher, err := certloader.CreateCertFetcher(config, key, domain, developmentMode, autoRenewCert)
 	if err != nil {
 		return nil, errors.Wrap(err, "creating cert fetcher from config")
 	}
 	certCache := New(certs, certFetcher, []string{domain}, config.CertFile, config.NewCertFile, config.OCSPCache, generateOCSPResponse)
+	deadlines := config.DeadlineDurations()
+	certCache.ocspRetry.Timeout = deadlines.OCSP
+	certCache.certChainDir = config.CertChainDir
+	certCache.requireFreshOCSP = config.RequireFreshOCSP
 
 	return certCache, nil
 }
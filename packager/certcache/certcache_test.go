@@ -15,8 +15,12 @@
 package certcache
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
 	"io"
 	"io/ioutil"
 	"log"
@@ -32,6 +36,7 @@ import (
 	"github.com/ampproject/amppackager/packager/mux"
 	pkgt "github.com/ampproject/amppackager/packager/testing"
 	"github.com/ampproject/amppackager/packager/util"
+	"github.com/gofrs/flock"
 	"github.com/stretchr/testify/suite"
 	"golang.org/x/crypto/ocsp"
 )
@@ -49,11 +54,19 @@ var caKey = func() *rsa.PrivateKey {
 }()
 
 func FakeOCSPResponse(thisUpdate time.Time) ([]byte, error) {
+	return fakeOCSPResponseFor(pkgt.B3Certs[0], thisUpdate)
+}
+
+func fakeOCSPResponseFor(cert *x509.Certificate, thisUpdate time.Time) ([]byte, error) {
+	return fakeOCSPResponseWithLifetime(cert, thisUpdate, 7*24*time.Hour)
+}
+
+func fakeOCSPResponseWithLifetime(cert *x509.Certificate, thisUpdate time.Time, lifetime time.Duration) ([]byte, error) {
 	template := ocsp.Response{
 		Status:           ocsp.Good,
-		SerialNumber:     pkgt.B3Certs[0].SerialNumber,
+		SerialNumber:     cert.SerialNumber,
 		ThisUpdate:       thisUpdate,
-		NextUpdate:       thisUpdate.Add(7 * 24 * time.Hour),
+		NextUpdate:       thisUpdate.Add(lifetime),
 		RevokedAt:        thisUpdate.AddDate( /*years=*/ 0 /*months=*/, 0 /*days=*/, 365),
 		RevocationReason: ocsp.Unspecified,
 	}
@@ -69,6 +82,7 @@ type CertCacheSuite struct {
 	ocspHandler         func(w http.ResponseWriter, req *http.Request)
 	tempDir             string
 	handler             *CertCache
+	clock               *pkgt.FakeClock
 }
 
 func stringPtr(s string) *string {
@@ -81,6 +95,7 @@ func (this *CertCacheSuite) New() (*CertCache, error) {
 	//  For now, this tests certcache without worrying about certfetcher.
 	certCache := New(pkgt.B3Certs, nil, []string{"example.com"}, "cert.crt", "newcert.crt",
 		filepath.Join(this.tempDir, "ocsp"), nil)
+	certCache.clock = this.clock
 	certCache.extractOCSPServer = func(*x509.Certificate) (string, error) {
 		return this.ocspServer.URL, nil
 	}
@@ -108,7 +123,9 @@ func (this *CertCacheSuite) TearDownSuite() {
 
 func (this *CertCacheSuite) SetupTest() {
 	var err error
-	this.fakeOCSP, err = FakeOCSPResponse(time.Now())
+	// OCSP times have a resolution of seconds.
+	this.clock = pkgt.NewFakeClock(time.Now().Truncate(time.Second))
+	this.fakeOCSP, err = FakeOCSPResponse(this.clock.Now())
 	this.Require().NoError(err, "creating fake OCSP response")
 
 	this.ocspHandler = func(resp http.ResponseWriter, req *http.Request) {
@@ -138,7 +155,7 @@ func (this *CertCacheSuite) TearDownTest() {
 }
 
 func (this *CertCacheSuite) mux() http.Handler {
-	return mux.New(this.handler, nil, nil, nil)
+	return mux.New(mux.Handlers{CertCache: this.handler})
 }
 
 func (this *CertCacheSuite) ocspServerCalled(f func()) bool {
@@ -178,6 +195,7 @@ func (this *CertCacheSuite) DecodeCBOR(r io.Reader) map[string][]byte {
 func (this *CertCacheSuite) TestServesCertificate() {
 	resp := pkgt.Get(this.T(), this.mux(), "/amppkg/cert/"+pkgt.CertName)
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/cert-chain+cbor", resp.Header.Get("Content-Type"))
 	this.Assert().Equal("nosniff", resp.Header.Get("X-Content-Type-Options"))
 	cbor := this.DecodeCBOR(resp.Body)
 	this.Assert().Contains(cbor, "cert")
@@ -185,15 +203,54 @@ func (this *CertCacheSuite) TestServesCertificate() {
 	this.Assert().NotContains(cbor, "sct")
 }
 
+func (this *CertCacheSuite) TestServesCurrentAlias() {
+	resp := pkgt.Get(this.T(), this.mux(), "/amppkg/cert/current")
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/cert-chain+cbor", resp.Header.Get("Content-Type"))
+	this.Assert().Equal("public, max-age=60", resp.Header.Get("Cache-Control"))
+	this.Assert().Equal("/amppkg/cert/"+pkgt.CertName, resp.Header.Get("Content-Location"))
+	this.Assert().Equal(pkgt.B3Certs[0].Raw, this.DecodeCBOR(resp.Body)["cert"])
+}
+
+func (this *CertCacheSuite) TestDescribeCerts() {
+	infos := this.handler.DescribeCerts()
+	this.Require().Len(infos, 1)
+	info := infos[0]
+	this.Assert().Equal(pkgt.Certs[0].Subject.String(), info.Subject)
+	this.Assert().Equal(pkgt.Certs[0].DNSNames, info.SANs)
+	this.Assert().Equal(pkgt.Certs[0].SerialNumber.String(), info.Serial)
+	this.Assert().Equal(pkgt.Certs[0].NotAfter, info.NotAfter)
+	this.Assert().Equal("good", info.OCSPStatus)
+	this.Require().NotNil(info.OCSPNextUpdate)
+	this.Assert().Equal(this.clock.Now().Add(7*24*time.Hour).Unix(), info.OCSPNextUpdate.Unix())
+	this.Assert().Equal("/amppkg/cert/"+pkgt.CertName, info.CertURL)
+}
+
+func (this *CertCacheSuite) TestSecondsUntilExpiry() {
+	this.clock = pkgt.NewFakeClock(pkgt.Certs[0].NotAfter.Add(-time.Hour))
+	this.Assert().Equal(int64(3600), SecondsUntilExpiry(this.handler, this.clock))
+	this.clock.Advance(2 * time.Hour)
+	this.Assert().Equal(int64(-3600), SecondsUntilExpiry(this.handler, this.clock))
+}
+
 func (this *CertCacheSuite) TestCertCacheIsHealthy() {
 	this.Assert().NoError(this.handler.IsHealthy())
 }
 
+func (this *CertCacheSuite) TestCertCacheWithoutCertIsNotHealthy() {
+	ocsp, _, err := this.handler.readOCSP(false)
+	this.Require().NoError(err)
+	this.handler.certsMu.Lock()
+	this.handler.certs = nil
+	this.handler.certsMu.Unlock()
+	this.Assert().EqualError(this.handler.isHealthy(ocsp), "No cert loaded.")
+}
+
 func (this *CertCacheSuite) TestCertCacheIsNotHealthy() {
 	// Prime memory cache with a past-midpoint OCSP:
 	err := os.Remove(filepath.Join(this.tempDir, "ocsp"))
 	this.Require().NoError(err, "deleting OCSP tempfile")
-	this.fakeOCSP, err = FakeOCSPResponse(time.Now().Add(-4 * 24 * time.Hour))
+	this.fakeOCSP, err = FakeOCSPResponse(this.clock.Now().Add(-4 * 24 * time.Hour))
 	this.Require().NoError(err, "creating stale OCSP response")
 	this.Require().True(this.ocspServerCalled(func() {
 		this.handler, err = this.New()
@@ -213,25 +270,111 @@ func (this *CertCacheSuite) TestCertCacheIsNotHealthy() {
 	this.Assert().Error(this.handler.IsHealthy())
 }
 
+func (this *CertCacheSuite) TestRequireFreshOCSP() {
+	// Valid per NextUpdate, but older than browsers accept. The packager
+	// wouldn't fetch this, but another replica might share it via disk.
+	oldOCSP, err := fakeOCSPResponseWithLifetime(pkgt.B3Certs[0], this.clock.Now().Add(-8*24*time.Hour), 10*24*time.Hour)
+	this.Require().NoError(err, "creating old OCSP response")
+	this.Require().NoError(ioutil.WriteFile(filepath.Join(this.tempDir, "ocsp"), oldOCSP, 0644))
+	this.fakeOCSP = oldOCSP
+	this.handler.Stop()
+	this.handler, err = this.New()
+	this.Require().NoError(err, "reinstantiating CertCache")
+	this.Assert().NoError(this.handler.IsHealthy())
+
+	resp := pkgt.Get(this.T(), this.mux(), "/amppkg/cert/"+pkgt.CertName)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	this.handler.requireFreshOCSP = true
+	this.Assert().Contains(errorString(this.handler.IsHealthy()), "Cached OCSP is older than 168h0m0s")
+	resp = pkgt.Get(this.T(), this.mux(), "/amppkg/cert/"+pkgt.CertName)
+	this.Assert().Equal(http.StatusInternalServerError, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+// Returns a copy of the test leaf cert with the OCSP must-staple extension.
+func mustStapleCert() (*x509.Certificate, error) {
+	template := *pkgt.B3Certs[0]
+	template.ExtraExtensions = append(template.Extensions, pkix.Extension{
+		Id: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+		// SEQUENCE { INTEGER 5 }, i.e. status_request.
+		Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+	})
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, pkgt.B3Certs[0].PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (this *CertCacheSuite) TestMustStapleRequiresFreshOCSP() {
+	leaf, err := mustStapleCert()
+	this.Require().NoError(err, "creating must-staple cert")
+	this.Require().True(util.HasMustStaple(leaf))
+	certPath := "/amppkg/cert/" + util.CertName(leaf)
+	newHandler := func(ocspResp []byte) error {
+		this.handler.Stop()
+		this.fakeOCSP = ocspResp
+		this.Require().NoError(ioutil.WriteFile(filepath.Join(this.tempDir, "ocsp"), ocspResp, 0644))
+		this.handler = New([]*x509.Certificate{leaf, caCert}, nil, []string{"example.com"}, "cert.crt", "newcert.crt",
+			filepath.Join(this.tempDir, "ocsp"), nil)
+		this.handler.clock = this.clock
+		this.handler.extractOCSPServer = func(*x509.Certificate) (string, error) {
+			return this.ocspServer.URL, nil
+		}
+		return this.handler.Init()
+	}
+
+	freshOCSP, err := fakeOCSPResponseFor(leaf, this.clock.Now())
+	this.Require().NoError(err, "creating OCSP response")
+	this.Require().NoError(newHandler(freshOCSP))
+	resp := pkgt.Get(this.T(), this.mux(), certPath)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().NoError(this.handler.IsHealthy())
+	this.Assert().True(this.handler.DescribeCerts()[0].MustStaple)
+
+	// Valid per NextUpdate, but older than browsers accept. Even without
+	// requireFreshOCSP, it's rejected.
+	oldOCSP, err := fakeOCSPResponseWithLifetime(leaf, this.clock.Now().Add(-8*24*time.Hour), 10*24*time.Hour)
+	this.Require().NoError(err, "creating old OCSP response")
+	this.Assert().Contains(errorString(newHandler(oldOCSP)), "Cached OCSP is older than 168h0m0s")
+}
+
 func (this *CertCacheSuite) TestServes404OnMissingCertificate() {
 	resp := pkgt.Get(this.T(), this.mux(), "/amppkg/cert/lalala")
 	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
 	body, _ := ioutil.ReadAll(resp.Body)
-	// Small enough not to fit a cert or key:
-	this.Assert().Condition(func() bool { return len(body) <= 20 }, "body too large: %q", body)
+	// Just the error page; too small to fit a cert or key:
+	this.Assert().Contains(string(body), "not_found")
+	this.Assert().Condition(func() bool { return len(body) <= 300 }, "body too large: %q", body)
 }
 
 func (this *CertCacheSuite) TestOCSP() {
 	// Verify it gets included in the cert-chain+cbor payload.
 	resp := pkgt.Get(this.T(), this.mux(), "/amppkg/cert/"+pkgt.CertName)
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-	// 302400 is 3.5 days. max-age is slightly less because of the time between fake OCSP generation and cert-chain response.
-	// TODO(twifkak): Make this less flaky, by injecting a fake clock.
-	this.Assert().Equal("public, max-age=302399", resp.Header.Get("Cache-Control"))
+	// 302400 is 3.5 days.
+	this.Assert().Equal("public, max-age=302400", resp.Header.Get("Cache-Control"))
 	cbor := this.DecodeCBOR(resp.Body)
 	this.Assert().Equal(this.fakeOCSP, cbor["ocsp"])
 }
 
+func (this *CertCacheSuite) TestOCSPUpdateAfterMidpoint() {
+	this.Assert().False(this.handler.shouldUpdateOCSP(this.fakeOCSP))
+
+	this.clock.Advance(84 * time.Hour)
+	this.Assert().False(this.handler.shouldUpdateOCSP(this.fakeOCSP))
+	resp := pkgt.Get(this.T(), this.mux(), "/amppkg/cert/"+pkgt.CertName)
+	this.Assert().Equal("public, max-age=0", resp.Header.Get("Cache-Control"))
+
+	this.clock.Advance(time.Second)
+	this.Assert().True(this.handler.shouldUpdateOCSP(this.fakeOCSP))
+
+	// Once past NextUpdate, the OCSP response is no longer healthy.
+	this.Assert().NoError(this.handler.isHealthy(this.fakeOCSP))
+	this.clock.Advance(84 * time.Hour)
+	this.Assert().Error(this.handler.isHealthy(this.fakeOCSP))
+}
+
 func (this *CertCacheSuite) TestOCSPCached() {
 	// Verify it is in the memory cache:
 	this.Assert().False(this.ocspServerCalled(func() {
@@ -250,7 +393,7 @@ func (this *CertCacheSuite) TestOCSPExpiry() {
 	// Prime memory and disk cache with a past-midpoint OCSP:
 	err := os.Remove(filepath.Join(this.tempDir, "ocsp"))
 	this.Require().NoError(err, "deleting OCSP tempfile")
-	this.fakeOCSP, err = FakeOCSPResponse(time.Now().Add(-4 * 24 * time.Hour))
+	this.fakeOCSP, err = FakeOCSPResponse(this.clock.Now().Add(-4 * 24 * time.Hour))
 	this.Require().NoError(err, "creating expired OCSP response")
 	this.Require().True(this.ocspServerCalled(func() {
 		this.handler, err = this.New()
@@ -268,11 +411,42 @@ func (this *CertCacheSuite) TestOCSPExpiry() {
 	}))
 }
 
+func (this *CertCacheSuite) TestOCSPDeadline() {
+	// Prime memory and disk cache with a past-midpoint OCSP:
+	err := os.Remove(filepath.Join(this.tempDir, "ocsp"))
+	this.Require().NoError(err, "deleting OCSP tempfile")
+	this.fakeOCSP, err = FakeOCSPResponse(this.clock.Now().Add(-4 * 24 * time.Hour))
+	this.Require().NoError(err, "creating stale OCSP response")
+	this.handler, err = this.New()
+	this.Require().NoError(err, "reinstantiating CertCache")
+
+	// A hanging OCSP responder doesn't block past the deadline, and the
+	// cached response continues to be served.
+	hung := make(chan struct{}, 1)
+	this.ocspHandler = func(resp http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+		hung <- struct{}{}
+	}
+	this.handler.ocspRetry.Timeout = 10 * time.Millisecond
+	start := time.Now()
+	ocsp, _, err := this.handler.readOCSP(true)
+	this.Assert().True(time.Since(start) < 5*time.Second, "readOCSP took %v", time.Since(start))
+	this.Require().NoError(err)
+	this.Assert().Equal(this.fakeOCSP, ocsp)
+
+	// Don't let the responder outlive the test; it reads ocspHandler,
+	// which the next test replaces.
+	<-hung
+}
+
 func (this *CertCacheSuite) TestOCSPUpdateFromDisk() {
 	// Prime memory cache with a past-midpoint OCSP:
 	err := os.Remove(filepath.Join(this.tempDir, "ocsp"))
 	this.Require().NoError(err, "deleting OCSP tempfile")
-	this.fakeOCSP, err = FakeOCSPResponse(time.Now().Add(-4 * 24 * time.Hour))
+	this.fakeOCSP, err = FakeOCSPResponse(this.clock.Now().Add(-4 * 24 * time.Hour))
 	this.Require().NoError(err, "creating stale OCSP response")
 	this.Require().True(this.ocspServerCalled(func() {
 		this.handler, err = this.New()
@@ -280,7 +454,7 @@ func (this *CertCacheSuite) TestOCSPUpdateFromDisk() {
 	}))
 
 	// Prime disk cache with a fresh OCSP.
-	freshOCSP, err := FakeOCSPResponse(time.Now())
+	freshOCSP, err := FakeOCSPResponse(this.clock.Now())
 	this.Require().NoError(err, "creating fresh OCSP response")
 	err = ioutil.WriteFile(filepath.Join(this.tempDir, "ocsp"), freshOCSP, 0644)
 	this.Require().NoError(err, "writing fresh OCSP response to disk")
@@ -315,7 +489,7 @@ func (this *CertCacheSuite) TestOCSPIgnoreInvalidUpdate() {
 	// Prime memory and disk cache with a past-midpoint OCSP:
 	err := os.Remove(filepath.Join(this.tempDir, "ocsp"))
 	this.Require().NoError(err, "deleting OCSP tempfile")
-	staleOCSP, err := FakeOCSPResponse(time.Now().Add(-4 * 24 * time.Hour))
+	staleOCSP, err := FakeOCSPResponse(this.clock.Now().Add(-4 * 24 * time.Hour))
 	this.Require().NoError(err, "creating stale OCSP response")
 	this.fakeOCSP = staleOCSP
 	this.Require().True(this.ocspServerCalled(func() {
@@ -324,7 +498,7 @@ func (this *CertCacheSuite) TestOCSPIgnoreInvalidUpdate() {
 	}))
 
 	// Try to update with an invalid OCSP:
-	this.fakeOCSP, err = FakeOCSPResponse(time.Now().Add(-8 * 24 * time.Hour))
+	this.fakeOCSP, err = FakeOCSPResponse(this.clock.Now().Add(-8 * 24 * time.Hour))
 	this.Require().NoError(err, "creating expired OCSP response")
 	this.Assert().True(this.ocspServerCalled(func() {
 		_, _, err := this.handler.readOCSP(true)
@@ -362,6 +536,163 @@ func (this *CertCacheSuite) TestPopulateCertCache() {
 	this.Assert().Equal(pkgt.B3Certs[0], certCache.GetLatestCert())
 }
 
+func (this *CertCacheSuite) TestPopulateCertCacheRejectsUnusableCert() {
+	config := &util.Config{
+		CertFile:  "../../testdata/b3/fullchain_91days.cert",
+		KeyFile:   "../../testdata/b3/server.privkey",
+		OCSPCache: "/tmp/ocsp",
+		URLSet: []util.URLSet{{
+			Sign: &util.URLPattern{
+				Domain:    "amppackageexample.com",
+				PathRE:    stringPtr(".*"),
+				QueryRE:   stringPtr(""),
+				MaxLength: 2000,
+			},
+		}},
+	}
+	_, err := PopulateCertCache(config, pkgt.B3Key, nil, false, false)
+	this.Assert().Contains(errorString(err), "Validity Period no greater than 90 days")
+
+	// In development mode, this is only a warning.
+	certCache, err := PopulateCertCache(config, pkgt.B3Key, nil, true, false)
+	this.Require().NoError(err)
+	this.Assert().Equal(pkgt.B3Certs91Days[0], certCache.GetLatestCert())
+}
+
+func (this *CertCacheSuite) TestPopulateCertCacheChecksCT() {
+	config := &util.Config{
+		CertFile:  "../../testdata/b3/fullchain.cert",
+		KeyFile:   "../../testdata/b3/server.privkey",
+		OCSPCache: "/tmp/ocsp",
+		URLSet: []util.URLSet{{
+			Sign: &util.URLPattern{Domain: "amppackageexample.com"},
+		}},
+		CT: &util.CTConfig{MinSCTs: 2},
+	}
+	// The test cert has no SCTs; without Enforce, this is only a warning.
+	_, err := PopulateCertCache(config, pkgt.B3Key, nil, false, false)
+	this.Require().NoError(err)
+
+	config.CT.Enforce = true
+	_, err = PopulateCertCache(config, pkgt.B3Key, nil, false, false)
+	this.Assert().Contains(errorString(err), "checking CT for ../../testdata/b3/fullchain.cert: Certificate has embedded SCTs from 0 qualifying CT log(s)")
+
+	// In development mode, it's always a warning.
+	_, err = PopulateCertCache(config, pkgt.B3Key, nil, true, false)
+	this.Require().NoError(err)
+}
+
+func (this *CertCacheSuite) TestCheckCacheFormat() {
+	path := filepath.Join(this.tempDir, "cache")
+
+	// A pre-versioning file in the legacy format is kept.
+	this.Require().NoError(ioutil.WriteFile(path, []byte("legacy"), 0600))
+	this.Require().NoError(checkCacheFormat(path, 1, 1))
+	contents, err := ioutil.ReadFile(path)
+	this.Require().NoError(err)
+	this.Assert().Equal("legacy", string(contents))
+	version, err := ioutil.ReadFile(path + ".version")
+	this.Require().NoError(err)
+	this.Assert().Equal("1", string(version))
+
+	// A format change invalidates the file.
+	this.Require().NoError(checkCacheFormat(path, 2, 1))
+	_, err = os.Stat(path)
+	this.Assert().True(os.IsNotExist(err))
+	version, err = ioutil.ReadFile(path + ".version")
+	this.Require().NoError(err)
+	this.Assert().Equal("2", string(version))
+
+	// A matching version leaves the file alone.
+	this.Require().NoError(ioutil.WriteFile(path, []byte("new"), 0600))
+	this.Require().NoError(checkCacheFormat(path, 2, 1))
+	contents, err = ioutil.ReadFile(path)
+	this.Require().NoError(err)
+	this.Assert().Equal("new", string(contents))
+
+	// Another instance sharing the cache doesn't stop the check.
+	other := flock.New(path + ".lock")
+	locked, err := other.TryRLock()
+	this.Require().NoError(err)
+	this.Require().True(locked)
+	defer other.Unlock()
+	this.Require().NoError(checkCacheFormat(path, 2, 1))
+}
+
+func (this *CertCacheSuite) TestPopulateCertCacheRejectsUncoveredDomains() {
+	_, err := PopulateCertCache(
+		&util.Config{
+			CertFile:  "../../testdata/b3/fullchain.cert",
+			KeyFile:   "../../testdata/b3/server.privkey",
+			OCSPCache: "/tmp/ocsp",
+			URLSet: []util.URLSet{
+				{Sign: &util.URLPattern{Domain: "amppackageexample.com"}},
+				{Sign: &util.URLPattern{Domain: "example.com"}},
+				{Sign: &util.URLPattern{Domain: "www.amppackageexample.com"}},
+				{Sign: &util.URLPattern{Domain: "amppackageexample2.com"}},
+			},
+		},
+		pkgt.B3Key,
+		nil,
+		true,
+		false)
+	this.Assert().Contains(errorString(err), "does not cover URLSet.Sign.Domain(s) [example.com, amppackageexample2.com]")
+	this.Assert().Contains(errorString(err), "amppackageexample.com, www.amppackageexample.com")
+}
+
+func (this *CertCacheSuite) TestPopulateCertCacheRejectsMismatchedKey() {
+	_, err := PopulateCertCache(
+		&util.Config{
+			CertFile:  "../../testdata/b3/fullchain.cert",
+			KeyFile:   "../../testdata/b3/server2.privkey",
+			OCSPCache: "/tmp/ocsp",
+			URLSet: []util.URLSet{{
+				Sign: &util.URLPattern{Domain: "amppackageexample.com"},
+			}},
+		},
+		pkgt.B3Key2,
+		nil,
+		true,
+		false)
+	this.Assert().Contains(errorString(err), "checking ../../testdata/b3/server2.privkey matches ../../testdata/b3/fullchain.cert: PublicKey.X not match")
+}
+
+func (this *CertCacheSuite) TestPopulateCertCacheRejectsMisorderedChain() {
+	certFile := filepath.Join(this.tempDir, "fullchain.cert")
+	var chain []byte
+	for _, cert := range []*x509.Certificate{pkgt.B3Certs[0], pkgt.B3Certs2[0], pkgt.B3Certs[1]} {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	this.Require().NoError(ioutil.WriteFile(certFile, chain, 0644))
+	_, err := PopulateCertCache(
+		&util.Config{
+			CertFile:  certFile,
+			KeyFile:   "../../testdata/b3/server.privkey",
+			OCSPCache: "/tmp/ocsp",
+			URLSet: []util.URLSet{{
+				Sign: &util.URLPattern{Domain: "amppackageexample.com"},
+			}},
+		},
+		pkgt.B3Key,
+		nil,
+		false,
+		false)
+	this.Assert().Contains(errorString(err), `Cert chain is out of order: cert 0 ("amppackageexample.com") is issued by cert 2 ("Fake CA")`)
+}
+
+func (this *CertCacheSuite) TestFetchOCSPRequiresResponder() {
+	// The test certs lack an OCSP responder URL.
+	_, err := FetchOCSP(pkgt.B3Certs, time.Second)
+	this.Assert().EqualError(err, "No valid OCSP response available")
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
 func TestCertCacheSuite(t *testing.T) {
 	suite.Run(t, new(CertCacheSuite))
 }
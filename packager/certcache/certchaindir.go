@@ -0,0 +1,81 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Configures the CertCache to write its cert chain (including its current
+// OCSP response) to dir, under the same content-addressed name it's served
+// at, whenever it changes. Must be called before Init.
+func (this *CertCache) WriteCertChainTo(dir string) {
+	this.certChainDir = dir
+}
+
+// Writes the cert chain with the given OCSP response to certChainDir, if it
+// has changed since the last write. Failures are logged, and retried on the
+// next OCSP check.
+func (this *CertCache) writeCertChain(ocsp []byte) {
+	if this.certChainDir == "" || len(ocsp) == 0 {
+		return
+	}
+	cbor, err := this.createCertChainCBOR(ocsp)
+	if err != nil {
+		log.Println("Error building cert chain for CertChainDir:", err)
+		return
+	}
+	sum := sha256.Sum256(cbor)
+	if bytes.Equal(sum[:], this.writtenCertChainSum) {
+		return
+	}
+	this.certsMu.RLock()
+	name := this.certName
+	this.certsMu.RUnlock()
+	if err := writeFileAtomically(this.certChainDir, name, cbor); err != nil {
+		log.Printf("Error writing cert chain %s: %+v\n", name, err)
+		return
+	}
+	log.Println("Wrote cert chain", name, "to", this.certChainDir)
+	this.writtenCertChainSum = sum[:]
+}
+
+// Writes data to dir/name via a tempfile, so that a server reading from the
+// directory never sees a partial file.
+func writeFileAtomically(dir string, name string, data []byte) error {
+	tmp, err := ioutil.TempFile(dir, "."+name+".")
+	if err != nil {
+		return errors.Wrapf(err, "creating tempfile in %s", dir)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "writing %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "closing %s", tmp.Name())
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrapf(err, "chmodding %s", tmp.Name())
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), filepath.Join(dir, name)), "renaming tempfile")
+}
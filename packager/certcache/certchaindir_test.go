@@ -0,0 +1,66 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+)
+
+func (this *CertCacheSuite) servedCertChain() []byte {
+	resp := pkgt.Get(this.T(), this.mux(), "/amppkg/cert/"+pkgt.CertName)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	return body
+}
+
+func (this *CertCacheSuite) TestWritesCertChain() {
+	this.handler.WriteCertChainTo(this.tempDir)
+	ocsp, _, err := this.handler.readOCSP(false)
+	this.Require().NoError(err)
+
+	this.handler.writeCertChain(ocsp)
+	path := filepath.Join(this.tempDir, pkgt.CertName)
+	written, err := ioutil.ReadFile(path)
+	this.Require().NoError(err)
+	this.Assert().Equal(this.servedCertChain(), written)
+
+	// Unchanged chains aren't rewritten.
+	this.Require().NoError(os.Remove(path))
+	this.handler.writeCertChain(ocsp)
+	_, err = os.Stat(path)
+	this.Assert().True(os.IsNotExist(err))
+}
+
+func (this *CertCacheSuite) TestRetriesFailedCertChainWrite() {
+	dir := filepath.Join(this.tempDir, "certs")
+	this.handler.WriteCertChainTo(dir)
+	ocsp, _, err := this.handler.readOCSP(false)
+	this.Require().NoError(err)
+
+	this.handler.writeCertChain(ocsp)
+	_, err = os.Stat(filepath.Join(dir, pkgt.CertName))
+	this.Assert().True(os.IsNotExist(err))
+
+	this.Require().NoError(os.Mkdir(dir, 0700))
+	this.handler.writeCertChain(ocsp)
+	_, err = os.Stat(filepath.Join(dir, pkgt.CertName))
+	this.Assert().NoError(err)
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"crypto"
+	"crypto/x509"
+	"log"
+	"net/http"
+
+	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// Optionally implemented by CertHandlers that may hold a secondary cert/key
+// pair (see util.SecondaryCertConfig), for URLSets that sign with both.
+type DualCertHandler interface {
+	KeyedCertHandler
+	// Returns a nil cert if there's no secondary, or it's unhealthy, in
+	// which case sign with just the primary.
+	GetSecondaryCertAndKey() (*x509.Certificate, crypto.PrivateKey)
+}
+
+// A CertHandler for a primary and a secondary cert/key pair, e.g. from two
+// CAs. Both cert chains are served, but only the primary's health counts;
+// signing with the secondary is skipped while it's unhealthy.
+type DualCertCache struct {
+	primary      *CertCache
+	primaryKey   crypto.PrivateKey
+	secondary    *CertCache
+	secondaryKey crypto.PrivateKey
+}
+
+// Both CertCaches should already be initialized.
+func NewDual(primary *CertCache, primaryKey crypto.PrivateKey, secondary *CertCache, secondaryKey crypto.PrivateKey) *DualCertCache {
+	return &DualCertCache{primary, primaryKey, secondary, secondaryKey}
+}
+
+func (this *DualCertCache) GetLatestCert() *x509.Certificate {
+	return this.primary.GetLatestCert()
+}
+
+func (this *DualCertCache) GetLatestCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	return this.primary.GetLatestCert(), this.primaryKey
+}
+
+func (this *DualCertCache) GetSecondaryCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	if err := this.secondary.IsHealthy(); err != nil {
+		log.Println("Not signing with the secondary cert, as it's unhealthy:", err)
+		return nil, nil
+	}
+	return this.secondary.GetLatestCert(), this.secondaryKey
+}
+
+func (this *DualCertCache) IsHealthy() error {
+	return this.primary.IsHealthy()
+}
+
+// Describes the primary cert, followed by the secondary.
+func (this *DualCertCache) DescribeCerts() []CertInfo {
+	return append(this.primary.DescribeCerts(), this.secondary.DescribeCerts()...)
+}
+
+func (this *DualCertCache) hasCertName(certName string) bool {
+	return this.primary.hasCertName(certName) || this.secondary.hasCertName(certName)
+}
+
+func (this *DualCertCache) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if certName := mux.Params(req)["certName"]; certName != util.CurrentCertAlias && this.secondary.hasCertName(certName) {
+		this.secondary.ServeHTTP(resp, req)
+	} else {
+		this.primary.ServeHTTP(resp, req)
+	}
+}
+
+// Stops both CertCaches.
+func (this *DualCertCache) Stop() bool {
+	stoppedSecondary := this.secondary.Stop()
+	return this.primary.Stop() || stoppedSecondary
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"crypto/x509"
+	"net/http"
+	"path/filepath"
+
+	"github.com/ampproject/amppackager/packager/mux"
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// If unhealthy, the secondary can't fetch an OCSP response.
+func (this *CertCacheSuite) newSecondary(healthy bool) *CertCache {
+	var err error
+	this.fakeOCSP, err = fakeOCSPResponseFor(pkgt.B3Certs2[0], this.clock.Now())
+	this.Require().NoError(err)
+	secondary := New(pkgt.B3Certs2, nil, []string{"example.com"}, "cert2.crt", "",
+		filepath.Join(this.tempDir, "ocsp.secondary"), nil)
+	secondary.clock = this.clock
+	secondary.extractOCSPServer = func(*x509.Certificate) (string, error) {
+		if !healthy {
+			return "", errors.New("no OCSP server")
+		}
+		return this.ocspServer.URL, nil
+	}
+	if healthy {
+		this.Require().NoError(secondary.Init())
+	}
+	return secondary
+}
+
+func (this *CertCacheSuite) TestDualSignsWithBoth() {
+	dual := NewDual(this.handler, pkgt.B3Key, this.newSecondary(true), pkgt.B3Key2)
+	defer dual.Stop()
+
+	cert, key := dual.GetLatestCertAndKey()
+	this.Assert().Equal(pkgt.B3Certs[0], cert)
+	this.Assert().Equal(pkgt.B3Key, key)
+	cert, key = dual.GetSecondaryCertAndKey()
+	this.Assert().Equal(pkgt.B3Certs2[0], cert)
+	this.Assert().Equal(pkgt.B3Key2, key)
+	this.Assert().NoError(dual.IsHealthy())
+	this.Assert().Len(dual.DescribeCerts(), 2)
+}
+
+func (this *CertCacheSuite) TestDualSkipsUnhealthySecondary() {
+	dual := NewDual(this.handler, pkgt.B3Key, this.newSecondary(false), pkgt.B3Key2)
+	defer dual.Stop()
+
+	cert, _ := dual.GetSecondaryCertAndKey()
+	this.Assert().Nil(cert)
+	this.Assert().NoError(dual.IsHealthy())
+}
+
+func (this *CertCacheSuite) TestDualServesBothCerts() {
+	dual := NewDual(this.handler, pkgt.B3Key, this.newSecondary(true), pkgt.B3Key2)
+	defer dual.Stop()
+	handler := mux.New(mux.Handlers{CertCache: dual})
+
+	for _, certs := range [][]*x509.Certificate{pkgt.B3Certs, pkgt.B3Certs2} {
+		resp := pkgt.Get(this.T(), handler, "/amppkg/cert/"+util.CertName(certs[0]))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(certs[0].Raw, this.DecodeCBOR(resp.Body)["cert"])
+	}
+
+	resp := pkgt.Get(this.T(), handler, "/amppkg/cert/current")
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("/amppkg/cert/"+util.CertName(pkgt.B3Certs[0]), resp.Header.Get("Content-Location"))
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"crypto/x509"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"golang.org/x/crypto/ocsp"
+)
+
+// A description of a loaded cert, for fleet monitoring and rotation tooling.
+type CertInfo struct {
+	Subject   string    `json:"subject"`
+	SANs      []string  `json:"sans"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	// One of "good", "revoked", "unknown", or "unavailable" if there's no
+	// valid OCSP response cached.
+	OCSPStatus     string     `json:"ocspStatus"`
+	OCSPNextUpdate *time.Time `json:"ocspNextUpdate,omitempty"`
+	// Whether the cert has the OCSP must-staple extension.
+	MustStaple bool `json:"mustStaple"`
+	// The path at which the cert chain is served.
+	CertURL string `json:"certURL"`
+}
+
+// Implemented by CertHandlers that can describe the certs they've loaded.
+type CertDescriber interface {
+	DescribeCerts() []CertInfo
+}
+
+// Returns the seconds until the latest cert expires, per clock, or 0 if there's
+// none. For the amppkg_cert_expiry_seconds metric.
+func SecondsUntilExpiry(certs CertHandler, clock util.Clock) int64 {
+	cert := certs.GetLatestCert()
+	if cert == nil {
+		return 0
+	}
+	return int64(cert.NotAfter.Sub(clock.Now()).Seconds())
+}
+
+var ocspStatusNames = map[int]string{
+	ocsp.Good:    "good",
+	ocsp.Revoked: "revoked",
+	ocsp.Unknown: "unknown",
+}
+
+// Describes the given leaf cert, given its (possibly nil) OCSP response.
+func describeCert(cert *x509.Certificate, issuer *x509.Certificate, ocspResp []byte) CertInfo {
+	info := CertInfo{
+		Subject:    cert.Subject.String(),
+		SANs:       cert.DNSNames,
+		Serial:     cert.SerialNumber.String(),
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+		OCSPStatus: "unavailable",
+		MustStaple: util.HasMustStaple(cert),
+		CertURL:    path.Join(util.CertURLPrefix, url.PathEscape(util.CertName(cert))),
+	}
+	if ocspResp != nil && issuer != nil {
+		if resp, err := ocsp.ParseResponseForCert(ocspResp, cert, issuer); err == nil {
+			if name, ok := ocspStatusNames[resp.Status]; ok {
+				info.OCSPStatus = name
+			}
+			info.OCSPNextUpdate = &resp.NextUpdate
+		}
+	}
+	return info
+}
+
+// Describes the cert currently served. Its OCSP status is "unavailable" if
+// the cached response is missing or stale.
+func (this *CertCache) DescribeCerts() []CertInfo {
+	cert := this.getCert()
+	if cert == nil {
+		return []CertInfo{}
+	}
+	ocspResp, _, _ := this.readOCSP(false)
+	return []CertInfo{describeCert(cert, this.findIssuer(), ocspResp)}
+}
+
+// Describes the current cert, followed by the next.
+func (this *RotatingCertCache) DescribeCerts() []CertInfo {
+	return append(this.current.DescribeCerts(), this.next.DescribeCerts()...)
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"crypto"
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// Implemented by *CertCache, *RotatingCertCache, and *DualCertCache.
+type Reloadable interface {
+	CertHandler
+	CertDescriber
+	http.Handler
+	Stop() bool
+	hasCertName(certName string) bool
+}
+
+// Loads a freshly initialized Reloadable, along with the key to sign with
+// (if it isn't a KeyedCertHandler).
+type Loader func() (Reloadable, crypto.PrivateKey, error)
+
+// Certs replaced by a reload, and when the last exchange signed with them
+// expires.
+type retiredCerts struct {
+	Reloadable
+	until time.Time
+}
+
+// A CertHandler whose certs and key can be reloaded on demand, e.g. by
+// deployment tooling driving a rotation. After a reload, each previous cert
+// chain continues to be served until every exchange signed with it has
+// expired, so that they remain valid.
+type ReloadableCertHandler struct {
+	load      Loader
+	retention time.Duration
+	clock     util.Clock
+
+	mu       sync.RWMutex
+	current  Reloadable
+	key      crypto.PrivateKey
+	previous []retiredCerts
+}
+
+// Calls load for the initial certs. retention is the longest signature
+// lifetime, for which replaced certs continue to be served.
+func NewReloadable(load Loader, retention time.Duration) (*ReloadableCertHandler, error) {
+	current, key, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadableCertHandler{load: load, retention: retention, clock: util.SystemClock{}, current: current, key: key}, nil
+}
+
+// Loads the certs and key anew. On success, signing switches to them
+// immediately. On failure, the current certs and key remain in use. Previous
+// certs whose exchanges have all expired are dropped.
+func (this *ReloadableCertHandler) Reload() error {
+	next, key, err := this.load()
+	if err != nil {
+		return errors.Wrap(err, "reloading certs")
+	}
+	now := this.clock.Now()
+	var evicted []retiredCerts
+	this.mu.Lock()
+	// Copied rather than filtered in place, as ServeHTTP may be
+	// iterating over the old slice.
+	previous := []retiredCerts{}
+	for _, retired := range this.previous {
+		if now.Before(retired.until) {
+			previous = append(previous, retired)
+		} else {
+			evicted = append(evicted, retired)
+		}
+	}
+	this.previous = append(previous, retiredCerts{this.current, now.Add(this.retention)})
+	this.current = next
+	this.key = key
+	this.mu.Unlock()
+	for _, retired := range evicted {
+		retired.Stop()
+	}
+	return nil
+}
+
+func (this *ReloadableCertHandler) active() (Reloadable, crypto.PrivateKey) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.current, this.key
+}
+
+func (this *ReloadableCertHandler) GetLatestCert() *x509.Certificate {
+	cert, _ := this.GetLatestCertAndKey()
+	return cert
+}
+
+func (this *ReloadableCertHandler) GetLatestCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	current, key := this.active()
+	if keyed, ok := current.(KeyedCertHandler); ok {
+		return keyed.GetLatestCertAndKey()
+	}
+	return current.GetLatestCert(), key
+}
+
+func (this *ReloadableCertHandler) GetSecondaryCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	current, _ := this.active()
+	if dual, ok := current.(DualCertHandler); ok {
+		return dual.GetSecondaryCertAndKey()
+	}
+	return nil, nil
+}
+
+func (this *ReloadableCertHandler) IsHealthy() error {
+	current, _ := this.active()
+	return current.IsHealthy()
+}
+
+func (this *ReloadableCertHandler) DescribeCerts() []CertInfo {
+	current, _ := this.active()
+	return current.DescribeCerts()
+}
+
+// Returns the current certs if they have certName, else the most recent
+// previous certs that do, else nil.
+func (this *ReloadableCertHandler) certsNamed(certName string) Reloadable {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if this.current.hasCertName(certName) {
+		return this.current
+	}
+	for i := len(this.previous) - 1; i >= 0; i-- {
+		if this.previous[i].hasCertName(certName) {
+			return this.previous[i].Reloadable
+		}
+	}
+	return nil
+}
+
+func (this *ReloadableCertHandler) hasCertName(certName string) bool {
+	return this.certsNamed(certName) != nil
+}
+
+func (this *ReloadableCertHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if certs := this.certsNamed(mux.Params(req)["certName"]); certs != nil {
+		certs.ServeHTTP(resp, req)
+	} else {
+		current, _ := this.active()
+		current.ServeHTTP(resp, req)
+	}
+}
+
+// Stops the current and previous certs' maintenance.
+func (this *ReloadableCertHandler) Stop() bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	stopped := this.current.Stop()
+	for _, retired := range this.previous {
+		stopped = retired.Stop() || stopped
+	}
+	return stopped
+}
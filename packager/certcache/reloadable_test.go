@@ -0,0 +1,128 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"crypto"
+	"crypto/x509"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/mux"
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// Returns a ReloadableCertHandler that initially loads this.handler, and on
+// reload loads B3Certs2, or fails if loadErr is set. Previous certs are
+// retained for reloadRetention.
+func (this *CertCacheSuite) newReloadable(loadErr *error) *ReloadableCertHandler {
+	loads := 0
+	reloadable, err := NewReloadable(func() (Reloadable, crypto.PrivateKey, error) {
+		loads++
+		if loads == 1 {
+			return this.handler, pkgt.B3Key, nil
+		}
+		if *loadErr != nil {
+			return nil, nil, *loadErr
+		}
+		var err error
+		this.fakeOCSP, err = fakeOCSPResponseFor(pkgt.B3Certs2[0], this.clock.Now())
+		this.Require().NoError(err)
+		next := New(pkgt.B3Certs2, nil, []string{"example.com"}, "cert2.crt", "",
+			filepath.Join(this.tempDir, "ocsp.next"), nil)
+		next.clock = this.clock
+		next.extractOCSPServer = func(*x509.Certificate) (string, error) {
+			return this.ocspServer.URL, nil
+		}
+		if err := next.Init(); err != nil {
+			return nil, nil, err
+		}
+		return next, pkgt.B3Key2, nil
+	}, reloadRetention)
+	this.Require().NoError(err)
+	reloadable.clock = this.clock
+	return reloadable
+}
+
+const reloadRetention = 24 * time.Hour
+
+func (this *CertCacheSuite) TestReloadableSwitchesOnReload() {
+	var loadErr error
+	reloadable := this.newReloadable(&loadErr)
+	defer reloadable.Stop()
+
+	cert, key := reloadable.GetLatestCertAndKey()
+	this.Assert().Equal(pkgt.B3Certs[0], cert)
+	this.Assert().Equal(pkgt.B3Key, key)
+
+	this.Require().NoError(reloadable.Reload())
+	cert, key = reloadable.GetLatestCertAndKey()
+	this.Assert().Equal(pkgt.B3Certs2[0], cert)
+	this.Assert().Equal(pkgt.B3Key2, key)
+	this.Assert().NoError(reloadable.IsHealthy())
+	this.Require().Len(reloadable.DescribeCerts(), 1)
+	this.Assert().Equal(pkgt.B3Certs2[0].SerialNumber.String(), reloadable.DescribeCerts()[0].Serial)
+}
+
+func (this *CertCacheSuite) TestReloadableServesPreviousCert() {
+	var loadErr error
+	reloadable := this.newReloadable(&loadErr)
+	defer reloadable.Stop()
+	this.Require().NoError(reloadable.Reload())
+	handler := mux.New(mux.Handlers{CertCache: reloadable})
+
+	for _, certs := range [][]*x509.Certificate{pkgt.B3Certs, pkgt.B3Certs2} {
+		resp := pkgt.Get(this.T(), handler, "/amppkg/cert/"+util.CertName(certs[0]))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(certs[0].Raw, this.DecodeCBOR(resp.Body)["cert"])
+	}
+}
+
+func (this *CertCacheSuite) TestReloadableRetainsPreviousCertsUntilExpiry() {
+	var loadErr error
+	reloadable := this.newReloadable(&loadErr)
+	defer reloadable.Stop()
+	handler := mux.New(mux.Handlers{CertCache: reloadable})
+	oldCertPath := "/amppkg/cert/" + util.CertName(pkgt.B3Certs[0])
+
+	// Still served after another reload, as its exchanges may be valid.
+	this.Require().NoError(reloadable.Reload())
+	this.clock.Advance(reloadRetention - time.Second)
+	this.Require().NoError(reloadable.Reload())
+	resp := pkgt.Get(this.T(), handler, oldCertPath)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	// Dropped by the first reload after its exchanges have all expired.
+	this.clock.Advance(time.Second)
+	this.Require().NoError(reloadable.Reload())
+	resp = pkgt.Get(this.T(), handler, oldCertPath)
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode, "incorrect status: %#v", resp)
+	resp = pkgt.Get(this.T(), handler, "/amppkg/cert/"+util.CertName(pkgt.B3Certs2[0]))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *CertCacheSuite) TestReloadableKeepsCurrentOnFailure() {
+	loadErr := errors.New("bad key")
+	reloadable := this.newReloadable(&loadErr)
+	defer reloadable.Stop()
+
+	this.Assert().EqualError(reloadable.Reload(), "reloading certs: bad key")
+	cert, key := reloadable.GetLatestCertAndKey()
+	this.Assert().Equal(pkgt.B3Certs[0], cert)
+	this.Assert().Equal(pkgt.B3Key, key)
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"crypto"
+	"crypto/x509"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// Optionally implemented by CertHandlers that manage more than one key, in
+// which case the signer must sign with the key returned alongside the cert.
+type KeyedCertHandler interface {
+	CertHandler
+	GetLatestCertAndKey() (*x509.Certificate, crypto.PrivateKey)
+}
+
+// Optionally implemented by CertHandlers that, for a time, sign every exchange
+// with a second cert/key pair alongside the latest, e.g. around a rotation.
+type OverlapCertHandler interface {
+	KeyedCertHandler
+	// Returns a nil cert if there's no overlap at the moment, or the
+	// second cert is unhealthy, in which case sign with just the latest.
+	GetOverlapCertAndKey() (*x509.Certificate, crypto.PrivateKey)
+}
+
+// A CertHandler for a staged rotation from one cert/key pair to the next
+// (see util.NextCertConfig). Both cert chains are served throughout, so that
+// exchanges signed with either remain valid, but signing switches from the
+// current to the next at switchTime.
+type RotatingCertCache struct {
+	current    *CertCache
+	currentKey crypto.PrivateKey
+	next       *CertCache
+	nextKey    crypto.PrivateKey
+	switchTime time.Time
+	// Within this of switchTime, exchanges are signed with both certs.
+	overlap time.Duration
+	clock   util.Clock
+}
+
+// Both CertCaches should already be initialized.
+func NewRotating(current *CertCache, currentKey crypto.PrivateKey, next *CertCache, nextKey crypto.PrivateKey, switchTime time.Time) *RotatingCertCache {
+	return &RotatingCertCache{current, currentKey, next, nextKey, switchTime, 0, util.SystemClock{}}
+}
+
+// Configures the cache so that, within overlap on either side of the switch
+// time, exchanges are also signed with the cert that isn't active. Must be
+// called before serving.
+func (this *RotatingCertCache) DualSignWithin(overlap time.Duration) {
+	this.overlap = overlap
+}
+
+// Returns the cert cache and key currently used for signing.
+func (this *RotatingCertCache) active() (*CertCache, crypto.PrivateKey) {
+	if this.clock.Now().Before(this.switchTime) {
+		return this.current, this.currentKey
+	}
+	return this.next, this.nextKey
+}
+
+func (this *RotatingCertCache) GetLatestCert() *x509.Certificate {
+	cert, _ := this.GetLatestCertAndKey()
+	return cert
+}
+
+func (this *RotatingCertCache) GetLatestCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	certCache, key := this.active()
+	return certCache.GetLatestCert(), key
+}
+
+func (this *RotatingCertCache) GetOverlapCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	now := this.clock.Now()
+	if now.Before(this.switchTime.Add(-this.overlap)) || !now.Before(this.switchTime.Add(this.overlap)) {
+		return nil, nil
+	}
+	other, otherKey := this.next, this.nextKey
+	if active, _ := this.active(); active == this.next {
+		other, otherKey = this.current, this.currentKey
+	}
+	if err := other.IsHealthy(); err != nil {
+		log.Println("Not signing with both certs during the rotation overlap, as one is unhealthy:", err)
+		return nil, nil
+	}
+	return other.GetLatestCert(), otherKey
+}
+
+// Only the active cert needs to be healthy. The next cert's health is
+// logged ahead of the switch, to allow time to fix it.
+func (this *RotatingCertCache) IsHealthy() error {
+	certCache, _ := this.active()
+	if certCache == this.current {
+		if err := this.next.IsHealthy(); err != nil {
+			log.Printf("Next cert, to be switched to at %v, is unhealthy: %v\n", this.switchTime, err)
+		}
+	}
+	return certCache.IsHealthy()
+}
+
+func (this *RotatingCertCache) hasCertName(certName string) bool {
+	return this.current.hasCertName(certName) || this.next.hasCertName(certName)
+}
+
+func (this *RotatingCertCache) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if mux.Params(req)["certName"] == util.CurrentCertAlias {
+		certCache, _ := this.active()
+		certCache.ServeHTTP(resp, req)
+	} else if this.next.hasCertName(mux.Params(req)["certName"]) {
+		this.next.ServeHTTP(resp, req)
+	} else {
+		this.current.ServeHTTP(resp, req)
+	}
+}
+
+// Stops both CertCaches.
+func (this *RotatingCertCache) Stop() bool {
+	stoppedNext := this.next.Stop()
+	return this.current.Stop() || stoppedNext
+}
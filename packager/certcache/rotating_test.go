@@ -0,0 +1,114 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certcache
+
+import (
+	"crypto/x509"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/mux"
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+func (this *CertCacheSuite) newRotating(switchTime time.Time) *RotatingCertCache {
+	var err error
+	this.fakeOCSP, err = fakeOCSPResponseFor(pkgt.B3Certs2[0], this.clock.Now())
+	this.Require().NoError(err)
+	next := New(pkgt.B3Certs2, nil, []string{"example.com"}, "cert2.crt", "",
+		filepath.Join(this.tempDir, "ocsp.next"), nil)
+	next.clock = this.clock
+	next.extractOCSPServer = func(*x509.Certificate) (string, error) {
+		return this.ocspServer.URL, nil
+	}
+	this.Require().NoError(next.Init())
+	rotating := NewRotating(this.handler, pkgt.B3Key, next, pkgt.B3Key2, switchTime)
+	rotating.clock = this.clock
+	return rotating
+}
+
+func (this *CertCacheSuite) TestRotatingSwitchesAtSwitchTime() {
+	rotating := this.newRotating(this.clock.Now().Add(time.Hour))
+	defer rotating.Stop()
+
+	cert, key := rotating.GetLatestCertAndKey()
+	this.Assert().Equal(pkgt.B3Certs[0], cert)
+	this.Assert().Equal(pkgt.B3Key, key)
+	this.Assert().NoError(rotating.IsHealthy())
+
+	this.clock.Advance(time.Hour)
+	cert, key = rotating.GetLatestCertAndKey()
+	this.Assert().Equal(pkgt.B3Certs2[0], cert)
+	this.Assert().Equal(pkgt.B3Key2, key)
+	this.Assert().NoError(rotating.IsHealthy())
+}
+
+func (this *CertCacheSuite) TestRotatingDualSignsWithinOverlap() {
+	rotating := this.newRotating(this.clock.Now().Add(2 * time.Hour))
+	defer rotating.Stop()
+	cert, _ := rotating.GetOverlapCertAndKey()
+	this.Assert().Nil(cert, "no overlap is configured")
+
+	rotating.DualSignWithin(time.Hour)
+	cert, _ = rotating.GetOverlapCertAndKey()
+	this.Assert().Nil(cert, "the overlap hasn't started")
+
+	// Before the switch, the next cert signs second.
+	this.clock.Advance(time.Hour)
+	cert, key := rotating.GetOverlapCertAndKey()
+	this.Assert().Equal(pkgt.B3Certs2[0], cert)
+	this.Assert().Equal(pkgt.B3Key2, key)
+
+	// After, the old one does.
+	this.clock.Advance(time.Hour)
+	cert, key = rotating.GetOverlapCertAndKey()
+	this.Assert().Equal(pkgt.B3Certs[0], cert)
+	this.Assert().Equal(pkgt.B3Key, key)
+
+	this.clock.Advance(time.Hour)
+	cert, _ = rotating.GetOverlapCertAndKey()
+	this.Assert().Nil(cert, "the overlap has ended")
+}
+
+func (this *CertCacheSuite) TestRotatingServesBothCerts() {
+	rotating := this.newRotating(this.clock.Now().Add(time.Hour))
+	defer rotating.Stop()
+	handler := mux.New(mux.Handlers{CertCache: rotating})
+
+	for _, certs := range [][]*x509.Certificate{pkgt.B3Certs, pkgt.B3Certs2} {
+		resp := pkgt.Get(this.T(), handler, "/amppkg/cert/"+util.CertName(certs[0]))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal(certs[0].Raw, this.DecodeCBOR(resp.Body)["cert"])
+	}
+
+	resp := pkgt.Get(this.T(), handler, "/amppkg/cert/lalala")
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (this *CertCacheSuite) TestRotatingServesCurrentAlias() {
+	rotating := this.newRotating(this.clock.Now().Add(time.Hour))
+	defer rotating.Stop()
+	handler := mux.New(mux.Handlers{CertCache: rotating})
+
+	for _, certs := range [][]*x509.Certificate{pkgt.B3Certs, pkgt.B3Certs2} {
+		resp := pkgt.Get(this.T(), handler, "/amppkg/cert/current")
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal("/amppkg/cert/"+util.CertName(certs[0]), resp.Header.Get("Content-Location"))
+		this.Assert().Equal(certs[0].Raw, this.DecodeCBOR(resp.Body)["cert"])
+		this.clock.Advance(time.Hour)
+	}
+}
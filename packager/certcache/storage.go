@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/gofrs/flock"
@@ -185,3 +187,82 @@ func (this *Chained) Read(ctx context.Context, isExpired func([]byte) bool, upda
 		return contents
 	})
 }
+
+// Ensures the on-disk cache at path is in the given format version, so that an
+// upgraded (or downgraded) packager never misinterprets a cache file written
+// by a different version. The version is recorded in a sidecar file at
+// path + ".version". A cache file without a sidecar predates versioning, and
+// is assumed to be in legacyVersion. If the recorded version differs from
+// the given one, the cache file is removed (and will be repopulated on next
+// read), and the sidecar is updated.
+//
+// The version is checked under a shared lock, so that instances sharing the
+// cache can start at once; only a rewrite takes the exclusive lock, waiting
+// for it as needed.
+func checkCacheFormat(path string, version int, legacyVersion int) error {
+	lockPath := path + ".lock"
+	versionPath := path + ".version"
+	lock := flock.New(lockPath)
+	if err := lock.RLock(); err != nil {
+		return errors.Wrapf(err, "obtaining shared lock for %s", lockPath)
+	}
+	onDisk, versionExists, err := readCacheFormat(versionPath, legacyVersion)
+	if unlockErr := lock.Unlock(); unlockErr != nil {
+		log.Printf("Error unlocking %s; %+v", lockPath, unlockErr)
+	}
+	if err != nil {
+		return err
+	}
+	if onDisk == version && versionExists {
+		return nil
+	}
+
+	if err := lock.Lock(); err != nil {
+		return errors.Wrapf(err, "obtaining exclusive lock for %s", lockPath)
+	}
+	defer func() {
+		if err = lock.Unlock(); err != nil {
+			log.Printf("Error unlocking %s; %+v", lockPath, err)
+		}
+	}()
+	// Reread, in case another instance rewrote it in the meantime.
+	onDisk, versionExists, err = readCacheFormat(versionPath, legacyVersion)
+	if err != nil {
+		return err
+	}
+	if onDisk == version && versionExists {
+		return nil
+	}
+	if onDisk != version {
+		log.Printf("Cache %s is in format version %d; expected %d. Invalidating.\n", path, onDisk, version)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "removing %s", path)
+		}
+	}
+	if err := ioutil.WriteFile(versionPath, []byte(strconv.Itoa(version)), 0600); err != nil {
+		return errors.Wrapf(err, "writing %s", versionPath)
+	}
+	return nil
+}
+
+// Returns the format version recorded at versionPath, or legacyVersion if
+// there's none, and whether it was recorded.
+func readCacheFormat(versionPath string, legacyVersion int) (int, bool, error) {
+	versionExists, err := exists(versionPath)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "checking file exists %s", versionPath)
+	}
+	if !versionExists {
+		return legacyVersion, false, nil
+	}
+	contents, err := ioutil.ReadFile(versionPath)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "reading %s", versionPath)
+	}
+	onDisk, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		// Garbled; treat as unknown so the cache is invalidated.
+		return -1, true, nil
+	}
+	return onDisk, true, nil
+}
@@ -18,6 +18,7 @@ import (
 	"crypto"
 	"crypto/x509"
 	"strconv"
+	"time"
 
 	"github.com/WICG/webpackage/go/signedexchange"
 	"github.com/go-acme/lego/v3/certcrypto"
@@ -61,9 +62,11 @@ func (u *AcmeUser) GetPrivateKey() crypto.PrivateKey {
 // fetcher := CertFetcher()
 // fetcher.setUser(email, privateKey)
 // fetcher.bindToPort(port)
+//
+// If timeout is positive, it bounds each request to the ACME CA.
 func New(email string, certSignRequest *x509.CertificateRequest, privateKey crypto.PrivateKey,
 	acmeDiscoURL string, httpChallengePort int, httpChallengeWebRoot string,
-	tlsChallengePort int, dnsProvider string, shouldRegister bool) (*CertFetcher, error) {
+	tlsChallengePort int, dnsProvider string, shouldRegister bool, timeout time.Duration) (*CertFetcher, error) {
 
 	acmeUser := AcmeUser{
 		Email: email,
@@ -73,6 +76,9 @@ func New(email string, certSignRequest *x509.CertificateRequest, privateKey cryp
 
 	config.CADirURL = acmeDiscoURL
 	config.Certificate.KeyType = certcrypto.EC256
+	if timeout > 0 {
+		config.HTTPClient.Timeout = timeout
+	}
 
 	// A client facilitates communication with the CA server.
 	client, err := lego.NewClient(config)
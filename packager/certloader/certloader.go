@@ -15,16 +15,23 @@
 package certloader
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 
 	"github.com/WICG/webpackage/go/signedexchange"
 	"github.com/gofrs/flock"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/ampproject/amppackager/packager/certfetcher"
 	"github.com/ampproject/amppackager/packager/util"
@@ -84,7 +91,7 @@ func CreateCertFetcher(config *util.Config, key crypto.PrivateKey, domain string
 
 	// Create the cert fetcher that will auto-renew the cert.
 	certFetcher, err := certfetcher.New(emailAddress, csr, key, acmeDiscoveryURL,
-		httpChallengePort, httpWebRootDir, tlsChallengePort, dnsProvider, true)
+		httpChallengePort, httpWebRootDir, tlsChallengePort, dnsProvider, true, config.DeadlineDurations().ACME)
 	if err != nil {
 		return nil, errors.Wrap(err, "creating certfetcher")
 	}
@@ -149,6 +156,63 @@ func LoadAndValidateCertsFromFile(certPath string, requireSign bool) ([]*x509.Ce
 	return certs, nil
 }
 
+// The maximum number of issuers to fetch via AIA, to guard against loops.
+const maxAIAFetches = 4
+
+// The maximum size of a fetched issuer cert.
+const maxAIACertLength = 1 << 20
+
+// If certs contains only the leaf, completes the chain by following the "CA
+// Issuers" URLs of its Authority Information Access extension, stopping at a
+// self-signed cert or one without such a URL. A cert chain missing its issuer
+// fails SXG validation, as the issuer is needed to verify the OCSP response.
+func CompleteCertChain(certs []*x509.Certificate, client *http.Client) ([]*x509.Certificate, error) {
+	if len(certs) != 1 {
+		return certs, nil
+	}
+	for i := 0; i < maxAIAFetches; i++ {
+		cert := certs[len(certs)-1]
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) || len(cert.IssuingCertificateURL) == 0 {
+			break
+		}
+		issuer, err := fetchIssuer(cert.IssuingCertificateURL[0], client)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching issuer of %q", cert.Subject.CommonName)
+		}
+		if err := cert.CheckSignatureFrom(issuer); err != nil {
+			return nil, errors.Wrapf(err, "verifying %q was issued by %q", cert.Subject.CommonName, issuer.Subject.CommonName)
+		}
+		log.Printf("Completed cert chain with %q from %s\n", issuer.Subject.CommonName, cert.IssuingCertificateURL[0])
+		certs = append(certs, issuer)
+	}
+	return certs, nil
+}
+
+// Fetches the cert at the given AIA URL, which may be DER (per
+// https://tools.ietf.org/html/rfc5280#section-4.2.2.1) or, commonly, PEM.
+func fetchIssuer(url string, client *http.Client) (*x509.Certificate, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s responded %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAIACertLength))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", url)
+	}
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", url)
+	}
+	return cert, nil
+}
+
 func WriteCertsToFile(certs []*x509.Certificate, filepath string) error {
 	if len(certs) < 2 {
 		return errors.New("Missing issuer in bundle")
@@ -236,6 +300,22 @@ func LoadCSRFromFile(config *util.Config) (*x509.CertificateRequest, error) {
 	return csr, nil
 }
 
+// Loads the signing key from KeyFile, and checks that it can sign exchanges.
+func LoadKey(config *util.Config) (crypto.PrivateKey, error) {
+	key, err := LoadKeyFromFile(config)
+	if err != nil {
+		return nil, err
+	}
+	source := "KeyFile " + config.KeyFile
+	if err := util.ValidateSigningKey(key); err != nil {
+		return nil, errors.Wrap(err, source)
+	}
+	if pub, ok := key.(crypto.Signer).Public().(*ecdsa.PublicKey); ok && pub.Curve == elliptic.P384() {
+		log.Printf("WARNING: %s is a P-384 key. The spec allows it, but browsers currently verify only P-256 signatures.\n", source)
+	}
+	return key, nil
+}
+
 // Loads private key from file.
 // Returns appropriate errors if:
 //	The file can't be read.
@@ -247,10 +327,29 @@ func LoadKeyFromFile(config *util.Config) (crypto.PrivateKey, error) {
 		return nil, errors.Wrapf(err, "reading %s", config.KeyFile)
 	}
 
-	key, err := util.ParsePrivateKey(keyPem)
+	key, err := util.ParseEncryptedPrivateKey(keyPem, func() ([]byte, error) { return keyPassphrase(config) })
 	if err != nil {
 		return nil, errors.Wrapf(err, "parsing %s", config.KeyFile)
 	}
 
 	return key, nil
 }
+
+// Returns the passphrase for KeyFile, from the config, the environment, or
+// else the terminal, in that order.
+func keyPassphrase(config *util.Config) ([]byte, error) {
+	if config.KeyPassphrase != "" {
+		return []byte(config.KeyPassphrase), nil
+	}
+	if passphrase, ok := os.LookupEnv("AMPPKG_KEY_PASSPHRASE"); ok {
+		return []byte(passphrase), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("KeyFile is encrypted; specify KeyPassphrase or AMPPKG_KEY_PASSPHRASE")
+	}
+	fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", config.KeyFile)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
@@ -15,12 +15,22 @@
 package certloader
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/WICG/webpackage/go/signedexchange"
 	"github.com/ampproject/amppackager/packager/util"
@@ -86,3 +96,83 @@ func TestLoadKeyFromFile(t *testing.T) {
 	assert.Equal(t, caKey, key)
 	assert.Nil(t, err)
 }
+
+func TestLoadEncryptedKeyFromFile(t *testing.T) {
+	serverKeyPem, _ := ioutil.ReadFile("../../testdata/b3/server.privkey")
+	serverKey, _ := util.ParsePrivateKey(serverKeyPem)
+
+	// Passphrase from config.
+	key, err := LoadKeyFromFile(
+		&util.Config{
+			KeyFile:       "../../testdata/b3/server_pkcs8_encrypted.privkey",
+			KeyPassphrase: "amppkg",
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, serverKey, key)
+
+	// Passphrase from environment.
+	os.Setenv("AMPPKG_KEY_PASSPHRASE", "amppkg")
+	defer os.Unsetenv("AMPPKG_KEY_PASSPHRASE")
+	key, err = LoadKeyFromFile(
+		&util.Config{
+			KeyFile: "../../testdata/b3/server_encrypted.privkey",
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, serverKey, key)
+
+	// Wrong passphrase.
+	_, err = LoadKeyFromFile(
+		&util.Config{
+			KeyFile:       "../../testdata/b3/server_encrypted.privkey",
+			KeyPassphrase: "wrong",
+		})
+	assert.Contains(t, err.Error(), "decrypting private key")
+}
+
+func TestLoadKey(t *testing.T) {
+	// ECDSA keys can sign exchanges.
+	key, err := LoadKey(&util.Config{KeyFile: "../../testdata/b3/server.privkey"})
+	assert.Nil(t, err)
+	assert.IsType(t, &ecdsa.PrivateKey{}, key)
+
+	// RSA keys can't.
+	_, err = LoadKey(&util.Config{KeyFile: "../../testdata/b3/ca.privkey"})
+	assert.Contains(t, err.Error(), "KeyFile ../../testdata/b3/ca.privkey: RSA keys")
+}
+
+func TestCompleteCertChain(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write(caCert.Raw)
+	}))
+	defer server.Close()
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.com"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IssuingCertificateURL: []string{server.URL},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &template, caCert, leafKey.Public(), caKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(leafDER)
+	require.NoError(t, err)
+
+	certs, err := CompleteCertChain([]*x509.Certificate{leaf}, server.Client())
+	require.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf, caCert}, certs)
+
+	// Full chains are left alone.
+	certs, err = CompleteCertChain([]*x509.Certificate{leaf, caCert}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf, caCert}, certs)
+
+	// Wrong issuer.
+	server.Config.Handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write(leaf.Raw)
+	})
+	_, err = CompleteCertChain([]*x509.Certificate{leaf}, server.Client())
+	assert.Contains(t, err.Error(), "verifying \"example.com\" was issued by")
+}
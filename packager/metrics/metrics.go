@@ -0,0 +1,123 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Exports internal counters and distributions, in expvar's JSON format, for
+// scraping by external monitoring. Served at util.MetricsPath.
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Serves all published metrics as a JSON object.
+func Handler() http.Handler {
+	return expvar.Handler()
+}
+
+// Returns count bucket upper bounds, starting at start and multiplying by
+// factor each time.
+func ExponentialBounds(start int64, factor int64, count int) []int64 {
+	bounds := make([]int64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// Publishes a gauge under the given name, whose value is computed by f
+// whenever the metrics are served. Like expvar.Publish, panics if the name is
+// already in use.
+func NewGauge(name string, f func() int64) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return f() }))
+}
+
+// A set of histograms, one per label, with shared bucket bounds. Implements
+// expvar.Var.
+type Histogram struct {
+	bounds []int64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	// counts[i] is the number of observations <= bounds[i];
+	// counts[len(bounds)] is the number of all observations.
+	counts []int64
+	sum    int64
+}
+
+// Creates a histogram with the given bucket upper bounds (in ascending order),
+// and publishes it under the given name. Like expvar.Publish, panics if the
+// name is already in use.
+func NewHistogram(name string, bounds []int64) *Histogram {
+	h := newHistogram(bounds)
+	expvar.Publish(name, h)
+	return h
+}
+
+func newHistogram(bounds []int64) *Histogram {
+	return &Histogram{bounds: bounds, values: map[string]*histogramValue{}}
+}
+
+// Records the given value under the given label.
+func (this *Histogram) Observe(label string, value int64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	v, ok := this.values[label]
+	if !ok {
+		v = &histogramValue{counts: make([]int64, len(this.bounds)+1)}
+		this.values[label] = v
+	}
+	for i, bound := range this.bounds {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.counts[len(this.bounds)]++
+	v.sum += value
+}
+
+// Formats the histogram as a JSON object from label to cumulative bucket
+// counts (keyed by upper bound, as in Prometheus), count, and sum.
+func (this *Histogram) String() string {
+	type jsonValue struct {
+		Buckets map[string]int64 `json:"buckets"`
+		Count   int64            `json:"count"`
+		Sum     int64            `json:"sum"`
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	out := make(map[string]jsonValue, len(this.values))
+	for label, v := range this.values {
+		buckets := make(map[string]int64, len(v.counts))
+		for i, bound := range this.bounds {
+			buckets[strconv.FormatInt(bound, 10)] = v.counts[i]
+		}
+		buckets["+Inf"] = v.counts[len(this.bounds)]
+		out[label] = jsonValue{buckets, v.counts[len(this.bounds)], v.sum}
+	}
+	bytes, err := json.Marshal(out)
+	if err != nil {
+		// This should never happen, but expvar.Var has no way to
+		// report errors.
+		return "{}"
+	}
+	return string(bytes)
+}
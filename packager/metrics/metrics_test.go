@@ -0,0 +1,46 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExponentialBounds(t *testing.T) {
+	assert.Equal(t, []int64{1, 4, 16, 64}, ExponentialBounds(1, 4, 4))
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]int64{10, 100})
+	h.Observe("a", 5)
+	h.Observe("a", 50)
+	h.Observe("a", 500)
+	h.Observe("b", 10)
+
+	var got map[string]struct {
+		Buckets map[string]int64
+		Count   int64
+		Sum     int64
+	}
+	require.NoError(t, json.Unmarshal([]byte(h.String()), &got))
+	assert.Equal(t, map[string]int64{"10": 1, "100": 2, "+Inf": 3}, got["a"].Buckets)
+	assert.Equal(t, int64(3), got["a"].Count)
+	assert.Equal(t, int64(555), got["a"].Sum)
+	assert.Equal(t, map[string]int64{"10": 1, "100": 1, "+Inf": 1}, got["b"].Buckets)
+}
@@ -41,16 +41,32 @@ import (
 	"github.com/ampproject/amppackager/packager/util"
 )
 
+// The handler for each route. Any may be nil, in which case its route
+// responds 404, as if it didn't exist.
+type Handlers struct {
+	// util.CertURLPrefix.
+	CertCache http.Handler
+	// /priv/doc and util.ResignPath.
+	Signer http.Handler
+	// util.ValidityMapPath.
+	ValidityMap http.Handler
+	// util.HealthzPath.
+	Healthz http.Handler
+	// util.MetricsPath.
+	Metrics http.Handler
+	// util.AdminPathPrefix.
+	Admin http.Handler
+	// util.VersionPath.
+	Version http.Handler
+}
+
 type mux struct {
-	certCache   http.Handler
-	signer      http.Handler
-	validityMap http.Handler
-	healthz     http.Handler
+	Handlers
 }
 
 // The main entry point. Use the return value for http.Server.Handler.
-func New(certCache http.Handler, signer http.Handler, validityMap http.Handler, healthz http.Handler) http.Handler {
-	return &mux{certCache, signer, validityMap, healthz}
+func New(handlers Handlers) http.Handler {
+	return &mux{handlers}
 }
 
 func tryTrimPrefix(s, prefix string) (string, bool) {
@@ -61,15 +77,17 @@ func tryTrimPrefix(s, prefix string) (string, bool) {
 
 var allowedMethods = map[string]bool{http.MethodGet: true, http.MethodHead: true}
 
-func (this *mux) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	if !allowedMethods[req.Method] {
-		http.Error(resp, "405 method not allowed", http.StatusMethodNotAllowed)
+// Serves the request with the given handler, or responds 404 if the handler
+// is nil (i.e. the route is disabled).
+func serveOrNotFound(handler http.Handler, resp http.ResponseWriter, req *http.Request) {
+	if handler == nil {
+		util.WriteErrorPage(resp, req, http.StatusNotFound, "")
 		return
 	}
+	handler.ServeHTTP(resp, req)
+}
 
-	params := map[string]string{}
-	req = WithParams(req, params)
-
+func (this *mux) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	// Use EscapedPath rather than RequestURI because the latter can take
 	// absolute-form, per https://tools.ietf.org/html/rfc7230#section-5.3.
 	//
@@ -78,32 +96,56 @@ func (this *mux) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	// https://wicg.github.io/webpackage/draft-yasskin-http-origin-signed-responses.html#application-signed-exchange
 	// item 3.
 	path := req.URL.EscapedPath()
+
+	// So that error pages cite the same request ID as the logs.
+	req = util.WithRequestID(req)
+
+	// The admin handler checks its own methods, as some of its endpoints
+	// are POST-only.
+	if !allowedMethods[req.Method] && !strings.HasPrefix(path, util.AdminPathPrefix) {
+		util.WriteErrorPage(resp, req, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	params := map[string]string{}
+	req = WithParams(req, params)
+
 	if suffix, ok := tryTrimPrefix(path, "/priv/doc"); ok {
 		if suffix == "" {
-			this.signer.ServeHTTP(resp, req)
+			serveOrNotFound(this.Signer, resp, req)
 		} else if suffix[0] == '/' {
 			params["signURL"] = suffix[1:]
 			if req.URL.RawQuery != "" {
 				params["signURL"] += "?" + req.URL.RawQuery
 			}
-			this.signer.ServeHTTP(resp, req)
+			serveOrNotFound(this.Signer, resp, req)
 		} else {
-			http.NotFound(resp, req)
+			util.WriteErrorPage(resp, req, http.StatusNotFound, "")
 		}
+	} else if path == util.ResignPath {
+		params["resign"] = "true"
+		serveOrNotFound(this.Signer, resp, req)
 	} else if suffix, ok := tryTrimPrefix(path, util.CertURLPrefix+"/"); ok {
 		unescaped, err := url.PathUnescape(suffix)
 		if err != nil {
-			http.Error(resp, "400 bad request - bad URL encoding", http.StatusBadRequest)
+			util.WriteErrorPage(resp, req, http.StatusBadRequest, "bad_url_encoding")
 		} else {
 			params["certName"] = unescaped
-			this.certCache.ServeHTTP(resp, req)
+			serveOrNotFound(this.CertCache, resp, req)
 		}
 	} else if path == util.HealthzPath {
-		this.healthz.ServeHTTP(resp, req)
+		serveOrNotFound(this.Healthz, resp, req)
 	} else if path == util.ValidityMapPath {
-		this.validityMap.ServeHTTP(resp, req)
+		serveOrNotFound(this.ValidityMap, resp, req)
+	} else if path == util.MetricsPath {
+		serveOrNotFound(this.Metrics, resp, req)
+	} else if path == util.VersionPath {
+		serveOrNotFound(this.Version, resp, req)
+	} else if suffix, ok := tryTrimPrefix(path, util.AdminPathPrefix); ok {
+		params["adminPath"] = suffix
+		serveOrNotFound(this.Admin, resp, req)
 	} else {
-		http.NotFound(resp, req)
+		util.WriteErrorPage(resp, req, http.StatusNotFound, "")
 	}
 }
 
@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tracks how often each signed URL is requested, so that a re-signer with a
+// limited budget can refresh the signatures of popular URLs before they
+// expire, and let long-tail ones lapse.
+package popularity
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// A URL and its request rate, for use as a re-sign priority.
+type URL struct {
+	Sign  string `json:"sign"`
+	Fetch string `json:"fetch,omitempty"`
+	// The number of requests, with each request's weight halving every
+	// half-life since it was made.
+	Score float64 `json:"score"`
+	// When its most recent signature expires, if known, so that a
+	// re-signer can refresh it beforehand.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type entry struct {
+	fetch   string
+	score   float64
+	updated time.Time
+	expires time.Time
+}
+
+type Tracker struct {
+	mu       sync.Mutex
+	urls     map[string]*entry
+	maxURLs  int
+	halfLife time.Duration
+	clock    util.Clock
+}
+
+// Tracks at most maxURLs URLs at a time; when more are requested, the least
+// popular are forgotten.
+func New(maxURLs int, halfLife time.Duration) *Tracker {
+	return &Tracker{urls: map[string]*entry{}, maxURLs: maxURLs, halfLife: halfLife, clock: util.SystemClock{}}
+}
+
+// Returns the entry's score as of now.
+func (this *Tracker) decayed(e *entry, now time.Time) float64 {
+	elapsed := now.Sub(e.updated)
+	if elapsed <= 0 {
+		return e.score
+	}
+	return e.score * math.Exp2(-float64(elapsed)/float64(this.halfLife))
+}
+
+// Records a request to sign the given URL, fetched from fetch (which may be
+// empty if it's the same as sign).
+func (this *Tracker) Record(fetch, sign string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := this.clock.Now()
+	e, ok := this.urls[sign]
+	if !ok {
+		e = &entry{}
+		this.urls[sign] = e
+	}
+	e.score = this.decayed(e, now) + 1
+	e.updated = now
+	e.fetch = fetch
+	// Prune in batches, so that the cost of sorting is amortized across
+	// many requests.
+	if len(this.urls) >= 2*this.maxURLs {
+		for _, url := range this.top(now, len(this.urls))[this.maxURLs:] {
+			delete(this.urls, url.Sign)
+		}
+	}
+}
+
+// Records when the signature most recently served for the given URL expires.
+// Ignored if the URL isn't tracked, e.g. because it was pruned.
+func (this *Tracker) RecordExpiry(sign string, expires time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if e, ok := this.urls[sign]; ok {
+		e.expires = expires
+	}
+}
+
+// Returns up to n URLs, most popular first.
+func (this *Tracker) Top(n int) []URL {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if n > this.maxURLs {
+		n = this.maxURLs
+	}
+	return this.top(this.clock.Now(), n)
+}
+
+func (this *Tracker) top(now time.Time, n int) []URL {
+	urls := make([]URL, 0, len(this.urls))
+	for sign, e := range this.urls {
+		url := URL{sign, e.fetch, this.decayed(e, now), nil}
+		if !e.expires.IsZero() {
+			expires := e.expires
+			url.Expires = &expires
+		}
+		urls = append(urls, url)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if urls[i].Score != urls[j].Score {
+			return urls[i].Score > urls[j].Score
+		}
+		return urls[i].Sign < urls[j].Sign
+	})
+	if n < len(urls) {
+		urls = urls[:n]
+	}
+	return urls
+}
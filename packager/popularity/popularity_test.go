@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package popularity
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTracker(maxURLs int) (*Tracker, *pkgt.FakeClock) {
+	tracker := New(maxURLs, time.Hour)
+	clock := pkgt.NewFakeClock(time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC))
+	tracker.clock = clock
+	return tracker, clock
+}
+
+func signs(urls []URL) []string {
+	var ret []string
+	for _, url := range urls {
+		ret = append(ret, url.Sign)
+	}
+	return ret
+}
+
+func TestTopOrdersByCount(t *testing.T) {
+	tracker, _ := newTracker(10)
+	tracker.Record("", "https://example.com/a")
+	tracker.Record("", "https://example.com/b")
+	tracker.Record("", "https://example.com/b")
+	tracker.Record("https://origin.example.com/c", "https://example.com/c")
+	tracker.Record("https://origin.example.com/c", "https://example.com/c")
+	tracker.Record("https://origin.example.com/c", "https://example.com/c")
+
+	top := tracker.Top(2)
+	require.Len(t, top, 2)
+	assert.Equal(t, URL{"https://example.com/c", "https://origin.example.com/c", 3, nil}, top[0])
+	assert.Equal(t, URL{"https://example.com/b", "", 2, nil}, top[1])
+}
+
+func TestScoresDecay(t *testing.T) {
+	tracker, clock := newTracker(10)
+	tracker.Record("", "https://example.com/old")
+	tracker.Record("", "https://example.com/old")
+	tracker.Record("", "https://example.com/old")
+	clock.Advance(2 * time.Hour)
+	tracker.Record("", "https://example.com/new")
+	tracker.Record("", "https://example.com/new")
+
+	top := tracker.Top(10)
+	assert.Equal(t, []string{"https://example.com/new", "https://example.com/old"}, signs(top))
+	assert.InDelta(t, 0.75, top[1].Score, 1e-9)
+}
+
+func TestDropsLongTail(t *testing.T) {
+	tracker, _ := newTracker(2)
+	tracker.Record("", "https://example.com/popular")
+	tracker.Record("", "https://example.com/popular")
+	for i := 0; i < 10; i++ {
+		tracker.Record("", fmt.Sprintf("https://example.com/tail%d", i))
+	}
+	assert.True(t, len(tracker.urls) < 4)
+	assert.Equal(t, "https://example.com/popular", tracker.Top(10)[0].Sign)
+	assert.Len(t, tracker.Top(10), 2)
+}
+
+func TestRecordExpiry(t *testing.T) {
+	tracker, clock := newTracker(10)
+	expires := clock.Now().Add(6 * time.Hour)
+	tracker.Record("", "https://example.com/signed")
+	tracker.RecordExpiry("https://example.com/signed", expires)
+	tracker.RecordExpiry("https://example.com/untracked", expires)
+
+	top := tracker.Top(10)
+	require.Len(t, top, 1)
+	require.NotNil(t, top[0].Expires)
+	assert.Equal(t, expires, *top[0].Expires)
+}
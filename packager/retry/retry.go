@@ -0,0 +1,116 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A retry and backoff policy shared by calls to external services (OCSP
+// responders, ACME CAs), so that each attempt has a deadline and waits
+// between attempts end promptly on shutdown.
+package retry
+
+import (
+	"context"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Policy struct {
+	// The deadline of each attempt. If zero, attempts have no deadline of
+	// their own, beyond that of the parent context.
+	Timeout time.Duration
+	// The maximum number of attempts. Zero means one.
+	MaxAttempts int
+	// The wait after the first failed attempt, doubling after each
+	// subsequent one up to MaxBackoff. Zero MaxBackoff means no maximum.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// If true, each wait is between half and all of that, at random, so
+	// that clients that failed at once don't retry in lockstep.
+	Jitter bool
+}
+
+type permanentError struct {
+	error
+}
+
+func (this permanentError) Cause() error {
+	return this.error
+}
+
+// Wraps err so that Do returns it without further attempts.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Calls op until it succeeds, returns a Permanent error, MaxAttempts is
+// reached, or ctx is done. The attempt number (from 0) is passed to op, along
+// with a context bounded by Timeout. Returns the last error from op; if ctx
+// ended the retries, its Cause is ctx.Err().
+func (this Policy) Do(ctx context.Context, op func(ctx context.Context, attempt int) error) error {
+	maxAttempts := this.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	for attempt := 0; ; attempt++ {
+		err := this.attempt(ctx, op, attempt)
+		if err == nil {
+			return nil
+		}
+		if permanent, ok := err.(permanentError); ok {
+			return permanent.error
+		}
+		if attempt+1 >= maxAttempts {
+			return err
+		}
+		backoff := this.Backoff(attempt)
+		log.Printf("Attempt %d failed; retrying in %v: %v\n", attempt+1, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrap(ctx.Err(), err.Error())
+		}
+	}
+}
+
+// Returns how long to wait after the given failed attempt (from 0), per
+// InitialBackoff, MaxBackoff, and Jitter.
+func (this Policy) Backoff(attempt int) time.Duration {
+	backoff := this.InitialBackoff
+	for i := 0; i < attempt && backoff <= math.MaxInt64/2; i++ {
+		backoff *= 2
+	}
+	if this.MaxBackoff > 0 && backoff > this.MaxBackoff {
+		backoff = this.MaxBackoff
+	}
+	if this.Jitter && backoff > 0 {
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	}
+	return backoff
+}
+
+func (this Policy) attempt(ctx context.Context, op func(ctx context.Context, attempt int) error, attempt int) error {
+	if err := ctx.Err(); err != nil {
+		return Permanent(err)
+	}
+	if this.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this.Timeout)
+		defer cancel()
+	}
+	return op(ctx, attempt)
+}
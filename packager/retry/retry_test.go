@@ -0,0 +1,115 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetriesUntilSuccess(t *testing.T) {
+	var attempts []int
+	err := Policy{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}.Do(context.Background(),
+		func(ctx context.Context, attempt int) error {
+			attempts = append(attempts, attempt)
+			if attempt < 2 {
+				return errors.New("flaky")
+			}
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, attempts)
+}
+
+func TestReturnsLastError(t *testing.T) {
+	calls := 0
+	err := Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}.Do(context.Background(),
+		func(ctx context.Context, attempt int) error {
+			calls++
+			return errors.Errorf("failure %d", attempt)
+		})
+	assert.EqualError(t, err, "failure 2")
+	assert.Equal(t, 3, calls)
+}
+
+func TestZeroPolicyTriesOnce(t *testing.T) {
+	calls := 0
+	err := Policy{}.Do(context.Background(), func(ctx context.Context, attempt int) error {
+		calls++
+		return errors.New("failure")
+	})
+	assert.EqualError(t, err, "failure")
+	assert.Equal(t, 1, calls)
+}
+
+func TestPermanentStopsRetries(t *testing.T) {
+	calls := 0
+	err := Policy{MaxAttempts: 3}.Do(context.Background(), func(ctx context.Context, attempt int) error {
+		calls++
+		return Permanent(errors.New("bad request"))
+	})
+	assert.EqualError(t, err, "bad request")
+	assert.Equal(t, 1, calls)
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	err := Policy{Timeout: time.Millisecond}.Do(context.Background(), func(ctx context.Context, attempt int) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestCancelInterruptsBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Policy{MaxAttempts: 2, InitialBackoff: time.Hour, MaxBackoff: time.Hour}.Do(ctx,
+			func(ctx context.Context, attempt int) error {
+				return errors.New("unavailable")
+			})
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, errors.Cause(err))
+	case <-time.After(10 * time.Second):
+		t.Fatal("Do did not return after cancel")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := Policy{InitialBackoff: time.Second, MaxBackoff: 4 * time.Second}
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		assert.Equal(t, expected, policy.Backoff(attempt), "attempt %d", attempt)
+	}
+	// Doubling past the range of time.Duration stops short of it.
+	assert.True(t, Policy{InitialBackoff: time.Hour}.Backoff(100) > 0)
+}
+
+func TestBackoffJitter(t *testing.T) {
+	policy := Policy{InitialBackoff: 100 * time.Millisecond, Jitter: true}
+	for attempt := 0; attempt < 4; attempt++ {
+		max := 100 * time.Millisecond << uint(attempt)
+		for i := 0; i < 20; i++ {
+			backoff := policy.Backoff(attempt)
+			assert.True(t, backoff >= max/2 && backoff <= max, "attempt %d: %v not in [%v, %v]", attempt, backoff, max/2, max)
+		}
+	}
+}
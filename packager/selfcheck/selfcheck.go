@@ -0,0 +1,175 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Periodically requests a sample of the packager's own recently signed URLs,
+// through the same path as its clients, and verifies the SXGs it gets back
+// the way a browser would, fetching the cert chain from its cert-url. This
+// catches problems that unit tests can't, such as a broken cert-url route, a
+// skewed clock, or a serialization bug, before they affect real traffic.
+//
+// Probes are only-if-cached requests, so they're served from the packager's
+// signature cache, without fetching from the origin or counting toward
+// popularity. The SXGs are checked by a verifier of this package's own,
+// rather than by the library that signed them.
+package selfcheck
+
+import (
+	"expvar"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/accept"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// The number of self-checks, by result: "verified", "unsigned" (the packager
+// proxied the document rather than signing it, e.g. because it's no longer
+// valid AMP), "uncached" (the signature cache no longer has it), or "failed".
+// Alert on a rising "failed".
+var results = expvar.NewMap("amppkg_self_checks")
+
+// The most bytes read from a probed response or cert chain.
+const maxResponseLength = 16 << 20
+
+// The result of a probe that didn't fail.
+type result string
+
+const (
+	verified result = "verified"
+	unsigned result = "unsigned"
+	uncached result = "uncached"
+)
+
+type Prober struct {
+	baseURL    *url.URL
+	client     *http.Client
+	candidates func() []string
+	sampleSize int
+	interval   time.Duration
+	clock      util.Clock
+	stop       chan struct{}
+}
+
+// Every interval, the Prober requests sampleSize of the sign URLs returned by
+// candidates, chosen at random, from /priv/doc under baseURL, or if baseURL
+// is nil, from the sign URL itself, via the publisher's frontend.
+func New(baseURL *url.URL, client *http.Client, candidates func() []string, sampleSize int, interval time.Duration) *Prober {
+	return &Prober{baseURL, client, candidates, sampleSize, interval, util.SystemClock{}, make(chan struct{})}
+}
+
+// StartCron starts a cron job to probe every interval.
+func (this *Prober) StartCron() {
+	go func() {
+		ticker := time.NewTicker(this.interval)
+
+		for {
+			select {
+			case <-ticker.C:
+				this.probeSample()
+			case <-this.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// StopCron stops the cron job, if started. It doesn't block, and may be
+// called more than once.
+func (this *Prober) StopCron() {
+	select {
+	// this.stop is only ever closed, so this matches only if it already was.
+	case <-this.stop:
+	default:
+		close(this.stop)
+	}
+}
+
+// Probes a random sample of the candidates, recording and logging the results.
+func (this *Prober) probeSample() {
+	candidates := this.candidates()
+	for i, j := range rand.Perm(len(candidates)) {
+		if i >= this.sampleSize {
+			break
+		}
+		res, err := this.probe(candidates[j])
+		if err != nil {
+			results.Add("failed", 1)
+			log.Printf("SELF-CHECK FAILED: %s: %v\n", candidates[j], err)
+			continue
+		}
+		results.Add(string(res), 1)
+	}
+}
+
+// Requests the exchange for signURL and verifies it. Returns an error if the
+// request fails, or the packager responds with an invalid exchange.
+func (this *Prober) probe(signURL string) (result, error) {
+	target := signURL
+	if this.baseURL != nil {
+		target = this.baseURL.ResolveReference(&url.URL{
+			Path:     "/priv/doc",
+			RawQuery: url.Values{"sign": {signURL}}.Encode(),
+		}).String()
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "building request")
+	}
+	req.Header.Set("Accept", accept.SxgContentType)
+	req.Header.Set("AMP-Cache-Transform", "google")
+	// A probe isn't demand, so mustn't cost an origin fetch.
+	req.Header.Set("Cache-Control", "only-if-cached")
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "requesting exchange")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGatewayTimeout {
+		return uncached, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("status %d", resp.StatusCode)
+	}
+	if contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); contentType != "application/signed-exchange" {
+		return unsigned, nil
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxResponseLength))
+	if err != nil {
+		return "", errors.Wrap(err, "reading exchange")
+	}
+	if err := verify(body, signURL, this.clock.Now(), this.fetchCert); err != nil {
+		return "", errors.Wrap(err, "verification failed")
+	}
+	return verified, nil
+}
+
+// Fetches the cert chain at certURL, as a browser would.
+func (this *Prober) fetchCert(certURL string) ([]byte, error) {
+	resp, err := this.client.Get(certURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching cert-url %s", certURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("fetching cert-url %s: status %d", certURL, resp.StatusCode)
+	}
+	return ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxResponseLength))
+}
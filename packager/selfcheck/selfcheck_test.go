@@ -0,0 +1,190 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selfcheck
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A fake packager, which signs an empty document for any sign URL on its own
+// origin, as the verifier requires the validity-url to be same-origin.
+type fakePackager struct {
+	server   *httptest.Server
+	date     time.Time
+	unsigned bool
+	uncached bool
+	noCert   bool
+}
+
+func newFakePackager() *fakePackager {
+	this := &fakePackager{date: pkgt.Certs[0].NotBefore.Add(24 * time.Hour)}
+	this.server = httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/priv/doc":
+			this.serveDoc(resp, req)
+		case "/cert":
+			this.serveCert(resp, req)
+		default:
+			http.NotFound(resp, req)
+		}
+	}))
+	return this
+}
+
+func (this *fakePackager) serveDoc(resp http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("AMP-Cache-Transform") == "" {
+		http.Error(resp, "missing AMP-Cache-Transform", http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Cache-Control") != "only-if-cached" {
+		http.Error(resp, "missing only-if-cached", http.StatusBadRequest)
+		return
+	}
+	if this.uncached {
+		http.Error(resp, "not cached", http.StatusGatewayTimeout)
+		return
+	}
+	if this.unsigned {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write([]byte("<html></html>"))
+		return
+	}
+	exchange := signedexchange.NewExchange(version.Version1b3, req.FormValue("sign"), "GET", http.Header{}, 200,
+		http.Header{"Content-Type": {"text/html"}}, []byte("<html amp></html>"))
+	if err := exchange.MiEncodePayload(4096); err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	certURL, _ := url.Parse(this.server.URL + "/cert")
+	validityURL, _ := url.Parse("/amppkg/validity")
+	signURL, _ := url.Parse(req.FormValue("sign"))
+	validityURL = signURL.ResolveReference(validityURL)
+	err := exchange.AddSignatureHeader(&signedexchange.Signer{
+		Date: this.date, Expires: this.date.Add(time.Hour),
+		Certs: pkgt.Certs, CertUrl: certURL, ValidityUrl: validityURL, PrivKey: pkgt.Key,
+	})
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/signed-exchange;v=b3")
+	exchange.Write(resp)
+}
+
+func (this *fakePackager) serveCert(resp http.ResponseWriter, req *http.Request) {
+	if this.noCert {
+		http.NotFound(resp, req)
+		return
+	}
+	chain, err := certurl.NewCertChain(pkgt.Certs, []byte("ocsp"), nil)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/cert-chain+cbor")
+	chain.Write(resp)
+}
+
+// Returns a Prober of the given paths on the fake packager's origin.
+func (this *fakePackager) newProber(paths ...string) (*Prober, *pkgt.FakeClock) {
+	baseURL, _ := url.Parse(this.server.URL)
+	candidates := []string{}
+	for _, path := range paths {
+		candidates = append(candidates, this.server.URL+path)
+	}
+	prober := New(baseURL, this.server.Client(), func() []string { return candidates }, 2, time.Minute)
+	clock := pkgt.NewFakeClock(this.date.Add(time.Minute))
+	prober.clock = clock
+	return prober, clock
+}
+
+func TestProbe(t *testing.T) {
+	packager := newFakePackager()
+	defer packager.server.Close()
+	prober, clock := packager.newProber()
+	signURL := packager.server.URL + "/amp/page.html"
+
+	res, err := prober.probe(signURL)
+	require.NoError(t, err)
+	assert.Equal(t, verified, res)
+
+	packager.unsigned = true
+	res, err = prober.probe(signURL)
+	require.NoError(t, err)
+	assert.Equal(t, unsigned, res)
+	packager.unsigned = false
+
+	packager.uncached = true
+	res, err = prober.probe(signURL)
+	require.NoError(t, err)
+	assert.Equal(t, uncached, res)
+	packager.uncached = false
+
+	packager.noCert = true
+	_, err = prober.probe(signURL)
+	assert.Contains(t, err.Error(), "verification failed")
+	packager.noCert = false
+
+	// As if the packager's clock were skewed.
+	clock.Advance(2 * time.Hour)
+	_, err = prober.probe(signURL)
+	assert.Contains(t, err.Error(), "verification failed")
+
+	// Public probes request the sign URL itself.
+	clock.Advance(-2 * time.Hour)
+	prober.baseURL = nil
+	_, err = prober.probe(signURL)
+	assert.EqualError(t, err, "status 404")
+
+	packager.server.Close()
+	_, err = prober.probe(signURL)
+	assert.Contains(t, err.Error(), "requesting exchange")
+}
+
+func count(result string) int64 {
+	if v, ok := results.Get(result).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestProbeSample(t *testing.T) {
+	packager := newFakePackager()
+	defer packager.server.Close()
+	prober, _ := packager.newProber("/1", "/2", "/3")
+
+	verifiedBefore, failedBefore := count("verified"), count("failed")
+	prober.probeSample()
+	// Only SampleSize of the candidates are checked.
+	assert.Equal(t, verifiedBefore+2, count("verified"))
+	assert.Equal(t, failedBefore, count("failed"))
+
+	packager.noCert = true
+	prober.probeSample()
+	assert.Equal(t, verifiedBefore+2, count("verified"))
+	assert.Equal(t, failedBefore+2, count("failed"))
+}
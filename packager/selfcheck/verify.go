@@ -0,0 +1,587 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selfcheck
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// The file signature of SXG b3, and the context string of its signed message.
+const (
+	sxgMagic      = "sxg1-b3\x00"
+	signedContext = "HTTP Exchange 1 b3"
+)
+
+// Limits from the format's parsing algorithm.
+const (
+	maxSignatureLength = 16 * 1024
+	maxHeaderLength    = 512 * 1024
+)
+
+// The longest that a signature may be valid.
+const maxSignatureValidity = 7 * 24 * time.Hour
+
+// Response headers that mustn't be signed, per section 4.1.
+var uncachedHeaders = []string{
+	"Authentication-Control", "Authentication-Info", "Clear-Site-Data", "Optional-WWW-Authenticate",
+	"Proxy-Authenticate", "Proxy-Authentication-Info", "Public-Key-Pins", "Sec-WebSocket-Accept",
+	"Set-Cookie", "Set-Cookie2", "SetProfile", "Strict-Transport-Security", "WWW-Authenticate"}
+
+// An SXG, as parsed per section 5.3.
+type exchange struct {
+	fallbackURL string
+	signature   string
+	// As serialized, as that's what's signed.
+	headerBytes []byte
+	header      http.Header
+	payload     []byte
+}
+
+// A parsed Signature header value, per section 3.1.
+type signature struct {
+	sig         []byte
+	integrity   string
+	certURL     string
+	certSHA256  []byte
+	validityURL string
+	date        int64
+	expires     int64
+}
+
+// Returns nil iff sxg is a valid exchange for signURL at now, signed by the
+// cert chain that fetchCert returns for its cert-url.
+//
+// This is written from the spec, rather than using the signedexchange library
+// that the packager signs with, so that a bug in the library can't both
+// produce a bad SXG and pass it. It handles only what the packager produces:
+// SXG b3, signed with ECDSA P-256, with a mi-sha256-03 payload. Like the
+// library's verifier, it doesn't check the cert chain against any roots, nor
+// the OCSP response, nor that the cert covers the sign URL's host; those
+// depend on the browser. Section numbers below are those of
+// https://tools.ietf.org/html/draft-yasskin-http-origin-signed-responses-05;
+// the payload encoding is per
+// https://tools.ietf.org/html/draft-thomson-http-mice-03.
+func verify(sxg []byte, signURL string, now time.Time, fetchCert func(string) ([]byte, error)) error {
+	exchange, err := parseExchange(sxg)
+	if err != nil {
+		return errors.Wrap(err, "parsing exchange")
+	}
+	if exchange.fallbackURL != signURL {
+		return errors.Errorf("exchange is for %s", exchange.fallbackURL)
+	}
+	signatures, err := parseSignatures(exchange.signature)
+	if err != nil {
+		return errors.Wrap(err, "parsing Signature")
+	}
+	// Valid if any signature is.
+	var reasons []string
+	for _, sig := range signatures {
+		err := exchange.verifySignature(sig, now, fetchCert)
+		if err == nil {
+			return exchange.verifyPayload()
+		}
+		reasons = append(reasons, err.Error())
+	}
+	return errors.Errorf("no valid signature: %s", strings.Join(reasons, "; "))
+}
+
+func parseExchange(sxg []byte) (*exchange, error) {
+	r := &byteReader{sxg}
+	if magic, _ := r.next(len(sxgMagic)); string(magic) != sxgMagic {
+		return nil, errors.New("not an SXG b3")
+	}
+	var this exchange
+	fallbackURL, err := r.next(int(r.uint(2)))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading fallback URL")
+	}
+	this.fallbackURL = string(fallbackURL)
+	sigLength, headerLength := r.uint(3), r.uint(3)
+	if sigLength > maxSignatureLength || headerLength > maxHeaderLength {
+		return nil, errors.Errorf("signature (%d bytes) or headers (%d bytes) too long", sigLength, headerLength)
+	}
+	signature, err := r.next(int(sigLength))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading signature")
+	}
+	this.signature = string(signature)
+	if this.headerBytes, err = r.next(int(headerLength)); err != nil {
+		return nil, errors.Wrap(err, "reading headers")
+	}
+	if this.header, err = parseHeaders(this.headerBytes); err != nil {
+		return nil, errors.Wrap(err, "parsing headers")
+	}
+	this.payload = r.b
+	return &this, nil
+}
+
+// Parses the CBOR map of response headers, per section 3.4, into an
+// http.Header, including the pseudo-header :status.
+func parseHeaders(b []byte) (http.Header, error) {
+	r := &cborReader{b}
+	n, err := r.head(cborMap)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	for i := uint64(0); i < n; i++ {
+		name, err := r.bytes(cborByteString)
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.bytes(cborByteString)
+		if err != nil {
+			return nil, err
+		}
+		// Canonicalized, other than :status.
+		header.Add(string(name), string(value))
+	}
+	if len(r.b) != 0 {
+		return nil, errors.New("trailing bytes")
+	}
+	return header, nil
+}
+
+// Parses a Signature header value: a comma-separated list of labels, each
+// with parameters. Only those that verification needs are kept.
+func parseSignatures(value string) ([]*signature, error) {
+	p := &paramParser{value}
+	var signatures []*signature
+	for {
+		p.skipSpace()
+		if p.token() == "" {
+			return nil, errors.New("missing label")
+		}
+		var sig signature
+		for p.consume(';') {
+			p.skipSpace()
+			name := p.token()
+			if !p.consume('=') {
+				return nil, errors.Errorf("missing value for %q", name)
+			}
+			var err error
+			switch name {
+			case "sig":
+				sig.sig, err = p.binary()
+			case "integrity":
+				sig.integrity, err = p.str()
+			case "cert-url":
+				sig.certURL, err = p.str()
+			case "cert-sha256":
+				sig.certSHA256, err = p.binary()
+			case "validity-url":
+				sig.validityURL, err = p.str()
+			case "date":
+				sig.date, err = p.integer()
+			case "expires":
+				sig.expires, err = p.integer()
+			default:
+				err = p.skipValue()
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing %q", name)
+			}
+		}
+		signatures = append(signatures, &sig)
+		p.skipSpace()
+		if p.s == "" {
+			return signatures, nil
+		}
+		if !p.consume(',') {
+			return nil, errors.Errorf("unexpected %q", p.s)
+		}
+	}
+}
+
+// Per section 3.5, other than the cert chain's trust and OCSP response.
+func (this *exchange) verifySignature(sig *signature, now time.Time, fetchCert func(string) ([]byte, error)) error {
+	if sig.integrity != "digest/mi-sha256-03" {
+		return errors.Errorf("unsupported integrity %q", sig.integrity)
+	}
+	date, expires := time.Unix(sig.date, 0), time.Unix(sig.expires, 0)
+	if expires.Sub(date) > maxSignatureValidity {
+		return errors.Errorf("expires %v is more than 7 days after date %v", expires, date)
+	}
+	if now.Before(date) || now.After(expires) {
+		return errors.Errorf("%v is outside of date %v and expires %v", now, date, expires)
+	}
+	validityURL, err := url.Parse(sig.validityURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing validity-url")
+	}
+	requestURL, err := url.Parse(this.fallbackURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing request URL")
+	}
+	if validityURL.Scheme != requestURL.Scheme || validityURL.Host != requestURL.Host {
+		return errors.Errorf("validity-url %s isn't same-origin with %s", sig.validityURL, this.fallbackURL)
+	}
+	chain, err := fetchCert(sig.certURL)
+	if err != nil {
+		return err
+	}
+	cert, err := parseCertChain(chain)
+	if err != nil {
+		return errors.Wrapf(err, "parsing cert chain from %s", sig.certURL)
+	}
+	certSHA256 := sha256.Sum256(cert.Raw)
+	if !bytes.Equal(sig.certSHA256, certSHA256[:]) {
+		return errors.New("cert-sha256 doesn't match the cert chain")
+	}
+	if err := util.CanSignHttpExchanges(cert); err != nil {
+		return err
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return errors.Errorf("%v is outside of the cert's validity", now)
+	}
+	key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return errors.New("cert's key isn't ECDSA P-256")
+	}
+	var rs struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(sig.sig, &rs); err != nil || len(rest) != 0 {
+		return errors.New("sig isn't a DER-encoded ECDSA signature")
+	}
+	digest := sha256.Sum256(this.signedMessage(sig))
+	if !ecdsa.Verify(key, digest[:], rs.R, rs.S) {
+		return errors.New("sig doesn't match")
+	}
+	if this.header.Get(":status") == "" {
+		return errors.New("missing :status")
+	}
+	if this.header.Get("Content-Type") == "" {
+		return errors.New("missing Content-Type")
+	}
+	for _, name := range uncachedHeaders {
+		if _, ok := this.header[http.CanonicalHeaderKey(name)]; ok {
+			return errors.Errorf("has uncached header %s", name)
+		}
+	}
+	return nil
+}
+
+// The message that sig signs, per step 7 of section 3.5.
+func (this *exchange) signedMessage(sig *signature) []byte {
+	var msg bytes.Buffer
+	msg.Write(bytes.Repeat([]byte{0x20}, 64))
+	msg.WriteString(signedContext)
+	msg.WriteByte(0)
+	if sig.certSHA256 != nil {
+		msg.WriteByte(byte(len(sig.certSHA256)))
+		msg.Write(sig.certSHA256)
+	} else {
+		msg.WriteByte(0)
+	}
+	writeUint64 := func(n uint64) {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		msg.Write(b[:])
+	}
+	writeUint64(uint64(len(sig.validityURL)))
+	msg.WriteString(sig.validityURL)
+	writeUint64(uint64(sig.date))
+	writeUint64(uint64(sig.expires))
+	writeUint64(uint64(len(this.fallbackURL)))
+	msg.WriteString(this.fallbackURL)
+	writeUint64(uint64(len(this.headerBytes)))
+	msg.Write(this.headerBytes)
+	return msg.Bytes()
+}
+
+// Checks the payload against its signed mi-sha256-03 Digest.
+func (this *exchange) verifyPayload() error {
+	if encoding := this.header.Get("Content-Encoding"); encoding != "mi-sha256-03" {
+		return errors.Errorf("Content-Encoding is %q", encoding)
+	}
+	digest := this.header.Get("Digest")
+	if !strings.HasPrefix(digest, "mi-sha256-03=") {
+		return errors.Errorf("unsupported Digest %q", digest)
+	}
+	proof, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(digest, "mi-sha256-03="))
+	if err != nil {
+		return errors.Wrap(err, "decoding Digest")
+	}
+	return verifyMI(this.payload, proof)
+}
+
+// Checks each record of the mi-sha256-03-encoded payload against its proof,
+// starting with the given top-level proof.
+func verifyMI(encoded []byte, proof []byte) error {
+	hash := func(parts ...[]byte) []byte {
+		h := sha256.New()
+		for _, part := range parts {
+			h.Write(part)
+		}
+		return h.Sum(nil)
+	}
+	if len(encoded) == 0 {
+		if !bytes.Equal(proof, hash([]byte{0})) {
+			return errors.New("empty payload doesn't match Digest")
+		}
+		return nil
+	}
+	r := &byteReader{encoded}
+	recordSize := r.uint(8)
+	if recordSize == 0 {
+		return errors.Errorf("invalid record size %d", recordSize)
+	}
+	for i := 0; ; i++ {
+		if uint64(len(r.b)) <= recordSize {
+			if !bytes.Equal(proof, hash(r.b, []byte{0})) {
+				return errors.Errorf("record %d doesn't match its proof", i)
+			}
+			return nil
+		}
+		record, _ := r.next(int(recordSize))
+		next, err := r.next(sha256.Size)
+		if err != nil || len(r.b) == 0 {
+			return errors.Errorf("truncated after record %d", i)
+		}
+		if !bytes.Equal(proof, hash(record, next, []byte{1})) {
+			return errors.Errorf("record %d doesn't match its proof", i)
+		}
+		proof = next
+	}
+}
+
+// Returns the first cert of an application/cert-chain+cbor chain, per section
+// 3.3, after checking that it has an OCSP response.
+func parseCertChain(chain []byte) (*x509.Certificate, error) {
+	r := &cborReader{chain}
+	n, err := r.head(cborArray)
+	if err != nil {
+		return nil, err
+	}
+	if magic, err := r.bytes(cborTextString); err != nil || string(magic) != "\U0001F4DC⛓" {
+		return nil, errors.New("missing magic")
+	}
+	if n < 2 {
+		return nil, errors.New("no certs")
+	}
+	fields, err := r.head(cborMap)
+	if err != nil {
+		return nil, err
+	}
+	var der, ocsp []byte
+	for i := uint64(0); i < fields; i++ {
+		name, err := r.bytes(cborTextString)
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.bytes(cborByteString)
+		if err != nil {
+			return nil, err
+		}
+		switch string(name) {
+		case "cert":
+			der = value
+		case "ocsp":
+			ocsp = value
+		}
+	}
+	if len(ocsp) == 0 {
+		return nil, errors.New("missing OCSP response")
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, errors.Wrap(err, "parsing cert")
+}
+
+// Reads big-endian fields from a byte slice.
+type byteReader struct {
+	b []byte
+}
+
+func (this *byteReader) next(n int) ([]byte, error) {
+	if n > len(this.b) {
+		return nil, errors.New("truncated")
+	}
+	next := this.b[:n]
+	this.b = this.b[n:]
+	return next, nil
+}
+
+// Returns 0 if truncated; the following read then fails.
+func (this *byteReader) uint(n int) uint64 {
+	b, err := this.next(n)
+	if err != nil {
+		this.b = nil
+		return 0
+	}
+	var value uint64
+	for _, octet := range b {
+		value = value<<8 | uint64(octet)
+	}
+	return value
+}
+
+// The CBOR major types used by the SXG format, per RFC 7049 section 2.1.
+const (
+	cborByteString = 2
+	cborTextString = 3
+	cborArray      = 4
+	cborMap        = 5
+)
+
+// Reads the definite-length items that the SXG format uses.
+type cborReader struct {
+	b []byte
+}
+
+// Reads the head of an item of the given major type, returning its argument:
+// the item's length in bytes or entries.
+func (this *cborReader) head(majorType byte) (uint64, error) {
+	if len(this.b) == 0 {
+		return 0, errors.New("truncated CBOR")
+	}
+	initial := this.b[0]
+	this.b = this.b[1:]
+	if initial>>5 != majorType {
+		return 0, errors.Errorf("CBOR major type is %d, not %d", initial>>5, majorType)
+	}
+	info := initial & 0x1f
+	if info < 24 {
+		return uint64(info), nil
+	}
+	if info > 27 {
+		return 0, errors.New("indefinite or invalid CBOR length")
+	}
+	r := &byteReader{this.b}
+	length := 1 << (info - 24)
+	if len(r.b) < length {
+		return 0, errors.New("truncated CBOR")
+	}
+	value := r.uint(length)
+	this.b = r.b
+	return value, nil
+}
+
+// Reads a byte or text string.
+func (this *cborReader) bytes(majorType byte) ([]byte, error) {
+	n, err := this.head(majorType)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(this.b)) {
+		return nil, errors.New("truncated CBOR")
+	}
+	value := this.b[:n]
+	this.b = this.b[n:]
+	return value, nil
+}
+
+// Parses the parameters of a Signature header, per
+// https://tools.ietf.org/html/draft-ietf-httpbis-header-structure-09.
+type paramParser struct {
+	s string
+}
+
+func (this *paramParser) skipSpace() {
+	this.s = strings.TrimLeft(this.s, " \t")
+}
+
+func (this *paramParser) consume(c byte) bool {
+	if this.s != "" && this.s[0] == c {
+		this.s = this.s[1:]
+		return true
+	}
+	return false
+}
+
+// Reads a token, or "" if there's none.
+func (this *paramParser) token() string {
+	end := strings.IndexFunc(this.s, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_-.:%*/", c))
+	})
+	if end < 0 {
+		end = len(this.s)
+	}
+	token := this.s[:end]
+	this.s = this.s[end:]
+	return token
+}
+
+func (this *paramParser) str() (string, error) {
+	if !this.consume('"') {
+		return "", errors.New("not a string")
+	}
+	var value strings.Builder
+	for this.s != "" {
+		c := this.s[0]
+		this.s = this.s[1:]
+		switch c {
+		case '"':
+			return value.String(), nil
+		case '\\':
+			if this.s == "" {
+				return "", errors.New("unterminated escape")
+			}
+			c, this.s = this.s[0], this.s[1:]
+		}
+		value.WriteByte(c)
+	}
+	return "", errors.New("unterminated string")
+}
+
+func (this *paramParser) binary() ([]byte, error) {
+	if !this.consume('*') {
+		return nil, errors.New("not binary content")
+	}
+	end := strings.IndexByte(this.s, '*')
+	if end < 0 {
+		return nil, errors.New("unterminated binary content")
+	}
+	encoded := this.s[:end]
+	this.s = this.s[end+1:]
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+func (this *paramParser) integer() (int64, error) {
+	end := strings.IndexFunc(this.s, func(c rune) bool { return !(c >= '0' && c <= '9' || c == '-') })
+	if end < 0 {
+		end = len(this.s)
+	}
+	value, err := strconv.ParseInt(this.s[:end], 10, 64)
+	this.s = this.s[end:]
+	return value, err
+}
+
+func (this *paramParser) skipValue() error {
+	var err error
+	switch {
+	case strings.HasPrefix(this.s, `"`):
+		_, err = this.str()
+	case strings.HasPrefix(this.s, "*"):
+		_, err = this.binary()
+	default:
+		this.token()
+	}
+	return err
+}
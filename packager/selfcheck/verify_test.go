@@ -0,0 +1,102 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selfcheck
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSignURL = "https://example.com/amp.html"
+
+// Returns an SXG of body for testSignURL, signed at date, in records of
+// recordSize, and a fetchCert that returns its cert chain.
+func signTestExchange(t *testing.T, body string, recordSize int, date time.Time) ([]byte, func(string) ([]byte, error)) {
+	exchange := signedexchange.NewExchange(version.Version1b3, testSignURL, "GET", http.Header{}, 200,
+		http.Header{"Content-Type": {"text/html"}}, []byte(body))
+	require.NoError(t, exchange.MiEncodePayload(recordSize))
+	certURL, _ := url.Parse("https://example.com/cert")
+	validityURL, _ := url.Parse("https://example.com/validity")
+	require.NoError(t, exchange.AddSignatureHeader(&signedexchange.Signer{
+		Date: date, Expires: date.Add(time.Hour),
+		Certs: pkgt.Certs, CertUrl: certURL, ValidityUrl: validityURL, PrivKey: pkgt.Key,
+	}))
+	var sxg bytes.Buffer
+	require.NoError(t, exchange.Write(&sxg))
+	chain, err := certurl.NewCertChain(pkgt.Certs, []byte("ocsp"), nil)
+	require.NoError(t, err)
+	var chainBytes bytes.Buffer
+	require.NoError(t, chain.Write(&chainBytes))
+	return sxg.Bytes(), func(string) ([]byte, error) { return chainBytes.Bytes(), nil }
+}
+
+func TestVerify(t *testing.T) {
+	date := pkgt.Certs[0].NotBefore.Add(24 * time.Hour)
+	now := date.Add(time.Minute)
+	body := strings.Repeat("<html amp>", 10)
+	for _, recordSize := range []int{16, 4096} {
+		sxg, fetchCert := signTestExchange(t, body, recordSize, date)
+		assert.NoError(t, verify(sxg, testSignURL, now, fetchCert), "recordSize=%d", recordSize)
+
+		assert.EqualError(t, verify(sxg, "https://example.com/other.html", now, fetchCert), "exchange is for "+testSignURL)
+		assert.Contains(t, verify(sxg, testSignURL, date.Add(2*time.Hour), fetchCert).Error(), "is outside of date")
+
+		// Tampering with the signed headers invalidates the signature.
+		tampered := append([]byte{}, sxg...)
+		i := bytes.Index(tampered, []byte("text/html"))
+		require.True(t, i > 0)
+		tampered[i] = 'T'
+		assert.Contains(t, verify(tampered, testSignURL, now, fetchCert).Error(), "sig doesn't match")
+
+		// Tampering with the payload fails its integrity check.
+		tampered = append([]byte{}, sxg...)
+		tampered[len(tampered)-1] ^= 1
+		assert.Contains(t, verify(tampered, testSignURL, now, fetchCert).Error(), "doesn't match its proof")
+
+		// As does truncating it.
+		assert.Error(t, verify(sxg[:len(sxg)-20], testSignURL, now, fetchCert))
+	}
+
+	sxg, fetchCert := signTestExchange(t, body, 16, date)
+	assert.Contains(t, verify(sxg, testSignURL, now, func(string) ([]byte, error) { return []byte("junk"), nil }).Error(), "parsing cert chain")
+	assert.EqualError(t, verify([]byte("sxg1-b2\x00"), testSignURL, now, fetchCert), "parsing exchange: not an SXG b3")
+}
+
+func TestParseSignatures(t *testing.T) {
+	signatures, err := parseSignatures(`a;sig=*AQI=*;integrity="digest/mi-sha256-03";cert-url="https://example.com/c\"1";` +
+		`cert-sha256=*AwQ=*;validity-url="https://example.com/v";date=1;expires=2;other=tok, b;sig=*BQ==*`)
+	require.NoError(t, err)
+	require.Len(t, signatures, 2)
+	assert.Equal(t, &signature{[]byte{1, 2}, "digest/mi-sha256-03", `https://example.com/c"1`, []byte{3, 4}, "https://example.com/v", 1, 2}, signatures[0])
+	assert.Equal(t, []byte{5}, signatures[1].sig)
+
+	_, err = parseSignatures(`a;sig=*AQI=`)
+	assert.Error(t, err)
+	_, err = parseSignatures(`a;cert-url="unterminated`)
+	assert.Error(t, err)
+	_, err = parseSignatures(`a b`)
+	assert.Error(t, err)
+}
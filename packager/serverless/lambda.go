@@ -0,0 +1,221 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Adapts an http.Handler to serverless environments that invoke it once per
+// request, rather than having it listen for connections.
+//
+// Container platforms that route HTTP to the container (e.g. Cloud Run) need
+// no adapter; amppkg listens on Port as usual. AWS Lambda instead delivers
+// each request as an event, via its runtime API, which ServeLambda handles
+// without depending on the AWS Lambda libraries.
+package serverless
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The environment variable by which Lambda passes the runtime API's address.
+const LambdaRuntimeAPIEnv = "AWS_LAMBDA_RUNTIME_API"
+
+// Set if running under Lambda.
+func IsLambda() bool {
+	return os.Getenv(LambdaRuntimeAPIEnv) != ""
+}
+
+// An API Gateway proxy event, in either the REST API (1.0) or HTTP API and
+// function URL (2.0) format.
+type lambdaEvent struct {
+	Version string `json:"version"`
+
+	// 1.0
+	HTTPMethod        string              `json:"httpMethod"`
+	Path              string              `json:"path"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	MultiValueQuery   map[string][]string `json:"multiValueQueryStringParameters"`
+
+	// 2.0
+	RawPath        string   `json:"rawPath"`
+	RawQueryString string   `json:"rawQueryString"`
+	Cookies        []string `json:"cookies"`
+
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		HTTP struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+	} `json:"requestContext"`
+}
+
+// The response to either format of event. Binary bodies (e.g. SXGs) require
+// base64 encoding.
+type lambdaResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Cookies           []string            `json:"cookies,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+func (this *lambdaEvent) isV2() bool {
+	return this.Version == "2.0"
+}
+
+// Builds the request that the event represents.
+func (this *lambdaEvent) request(ctx context.Context) (*http.Request, error) {
+	// 1.0's path is decoded, so needs escaping; 2.0's is as sent, so is
+	// used verbatim, lest e.g. %2F be escaped again to %252F.
+	method, target, remoteIP := this.HTTPMethod, (&url.URL{Path: this.Path}).EscapedPath(), this.RequestContext.Identity.SourceIP
+	if this.isV2() {
+		method, target, remoteIP = this.RequestContext.HTTP.Method, this.RawPath, this.RequestContext.HTTP.SourceIP
+		if this.RawQueryString != "" {
+			target += "?" + this.RawQueryString
+		}
+	} else if len(this.MultiValueQuery) > 0 {
+		target += "?" + url.Values(this.MultiValueQuery).Encode()
+	}
+	body := []byte(this.Body)
+	if this.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(this.Body); err != nil {
+			return nil, errors.Wrap(err, "decoding body")
+		}
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "building request")
+	}
+	for name, value := range this.Headers {
+		req.Header.Set(name, value)
+	}
+	for name, values := range this.MultiValueHeaders {
+		req.Header.Del(name)
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if len(this.Cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(this.Cookies, "; "))
+	}
+	req.Host = req.Header.Get("Host")
+	req.RemoteAddr = remoteIP
+	return req.WithContext(ctx), nil
+}
+
+// Serves the request that the event represents, returning the response in the
+// matching format.
+func serveEvent(ctx context.Context, handler http.Handler, event *lambdaEvent) *lambdaResponse {
+	req, err := event.request(ctx)
+	if err != nil {
+		log.Println("Error parsing Lambda event:", err)
+		return &lambdaResponse{StatusCode: http.StatusBadRequest}
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	result := recorder.Result()
+	resp := &lambdaResponse{
+		StatusCode:      result.StatusCode,
+		Body:            base64.StdEncoding.EncodeToString(recorder.Body.Bytes()),
+		IsBase64Encoded: true,
+	}
+	if event.isV2() {
+		resp.Headers = map[string]string{}
+		for name, values := range result.Header {
+			if name == "Set-Cookie" {
+				resp.Cookies = values
+			} else {
+				resp.Headers[name] = strings.Join(values, ",")
+			}
+		}
+	} else {
+		resp.MultiValueHeaders = result.Header
+	}
+	return resp
+}
+
+// Serves Lambda invocations with handler, one at a time, until the runtime API
+// fails. Each invocation's context expires at its deadline.
+func ServeLambda(handler http.Handler) error {
+	return serveLambda(os.Getenv(LambdaRuntimeAPIEnv), handler)
+}
+
+func serveLambda(runtimeAPI string, handler http.Handler) error {
+	base := "http://" + runtimeAPI + "/2018-06-01/runtime/invocation/"
+	// Long-polls for the next invocation, so it mustn't time out.
+	client := &http.Client{}
+	for {
+		next, err := client.Get(base + "next")
+		if err != nil {
+			return errors.Wrap(err, "getting next Lambda invocation")
+		}
+		eventBytes, err := ioutil.ReadAll(next.Body)
+		next.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "reading Lambda invocation")
+		}
+		if next.StatusCode != http.StatusOK {
+			return errors.Errorf("getting next Lambda invocation: status %d", next.StatusCode)
+		}
+		requestID := next.Header.Get("Lambda-Runtime-Aws-Request-Id")
+
+		ctx, cancel := context.Background(), func() {}
+		if ms, err := strconv.ParseInt(next.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64); err == nil {
+			ctx, cancel = context.WithDeadline(ctx, time.Unix(0, ms*int64(time.Millisecond)))
+		}
+		var event lambdaEvent
+		var resp *lambdaResponse
+		if err := json.Unmarshal(eventBytes, &event); err != nil {
+			log.Println("Error parsing Lambda event:", err)
+			resp = &lambdaResponse{StatusCode: http.StatusBadRequest}
+		} else {
+			resp = serveEvent(ctx, handler, &event)
+		}
+		cancel()
+
+		respBytes, err := json.Marshal(resp)
+		if err != nil {
+			return errors.Wrap(err, "encoding Lambda response")
+		}
+		posted, err := client.Post(base+url.PathEscape(requestID)+"/response", "application/json", bytes.NewReader(respBytes))
+		if err != nil {
+			return errors.Wrap(err, "posting Lambda response")
+		}
+		posted.Body.Close()
+		if posted.StatusCode != http.StatusAccepted {
+			// E.g. the response was too large; the invocation fails,
+			// but others may succeed.
+			log.Printf("Error posting Lambda response for %s: status %d\n", requestID, posted.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serverless
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Echoes details of the request, and sets a cookie.
+var echo = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	resp.Header().Set("Content-Type", "application/signed-exchange;v=b3")
+	resp.Header().Add("Set-Cookie", "a=b")
+	resp.WriteHeader(http.StatusTeapot)
+	resp.Write([]byte(strings.Join([]string{req.Method, req.URL.String(), req.Host, req.RemoteAddr, req.Header.Get("Accept"), req.Header.Get("Cookie"), string(body)}, "|")))
+})
+
+func TestServeLambda(t *testing.T) {
+	events := []string{
+		`{"httpMethod": "GET", "path": "/priv/doc/https://example.com/", "multiValueQueryStringParameters": {"a": ["1", "2"]},
+		  "headers": {"Host": "amppkg.example", "Accept": "text/html"}, "multiValueHeaders": {"Accept": ["text/html", "application/signed-exchange;v=b3"]},
+		  "requestContext": {"identity": {"sourceIp": "192.0.2.1"}}}`,
+		`{"version": "2.0", "rawPath": "/priv/doc", "rawQueryString": "sign=https%3A%2F%2Fexample.com%2F",
+		  "headers": {"host": "amppkg.example", "accept": "application/signed-exchange;v=b3"}, "cookies": ["c=d", "e=f"],
+		  "body": "` + base64.StdEncoding.EncodeToString([]byte("\x00binary")) + `", "isBase64Encoded": true,
+		  "requestContext": {"http": {"method": "POST", "sourceIp": "192.0.2.2"}}}`,
+		`{"version": "2.0", "rawPath": "/priv/doc/https%3A%2F%2Fexample.com%2Fa%2520b", "headers": {"host": "amppkg.example"},
+		  "requestContext": {"http": {"method": "GET", "sourceIp": "192.0.2.3"}}}`,
+		`not json`,
+	}
+	var mu sync.Mutex
+	responses := map[string]lambdaResponse{}
+	runtime := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.URL.Path == "/2018-06-01/runtime/invocation/next" {
+			if len(events) == 0 {
+				resp.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			resp.Header().Set("Lambda-Runtime-Aws-Request-Id", string('a'+rune(len(responses))))
+			resp.Header().Set("Lambda-Runtime-Deadline-Ms", "4102444800000")
+			resp.Write([]byte(events[0]))
+			events = events[1:]
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/2018-06-01/runtime/invocation/"), "/response")
+		var response lambdaResponse
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&response))
+		responses[id] = response
+		resp.WriteHeader(http.StatusAccepted)
+	}))
+	defer runtime.Close()
+
+	err := serveLambda(strings.TrimPrefix(runtime.URL, "http://"), echo)
+	assert.EqualError(t, err, "getting next Lambda invocation: status 500")
+	require.Len(t, responses, 4)
+
+	decode := func(resp lambdaResponse) string {
+		assert.True(t, resp.IsBase64Encoded)
+		body, err := base64.StdEncoding.DecodeString(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	v1 := responses["a"]
+	assert.Equal(t, http.StatusTeapot, v1.StatusCode)
+	assert.Equal(t, []string{"application/signed-exchange;v=b3"}, v1.MultiValueHeaders["Content-Type"])
+	assert.Equal(t, []string{"a=b"}, v1.MultiValueHeaders["Set-Cookie"])
+	assert.Equal(t, "GET|/priv/doc/https://example.com/?a=1&a=2|amppkg.example|192.0.2.1|text/html||", decode(v1))
+
+	v2 := responses["b"]
+	assert.Equal(t, http.StatusTeapot, v2.StatusCode)
+	assert.Equal(t, "application/signed-exchange;v=b3", v2.Headers["Content-Type"])
+	assert.Equal(t, []string{"a=b"}, v2.Cookies)
+	assert.Equal(t, "POST|/priv/doc?sign=https%3A%2F%2Fexample.com%2F|amppkg.example|192.0.2.2|application/signed-exchange;v=b3|c=d; e=f|\x00binary", decode(v2))
+
+	// The raw path is passed through, rather than escaped again.
+	assert.Equal(t, "GET|/priv/doc/https%3A%2F%2Fexample.com%2Fa%2520b|amppkg.example|192.0.2.3|||", decode(responses["c"]))
+
+	assert.Equal(t, http.StatusBadRequest, responses["d"].StatusCode)
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Reads a fetched body into memory, enforcing a length cap as it goes, rather
+// than reading a fixed amount and hoping that was all of it.
+//
+// Note that MI-encoding can't be interleaved with the read: the transformer
+// needs the whole document before it can produce the payload, and MICE
+// computes the integrity proof starting from the last record (see
+// https://tools.ietf.org/html/draft-thomson-http-mice-03#section-2.1). Hence
+// the whole document is held in memory, up to URLSet.MaxBodyLength.
+//
+// The body may be chunked, or otherwise of unknown length. Its Content-Length,
+// if any, is used to presize the buffer, to refuse a body declared too long
+// without reading it, and to check the body once read.
+type bodyReader struct {
+	resp *http.Response
+	// The bytes read so far. A body longer than the last limit passed to
+	// readWithin holds its first limit+1 bytes, for proxy to write before
+	// the rest.
+	body []byte
+	eof  bool
+}
+
+func newBodyReader(resp *http.Response) *bodyReader {
+	return &bodyReader{resp: resp}
+}
+
+// Reads until the end of the body, or until more than limit bytes have been
+// read, and returns true if the whole body is within limit. May be called
+// again with a larger limit to read on.
+func (this *bodyReader) readWithin(limit int) (bool, error) {
+	if !this.eof && this.resp.ContentLength > int64(limit) {
+		return false, nil
+	}
+	for !this.eof && len(this.body) <= limit {
+		if len(this.body) == cap(this.body) {
+			grow := bytes.MinRead
+			if remaining := this.resp.ContentLength - int64(len(this.body)); remaining >= 0 {
+				// One spare byte, to read the EOF into.
+				grow = int(remaining) + 1
+			} else if len(this.body) > grow {
+				grow = len(this.body)
+			}
+			if room := limit + 1 - len(this.body); grow > room {
+				grow = room
+			}
+			body := make([]byte, len(this.body), len(this.body)+grow)
+			copy(body, this.body)
+			this.body = body
+		}
+		n, err := this.resp.Body.Read(this.body[len(this.body):cap(this.body)])
+		this.body = this.body[:len(this.body)+n]
+		if err == io.EOF {
+			this.eof = true
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if this.eof && this.resp.ContentLength >= 0 && int64(len(this.body)) != this.resp.ContentLength {
+		return false, errors.Errorf("body is %d bytes, but its Content-Length is %d", len(this.body), this.resp.ContentLength)
+	}
+	return len(this.body) <= limit, nil
+}
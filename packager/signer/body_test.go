@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bodyResponse(body io.Reader, contentLength int64) *http.Response {
+	return &http.Response{Body: ioutil.NopCloser(body), ContentLength: contentLength}
+}
+
+func TestBodyReader(t *testing.T) {
+	// Of unknown length, as if chunked, and read a byte at a time.
+	body := newBodyReader(bodyResponse(iotest.OneByteReader(strings.NewReader("0123456789")), -1))
+	within, err := body.readWithin(10)
+	require.NoError(t, err)
+	assert.True(t, within)
+	assert.Equal(t, "0123456789", string(body.body))
+
+	// Bodies over the limit are read one byte past it, and may be read on.
+	body = newBodyReader(bodyResponse(strings.NewReader("0123456789"), -1))
+	within, err = body.readWithin(4)
+	require.NoError(t, err)
+	assert.False(t, within)
+	assert.Equal(t, "01234", string(body.body))
+	within, err = body.readWithin(8)
+	require.NoError(t, err)
+	assert.False(t, within)
+	assert.Equal(t, "012345678", string(body.body))
+	within, err = body.readWithin(10)
+	require.NoError(t, err)
+	assert.True(t, within)
+	assert.Equal(t, "0123456789", string(body.body))
+
+	// Of known length.
+	body = newBodyReader(bodyResponse(strings.NewReader("0123456789"), 10))
+	within, err = body.readWithin(10)
+	require.NoError(t, err)
+	assert.True(t, within)
+	assert.Equal(t, "0123456789", string(body.body))
+	assert.Equal(t, 11, cap(body.body), "should be presized")
+
+	// Declared too long, so not read.
+	body = newBodyReader(bodyResponse(iotest.TimeoutReader(strings.NewReader("0123456789")), 10))
+	within, err = body.readWithin(4)
+	require.NoError(t, err)
+	assert.False(t, within)
+	assert.Empty(t, body.body)
+
+	// Shorter than declared.
+	body = newBodyReader(bodyResponse(strings.NewReader("01234"), 10))
+	_, err = body.readWithin(10)
+	assert.EqualError(t, err, "body is 5 bytes, but its Content-Length is 10")
+
+	// Cut off mid-stream.
+	body = newBodyReader(bodyResponse(io.MultiReader(strings.NewReader("01234"), iotest.TimeoutReader(strings.NewReader("56789"))), -1))
+	_, err = body.readWithin(10)
+	assert.Equal(t, iotest.ErrTimeout, err)
+
+	// Empty.
+	body = newBodyReader(bodyResponse(strings.NewReader(""), -1))
+	within, err = body.readWithin(10)
+	require.NoError(t, err)
+	assert.True(t, within)
+	assert.Empty(t, body.body)
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"expvar"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// The origin hosts whose circuits have opened (see URLSet.CircuitBreaker),
+// and the Unix time until which each fails fast. Hosts leave once a fetch
+// from them succeeds.
+var openCircuits = expvar.NewMap("amppkg_open_circuits")
+
+// The number of fetches failed fast due to an open circuit, by host.
+var circuitFastFails = expvar.NewMap("amppkg_circuit_fast_fails")
+
+// Tracks consecutive fetch failures by origin host, per URLSet.CircuitBreaker.
+type circuitBreaker struct {
+	now   func() time.Time
+	mu    sync.Mutex
+	hosts map[string]*circuitState
+}
+
+type circuitState struct {
+	failures  int
+	openUntil time.Time
+	// Set once the circuit has opened.
+	coolDown time.Duration
+}
+
+func newCircuitBreaker(now func() time.Time) *circuitBreaker {
+	return &circuitBreaker{now: now, hosts: map[string]*circuitState{}}
+}
+
+// Returns how much longer the circuit for host is open, or 0 if a fetch may
+// proceed. Once an open circuit's cool-down ends, it lets one fetch through as
+// a trial, and stays open to others until the trial's outcome is recorded, or
+// for another cool-down if it never is.
+func (this *circuitBreaker) openFor(host string) time.Duration {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	state, ok := this.hosts[host]
+	if !ok {
+		return 0
+	}
+	now := this.now()
+	if remaining := state.openUntil.Sub(now); remaining > 0 {
+		circuitFastFails.Add(host, 1)
+		return remaining
+	}
+	if state.coolDown > 0 {
+		this.open(host, state, now)
+	}
+	return 0
+}
+
+// Records the outcome of a fetch from host, opening its circuit once config's
+// Failures are reached.
+func (this *circuitBreaker) record(host string, config *util.CircuitBreakerConfig, failed bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	state, ok := this.hosts[host]
+	if !failed {
+		if ok {
+			delete(this.hosts, host)
+			openCircuits.Delete(host)
+		}
+		return
+	}
+	if !ok {
+		state = &circuitState{}
+		this.hosts[host] = state
+	}
+	state.failures++
+	if state.failures >= config.Failures {
+		state.coolDown = config.CoolDownDuration()
+		this.open(host, state, this.now())
+	}
+}
+
+func (this *circuitBreaker) open(host string, state *circuitState, now time.Time) {
+	state.openUntil = now.Add(state.coolDown)
+	openUntil := new(expvar.Int)
+	openUntil.Set(state.openUntil.Unix())
+	openCircuits.Set(host, openUntil)
+}
+
+// True if the fetch failed because it was canceled, rather than due to the
+// origin.
+func isCanceled(err error) bool {
+	cause := errors.Cause(err)
+	if urlErr, ok := cause.(*url.Error); ok {
+		cause = errors.Cause(urlErr.Err)
+	}
+	return cause == context.Canceled
+}
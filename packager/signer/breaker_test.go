@@ -0,0 +1,73 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	breaker := newCircuitBreaker(func() time.Time { return now })
+	config := &util.CircuitBreakerConfig{Failures: 2, CoolDown: "10s"}
+
+	breaker.record("a.example", config, true)
+	assert.Zero(t, breaker.openFor("a.example"))
+	// A success resets the count.
+	breaker.record("a.example", config, false)
+	breaker.record("a.example", config, true)
+	assert.Zero(t, breaker.openFor("a.example"))
+	breaker.record("a.example", config, true)
+	assert.Equal(t, 10*time.Second, breaker.openFor("a.example"))
+	assert.Equal(t, "1010", openCircuits.Get("a.example").String())
+	// Other hosts are unaffected.
+	assert.Zero(t, breaker.openFor("b.example"))
+
+	now = now.Add(4 * time.Second)
+	assert.Equal(t, 6*time.Second, breaker.openFor("a.example"))
+
+	// After the cool-down, only one trial is let through, and a failed one
+	// reopens the circuit.
+	now = now.Add(6 * time.Second)
+	assert.Zero(t, breaker.openFor("a.example"))
+	assert.Equal(t, 10*time.Second, breaker.openFor("a.example"))
+	now = now.Add(time.Second)
+	breaker.record("a.example", config, true)
+	assert.Equal(t, 10*time.Second, breaker.openFor("a.example"))
+
+	// A trial whose outcome is never recorded is followed by another.
+	now = now.Add(10 * time.Second)
+	assert.Zero(t, breaker.openFor("a.example"))
+	now = now.Add(10 * time.Second)
+	assert.Zero(t, breaker.openFor("a.example"))
+
+	// A successful one closes it.
+	now = now.Add(10 * time.Second)
+	breaker.record("a.example", config, false)
+	assert.Zero(t, breaker.openFor("a.example"))
+	assert.Nil(t, openCircuits.Get("a.example"))
+}
+
+func TestIsCanceled(t *testing.T) {
+	assert.True(t, isCanceled(&url.Error{Op: "Get", URL: "https://example.com/", Err: context.Canceled}))
+	assert.False(t, isCanceled(&url.Error{Op: "Get", URL: "https://example.com/", Err: context.DeadlineExceeded}))
+	assert.False(t, isCanceled(nil))
+}
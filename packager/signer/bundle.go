@@ -0,0 +1,281 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/WICG/webpackage/go/signedexchange/cbor"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/ampproject/amppackager/transformer"
+	"github.com/pkg/errors"
+)
+
+// The value of the output param that requests a Web Bundle.
+const webBundleOutput = "bundle"
+
+// The Content-Type of Web Bundles.
+const webBundleContentType = "application/webbundle"
+
+// The magic number and version that start a b1 Web Bundle, per
+// https://wicg.github.io/webpackage/draft-yasskin-wpack-bundled-exchanges.html#name-top-level-structure.
+var (
+	webBundleMagic   = []byte("\U0001F310\U0001F4E6")
+	webBundleVersion = []byte("b1\x00\x00")
+)
+
+// An unsigned exchange, to be included in a Web Bundle.
+type bundledExchange struct {
+	url     string
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+// Writes a b1 Web Bundle of the given exchanges, whose primary URL is that of
+// the first. Header names are lowercased, per HTTP/2.
+func writeWebBundle(w io.Writer, exchanges []*bundledExchange) error {
+	if len(exchanges) == 0 {
+		return errors.New("no exchanges to bundle")
+	}
+	var responses bytes.Buffer
+	responsesE := cbor.NewEncoder(&responses)
+	if err := responsesE.EncodeArrayHeader(len(exchanges)); err != nil {
+		return errors.Wrap(err, "encoding responses")
+	}
+	index := make([]*cbor.MapEntryEncoder, 0, len(exchanges))
+	for _, exchange := range exchanges {
+		entries := []*cbor.MapEntryEncoder{cbor.GenerateMapEntry(func(keyE *cbor.Encoder, valueE *cbor.Encoder) {
+			keyE.EncodeByteString([]byte(":status"))
+			valueE.EncodeByteString([]byte(strconv.Itoa(exchange.status)))
+		})}
+		for name, values := range exchange.headers {
+			value := strings.Join(values, ",")
+			entries = append(entries, cbor.GenerateMapEntry(func(keyE *cbor.Encoder, valueE *cbor.Encoder) {
+				keyE.EncodeByteString([]byte(strings.ToLower(name)))
+				valueE.EncodeByteString([]byte(value))
+			}))
+		}
+		var headers bytes.Buffer
+		if err := cbor.NewEncoder(&headers).EncodeMap(entries); err != nil {
+			return errors.Wrapf(err, "encoding headers of %s", exchange.url)
+		}
+		offset := responses.Len()
+		if err := responsesE.EncodeArrayHeader(2); err != nil {
+			return errors.Wrapf(err, "encoding response for %s", exchange.url)
+		}
+		if err := responsesE.EncodeByteString(headers.Bytes()); err != nil {
+			return errors.Wrapf(err, "encoding response for %s", exchange.url)
+		}
+		if err := responsesE.EncodeByteString(exchange.body); err != nil {
+			return errors.Wrapf(err, "encoding response for %s", exchange.url)
+		}
+		length := responses.Len() - offset
+		index = append(index, cbor.GenerateMapEntry(func(keyE *cbor.Encoder, valueE *cbor.Encoder) {
+			keyE.EncodeTextString(exchange.url)
+			// No variants.
+			valueE.EncodeArrayHeader(3)
+			valueE.EncodeByteString(nil)
+			valueE.EncodeUint(uint64(offset))
+			valueE.EncodeUint(uint64(length))
+		}))
+	}
+	var indexSection bytes.Buffer
+	if err := cbor.NewEncoder(&indexSection).EncodeMap(index); err != nil {
+		return errors.Wrap(err, "encoding index")
+	}
+
+	var sectionLengths bytes.Buffer
+	sectionLengthsE := cbor.NewEncoder(&sectionLengths)
+	sectionLengthsE.EncodeArrayHeader(4)
+	sectionLengthsE.EncodeTextString("index")
+	sectionLengthsE.EncodeUint(uint64(indexSection.Len()))
+	sectionLengthsE.EncodeTextString("responses")
+	sectionLengthsE.EncodeUint(uint64(responses.Len()))
+
+	var bundle bytes.Buffer
+	bundleE := cbor.NewEncoder(&bundle)
+	bundleE.EncodeArrayHeader(6)
+	bundleE.EncodeByteString(webBundleMagic)
+	bundleE.EncodeByteString(webBundleVersion)
+	bundleE.EncodeTextString(exchanges[0].url)
+	bundleE.EncodeByteString(sectionLengths.Bytes())
+	bundleE.EncodeArrayHeader(2)
+	bundle.Write(indexSection.Bytes())
+	bundle.Write(responses.Bytes())
+	// The length of the whole bundle, including this 9-byte byte string.
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(bundle.Len()+9))
+	bundleE.EncodeByteString(length[:])
+	_, err := bundle.WriteTo(w)
+	return errors.Wrap(err, "writing bundle")
+}
+
+// Returns the headers of fetchResp to include in a Web Bundle: those the
+// URLSet would sign, other than stateful ones.
+func bundledHeaders(fetchResp *http.Response, urlSet *util.URLSet, body []byte) http.Header {
+	headers := http.Header{}
+	for name, values := range fetchResp.Header {
+		if !statefulResponseHeaders[name] && (alwaysSignedHeaders[name] || urlSet.SignsHeader(name)) {
+			headers[name] = values
+		}
+	}
+	headers.Set("Content-Length", strconv.Itoa(len(body)))
+	headers.Set("X-Content-Type-Options", "nosniff")
+	return headers
+}
+
+// Serves an unsigned Web Bundle of the document, as transformed for signing,
+// and its subresources (see subresourcesOf), for clients experimenting with
+// bundled delivery. Auxiliary resources are bundled alone, as-is. If the
+// document can't be bundled, it's proxied instead.
+func (this *Signer) serveWebBundle(resp http.ResponseWriter, req *http.Request, fetchReq *http.Request, fetchResp *http.Response, signURL *url.URL, urlSet *util.URLSet, resource *util.AuxiliaryResource, budget *originRequestBudget) {
+	if fetchResp.StatusCode != http.StatusOK {
+		log.Printf("Not bundling because status code %d is not 200.\n", fetchResp.StatusCode)
+		proxy(resp, fetchResp, nil)
+		return
+	}
+	if httpErr := checkNotSignedExchange(fetchResp, nil); httpErr != nil {
+		httpErr.LogAndRespond(resp, req)
+		return
+	}
+	contentTypes := urlSet.ContentTypes()
+	if resource != nil {
+		contentTypes = []string{resource.ContentType}
+	}
+	if err := validateFetch(fetchReq, fetchResp, contentTypes); err != nil {
+		log.Println("Not bundling because of invalid fetch: ", err)
+		proxy(resp, fetchResp, nil)
+		return
+	}
+	limit := urlSet.BodyLength()
+	body := newBodyReader(fetchResp)
+	within, err := body.readWithin(limit)
+	if err != nil {
+		util.NewHTTPError(http.StatusBadGateway, "Error reading body: ", err).LogAndRespond(resp, req)
+		return
+	}
+	if !within {
+		log.Printf("Not bundling because the body is longer than %d bytes.\n", limit)
+		proxy(resp, fetchResp, body.body)
+		return
+	}
+	fetchBody := body.body
+	if resource != nil {
+		this.writeWebBundle(resp, req, []*bundledExchange{{signURL.String(), http.StatusOK, bundledHeaders(fetchResp, urlSet, fetchBody), fetchBody}})
+		return
+	}
+	if urlSet.AMPOnly {
+		if err := checkAMPDocument(fetchBody); err != nil {
+			log.Println("Not bundling because AMPOnly is set and the body doesn't look like AMP:", err)
+			proxy(resp, fetchResp, fetchBody)
+			return
+		}
+	}
+
+	// Transforming the document and fetching its subresources is as costly as
+	// signing them, so takes a signing worker too.
+	release, ok := this.acquireSigningWorker(resp, req, urlSet)
+	if !ok {
+		return
+	}
+	defer release()
+
+	transformVersion, err := transformer.SelectVersion(nil)
+	if err != nil {
+		log.Println("Not bundling because of internal SelectVersion error:", err)
+		proxy(resp, fetchResp, fetchBody)
+		return
+	}
+	transformReq := getTransformerRequest(this.rtvCache, string(fetchBody), signURL.String())
+	transformReq.Version = transformVersion
+	transformed, metadata, err := transformer.Process(transformReq)
+	if err != nil {
+		log.Println("Not bundling due to transformer error:", err)
+		proxy(resp, fetchResp, fetchBody)
+		return
+	}
+	linkHeader, err := formatLinkHeader(metadata.Preloads)
+	if err != nil {
+		log.Println("Not bundling due to Link header error:", err)
+		proxy(resp, fetchResp, fetchBody)
+		return
+	}
+	headers := bundledHeaders(fetchResp, urlSet, []byte(transformed))
+	if linkHeader != "" {
+		headers.Set("Link", linkHeader)
+	} else {
+		headers.Del("Link")
+	}
+	headers.Set("Content-Security-Policy", MutateFetchedContentSecurityPolicy(headers.Get("Content-Security-Policy")))
+	exchanges := []*bundledExchange{{signURL.String(), http.StatusOK, headers, []byte(transformed)}}
+	for _, sub := range this.subresourcesOf(signURL, fetchBody, metadata.Preloads) {
+		exchange, err := this.fetchBundledSubresource(req, sub, budget)
+		if err != nil {
+			log.Printf("Not bundling subresource %s: %v\n", sub.url, err)
+			continue
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	this.writeWebBundle(resp, req, exchanges)
+}
+
+// Fetches the subresource for inclusion in a Web Bundle, subject to the same
+// checks as when signing it.
+func (this *Signer) fetchBundledSubresource(req *http.Request, sub subresource, budget *originRequestBudget) (*bundledExchange, error) {
+	fetchReq, fetchResp, httpErr := this.fetchURL(sub.url, req, sub.urlSet, budget)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	defer fetchResp.Body.Close()
+	if fetchResp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("got status %d", fetchResp.StatusCode)
+	}
+	if err := validateFetch(fetchReq, fetchResp, []string{sub.resource.ContentType}); err != nil {
+		return nil, err
+	}
+	limit := sub.urlSet.BodyLength()
+	body := newBodyReader(fetchResp)
+	within, err := body.readWithin(limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading body")
+	}
+	if !within {
+		return nil, errors.Errorf("body is longer than %d bytes", limit)
+	}
+	return &bundledExchange{sub.url.String(), http.StatusOK, bundledHeaders(fetchResp, sub.urlSet, body.body), body.body}, nil
+}
+
+func (this *Signer) writeWebBundle(resp http.ResponseWriter, req *http.Request, exchanges []*bundledExchange) {
+	var bundle bytes.Buffer
+	if err := writeWebBundle(&bundle, exchanges); err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error building Web Bundle: ", err).LogAndRespond(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", webBundleContentType)
+	resp.Header().Set("Content-Length", strconv.Itoa(bundle.Len()))
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.WriteHeader(http.StatusOK)
+	if _, err := bundle.WriteTo(resp); err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"testing"
+
+	"github.com/WICG/webpackage/go/signedexchange/cbor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Parses a b1 Web Bundle, as written by writeWebBundle, returning its primary
+// URL and its exchanges by URL. Header names are as in the bundle.
+func readWebBundle(t *testing.T, bundle []byte) (string, map[string]*bundledExchange) {
+	r := bytes.NewReader(bundle)
+	dec := cbor.NewDecoder(r)
+	n, err := dec.DecodeArrayHeader()
+	require.NoError(t, err)
+	require.EqualValues(t, 6, n)
+	magic, err := dec.DecodeByteString()
+	require.NoError(t, err)
+	require.Equal(t, webBundleMagic, magic)
+	version, err := dec.DecodeByteString()
+	require.NoError(t, err)
+	require.Equal(t, webBundleVersion, version)
+	primary, err := dec.DecodeTextString()
+	require.NoError(t, err)
+
+	sectionLengths, err := dec.DecodeByteString()
+	require.NoError(t, err)
+	lengthsDec := cbor.NewDecoder(bytes.NewReader(sectionLengths))
+	n, err = lengthsDec.DecodeArrayHeader()
+	require.NoError(t, err)
+	lengths := map[string]uint64{}
+	for i := uint64(0); i < n; i += 2 {
+		name, err := lengthsDec.DecodeTextString()
+		require.NoError(t, err)
+		lengths[name], err = lengthsDec.DecodeUint()
+		require.NoError(t, err)
+	}
+	n, err = dec.DecodeArrayHeader()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, n)
+	index := make([]byte, lengths["index"])
+	_, err = r.Read(index)
+	require.NoError(t, err)
+	responses := make([]byte, lengths["responses"])
+	_, err = r.Read(responses)
+	require.NoError(t, err)
+	length, err := dec.DecodeByteString()
+	require.NoError(t, err)
+	require.EqualValues(t, len(bundle), binary.BigEndian.Uint64(length))
+	require.Zero(t, r.Len())
+
+	exchanges := map[string]*bundledExchange{}
+	indexDec := cbor.NewDecoder(bytes.NewReader(index))
+	n, err = indexDec.DecodeMapHeader()
+	require.NoError(t, err)
+	for i := uint64(0); i < n; i++ {
+		url, err := indexDec.DecodeTextString()
+		require.NoError(t, err)
+		m, err := indexDec.DecodeArrayHeader()
+		require.NoError(t, err)
+		require.EqualValues(t, 3, m)
+		variants, err := indexDec.DecodeByteString()
+		require.NoError(t, err)
+		require.Empty(t, variants)
+		offset, err := indexDec.DecodeUint()
+		require.NoError(t, err)
+		size, err := indexDec.DecodeUint()
+		require.NoError(t, err)
+
+		responseDec := cbor.NewDecoder(bytes.NewReader(responses[offset : offset+size]))
+		m, err = responseDec.DecodeArrayHeader()
+		require.NoError(t, err)
+		require.EqualValues(t, 2, m)
+		encodedHeaders, err := responseDec.DecodeByteString()
+		require.NoError(t, err)
+		body, err := responseDec.DecodeByteString()
+		require.NoError(t, err)
+		exchange := &bundledExchange{url: url, headers: http.Header{}, body: body}
+		headersDec := cbor.NewDecoder(bytes.NewReader(encodedHeaders))
+		m, err = headersDec.DecodeMapHeader()
+		require.NoError(t, err)
+		for j := uint64(0); j < m; j++ {
+			name, err := headersDec.DecodeByteString()
+			require.NoError(t, err)
+			value, err := headersDec.DecodeByteString()
+			require.NoError(t, err)
+			exchange.headers[string(name)] = []string{string(value)}
+		}
+		exchanges[url] = exchange
+	}
+	return primary, exchanges
+}
+
+func TestWriteWebBundle(t *testing.T) {
+	var bundle bytes.Buffer
+	require.NoError(t, writeWebBundle(&bundle, []*bundledExchange{
+		{"https://example.com/amp.html", 200, http.Header{"Content-Type": {"text/html"}}, []byte("<html amp>")},
+		{"https://example.com/style.css", 200, http.Header{"Content-Type": {"text/css"}, "Cache-Control": {"max-age=60", "public"}}, []byte("body {}")},
+	}))
+	primary, exchanges := readWebBundle(t, bundle.Bytes())
+	assert.Equal(t, "https://example.com/amp.html", primary)
+	require.Len(t, exchanges, 2)
+	assert.Equal(t, http.Header{":status": {"200"}, "content-type": {"text/html"}}, exchanges["https://example.com/amp.html"].headers)
+	assert.Equal(t, []byte("<html amp>"), exchanges["https://example.com/amp.html"].body)
+	assert.Equal(t, http.Header{":status": {"200"}, "content-type": {"text/css"}, "cache-control": {"max-age=60,public"}}, exchanges["https://example.com/style.css"].headers)
+	assert.Equal(t, []byte("body {}"), exchanges["https://example.com/style.css"].body)
+
+	assert.Error(t, writeWebBundle(&bundle, nil))
+}
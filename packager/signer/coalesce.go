@@ -0,0 +1,145 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// The number of fetches that shared the response of an identical fetch in
+// flight, rather than fetching it themselves, by URLSet.
+var coalescedFetches = expvar.NewMap("amppkg_coalesced_fetches")
+
+// Coalesces concurrent identical fetches; see Signer.CoalesceFetches.
+type fetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*fetchCall
+}
+
+// A fetch in flight. Its result is set before done is closed.
+type fetchCall struct {
+	done chan struct{}
+	// The number of identical fetches waiting on it. Guarded by
+	// fetchGroup.mu.
+	waiters int
+	// A copy of the response, without its body, or nil if it can't be
+	// shared.
+	resp    *http.Response
+	body    []byte
+	httpErr *util.HTTPError
+}
+
+func newFetchGroup() *fetchGroup {
+	return &fetchGroup{calls: map[string]*fetchCall{}}
+}
+
+// Identifies the fetch by everything sent to the origin, except the request
+// ID, and by the URLSet whose settings apply to it.
+func fetchKey(req *http.Request, urlSet *util.URLSet) string {
+	var key strings.Builder
+	fmt.Fprintf(&key, "%p %s %s\n", urlSet, req.URL, req.Host)
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		if name != http.CanonicalHeaderKey(util.RequestIDHeader) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&key, "%s: %q\n", name, req.Header[name])
+	}
+	return key.String()
+}
+
+// Calls send, unless an identical fetch is in flight, in which case it waits
+// for that one and returns a copy of its response, or its error. Responses
+// whose bodies are longer than urlSet allows aren't shared, nor are errors
+// due to the sender's request having ended; those waiting on them call send
+// themselves.
+func (this *fetchGroup) do(req *http.Request, serveHTTPReq *http.Request, urlSet *util.URLSet, send func() (*http.Response, *util.HTTPError)) (*http.Response, *util.HTTPError) {
+	key := fetchKey(req, urlSet)
+	this.mu.Lock()
+	if call, ok := this.calls[key]; ok {
+		call.waiters++
+		this.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-serveHTTPReq.Context().Done():
+			return nil, util.NewHTTPError(http.StatusBadGateway, "Error fetching: ", serveHTTPReq.Context().Err(), " while waiting for an identical fetch")
+		}
+		if call.resp == nil && call.httpErr == nil {
+			return send()
+		}
+		coalescedFetches.Add(urlSetLabel(urlSet), 1)
+		if call.httpErr != nil {
+			return nil, call.httpErr
+		}
+		return call.share(), nil
+	}
+	call := &fetchCall{done: make(chan struct{})}
+	this.calls[key] = call
+	this.mu.Unlock()
+	defer func() {
+		this.mu.Lock()
+		delete(this.calls, key)
+		waiters := call.waiters
+		this.mu.Unlock()
+		close(call.done)
+		if waiters > 0 {
+			log.Printf("%d identical fetches waited on the fetch of %q.\n", waiters, req.URL)
+		}
+	}()
+
+	resp, httpErr := send()
+	if httpErr != nil {
+		if serveHTTPReq.Context().Err() == nil {
+			call.httpErr = httpErr
+		}
+		return nil, httpErr
+	}
+	body := newBodyReader(resp)
+	within, err := body.readWithin(bodyLimit(urlSet))
+	if err != nil || !within {
+		// Leave the rest, or the error, for the sender to read.
+		resp.Body = decodedBody{io.MultiReader(bytes.NewReader(body.body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	// Releases any FetchConcurrency slot.
+	resp.Body.Close()
+	shared := *resp
+	shared.Header = resp.Header.Clone()
+	shared.Body = nil
+	call.resp, call.body = &shared, body.body
+	return call.share(), nil
+}
+
+// Returns a copy of the shared response, with its own header and body.
+func (this *fetchCall) share() *http.Response {
+	resp := *this.resp
+	resp.Header = this.resp.Header.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(this.body))
+	return &resp
+}
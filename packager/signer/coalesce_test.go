@@ -0,0 +1,146 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCoalescedRequest(t *testing.T, id string) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/amp.html", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Language", "en")
+	req.Header.Set(util.RequestIDHeader, id)
+	return req
+}
+
+func TestFetchKey(t *testing.T) {
+	urlSet, otherURLSet := &util.URLSet{Sign: &util.URLPattern{Domain: "example.com"}}, &util.URLSet{Sign: &util.URLPattern{Domain: "example.com"}}
+	req := newCoalescedRequest(t, "1")
+	assert.Equal(t, fetchKey(req, urlSet), fetchKey(newCoalescedRequest(t, "2"), urlSet))
+	assert.NotEqual(t, fetchKey(req, urlSet), fetchKey(req, otherURLSet))
+	other := newCoalescedRequest(t, "1")
+	other.Header.Set("Accept-Language", "fr")
+	assert.NotEqual(t, fetchKey(req, urlSet), fetchKey(other, urlSet))
+	other = newCoalescedRequest(t, "1")
+	other.Host = "www.example.com"
+	assert.NotEqual(t, fetchKey(req, urlSet), fetchKey(other, urlSet))
+}
+
+// Calls group.do with req in the background, and waits until it's sending
+// its fetch or waiting on an identical one. Its response or error is sent on
+// the returned channel.
+func startFetch(group *fetchGroup, req *http.Request, urlSet *util.URLSet, send func() (*http.Response, *util.HTTPError)) chan interface{} {
+	key := fetchKey(req, urlSet)
+	started := func() (bool, int) {
+		group.mu.Lock()
+		defer group.mu.Unlock()
+		call, ok := group.calls[key]
+		if !ok {
+			return false, 0
+		}
+		return true, call.waiters
+	}
+	inFlight, waiters := started()
+	result := make(chan interface{}, 1)
+	go func() {
+		resp, httpErr := group.do(req, req, urlSet, send)
+		if httpErr != nil {
+			result <- httpErr
+		} else {
+			result <- resp
+		}
+	}()
+	for {
+		ok, nowWaiting := started()
+		if ok && (!inFlight || nowWaiting > waiters) {
+			return result
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestFetchGroup(t *testing.T) {
+	group := newFetchGroup()
+	urlSet := &util.URLSet{Sign: &util.URLPattern{Domain: "example.com"}, MaxBodyLength: 4}
+	sends := 0
+	// Returns a send func that waits for proceed before responding.
+	sender := func(proceed chan struct{}, body string, httpErr *util.HTTPError) func() (*http.Response, *util.HTTPError) {
+		return func() (*http.Response, *util.HTTPError) {
+			sends++
+			<-proceed
+			if httpErr != nil {
+				return nil, httpErr
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/html"}}, ContentLength: -1, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+		}
+	}
+	fail := func() (*http.Response, *util.HTTPError) {
+		t.Error("unexpected fetch")
+		return nil, util.NewHTTPError(http.StatusInternalServerError, "unexpected fetch")
+	}
+	// Identical fetches share the response, each with its own copy.
+	proceed := make(chan struct{})
+	leader := startFetch(group, newCoalescedRequest(t, "1"), urlSet, sender(proceed, "body", nil))
+	follower := startFetch(group, newCoalescedRequest(t, "2"), urlSet, fail)
+	close(proceed)
+	for _, result := range []chan interface{}{leader, follower} {
+		resp, ok := (<-result).(*http.Response)
+		require.True(t, ok)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "body", string(body))
+		resp.Header.Set("Content-Type", "text/plain")
+	}
+	assert.Equal(t, 1, sends)
+	assert.Empty(t, group.calls)
+
+	// As do their errors.
+	sends = 0
+	proceed = make(chan struct{})
+	originDown := util.NewHTTPError(http.StatusBadGateway, "origin down")
+	leader = startFetch(group, newCoalescedRequest(t, "1"), urlSet, sender(proceed, "", originDown))
+	follower = startFetch(group, newCoalescedRequest(t, "2"), urlSet, fail)
+	close(proceed)
+	for _, result := range []chan interface{}{leader, follower} {
+		assert.Equal(t, originDown, <-result)
+	}
+	assert.Equal(t, 1, sends)
+
+	// Bodies longer than MaxBodyLength aren't shared; the sender reads all
+	// of it, and the others fetch it themselves.
+	sends = 0
+	proceed = make(chan struct{})
+	leader = startFetch(group, newCoalescedRequest(t, "1"), urlSet, sender(proceed, "longer body", nil))
+	follower = startFetch(group, newCoalescedRequest(t, "2"), urlSet, sender(proceed, "longer body", nil))
+	close(proceed)
+	for _, result := range []chan interface{}{leader, follower} {
+		resp, ok := (<-result).(*http.Response)
+		require.True(t, ok)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "longer body", string(body))
+	}
+	assert.Equal(t, 2, sends)
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+)
+
+// The Accept-Encoding sent on fetches: the content codings that
+// decodeContentEncoding can undo. Setting it explicitly disables the
+// transport's own gzip handling, which doesn't check the body.
+const fetchAcceptEncoding = "gzip, deflate, br"
+
+// The leading bytes of gzip and zlib (HTTP's "deflate") streams, per
+// https://tools.ietf.org/html/rfc1952#section-2.3.1 and
+// https://tools.ietf.org/html/rfc1950#section-2.2. zlib's second byte varies,
+// but these cover the default window size at every compression level.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zlibMagics = [][]byte{{0x78, 0x01}, {0x78, 0x5e}, {0x78, 0x9c}, {0x78, 0xda}}
+)
+
+// A body that decodes one stream while closing the underlying one.
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Replaces resp.Body with its decoded form, if it has a Content-Encoding that
+// fetchAcceptEncoding lists, and removes the headers describing the encoded
+// form. The body must start as the coding requires. Textual bodies without a
+// Content-Encoding mustn't look compressed, lest they be signed as text.
+// Other codings are left for validateFetch to reject.
+func decodeContentEncoding(resp *http.Response) error {
+	body := bufio.NewReader(resp.Body)
+	// Peek errors, such as on an empty body, leave prefix short.
+	prefix, _ := body.Peek(2)
+	coding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	var decoded io.Reader
+	switch {
+	case len(prefix) == 0:
+		// Nothing to decode, e.g. for a 304, whose headers describe the
+		// representation it omits.
+	case coding == "":
+		if isTextual(resp.Header.Get("Content-Type")) && looksCompressed(prefix) {
+			return errors.New("body looks compressed, but has no Content-Encoding")
+		}
+	case coding == "gzip", coding == "x-gzip":
+		if !bytes.Equal(prefix, gzipMagic) {
+			return errors.Errorf("body doesn't match Content-Encoding %s", coding)
+		}
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return errors.Wrapf(err, "decoding Content-Encoding %s", coding)
+		}
+		decoded = gz
+	case coding == "deflate":
+		if !hasZlibMagic(prefix) {
+			return errors.Errorf("body doesn't match Content-Encoding %s", coding)
+		}
+		z, err := zlib.NewReader(body)
+		if err != nil {
+			return errors.Wrapf(err, "decoding Content-Encoding %s", coding)
+		}
+		decoded = z
+	case coding == "br":
+		// Brotli streams have no magic number, so a mislabeled body
+		// instead fails to decode as it's read.
+		decoded = brotli.NewReader(body)
+	}
+	if decoded == nil {
+		resp.Body = decodedBody{body, resp.Body}
+		return nil
+	}
+	resp.Body = decodedBody{decoded, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+func hasZlibMagic(prefix []byte) bool {
+	for _, magic := range zlibMagics {
+		if bytes.Equal(prefix, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// True if the prefix matches a gzip or zlib stream, except for zlib's "x^",
+// which plain text may well start with.
+func looksCompressed(prefix []byte) bool {
+	return bytes.Equal(prefix, gzipMagic) || (hasZlibMagic(prefix) && prefix[1] != '^')
+}
+
+// True if the media type is text, for which a compressed-looking body is
+// surely mislabeled. AMP documents are text/html.
+func isTextual(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.HasPrefix(mediaType, "text/")
+}
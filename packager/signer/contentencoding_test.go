@@ -0,0 +1,77 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodedResponse(header http.Header, body []byte) *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(bytes.NewReader(body)), ContentLength: int64(len(body))}
+}
+
+func TestDecodeContentEncoding(t *testing.T) {
+	html := []byte("<html amp><body>hello</body></html>")
+	var gzipped, deflated bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(html)
+	require.NoError(t, gz.Close())
+	z := zlib.NewWriter(&deflated)
+	z.Write(html)
+	require.NoError(t, z.Close())
+	var brotlied bytes.Buffer
+	br := brotli.NewWriter(&brotlied)
+	br.Write(html)
+	require.NoError(t, br.Close())
+
+	for coding, body := range map[string][]byte{"": html, "gzip": gzipped.Bytes(), "x-gzip": gzipped.Bytes(), "deflate": deflated.Bytes(), "br": brotlied.Bytes()} {
+		resp := encodedResponse(http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {coding}}, body)
+		require.NoError(t, decodeContentEncoding(resp), coding)
+		decoded, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err, coding)
+		assert.Equal(t, html, decoded, coding)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"), coding)
+	}
+
+	// Unsupported codings are left as-is.
+	resp := encodedResponse(http.Header{"Content-Encoding": {"zstd"}}, []byte("zstd"))
+	require.NoError(t, decodeContentEncoding(resp))
+	assert.Equal(t, "zstd", resp.Header.Get("Content-Encoding"))
+
+	// As are empty bodies.
+	resp = encodedResponse(http.Header{"Content-Encoding": {"gzip"}}, nil)
+	require.NoError(t, decodeContentEncoding(resp))
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	assert.EqualError(t, decodeContentEncoding(encodedResponse(http.Header{"Content-Encoding": {"gzip"}}, html)), "body doesn't match Content-Encoding gzip")
+	assert.EqualError(t, decodeContentEncoding(encodedResponse(http.Header{"Content-Encoding": {"deflate"}}, gzipped.Bytes())), "body doesn't match Content-Encoding deflate")
+	assert.EqualError(t, decodeContentEncoding(encodedResponse(http.Header{"Content-Type": {"text/html"}}, gzipped.Bytes())), "body looks compressed, but has no Content-Encoding")
+	// Mislabeled brotli fails as it's read.
+	resp = encodedResponse(http.Header{"Content-Encoding": {"br"}}, html)
+	require.NoError(t, decodeContentEncoding(resp))
+	_, err := ioutil.ReadAll(resp.Body)
+	assert.Error(t, err)
+	// Binary types may legitimately be compressed.
+	assert.NoError(t, decodeContentEncoding(encodedResponse(http.Header{"Content-Type": {"application/gzip"}}, gzipped.Bytes())))
+}
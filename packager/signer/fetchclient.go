@@ -0,0 +1,323 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// The connections that fetches used, by whether they were "reused" from the
+// pool or "new".
+var fetchConnections = expvar.NewMap("amppkg_fetch_connections")
+
+// The TLS handshakes of new fetch connections, by whether they "resumed" a
+// cached session or were "full".
+var fetchTLSHandshakes = expvar.NewMap("amppkg_fetch_tls_handshakes")
+
+// Returns a transport for fetches, with http.DefaultTransport's settings, but
+// the connection pool and TLS session cache of pool, and reading at most
+// maxHeaderBytes of each response's headers.
+func newPooledTransport(pool util.FetchPool, maxHeaderBytes int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxResponseHeaderBytes = int64(maxHeaderBytes)
+	transport.MaxIdleConns = pool.MaxIdleConns
+	transport.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = pool.IdleConnTimeout
+	transport.TLSClientConfig = &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(pool.TLSSessionCacheSize),
+	}
+	return transport
+}
+
+// Returns req, recording its connections in fetchConnections and
+// fetchTLSHandshakes.
+func withConnectionMetrics(req *http.Request) *http.Request {
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				fetchConnections.Add("reused", 1)
+			} else {
+				fetchConnections.Add("new", 1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			if state.DidResume {
+				fetchTLSHandshakes.Add("resumed", 1)
+			} else {
+				fetchTLSHandshakes.Add("full", 1)
+			}
+		},
+	}))
+}
+
+// The settings that distinguish the transports of URLSets.
+type transportKey struct {
+	proxy    string
+	backend  string
+	timeouts util.FetchTimeouts
+	http2    util.FetchHTTP2Config
+	tls      util.FetchTLSConfig
+}
+
+// Transports for URLSets that set a FetchProxy, FetchBackend, FetchTimeouts,
+// FetchHTTP2, or FetchTLS, or for all URLSets under BlockPrivateFetches or
+// ResolveFetchHosts, by their settings, so that URLSets with the same settings share connections.
+// Each is built on first use, from the transport of the Signer's client.
+type fetchTransports struct {
+	mu    sync.Mutex
+	byKey map[transportKey]http.RoundTripper
+}
+
+func newFetchTransports() *fetchTransports {
+	return &fetchTransports{byKey: map[transportKey]http.RoundTripper{}}
+}
+
+// Bounds the requests in flight to each host, per
+// FetchHTTP2.MaxConcurrentStreams, with slots from hosts. Each holds its slot
+// until its response body is read to the end or closed.
+type streamLimiter struct {
+	transport http.RoundTripper
+	max       int
+	hosts     *fetchLimiter
+}
+
+func newStreamLimiter(transport http.RoundTripper, max int, hosts *fetchLimiter) *streamLimiter {
+	return &streamLimiter{transport, max, hosts}
+}
+
+func (this *streamLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := this.hosts.wait(req.Context(), slotKey{req.URL.Host, this.max, true}, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := this.transport.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = slotBody{resp.Body, release}
+	return resp, nil
+}
+
+// Returns a copy of base, or an empty config if nil, with the settings of
+// fetchTLS.
+func fetchTLSConfig(fetchTLS *util.FetchTLSConfig, base *tls.Config) (*tls.Config, error) {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	if fetchTLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(fetchTLS.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading CAFile")
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certs in CAFile %s", fetchTLS.CAFile)
+		}
+		config.RootCAs = roots
+	}
+	if fetchTLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(fetchTLS.CertFile, fetchTLS.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading CertFile and KeyFile")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	config.InsecureSkipVerify = fetchTLS.InsecureSkipVerify
+	return config, nil
+}
+
+// Configures transport to speak only HTTP/1.1.
+func disableHTTP2(transport *http.Transport) {
+	transport.ForceAttemptHTTP2 = false
+	// A non-nil, empty TLSNextProto disables HTTP/2 via ALPN.
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if transport.TLSClientConfig != nil {
+		var protos []string
+		for _, proto := range transport.TLSClientConfig.NextProtos {
+			if proto != "h2" {
+				protos = append(protos, proto)
+			}
+		}
+		transport.TLSClientConfig.NextProtos = protos
+	}
+}
+
+// Sends each request with the scheme of backend, via a transport that dials
+// backend for every host, so that the URL's host is kept for the Host header
+// and for verifying an https backend's cert.
+type backendTransport struct {
+	transport http.RoundTripper
+	scheme    string
+}
+
+func (this backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == this.scheme {
+		return this.transport.RoundTrip(req)
+	}
+	backendReq := req.Clone(req.Context())
+	backendReq.URL.Scheme = this.scheme
+	resp, err := this.transport.RoundTrip(backendReq)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// Returns the network and address to dial for the backend, and the scheme of
+// requests to it. A unix: backend is spoken to in plain HTTP. Otherwise, the
+// address is host:port, with the scheme's default port if unset.
+func backendAddr(backend *url.URL) (network, addr, scheme string) {
+	if backend.Scheme == util.UnixFetchBackendScheme {
+		return "unix", backend.Path, "http"
+	}
+	port := backend.Port()
+	if port == "" {
+		port = "80"
+		if backend.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return "tcp", net.JoinHostPort(backend.Hostname(), port), backend.Scheme
+}
+
+// Returns the client with which to fetch for urlSet: a copy of this.client,
+// via urlSet.FetchProxy or FetchBackend and with urlSet.FetchTimeouts,
+// FetchHTTP2, and FetchTLS, if set, refusing private addresses under
+// BlockPrivateFetches, and resolving hosts per ResolveFetchHosts.
+func (this *Signer) fetchClient(urlSet *util.URLSet) (http.Client, error) {
+	client := *this.client
+	if urlSet.FetchProxy == "" && urlSet.FetchBackend == "" && urlSet.FetchTimeouts == nil && urlSet.FetchHTTP2 == nil && urlSet.FetchTLS == nil && this.privateFetches == nil && this.resolver == nil {
+		return client, nil
+	}
+	key := transportKey{proxy: urlSet.FetchProxy, backend: urlSet.FetchBackend}
+	var backend *url.URL
+	if key.backend != "" {
+		var err error
+		if backend, err = url.Parse(key.backend); err != nil {
+			return client, errors.Wrap(err, "parsing FetchBackend")
+		}
+		key.proxy = util.DirectFetchProxy
+	}
+	if urlSet.FetchTimeouts != nil {
+		key.timeouts = urlSet.FetchTimeoutDurations()
+		client.Timeout = key.timeouts.Total
+	}
+	if urlSet.FetchHTTP2 != nil {
+		key.http2 = *urlSet.FetchHTTP2
+	}
+	if urlSet.FetchTLS != nil {
+		key.tls = *urlSet.FetchTLS
+	}
+	this.transports.mu.Lock()
+	defer this.transports.mu.Unlock()
+	roundTripper, ok := this.transports.byKey[key]
+	if !ok {
+		base := client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		baseTransport, ok := base.(*http.Transport)
+		if !ok {
+			return client, errors.Errorf("can't configure fetches on a %T", base)
+		}
+		transport := baseTransport.Clone()
+		if urlSet.FetchTLS != nil {
+			tlsConfig, err := fetchTLSConfig(&key.tls, transport.TLSClientConfig)
+			if err != nil {
+				return client, errors.Wrap(err, "configuring FetchTLS")
+			}
+			transport.TLSClientConfig = tlsConfig
+		}
+		switch key.proxy {
+		case "":
+		case util.DirectFetchProxy:
+			transport.Proxy = nil
+		default:
+			proxyURL, err := url.Parse(key.proxy)
+			if err != nil {
+				return client, errors.Wrap(err, "parsing FetchProxy")
+			}
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+		dialer := &net.Dialer{
+			Timeout:   util.DefaultFetchTimeouts.Dial,
+			KeepAlive: 30 * time.Second,
+		}
+		if urlSet.FetchTimeouts != nil {
+			dialer.Timeout = key.timeouts.Dial
+			transport.TLSHandshakeTimeout = key.timeouts.TLSHandshake
+			transport.ResponseHeaderTimeout = key.timeouts.ResponseHeader
+		}
+		dial := dialer.DialContext
+		if this.resolver != nil {
+			dial = this.resolver.dialContext(dial)
+		}
+		if this.privateFetches != nil && backend == nil {
+			guarded := *dialer
+			guarded.Control = this.privateFetches.control
+			guardedDial := guarded.DialContext
+			if this.resolver != nil {
+				guardedDial = this.resolver.dialContext(guardedDial)
+			}
+			dial = this.privateFetches.dialContext(guardedDial, dial)
+			if transport.Proxy != nil {
+				transport.Proxy = this.privateFetches.proxy(transport.Proxy, this.resolver)
+			}
+		}
+		transport.DialContext = dial
+		if backend != nil {
+			network, addr, _ := backendAddr(backend)
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			}
+		}
+		if key.http2.Disable {
+			disableHTTP2(transport)
+		}
+		roundTripper = transport
+		if key.http2.MaxConcurrentStreams > 0 {
+			roundTripper = newStreamLimiter(transport, key.http2.MaxConcurrentStreams, this.fetchSlots)
+		}
+		this.transports.byKey[key] = roundTripper
+	}
+	if backend != nil {
+		_, _, scheme := backendAddr(backend)
+		client.Transport = backendTransport{roundTripper, scheme}
+	} else {
+		client.Transport = roundTripper
+	}
+	return client, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Records the most requests in flight at once, each until its body is closed.
+type concurrencyRecorder struct {
+	mu             sync.Mutex
+	inFlight, most int
+}
+
+func (this *concurrencyRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.inFlight++
+	if this.inFlight > this.most {
+		this.most = this.inFlight
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: &recordedBody{Reader: strings.NewReader("body"), recorder: this}}, nil
+}
+
+type recordedBody struct {
+	io.Reader
+	recorder *concurrencyRecorder
+	closed   bool
+}
+
+func (this *recordedBody) Close() error {
+	this.recorder.mu.Lock()
+	defer this.recorder.mu.Unlock()
+	if !this.closed {
+		this.recorder.inFlight--
+		this.closed = true
+	}
+	return nil
+}
+
+func TestStreamLimiter(t *testing.T) {
+	recorder := &concurrencyRecorder{}
+	limiter := newStreamLimiter(recorder, 2, newFetchLimiter())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		host := "a.example"
+		if i%2 == 1 {
+			host = "b.example"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "https://"+host+"/", nil)
+			resp, err := limiter.RoundTrip(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			resp.Body.Close()
+			// Closing again mustn't release another slot.
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	// Two per host.
+	assert.True(t, recorder.most <= 4, "%d in flight", recorder.most)
+	assert.Equal(t, 0, recorder.inFlight)
+	for _, slots := range limiter.hosts.byKey {
+		assert.Len(t, slots, 0)
+	}
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	var protos []int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		protos = append(protos, req.ProtoMajor)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	transport := server.Client().Transport.(*http.Transport)
+	h1 := transport.Clone()
+	disableHTTP2(h1)
+	for _, roundTripper := range []http.RoundTripper{transport, h1} {
+		resp, err := (&http.Client{Transport: roundTripper}).Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.Equal(t, []int{2, 1}, protos)
+}
+
+func TestNewPooledTransport(t *testing.T) {
+	transport := newPooledTransport(util.FetchPool{MaxIdleConns: 10, MaxIdleConnsPerHost: 5, IdleConnTimeout: time.Minute, TLSSessionCacheSize: 8}, 1024)
+	assert.Equal(t, 10, transport.MaxIdleConns)
+	assert.Equal(t, 5, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+	assert.EqualValues(t, 1024, transport.MaxResponseHeaderBytes)
+	assert.NotNil(t, transport.TLSClientConfig.ClientSessionCache)
+	assert.NotNil(t, transport.Proxy, "should keep http.DefaultTransport's settings")
+}
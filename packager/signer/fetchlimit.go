@@ -0,0 +1,116 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+var errFetchQueueTimeout = errors.New("no fetch slot freed up within FetchConcurrency.QueueTimeout")
+
+// The number of fetches refused for want of a slot (see
+// URLSet.FetchConcurrency), by host.
+var fetchConcurrencyRefused = expvar.NewMap("amppkg_fetch_concurrency_refused")
+
+// Bounds the requests in flight to each host: fetches, per
+// URLSet.FetchConcurrency, and the streams of transports, per
+// FetchHTTP2.MaxConcurrentStreams (see streamLimiter).
+type fetchLimiter struct {
+	mu    sync.Mutex
+	byKey map[slotKey]chan struct{}
+}
+
+// Identifies the slots for one limit on a host. Limits of different sizes on
+// the same host have their own slots, so that each URLSet gets the bound it
+// configured, rather than that of whichever fetched from the host first.
+type slotKey struct {
+	host string
+	max  int
+	// True for streamLimiter's slots, which a fetch takes while holding one
+	// of FetchConcurrency's, so they mustn't be the same.
+	streams bool
+}
+
+func newFetchLimiter() *fetchLimiter {
+	return &fetchLimiter{byKey: map[slotKey]chan struct{}{}}
+}
+
+func (this *fetchLimiter) slots(key slotKey) chan struct{} {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	slots, ok := this.byKey[key]
+	if !ok {
+		slots = make(chan struct{}, key.max)
+		this.byKey[key] = slots
+	}
+	return slots
+}
+
+// Waits up to config's QueueTimeout for a slot to fetch from host, and returns
+// a func that releases it, which may be called more than once. Returns
+// errFetchQueueTimeout if none frees up in time, or ctx's error if it's done
+// first.
+func (this *fetchLimiter) acquire(ctx context.Context, host string, config *util.FetchConcurrencyConfig) (func(), error) {
+	timer := time.NewTimer(config.QueueTimeoutDuration())
+	defer timer.Stop()
+	return this.wait(ctx, slotKey{host, config.Max, false}, timer.C)
+}
+
+// Like acquire, but for one of the slots for key, giving up when timeout
+// fires. A nil timeout waits as long as ctx allows.
+func (this *fetchLimiter) wait(ctx context.Context, key slotKey, timeout <-chan time.Time) (func(), error) {
+	slots := this.slots(key)
+	select {
+	case slots <- struct{}{}:
+	default:
+		select {
+		case slots <- struct{}{}:
+		case <-timeout:
+			return nil, errFetchQueueTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
+
+// A response body that releases its fetchLimiter slot once read to the end or
+// closed, so that a document's slot isn't held while it's signed.
+type slotBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (this slotBody) Read(p []byte) (int, error) {
+	n, err := this.ReadCloser.Read(p)
+	if err == io.EOF {
+		this.release()
+	}
+	return n, err
+}
+
+func (this slotBody) Close() error {
+	err := this.ReadCloser.Close()
+	this.release()
+	return err
+}
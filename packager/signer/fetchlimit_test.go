@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchLimiter(t *testing.T) {
+	limiter := newFetchLimiter()
+	config := &util.FetchConcurrencyConfig{Max: 1, QueueTimeout: "1h"}
+	release, err := limiter.acquire(context.Background(), "a.example", config)
+	require.NoError(t, err)
+
+	// Other hosts have their own slots.
+	other, err := limiter.acquire(context.Background(), "b.example", config)
+	require.NoError(t, err)
+	other()
+	// As do other limits on the same host, and streams.
+	other, err = limiter.acquire(context.Background(), "a.example", &util.FetchConcurrencyConfig{Max: 2, QueueTimeout: "0s"})
+	require.NoError(t, err)
+	other()
+	other, err = limiter.wait(context.Background(), slotKey{"a.example", 1, true}, nil)
+	require.NoError(t, err)
+	other()
+
+	// The next waits for the slot.
+	acquired := make(chan func())
+	go func() {
+		release, err := limiter.acquire(context.Background(), "a.example", config)
+		if err == nil {
+			acquired <- release
+		}
+	}()
+	// Releasing twice frees only one slot.
+	release()
+	release()
+	waiter := <-acquired
+	assert.Len(t, limiter.byKey[slotKey{"a.example", 1, false}], 1)
+
+	// Waiting ends after QueueTimeout, or with the request.
+	_, err = limiter.acquire(context.Background(), "a.example", &util.FetchConcurrencyConfig{Max: 1, QueueTimeout: "0s"})
+	assert.Equal(t, errFetchQueueTimeout, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = limiter.acquire(ctx, "a.example", config)
+	assert.Equal(t, context.Canceled, err)
+
+	waiter()
+	assert.Len(t, limiter.byKey[slotKey{"a.example", 1, false}], 0)
+}
+
+func TestSlotBody(t *testing.T) {
+	released := 0
+	body := slotBody{ioutil.NopCloser(strings.NewReader("body")), func() { released++ }}
+	buf := make([]byte, 4)
+	_, err := body.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, 0, released)
+	_, err = ioutil.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, 1, released)
+
+	released = 0
+	body = slotBody{ioutil.NopCloser(strings.NewReader("body")), func() { released++ }}
+	require.NoError(t, body.Close())
+	assert.Equal(t, 1, released)
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// The number of signed exchanges that dropped origin headers to fit within
+// URLSet.MaxSignedHeaders or MaxSignedHeaderBytes, by URLSet.
+var trimmedSignedHeaders = expvar.NewMap("amppkg_trimmed_signed_headers")
+
+// The headers that serveSignedExchange sets itself, besides the MI digest,
+// which limitSignedHeaders never drops.
+var packagerSetHeaders = map[string]bool{
+	"Content-Encoding":        true,
+	"Content-Length":          true,
+	"Content-Security-Policy": true,
+	"Link":                    true,
+	"X-Content-Type-Options":  true,
+}
+
+// Part of the error that http.Transport returns for responses with more than
+// its MaxResponseHeaderBytes of headers, which it doesn't export.
+const fetchHeadersExceeded = "server response headers exceeded"
+
+// True if err is from a fetch whose response had more than
+// Signer.maxFetchHeaderBytes of headers.
+func isFetchHeaderOverflow(err error) bool {
+	return err != nil && strings.Contains(err.Error(), fetchHeadersExceeded)
+}
+
+// The number of header fields, as counted against Signer.maxFetchHeaders: one
+// per value, as each is sent on its own line.
+func countHeaderFields(header http.Header) int {
+	count := 0
+	for _, values := range header {
+		count += len(values)
+	}
+	return count
+}
+
+// The bytes of the header's name and values, as counted against
+// URLSet.MaxSignedHeaderBytes.
+func signedHeaderSize(name string, values []string) int {
+	size := 0
+	for _, value := range values {
+		size += len(name) + len(value)
+	}
+	return size
+}
+
+// Checks the headers to be signed against urlSet's MaxSignedHeaders and
+// MaxSignedHeaderBytes. If they're over, and urlSet.TrimSignedHeaders is set,
+// drops origin headers, largest first, until they're within both. Neither
+// the packager's own headers nor digestHeader are dropped. Returns true if
+// any were dropped, or an error if they're still over.
+func limitSignedHeaders(header http.Header, urlSet *util.URLSet, digestHeader string) (bool, error) {
+	count, size := len(header), 0
+	for name, values := range header {
+		size += signedHeaderSize(name, values)
+	}
+	within := func() bool {
+		return (urlSet.MaxSignedHeaders == 0 || count <= urlSet.MaxSignedHeaders) &&
+			(urlSet.MaxSignedHeaderBytes == 0 || size <= urlSet.MaxSignedHeaderBytes)
+	}
+	if within() {
+		return false, nil
+	}
+	trimmed := false
+	if urlSet.TrimSignedHeaders {
+		var trimmable []string
+		for name := range header {
+			if !alwaysSignedHeaders[name] && !packagerSetHeaders[name] && name != digestHeader {
+				trimmable = append(trimmable, name)
+			}
+		}
+		sort.Slice(trimmable, func(i, j int) bool {
+			sizeI, sizeJ := signedHeaderSize(trimmable[i], header[trimmable[i]]), signedHeaderSize(trimmable[j], header[trimmable[j]])
+			if sizeI != sizeJ {
+				return sizeI > sizeJ
+			}
+			return trimmable[i] < trimmable[j]
+		})
+		for _, name := range trimmable {
+			if within() {
+				break
+			}
+			count--
+			size -= signedHeaderSize(name, header[name])
+			header.Del(name)
+			trimmed = true
+		}
+	}
+	if !within() {
+		return trimmed, errors.Errorf("the %d signed headers, totaling %d bytes, are over MaxSignedHeaders of %d or MaxSignedHeaderBytes of %d", count, size, urlSet.MaxSignedHeaders, urlSet.MaxSignedHeaderBytes)
+	}
+	return trimmed, nil
+}
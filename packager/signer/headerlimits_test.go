@@ -0,0 +1,91 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func signedHeadersForTest() http.Header {
+	return http.Header{
+		"Content-Type":   {"text/html"},
+		"Content-Length": {"100"},
+		"Digest":         {"mi-sha256-03=abc"},
+		"Cache-Control":  {"max-age=60"},
+		"X-Big":          {"0123456789012345678901234567890123456789"},
+	}
+}
+
+func TestLimitSignedHeaders(t *testing.T) {
+	// No limits.
+	header := signedHeadersForTest()
+	trimmed, err := limitSignedHeaders(header, &util.URLSet{}, "Digest")
+	assert.NoError(t, err)
+	assert.False(t, trimmed)
+	assert.Equal(t, signedHeadersForTest(), header)
+
+	// Within the limits.
+	trimmed, err = limitSignedHeaders(header, &util.URLSet{MaxSignedHeaders: 5, MaxSignedHeaderBytes: 200}, "Digest")
+	assert.NoError(t, err)
+	assert.False(t, trimmed)
+
+	// Over, without trimming.
+	_, err = limitSignedHeaders(header, &util.URLSet{MaxSignedHeaders: 4}, "Digest")
+	assert.EqualError(t, err, "the 5 signed headers, totaling 128 bytes, are over MaxSignedHeaders of 4 or MaxSignedHeaderBytes of 0")
+	assert.Equal(t, signedHeadersForTest(), header)
+
+	// Over, trimming the largest origin header first.
+	trimmed, err = limitSignedHeaders(header, &util.URLSet{MaxSignedHeaders: 4, TrimSignedHeaders: true}, "Digest")
+	assert.NoError(t, err)
+	assert.True(t, trimmed)
+	assert.Empty(t, header.Get("X-Big"))
+	assert.Equal(t, "max-age=60", header.Get("Cache-Control"))
+
+	// Over, even after trimming all origin headers.
+	header = signedHeadersForTest()
+	trimmed, err = limitSignedHeaders(header, &util.URLSet{MaxSignedHeaderBytes: 50, TrimSignedHeaders: true}, "Digest")
+	assert.EqualError(t, err, "the 3 signed headers, totaling 60 bytes, are over MaxSignedHeaders of 0 or MaxSignedHeaderBytes of 50")
+	assert.True(t, trimmed)
+	assert.Equal(t, "text/html", header.Get("Content-Type"))
+	assert.Equal(t, "100", header.Get("Content-Length"))
+	assert.Equal(t, "mi-sha256-03=abc", header.Get("Digest"))
+}
+
+func TestCountHeaderFields(t *testing.T) {
+	assert.Equal(t, 0, countHeaderFields(http.Header{}))
+	assert.Equal(t, 3, countHeaderFields(http.Header{"Content-Type": {"text/html"}, "Set-Cookie": {"a=1", "b=2"}}))
+}
+
+// Pins the unexported net/http error that isFetchHeaderOverflow matches.
+func TestIsFetchHeaderOverflow(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("X-Big", strings.Repeat("x", 4096))
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{MaxResponseHeaderBytes: 1024}}
+	_, err := client.Get(server.URL)
+	if assert.Error(t, err) {
+		assert.True(t, isFetchHeaderOverflow(err), "%v", err)
+	}
+	assert.False(t, isFetchHeaderOverflow(errors.New("connection refused")))
+	assert.False(t, isFetchHeaderOverflow(nil))
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// How long a signed exchange may be served: from its date until the soonest
+// of the limits added to it. The signature's expires, the freshness lifetime
+// in its inner Cache-Control and Expires, and the expiry reported for re-sign
+// scheduling are all derived from it, so that they agree.
+type exchangeLifetime struct {
+	date    time.Time
+	expires time.Time
+}
+
+// Starts with the configured signature lifetime, which runs from date.
+func newExchangeLifetime(date time.Time, duration time.Duration) *exchangeLifetime {
+	return &exchangeLifetime{date, date.Add(duration)}
+}
+
+// Ends the lifetime at t, if that's sooner: e.g. the document's max age, the
+// origin TTL (per URLSet.ShortTTL), the cert's expiry, or its OCSP response's.
+func (this *exchangeLifetime) limit(t time.Time) {
+	if t.Before(this.expires) {
+		this.expires = t
+	}
+}
+
+// Matches the delta-seconds of freshness directives in Cache-Control, per
+// https://tools.ietf.org/html/rfc7234#section-5.2.2.8 and 5.2.2.9.
+var freshnessDirective = regexp.MustCompile(`(?i)(^|[\s,])(max-age|s-maxage)\s*=\s*"?(\d+)"?`)
+
+// Returns the Cache-Control value with any max-age and s-maxage lowered to at
+// most the lifetime remaining at now, so that caches of the inner response
+// don't consider it fresh after the signature expires.
+func (this *exchangeLifetime) capCacheControl(value string, now time.Time) string {
+	remaining := int64(this.expires.Sub(now) / time.Second)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return freshnessDirective.ReplaceAllStringFunc(value, func(directive string) string {
+		match := freshnessDirective.FindStringSubmatch(directive)
+		if secs, err := strconv.ParseInt(match[3], 10, 64); err == nil && secs <= remaining {
+			return directive
+		}
+		return match[1] + match[2] + "=" + strconv.FormatInt(remaining, 10)
+	})
+}
+
+// Returns the max-age of the SXG itself, as served at now: until
+// minSignatureLifetime before its signature expires, leaving caches time to
+// fetch a re-signed one, but no longer than the document's freshness lifetime
+// per cacheControl, its inner Cache-Control (s-maxage if any, else max-age, as
+// in originTTL, or none if no-cache), so that they update it as often as the
+// origin asked.
+func (this *exchangeLifetime) maxAge(cacheControl string, now time.Time) int64 {
+	maxAge := int64(this.expires.Sub(now.Add(minSignatureLifetime)) / time.Second)
+	if directives, err := cacheobject.ParseResponseCacheControl(cacheControl); err == nil {
+		freshness := directives.SMaxAge
+		if freshness < 0 {
+			freshness = directives.MaxAge
+		}
+		if directives.NoCachePresent {
+			freshness = 0
+		}
+		if freshness >= 0 && int64(freshness) < maxAge {
+			maxAge = int64(freshness)
+		}
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return maxAge
+}
+
+// Returns the Expires value, or if it's later than the lifetime's end, that
+// instead, so that caches of the inner response that go by Expires (i.e. when
+// Cache-Control has no max-age or s-maxage) don't consider it fresh after the
+// signature expires. Invalid values mean "already expired", per
+// https://tools.ietf.org/html/rfc7234#section-5.3, so they're kept as-is.
+func (this *exchangeLifetime) capExpires(value string) string {
+	expires, err := http.ParseTime(value)
+	if err != nil || !expires.After(this.expires) {
+		return value
+	}
+	return this.expires.UTC().Format(http.TimeFormat)
+}
+
+// Returns the time until which an SXG signed for this lifetime, with the given
+// (capped) inner Cache-Control, may be served again: while at least
+// minSignatureLifetime of the signature remains, and while a cache receiving
+// it wouldn't consider the inner response fresh after the signature expires.
+// Its freshness directives count from when a cache receives the SXG, not from
+// when it was signed, so an SXG whose freshness was capped to the whole
+// lifetime can't be reused at all.
+func (this *exchangeLifetime) reusableUntil(cacheControl string) time.Time {
+	reserve := minSignatureLifetime
+	for _, match := range freshnessDirective.FindAllStringSubmatch(cacheControl, -1) {
+		secs, err := strconv.ParseInt(match[3], 10, 64)
+		if err != nil || secs > int64(this.expires.Sub(this.date)/time.Second) {
+			// Fresh for the whole lifetime, or more.
+			return this.date
+		}
+		if freshness := time.Duration(secs) * time.Second; freshness > reserve {
+			reserve = freshness
+		}
+	}
+	return this.expires.Add(-reserve)
+}
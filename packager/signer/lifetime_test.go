@@ -0,0 +1,99 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangeLifetimeLimit(t *testing.T) {
+	date := time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := newExchangeLifetime(date, 7*24*time.Hour)
+	lifetime.limit(date.Add(48 * time.Hour))
+	lifetime.limit(date.Add(72 * time.Hour))
+	assert.Equal(t, date, lifetime.date)
+	assert.Equal(t, date.Add(48*time.Hour), lifetime.expires)
+}
+
+func TestCapCacheControl(t *testing.T) {
+	now := time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := newExchangeLifetime(now.Add(-24*time.Hour), 25*time.Hour)
+	for _, test := range []struct{ value, expected string }{
+		{"public, max-age=86400", "public, max-age=3600"},
+		{"max-age=60", "max-age=60"},
+		{"public, Max-Age=\"86400\", s-maxage=86400", "public, Max-Age=3600, s-maxage=3600"},
+		{"no-cache", "no-cache"},
+		{"private, x-max-age=86400", "private, x-max-age=86400"},
+		{"max-age=99999999999999999999", "max-age=3600"},
+	} {
+		assert.Equal(t, test.expected, lifetime.capCacheControl(test.value, now), test.value)
+	}
+
+	expired := newExchangeLifetime(now.Add(-24*time.Hour), time.Hour)
+	assert.Equal(t, "max-age=0", expired.capCacheControl("max-age=60", now))
+}
+
+func TestMaxAge(t *testing.T) {
+	now := time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := newExchangeLifetime(now.Add(-time.Hour), 25*time.Hour)
+	for _, test := range []struct {
+		value    string
+		expected int64
+	}{
+		{"", 23 * 3600},
+		{"public, max-age=86400", 23 * 3600},
+		{"max-age=60", 60},
+		{"max-age=60, s-maxage=600", 600},
+		{"no-cache, max-age=60", 0},
+	} {
+		assert.Equal(t, test.expected, lifetime.maxAge(test.value, now), test.value)
+	}
+
+	expiring := newExchangeLifetime(now.Add(-24*time.Hour), 24*time.Hour+30*time.Minute)
+	assert.Equal(t, int64(0), expiring.maxAge("max-age=60", now))
+}
+
+func TestCapExpires(t *testing.T) {
+	date := time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := newExchangeLifetime(date, 24*time.Hour)
+	for _, test := range []struct{ value, expected string }{
+		{"Wed, 01 Jul 2020 00:00:00 GMT", "Tue, 02 Jul 2019 00:00:00 GMT"},
+		{"Mon, 01 Jul 2019 12:00:00 GMT", "Mon, 01 Jul 2019 12:00:00 GMT"},
+		{"Tue, 02 Jul 2019 00:00:00 GMT", "Tue, 02 Jul 2019 00:00:00 GMT"},
+		{"0", "0"},
+	} {
+		assert.Equal(t, test.expected, lifetime.capExpires(test.value), test.value)
+	}
+}
+
+func TestReusableUntil(t *testing.T) {
+	date := time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := newExchangeLifetime(date, 24*time.Hour)
+	for _, test := range []struct {
+		value    string
+		expected time.Time
+	}{
+		{"", date.Add(23 * time.Hour)},
+		{"max-age=60", date.Add(23 * time.Hour)},
+		{"public, max-age=7200, s-maxage=36000", date.Add(14 * time.Hour)},
+		{"max-age=86400", date},
+		{"max-age=99999999999999999999", date},
+	} {
+		assert.Equal(t, test.expected, lifetime.reusableUntil(test.value), test.value)
+	}
+}
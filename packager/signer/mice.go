@@ -0,0 +1,133 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+)
+
+// A payload MI-encoded per
+// https://tools.ietf.org/html/draft-thomson-http-mice-03 (or -02, for SXG b1).
+// Unlike exchange.MiEncodePayload, it doesn't build an encoded copy of the
+// payload; it holds only the integrity proof of each record (32 bytes per
+// record), and interleaves them with the records as they're written.
+//
+// This isn't streaming signing: the proofs are computed from the last record
+// to the first, and the transformer needs the whole document, so the whole
+// payload is in memory before anything is written (see bodyReader). It only
+// saves the encoded copy, as the signature covers just the Digest header.
+type miPayload struct {
+	body       string
+	recordSize int
+	encoding   mice.Encoding
+	// proofs[i] is the integrity proof of body's ith record, and proofs[0]
+	// is the top-level proof, in the Digest header.
+	proofs [][sha256.Size]byte
+}
+
+// The memory held by the payload, approximately.
+func payloadSize(payload *miPayload) int {
+	return len(payload.body) + sha256.Size*len(payload.proofs)
+}
+
+// The MI encoding used by the given SXG version.
+func miEncoding(v version.Version) mice.Encoding {
+	if v == version.Version1b1 {
+		return mice.Draft02Encoding
+	}
+	return mice.Draft03Encoding
+}
+
+func newMIPayload(body string, recordSize int, encoding mice.Encoding) *miPayload {
+	numRecords := (len(body) + recordSize - 1) / recordSize
+	if numRecords == 0 && encoding == mice.Draft02Encoding {
+		// Draft 02 encodes an empty payload as one empty record.
+		numRecords = 1
+	}
+	this := &miPayload{body, recordSize, encoding, make([][sha256.Size]byte, numRecords)}
+	for rec := numRecords - 1; rec >= 0; rec-- {
+		h := sha256.New()
+		if rec == numRecords-1 {
+			io.WriteString(h, body[rec*recordSize:])
+			h.Write([]byte{0})
+		} else {
+			io.WriteString(h, body[rec*recordSize:(rec+1)*recordSize])
+			h.Write(this.proofs[rec+1][:])
+			h.Write([]byte{1})
+		}
+		h.Sum(this.proofs[rec][:0])
+	}
+	return this
+}
+
+// The value of the Digest (or MI-Draft2) header, to be signed along with the
+// other headers.
+func (this *miPayload) digest() string {
+	if len(this.proofs) == 0 {
+		// The encoding of an empty payload is itself empty, and its
+		// integrity proof is SHA-256("\0").
+		proof := sha256.Sum256([]byte{0})
+		return this.encoding.FormatDigestHeader(proof[:])
+	}
+	return this.encoding.FormatDigestHeader(this.proofs[0][:])
+}
+
+// The length of the encoded payload, as written by WriteTo.
+func (this *miPayload) encodedLen() int64 {
+	if len(this.proofs) == 0 {
+		return 0
+	}
+	return 8 + int64(len(this.body)) + int64(sha256.Size*(len(this.proofs)-1))
+}
+
+// Writes the encoded payload: the record size, followed by each record, each
+// but the last followed by the proof of the next.
+func (this *miPayload) WriteTo(w io.Writer) (int64, error) {
+	if len(this.proofs) == 0 {
+		return 0, nil
+	}
+	var written int64
+	var recordSize [8]byte
+	binary.BigEndian.PutUint64(recordSize[:], uint64(this.recordSize))
+	n, err := w.Write(recordSize[:])
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	for i := range this.proofs {
+		if i > 0 {
+			n, err := w.Write(this.proofs[i][:])
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		high := (i + 1) * this.recordSize
+		if high > len(this.body) {
+			high = len(this.body)
+		}
+		n, err := io.WriteString(w, this.body[i*this.recordSize:high])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
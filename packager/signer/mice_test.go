@@ -0,0 +1,51 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMIPayloadMatchesLibrary(t *testing.T) {
+	for _, encoding := range []mice.Encoding{mice.Draft02Encoding, mice.Draft03Encoding} {
+		for _, body := range []string{"", "a", strings.Repeat("a", 16), strings.Repeat("ab", 16), strings.Repeat("abc", 100)} {
+			var want bytes.Buffer
+			wantDigest, err := encoding.Encode(&want, []byte(body), 16)
+			require.NoError(t, err)
+
+			payload := newMIPayload(body, 16, encoding)
+			var got bytes.Buffer
+			n, err := payload.WriteTo(&got)
+			require.NoError(t, err)
+			assert.Equal(t, wantDigest, payload.digest(), "%s %q", encoding, body)
+			assert.Equal(t, want.Bytes(), got.Bytes(), "%s %q", encoding, body)
+			assert.Equal(t, int64(got.Len()), n, "%s %q", encoding, body)
+			assert.Equal(t, int64(got.Len()), payload.encodedLen(), "%s %q", encoding, body)
+
+			decoder, err := encoding.NewDecoder(&got, payload.digest(), 16)
+			require.NoError(t, err)
+			decoded, err := ioutil.ReadAll(decoder)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(decoded))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var errSigningQueueFull = errors.New("the signing queue is full")
+
+// Bounds the number of documents being transformed, MI-encoded, and signed at
+// once, as each holds several copies of itself in memory. Requests beyond
+// that wait their turn, up to a queue depth, past which they're shed.
+type signingPool struct {
+	workers chan struct{}
+	// Holds a token for each request that's running or waiting.
+	admitted chan struct{}
+}
+
+func newSigningPool(workers int, queueDepth int) *signingPool {
+	return &signingPool{make(chan struct{}, workers), make(chan struct{}, workers+queueDepth)}
+}
+
+// Waits for a worker, and returns a func that releases it, which may be called
+// more than once. Returns errSigningQueueFull, without waiting, if queueDepth
+// requests are already waiting, or ctx's error if it's done first.
+func (this *signingPool) acquire(ctx context.Context) (func(), error) {
+	select {
+	case this.admitted <- struct{}{}:
+	default:
+		return nil, errSigningQueueFull
+	}
+	select {
+	case this.workers <- struct{}{}:
+	case <-ctx.Done():
+		<-this.admitted
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-this.workers
+			<-this.admitted
+		})
+	}, nil
+}
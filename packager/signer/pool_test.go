@@ -0,0 +1,63 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningPool(t *testing.T) {
+	pool := newSigningPool(1, 1)
+	release, err := pool.acquire(context.Background())
+	require.NoError(t, err)
+
+	// The next waits for the worker, and the one after that is shed.
+	acquired := make(chan func())
+	go func() {
+		release, err := pool.acquire(context.Background())
+		if err == nil {
+			acquired <- release
+		}
+	}()
+	for len(pool.admitted) < 2 {
+		// Wait for the goroutine to queue.
+		runtime.Gosched()
+	}
+	_, err = pool.acquire(context.Background())
+	assert.Equal(t, errSigningQueueFull, err)
+
+	// Releasing twice frees only one worker.
+	release()
+	release()
+	waiter := <-acquired
+	assert.Len(t, pool.workers, 1)
+	assert.Len(t, pool.admitted, 1)
+
+	// Waiting ends with the request.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = pool.acquire(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, pool.admitted, 1)
+
+	waiter()
+	assert.Len(t, pool.workers, 0)
+	assert.Len(t, pool.admitted, 0)
+}
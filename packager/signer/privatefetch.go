@@ -0,0 +1,176 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+)
+
+// The loopback, private, link-local, and otherwise non-public ranges that
+// fetches mustn't connect to, unless allowed.
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "This" network.
+		"10.0.0.0/8",     // RFC 1918.
+		"100.64.0.0/10",  // Carrier-grade NAT.
+		"127.0.0.0/8",    // Loopback.
+		"169.254.0.0/16", // Link-local, including cloud metadata services.
+		"172.16.0.0/12",  // RFC 1918.
+		"192.0.0.0/24",   // IETF protocol assignments.
+		"192.168.0.0/16", // RFC 1918.
+		"198.18.0.0/15",  // Benchmarking.
+		"240.0.0.0/4",    // Reserved.
+		"::/128",         // Unspecified.
+		"::1/128",        // Loopback.
+		"64:ff9b::/96",   // NAT64, which embeds IPv4 addresses.
+		"fc00::/7",       // Unique local.
+		"fe80::/10",      // Link-local.
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// Refuses connections to privateNetworks, other than to allowed ones.
+type privateAddressGuard struct {
+	allowed []*net.IPNet
+	// The addresses of the proxies that fetches have gone via, which
+	// dialContext doesn't check.
+	proxies sync.Map
+}
+
+func newPrivateAddressGuard(allowed []*net.IPNet) *privateAddressGuard {
+	return &privateAddressGuard{allowed: allowed}
+}
+
+// The error for a connection refused by privateAddressGuard.
+type privateAddressError struct {
+	ip net.IP
+}
+
+func (this *privateAddressError) Error() string {
+	return fmt.Sprintf("refusing to connect to %s, a private address not in AllowedFetchNetworks", this.ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// A net.Dialer Control func, called with the resolved address of each
+// connection, so that DNS can't point an allowed name at a private address.
+func (this *privateAddressGuard) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &privateAddressError{nil}
+	}
+	return this.check(ip)
+}
+
+func (this *privateAddressGuard) check(ip net.IP) error {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if containsIP(privateNetworks, ip) && !containsIP(this.allowed, ip) {
+		return &privateAddressError{ip}
+	}
+	return nil
+}
+
+// Returns a dial func that connects to proxies (per proxy) with dialProxy,
+// and to all else with dial, whose dialer's Control is control.
+func (this *privateAddressGuard) dialContext(dial, dialProxy func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := this.proxies.Load(addr); ok {
+			return dialProxy(ctx, network, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// Wraps a transport's Proxy func so that, for fetches via a proxy, it checks
+// the addresses of the fetched host, per resolver if non-nil, and exempts the
+// proxy, which may well be private, from dialContext's check. This is only a
+// pre-check, as the proxy resolves the host again for itself. Direct fetches
+// are left to dialContext.
+func (this *privateAddressGuard) proxy(proxy func(*http.Request) (*url.URL, error), resolver *fetchResolver) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if proxyURL == nil || err != nil {
+			return proxyURL, err
+		}
+		ips, err := lookupHost(req.Context(), req.URL.Hostname(), resolver)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if err := this.check(ip); err != nil {
+				return nil, err
+			}
+		}
+		this.proxies.Store(proxyAddr(proxyURL), true)
+		return proxyURL, nil
+	}
+}
+
+// Returns the addresses of host, per resolver if non-nil, else DNS.
+func lookupHost(ctx context.Context, host string, resolver *fetchResolver) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if resolver != nil {
+		return resolver.resolve(ctx, host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// The default ports of proxy schemes, as http.Transport dials them.
+var proxyPorts = map[string]string{"http": "80", "https": "443", "socks5": "1080"}
+
+// Returns the address that http.Transport dials for a proxy.
+func proxyAddr(proxyURL *url.URL) string {
+	port := proxyURL.Port()
+	if port == "" {
+		port = proxyPorts[proxyURL.Scheme]
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
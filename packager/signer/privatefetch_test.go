@@ -0,0 +1,79 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivateAddressGuard(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.1.0.0/16")
+	guard := newPrivateAddressGuard([]*net.IPNet{allowed})
+	for _, address := range []string{"93.184.216.34:443", "[2606:2800:220:1:248:1893:25c8:1946]:443", "10.1.2.3:80", "172.32.0.1:443"} {
+		assert.NoError(t, guard.control("tcp", address, nil), address)
+	}
+	for _, address := range []string{"127.0.0.1:443", "10.2.0.1:80", "172.16.0.1:443", "192.168.1.1:80", "169.254.169.254:80", "0.0.0.0:80", "[::1]:443", "[fe80::1]:443", "[fd00::1]:443", "[::ffff:127.0.0.1]:443",
+		"198.18.0.1:80", "192.0.0.8:80", "240.0.0.1:80", "[64:ff9b::7f00:1]:443"} {
+		err := guard.control("tcp", address, nil)
+		if assert.Error(t, err, address) {
+			assert.Contains(t, err.Error(), "a private address not in AllowedFetchNetworks")
+		}
+	}
+	// As returned by http.Client.
+	err := &url.Error{Op: "Get", URL: "https://localhost/", Err: &net.OpError{Op: "dial", Net: "tcp", Err: guard.control("tcp", "127.0.0.1:443", nil)}}
+	assert.False(t, isRetryable(nil, err))
+}
+
+func TestPrivateAddressGuardProxy(t *testing.T) {
+	guard := newPrivateAddressGuard(nil)
+	// The proxy itself may be private; it's the fetched host that's checked.
+	proxyURL, _ := url.Parse("http://10.0.0.1:3128")
+	proxy := guard.proxy(http.ProxyURL(proxyURL), nil)
+
+	got, err := proxy(httptest.NewRequest("GET", "https://93.184.216.34/amp/", nil))
+	if assert.NoError(t, err) {
+		assert.Equal(t, proxyURL, got)
+	}
+	_, err = proxy(httptest.NewRequest("GET", "https://169.254.169.254/latest/meta-data/", nil))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "a private address not in AllowedFetchNetworks")
+	}
+
+	// Only the proxy is exempt from dialContext's check.
+	var dialed []string
+	dial := guard.dialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, "checked "+addr)
+		return nil, nil
+	}, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, "proxy "+addr)
+		return nil, nil
+	})
+	dial(context.Background(), "tcp", "10.0.0.1:3128")
+	dial(context.Background(), "tcp", "10.0.0.1:80")
+	assert.Equal(t, []string{"proxy 10.0.0.1:3128", "checked 10.0.0.1:80"}, dialed)
+
+	// Direct fetches are left to dialContext.
+	direct := guard.proxy(func(*http.Request) (*url.URL, error) { return nil, nil }, nil)
+	got, err = direct(httptest.NewRequest("GET", "https://169.254.169.254/latest/meta-data/", nil))
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
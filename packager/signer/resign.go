@@ -0,0 +1,180 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"container/list"
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/ampproject/amppackager/packager/validitymap"
+)
+
+// How long after an exchange was fetched it may be re-signed. Past this, a
+// cache must refetch it, so that changes on the origin that the cache never
+// noticed eventually propagate.
+const maxResignAge = 30 * 24 * time.Hour
+
+// The number of exchanges re-signed via /priv/resign, by URLSet.
+var resignedExchanges = expvar.NewMap("amppkg_resigned_exchanges")
+
+// What's needed to sign an exchange again, as the signature covers its
+// response headers (including the Digest of its payload), but not the payload
+// itself.
+type resignableExchange struct {
+	fetch   string
+	version version.Version
+	status  int
+	header  http.Header
+	// When the exchange was fetched and first signed.
+	fetched time.Time
+	// The lifetime of the first signature, which bounds that of later ones,
+	// e.g. per the document's max age or URLSet.ShortTTL.
+	duration time.Duration
+}
+
+type resignableKey struct {
+	signURL string
+	digest  string
+}
+
+// Recently signed exchanges, keyed by sign URL and the value of their Digest
+// header, so that a cache holding an exchange can ask for a fresh signature
+// for it without either side fetching its payload again.
+type exchangeCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[resignableKey]*list.Element
+	// Of *exchangeCacheEntry, most recently used first.
+	lru *list.List
+}
+
+type exchangeCacheEntry struct {
+	key      resignableKey
+	exchange *resignableExchange
+}
+
+// Holds at most maxEntries exchanges; when more are added, the least recently
+// used are forgotten.
+func newExchangeCache(maxEntries int) *exchangeCache {
+	return &exchangeCache{maxEntries: maxEntries, entries: map[resignableKey]*list.Element{}, lru: list.New()}
+}
+
+func (this *exchangeCache) add(signURL string, digest string, exchange *resignableExchange) {
+	key := resignableKey{signURL, digest}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if elem, ok := this.entries[key]; ok {
+		elem.Value.(*exchangeCacheEntry).exchange = exchange
+		this.lru.MoveToFront(elem)
+		return
+	}
+	this.entries[key] = this.lru.PushFront(&exchangeCacheEntry{key, exchange})
+	for this.lru.Len() > this.maxEntries {
+		oldest := this.lru.Remove(this.lru.Back()).(*exchangeCacheEntry)
+		delete(this.entries, oldest.key)
+	}
+}
+
+// Returns the exchange for signURL with the given Digest header value, if it
+// was signed recently.
+func (this *exchangeCache) get(signURL string, digest string) (*resignableExchange, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	elem, ok := this.entries[resignableKey{signURL, digest}]
+	if !ok {
+		return nil, false
+	}
+	this.lru.MoveToFront(elem)
+	return elem.Value.(*exchangeCacheEntry).exchange, true
+}
+
+// Serves /priv/resign?sign=<sign URL>&digest=<Digest header value>: signs a
+// recently signed exchange again, with a fresh date and expiry, and responds
+// with the new signature as validity data, as served from its validity URL.
+// Neither the packager nor the cache needs to fetch the payload, so caches
+// can keep serving an unchanged document past the 7-day signature limit.
+func (this *Signer) serveResign(resp http.ResponseWriter, req *http.Request) {
+	if this.resignable == nil {
+		util.NewHTTPError(http.StatusNotFound, "Not re-signing because no exchanges are remembered").LogAndRespond(resp, req)
+		return
+	}
+	if len(req.Form["sign"]) != 1 || len(req.Form["digest"]) != 1 {
+		util.NewHTTPError(http.StatusBadRequest, "Not exactly 1 sign param and 1 digest param").LogAndRespond(resp, req)
+		return
+	}
+	sign := req.FormValue("sign")
+	exchange, ok := this.resignable.get(sign, req.FormValue("digest"))
+	now := this.clock.Now()
+	if !ok || now.Sub(exchange.fetched) > maxResignAge {
+		util.NewHTTPError(http.StatusNotFound, "Not re-signing because no recent exchange matches; refetch it").WithCode("unknown_exchange").LogAndRespond(resp, req)
+		return
+	}
+	// The config may have changed since the exchange was signed.
+	_, signURL, urlSet, httpErr := parseURLs(exchange.fetch, sign, this.urlSets, this.fetchAllowlists)
+	if httpErr != nil {
+		httpErr.LogAndRespond(resp, req)
+		return
+	}
+	if err := this.shouldPackage(); err != nil {
+		util.NewHTTPError(http.StatusServiceUnavailable, "Not re-signing because server is unhealthy: ", err).LogAndRespond(resp, req)
+		return
+	}
+	certs, err := this.chooseCerts(urlSet, now)
+	if err != nil {
+		util.NewHTTPError(http.StatusServiceUnavailable, "Not re-signing because ", err).LogAndRespond(resp, req)
+		return
+	}
+	lifetime := newExchangeLifetime(now.Add(-urlSet.BackdateDuration(exchange.duration)), exchange.duration)
+	this.limitByCerts(lifetime, certs)
+	if lifetime.expires.Sub(now) < minSignatureLifetime {
+		util.NewHTTPError(http.StatusServiceUnavailable, "Not re-signing because the signature would expire at ", lifetime.expires).LogAndRespond(resp, req)
+		return
+	}
+	signed := signedexchange.NewExchange(
+		exchange.version /*uri=*/, signURL.String() /*method=*/, "GET",
+		http.Header{}, exchange.status, exchange.header, nil)
+	if httpErr := this.signExchange(signed, signURL, req.FormValue("digest"), lifetime, certs); httpErr != nil {
+		httpErr.LogAndRespond(resp, req)
+		return
+	}
+	recordSignatures(signURL, certs)
+	resignedExchanges.Add(urlSetLabel(urlSet), 1)
+	if this.popularity != nil {
+		this.popularity.RecordExpiry(signURL.String(), lifetime.expires)
+	}
+	if this.validityMap != nil {
+		this.validityMap.Record(signURL.String(), req.FormValue("digest"), signed.SignatureHeaderValue, lifetime.expires)
+	}
+	body, err := validitymap.EncodeSignatures(signed.SignatureHeaderValue)
+	if err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, err).LogAndRespond(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/cbor")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if _, err := resp.Write(body); err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
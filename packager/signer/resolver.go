@@ -0,0 +1,141 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The most hosts whose addresses fetchResolver caches. Past that, lookups
+// aren't cached until entries expire.
+const maxResolvedHosts = 1024
+
+// Fetch host resolutions, by source: "override", "cached", or "lookup".
+var fetchResolutions = expvar.NewMap("amppkg_fetch_resolutions")
+
+// Resolves the hosts that fetches connect to: per the config's FetchHosts
+// overrides, else via DNS, with the results cached for ttl, if positive.
+type fetchResolver struct {
+	overrides map[string]net.IP
+	ttl       time.Duration
+	lookup    func(ctx context.Context, host string) ([]net.IPAddr, error)
+	now       func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+func newFetchResolver(overrides map[string]net.IP, ttl time.Duration, now func() time.Time) *fetchResolver {
+	lowered := map[string]net.IP{}
+	for host, ip := range overrides {
+		lowered[strings.ToLower(host)] = ip
+	}
+	return &fetchResolver{
+		overrides: lowered,
+		ttl:       ttl,
+		lookup:    net.DefaultResolver.LookupIPAddr,
+		now:       now,
+		hosts:     map[string]resolvedHost{},
+	}
+}
+
+// Returns the addresses of host.
+func (this *fetchResolver) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	host = strings.ToLower(host)
+	if ip, ok := this.overrides[host]; ok {
+		fetchResolutions.Add("override", 1)
+		return []net.IP{ip}, nil
+	}
+	if this.ttl > 0 {
+		this.mu.Lock()
+		resolved, ok := this.hosts[host]
+		this.mu.Unlock()
+		if ok && this.now().Before(resolved.expires) {
+			fetchResolutions.Add("cached", 1)
+			return resolved.ips, nil
+		}
+	}
+	fetchResolutions.Add("lookup", 1)
+	addrs, err := this.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no addresses for %s", host)
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	if this.ttl > 0 {
+		this.cache(host, ips)
+	}
+	return ips, nil
+}
+
+func (this *fetchResolver) cache(host string, ips []net.IP) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := this.now()
+	if _, ok := this.hosts[host]; !ok && len(this.hosts) >= maxResolvedHosts {
+		for cached, resolved := range this.hosts {
+			if !now.Before(resolved.expires) {
+				delete(this.hosts, cached)
+			}
+		}
+		if len(this.hosts) >= maxResolvedHosts {
+			return
+		}
+	}
+	this.hosts[host] = resolvedHost{ips, now.Add(this.ttl)}
+}
+
+// Wraps dial so that it connects to the resolved addresses of the host, in
+// turn until one succeeds.
+func (this *fetchResolver) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ips, err := this.resolve(ctx, host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving %s", host)
+		}
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchResolver(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	resolver := newFetchResolver(map[string]net.IP{"Override.example": net.ParseIP("203.0.113.7")}, time.Minute, func() time.Time { return now })
+	lookups := 0
+	resolver.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if host == "missing.example" {
+			return nil, errors.New("no such host")
+		}
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("192.0.2.2")}}, nil
+	}
+
+	ips, err := resolver.resolve(context.Background(), "override.example")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("203.0.113.7")}, ips)
+	assert.Equal(t, 0, lookups)
+
+	for i := 0; i < 2; i++ {
+		ips, err = resolver.resolve(context.Background(), "www.example")
+		require.NoError(t, err)
+		assert.Equal(t, []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}, ips)
+	}
+	assert.Equal(t, 1, lookups, "should be cached")
+	now = now.Add(time.Minute)
+	_, err = resolver.resolve(context.Background(), "www.example")
+	require.NoError(t, err)
+	assert.Equal(t, 2, lookups, "should have expired")
+
+	for i := 0; i < 2; i++ {
+		_, err = resolver.resolve(context.Background(), "missing.example")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 4, lookups, "errors shouldn't be cached")
+}
+
+func TestFetchResolverDialsInTurn(t *testing.T) {
+	resolver := newFetchResolver(nil, 0, time.Now)
+	resolver.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+	}
+	var dialed []string
+	dial := resolver.dialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "[2001:db8::1]:443" {
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}
+		return nil, errors.New("unreachable")
+	})
+	conn, err := dial(context.Background(), "tcp", "www.example:443")
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, []string{"192.0.2.1:443", "[2001:db8::1]:443"}, dialed)
+
+	dialed = nil
+	_, err = dial(context.Background(), "tcp", "192.0.2.9:80")
+	assert.EqualError(t, err, "unreachable")
+	assert.Equal(t, []string{"192.0.2.9:80"}, dialed, "IPs shouldn't be resolved")
+}
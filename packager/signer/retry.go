@@ -0,0 +1,78 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// The number of fetches retried (see URLSet.FetchRetries), by URLSet.
+var fetchRetries = expvar.NewMap("amppkg_fetch_retries")
+
+// The number of fetches that succeeded after being retried, by URLSet.
+var fetchRetriesRecovered = expvar.NewMap("amppkg_fetch_retries_recovered")
+
+// True if the fetch failed in a way that may be transient: a network error,
+// timeout, or truncated response, or the origin, or a gateway in front of it,
+// was unavailable. Other errors, such as refused redirects and certificate
+// errors, would recur.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		// Headers over MaxFetchHeaderBytes would be again.
+		if isFetchHeaderOverflow(err) {
+			return false
+		}
+		// Every error from http.Client is a *url.Error, which is itself
+		// a net.Error, so look at what it wraps, and at what a dial's
+		// *net.OpError wraps.
+		cause := errors.Cause(err)
+		if urlErr, ok := cause.(*url.Error); ok {
+			cause = errors.Cause(urlErr.Err)
+		}
+		if opErr, ok := cause.(*net.OpError); ok {
+			if _, ok := opErr.Err.(*privateAddressError); ok {
+				cause = opErr.Err
+			}
+		}
+		switch cause.(type) {
+		case *privateAddressError:
+			// Refused by BlockPrivateFetches, as it would be again.
+			return false
+		case net.Error:
+			return true
+		}
+		return cause == io.ErrUnexpectedEOF
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Describes the failed fetch, for logging.
+func describeFailedFetch(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("status %d", resp.StatusCode)
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryable(t *testing.T) {
+	fetchErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com/", Err: err}
+	}
+	assert.True(t, isRetryable(nil, fetchErr(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})))
+	assert.True(t, isRetryable(nil, fetchErr(context.DeadlineExceeded)))
+	assert.True(t, isRetryable(nil, fetchErr(io.ErrUnexpectedEOF)))
+	assert.False(t, isRetryable(nil, fetchErr(errors.New("net/http: server response headers exceeded 1024 bytes; aborted"))))
+	assert.False(t, isRetryable(nil, fetchErr(&net.OpError{Op: "dial", Net: "tcp", Err: &privateAddressError{net.IPv4(10, 0, 0, 1)}})))
+	assert.False(t, isRetryable(nil, fetchErr(x509.UnknownAuthorityError{})))
+	assert.False(t, isRetryable(nil, fetchErr(errors.New("redirect from https://example.com/: no pinned SPKI hash matches"))))
+	assert.False(t, isRetryable(nil, fetchErr(context.Canceled)))
+	assert.True(t, isRetryable(&http.Response{StatusCode: http.StatusBadGateway}, nil))
+	assert.True(t, isRetryable(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil))
+	assert.True(t, isRetryable(&http.Response{StatusCode: http.StatusGatewayTimeout}, nil))
+	assert.False(t, isRetryable(&http.Response{StatusCode: http.StatusOK}, nil))
+	assert.False(t, isRetryable(&http.Response{StatusCode: http.StatusNotFound}, nil))
+	assert.False(t, isRetryable(&http.Response{StatusCode: http.StatusInternalServerError}, nil))
+}
@@ -0,0 +1,345 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	"github.com/pkg/errors"
+)
+
+// Identifies what went into a signed exchange: the sign URL, SXG version, and
+// transform, and the origin's response, other than its Date header, which
+// differs between otherwise identical responses. If two requests have the
+// same key, they'd produce the same exchange, but for its signature date.
+type signedExchangeKey [sha256.Size]byte
+
+func signedExchangeKeyOf(signURL *url.URL, sxgVersion string, transformVersion int64, rtv string, fetchResp *http.Response, fetchBody []byte) signedExchangeKey {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%d\n%s\n%d\n", signURL, sxgVersion, transformVersion, rtv, fetchResp.StatusCode)
+	writeHeadersExceptDate(h, fetchResp.Header)
+	h.Write(fetchBody)
+	var key signedExchangeKey
+	h.Sum(key[:0])
+	return key
+}
+
+// Writes the header to w, in a canonical form, other than its Date, which
+// changes on every fetch, and followed by a blank line.
+func writeHeadersExceptDate(w io.Writer, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		if name != "Date" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(w, "%s: %q\n", name, value)
+		}
+	}
+	io.WriteString(w, "\n")
+}
+
+// Identifies the exchanges that would satisfy a request, whatever the origin's
+// response: those with the same sign URL, SXG version, and transform.
+type exchangeVariant string
+
+func exchangeVariantOf(signURL *url.URL, sxgVersion string, transformVersion int64) exchangeVariant {
+	return exchangeVariant(fmt.Sprintf("%s\n%s\n%d", signURL, sxgVersion, transformVersion))
+}
+
+// A signed exchange, ready to be served again.
+type signedExchange struct {
+	key     signedExchangeKey
+	variant exchangeVariant
+	// The serialized exchange, up to its payload.
+	headers  []byte
+	payload  *miPayload
+	lifetime *exchangeLifetime
+	certs    *signingCerts
+	// Per exchangeLifetime.reusableUntil.
+	reusableUntil time.Time
+}
+
+// The memory held by the exchange, approximately.
+func (this *signedExchange) size() int {
+	return len(this.headers) + payloadSize(this.payload)
+}
+
+// Recently signed exchanges, so that repeat requests for a document that
+// hasn't changed on the origin can skip transforming, MI-encoding, and
+// signing it. Each is reused until its reusableUntil, or the signing cert
+// changes.
+type signatureCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	entries  map[signedExchangeKey]*list.Element
+	// The most recently added of each variant, for requests that can't
+	// be served a fresh fetch (see serveOnlyIfCached).
+	latest map[exchangeVariant]*list.Element
+	// Of *signedExchange, most recently used first.
+	lru *list.List
+}
+
+// Holds exchanges totalling at most maxBytes; when more are added, the least
+// recently used are forgotten.
+func newSignatureCache(maxBytes int) *signatureCache {
+	return &signatureCache{maxBytes: maxBytes, entries: map[signedExchangeKey]*list.Element{}, latest: map[exchangeVariant]*list.Element{}, lru: list.New()}
+}
+
+func (this *signatureCache) add(exchange *signedExchange) {
+	size := exchange.size()
+	if size > this.maxBytes {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if elem, ok := this.entries[exchange.key]; ok {
+		this.remove(elem)
+	}
+	elem := this.lru.PushFront(exchange)
+	this.entries[exchange.key] = elem
+	this.latest[exchange.variant] = elem
+	this.bytes += size
+	for this.bytes > this.maxBytes {
+		this.remove(this.lru.Back())
+	}
+}
+
+// Must be called with mu held.
+func (this *signatureCache) remove(elem *list.Element) {
+	exchange := this.lru.Remove(elem).(*signedExchange)
+	delete(this.entries, exchange.key)
+	if this.latest[exchange.variant] == elem {
+		delete(this.latest, exchange.variant)
+	}
+	this.bytes -= exchange.size()
+}
+
+// Returns the exchange with the given key, if it's still fresh at now and was
+// signed with certs.
+func (this *signatureCache) get(key signedExchangeKey, certs *signingCerts, now time.Time) (*signedExchange, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	elem, ok := this.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return this.getElem(elem, certs, now)
+}
+
+// Returns the most recently added exchange of the given variant, if it's still
+// fresh at now and was signed with certs.
+func (this *signatureCache) getLatest(variant exchangeVariant, certs *signingCerts, now time.Time) (*signedExchange, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	elem, ok := this.latest[variant]
+	if !ok {
+		return nil, false
+	}
+	return this.getElem(elem, certs, now)
+}
+
+// Must be called with mu held.
+func (this *signatureCache) getElem(elem *list.Element, certs *signingCerts, now time.Time) (*signedExchange, bool) {
+	exchange := elem.Value.(*signedExchange)
+	if !now.Before(exchange.reusableUntil) {
+		this.remove(elem)
+		return nil, false
+	}
+	if !sameCert(exchange.certs.cert, certs.cert) || !sameCert(exchange.certs.secondaryCert, certs.secondaryCert) {
+		return nil, false
+	}
+	this.lru.MoveToFront(elem)
+	return exchange, true
+}
+
+// True if a and b are the same cert, or both nil.
+func sameCert(a *x509.Certificate, b *x509.Certificate) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(b)
+}
+
+// Bumped whenever the snapshot format, or the serialized exchange headers for
+// a given key, change, so that older snapshots are ignored.
+const signatureSnapshotVersion = 3
+
+// The gob-encoded form of a signatureCache.
+type signatureSnapshot struct {
+	Version int
+	// Least recently used first.
+	Exchanges []savedExchange
+}
+
+// The gob-encoded form of a signedExchange.
+type savedExchange struct {
+	Key           signedExchangeKey
+	Variant       string
+	Headers       []byte
+	Body          string
+	RecordSize    int
+	Encoding      string
+	Proofs        [][sha256.Size]byte
+	Date          time.Time
+	Expires       time.Time
+	ReusableUntil time.Time
+	Cert          []byte
+	SecondaryCert []byte
+}
+
+// Writes the cached exchanges to w, for load.
+func (this *signatureCache) save(w io.Writer) error {
+	this.mu.Lock()
+	snapshot := signatureSnapshot{signatureSnapshotVersion, make([]savedExchange, 0, this.lru.Len())}
+	for elem := this.lru.Back(); elem != nil; elem = elem.Prev() {
+		exchange := elem.Value.(*signedExchange)
+		saved := savedExchange{
+			Key:           exchange.key,
+			Variant:       string(exchange.variant),
+			Headers:       exchange.headers,
+			Body:          exchange.payload.body,
+			RecordSize:    exchange.payload.recordSize,
+			Encoding:      string(exchange.payload.encoding),
+			Proofs:        exchange.payload.proofs,
+			Date:          exchange.lifetime.date,
+			Expires:       exchange.lifetime.expires,
+			ReusableUntil: exchange.reusableUntil,
+			Cert:          exchange.certs.cert.Raw,
+		}
+		if exchange.certs.secondaryCert != nil {
+			saved.SecondaryCert = exchange.certs.secondaryCert.Raw
+		}
+		snapshot.Exchanges = append(snapshot.Exchanges, saved)
+	}
+	// Encoded after unlocking, as w may be slow. The exchanges are
+	// immutable once added.
+	this.mu.Unlock()
+	return errors.Wrap(gob.NewEncoder(w).Encode(&snapshot), "encoding signature snapshot")
+}
+
+// Adds the exchanges written by save, other than those that would no longer
+// be served at now. Returns the number added. A snapshot of another version is
+// ignored.
+func (this *signatureCache) load(r io.Reader, now time.Time) (int, error) {
+	var snapshot signatureSnapshot
+	if err := gob.NewDecoder(r).Decode(&snapshot); err != nil {
+		return 0, errors.Wrap(err, "decoding signature snapshot")
+	}
+	if snapshot.Version != signatureSnapshotVersion {
+		return 0, nil
+	}
+	// Certs are shared by many exchanges, so parse each once.
+	parsed := map[string]*x509.Certificate{}
+	parseCert := func(der []byte) (*x509.Certificate, error) {
+		if der == nil {
+			return nil, nil
+		}
+		if cert, ok := parsed[string(der)]; ok {
+			return cert, nil
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing snapshotted cert")
+		}
+		parsed[string(der)] = cert
+		return cert, nil
+	}
+	added := 0
+	for _, saved := range snapshot.Exchanges {
+		if !now.Before(saved.ReusableUntil) {
+			continue
+		}
+		cert, err := parseCert(saved.Cert)
+		if err != nil {
+			return added, err
+		}
+		secondaryCert, err := parseCert(saved.SecondaryCert)
+		if err != nil {
+			return added, err
+		}
+		// The keys aren't needed to serve the exchange again.
+		this.add(&signedExchange{
+			key:           saved.Key,
+			variant:       exchangeVariant(saved.Variant),
+			headers:       saved.Headers,
+			payload:       &miPayload{saved.Body, saved.RecordSize, mice.Encoding(saved.Encoding), saved.Proofs},
+			lifetime:      &exchangeLifetime{saved.Date, saved.Expires},
+			certs:         &signingCerts{cert: cert, secondaryCert: secondaryCert},
+			reusableUntil: saved.ReusableUntil,
+		})
+		added++
+	}
+	return added, nil
+}
+
+// Writes the signature cache (see CacheSignatures) to the file at path, so
+// that LoadSignatures can restore it after a restart.
+func (this *Signer) SaveSignatures(path string) error {
+	if this.signedExchanges == nil {
+		return errors.New("signature cache is disabled")
+	}
+	// Write to a tempfile and move it into place, so that a crash never
+	// leaves a partial snapshot.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return errors.Wrapf(err, "creating tempfile for %s", path)
+	}
+	defer os.Remove(tmp.Name())
+	if err := this.signedExchanges.save(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "closing %s", tmp.Name())
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), path), "renaming to %s", path)
+}
+
+// Adds the exchanges saved by SaveSignatures to the signature cache, other
+// than those that have since gone stale. Returns the number added. A missing
+// file isn't an error, so that the first start after enabling this succeeds.
+// Must be called before serving.
+func (this *Signer) LoadSignatures(path string) (int, error) {
+	if this.signedExchanges == nil {
+		return 0, errors.New("signature cache is disabled")
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrapf(err, "opening %s", path)
+	}
+	defer file.Close()
+	return this.signedExchanges.load(file, this.clock.Now())
+}
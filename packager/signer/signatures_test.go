@@ -0,0 +1,107 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange/mice"
+	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedExchangeKeyIgnoresDate(t *testing.T) {
+	signURL, _ := url.Parse("https://example.com/amp.html")
+	key := func(header http.Header, body string) signedExchangeKey {
+		return signedExchangeKeyOf(signURL, "b3", 1, "rtv", &http.Response{StatusCode: 200, Header: header}, []byte(body))
+	}
+	base := key(http.Header{"Content-Type": {"text/html"}, "Date": {"Mon, 01 Jan 2018 00:00:00 GMT"}}, "<html amp>")
+	assert.Equal(t, base, key(http.Header{"Content-Type": {"text/html"}, "Date": {"Tue, 02 Jan 2018 00:00:00 GMT"}}, "<html amp>"))
+	assert.NotEqual(t, base, key(http.Header{"Content-Type": {"text/html"}}, "<html amp >"))
+	assert.NotEqual(t, base, key(http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"max-age=60"}}, "<html amp>"))
+}
+
+func TestSignatureCache(t *testing.T) {
+	now := pkgt.Certs[0].NotBefore
+	certs := &signingCerts{cert: pkgt.Certs[0]}
+	exchange := func(key byte, body string) *signedExchange {
+		return &signedExchange{signedExchangeKey{key}, "", []byte("headers"), newMIPayload(body, 16, mice.Draft03Encoding),
+			newExchangeLifetime(now, 2*time.Hour), certs, now.Add(time.Hour)}
+	}
+	a, b := exchange(1, strings.Repeat("a", 400)), exchange(2, strings.Repeat("b", 400))
+	cache := newSignatureCache(a.size() + b.size())
+	cache.add(a)
+	cache.add(b)
+	got, ok := cache.get(a.key, certs, now)
+	assert.True(t, ok)
+	assert.True(t, got == a)
+
+	// Not once it's no longer reusable.
+	_, ok = cache.get(a.key, certs, now.Add(time.Hour))
+	assert.False(t, ok)
+	_, ok = cache.get(a.key, certs, now)
+	assert.False(t, ok, "a should have been removed")
+
+	// Not if the cert has changed.
+	_, ok = cache.get(b.key, &signingCerts{cert: pkgt.B3Certs2[0]}, now)
+	assert.False(t, ok)
+	_, ok = cache.get(b.key, certs, now)
+	assert.True(t, ok)
+
+	// The least recently used is evicted, and those larger than the cache
+	// aren't held.
+	cache.add(a)
+	cache.add(exchange(3, strings.Repeat("c", 400)))
+	_, ok = cache.get(b.key, certs, now)
+	assert.False(t, ok, "b should have been evicted")
+	cache.add(exchange(4, strings.Repeat("d", 2000)))
+	_, ok = cache.get(signedExchangeKey{4}, certs, now)
+	assert.False(t, ok)
+	assert.Equal(t, 2*a.size(), cache.bytes)
+}
+
+func TestSignatureCacheSaveAndLoad(t *testing.T) {
+	now := pkgt.Certs[0].NotBefore
+	certs := &signingCerts{cert: pkgt.Certs[0], secondaryCert: pkgt.B3Certs2[0]}
+	exchange := func(key byte, duration time.Duration) *signedExchange {
+		lifetime := newExchangeLifetime(now, duration)
+		return &signedExchange{signedExchangeKey{key}, "", []byte("headers"), newMIPayload(strings.Repeat("a", 40), 16, mice.Draft03Encoding),
+			lifetime, certs, lifetime.reusableUntil("")}
+	}
+	fresh, stale := exchange(1, 3*time.Hour), exchange(2, 2*time.Hour)
+	cache := newSignatureCache(1 << 20)
+	cache.add(fresh)
+	cache.add(stale)
+	var snapshot bytes.Buffer
+	require.NoError(t, cache.save(&snapshot))
+
+	restored := newSignatureCache(1 << 20)
+	added, err := restored.load(&snapshot, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, added)
+	got, ok := restored.get(fresh.key, certs, now.Add(time.Hour))
+	require.True(t, ok)
+	assert.Equal(t, fresh.headers, got.headers)
+	assert.Equal(t, fresh.payload, got.payload)
+	assert.Equal(t, fresh.lifetime.expires.Unix(), got.lifetime.expires.Unix())
+	_, ok = restored.get(stale.key, certs, now.Add(time.Hour))
+	assert.False(t, ok, "stale should have been skipped")
+}
@@ -16,11 +16,16 @@ package signer
 
 import (
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"expvar"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
@@ -33,18 +38,46 @@ import (
 	"github.com/ampproject/amppackager/packager/accept"
 	"github.com/ampproject/amppackager/packager/amp_cache_transform"
 	"github.com/ampproject/amppackager/packager/certcache"
+	"github.com/ampproject/amppackager/packager/metrics"
 	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/popularity"
+	"github.com/ampproject/amppackager/packager/retry"
 	"github.com/ampproject/amppackager/packager/rtv"
+	"github.com/ampproject/amppackager/packager/urlmatch"
 	"github.com/ampproject/amppackager/packager/util"
+	"github.com/ampproject/amppackager/packager/validitymap"
+	pkgversion "github.com/ampproject/amppackager/packager/version"
 	"github.com/ampproject/amppackager/transformer"
 	rpb "github.com/ampproject/amppackager/transformer/request"
 	"github.com/pkg/errors"
 )
 
-// The user agent to send when issuing fetches. Should look like a mobile device.
-const userAgent = "Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) " +
-	"AppleWebKit/537.36 (KHTML, like Gecko) Chrome/41.0.2272.96 Mobile " +
-	"Safari/537.36 (compatible; amppackager/0.0.0; +https://github.com/ampproject/amppackager)"
+// The user agent to send when issuing fetches, unless the operator sets their
+// own (see IdentifyFetches): the product and version of the running build,
+// e.g. "amppkg/v1.2.3 (+https://github.com/ampproject/amppackager)".
+func defaultUserAgent() string {
+	// Source checkouts have the version "(devel)", which isn't a token.
+	return "amppkg/" + strings.Trim(pkgversion.Get().Version, "()") + " (+https://github.com/ampproject/amppackager)"
+}
+
+// Lets publishers distinguish packager fetches from user and bot traffic in
+// their origin access logs.
+const purposeHeader = "X-AmpPkg-Purpose"
+const purposeValue = "sxg-packaging"
+
+// Lists the SXG versions that the packager can produce, in 406 responses to
+// clients that accept none of them.
+const supportedSxgVersionsHeader = "X-AmpPkg-Sxg-Versions"
+
+// Describe the signature of a packaged SXG, so that caches and monitoring in
+// front of the packager can track its freshness without parsing the SXG. The
+// dates are HTTP-dates; the cert is named as in its cert-url, and if the
+// exchange is dual-signed, the secondary cert follows, comma-separated.
+const (
+	signatureDateHeader    = "X-AmpPkg-Signature-Date"
+	signatureExpiresHeader = "X-AmpPkg-Signature-Expires"
+	signatureCertHeader    = "X-AmpPkg-Signature-Cert"
+)
 
 // Advised against, per
 // https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-4.1
@@ -65,6 +98,13 @@ var statefulResponseHeaders = map[string]bool{
 	"WWW-Authenticate":          true,
 }
 
+// Origin response headers that are signed regardless of URLSet.SignedHeaders,
+// as the packager requires or rewrites them.
+var alwaysSignedHeaders = map[string]bool{
+	"Content-Security-Policy": true,
+	"Content-Type":            true,
+}
+
 // The server generating a 304 response MUST generate any of the
 // following header fields that would have been sent in a 200 (OK) response
 // to the same request.
@@ -78,19 +118,54 @@ var statusNotModifiedHeaders = map[string]bool{
 	"Vary":             true,
 }
 
-// MICE requires the sender process its payload in reverse order
-// (https://tools.ietf.org/html/draft-thomson-http-mice-03#section-2.1).
-// In an HTTP reverse proxy, this could be done using range requests, but would
-// be inefficient. Therefore, the signer requires the whole payload in memory.
-// To prevent DoS, a memory limit is set. This limit is mostly arbitrary,
-// though there's no benefit to having a limit greater than that of AMP Caches.
-const maxBodyLength = 4 * 1 << 20
+// The minimum lifetime (from now) a signature must have to be worth signing.
+// Signatures are clamped to the cert's expiry, so as it approaches, documents
+// are proxied unsigned instead.
+const minSignatureLifetime = 1 * time.Hour
+
+// The number of documents larger than URLSet.MaxBodyLength (see
+// URLSet.LargeDocumentMaxLength) that may be processed concurrently. Each
+// occupies a few times its size in memory, between the fetched body, the
+// transformed body, and the integrity proofs (see miPayload).
+const maxConcurrentLargeDocuments = 2
+
+var largeDocumentSlots = make(chan struct{}, maxConcurrentLargeDocuments)
+
+// The distribution of fetched body sizes, by URLSet.
+var payloadSizes = metrics.NewHistogram("amppkg_payload_bytes", metrics.ExponentialBounds(1<<10, 4, 8))
+
+// The number of documents routed to the large document pipeline, by URLSet.
+var largeDocuments = expvar.NewMap("amppkg_large_documents")
+
+// The number of documents under their URLSet's ShortTTL threshold, by URLSet.
+var shortTTLDocuments = expvar.NewMap("amppkg_short_ttl_documents")
+
+// The number of signatures served, by signing key and cert, labeled as
+// "<util.KeyID>/<cert serial, in hex>", for tracking the usage of each key.
+var signatures = expvar.NewMap("amppkg_signatures")
 
-// The current maximum is defined at:
-// https://cs.chromium.org/chromium/src/content/browser/loader/merkle_integrity_source_stream.cc?l=18&rcl=591949795043a818e50aba8a539094c321a4220c
-// The maximum is cheapest in terms of network usage, and probably CPU on both
-// server and client. The memory usage difference is negligible.
-const miRecordSize = 16 << 10
+// The number of packaging requests that ran out of origin request budget (see
+// Config.MaxOriginRequests), by URLSet.
+var originBudgetExhausted = expvar.NewMap("amppkg_origin_budget_exhausted")
+
+// The number of documents not packaged because the SXG would be larger than
+// Config.MaxSXGSize, by URLSet.
+var oversizedExchanges = expvar.NewMap("amppkg_oversized_exchanges")
+
+// The number of signed exchanges served again from the signature cache (see
+// CacheSignatures), by URLSet.
+var reusedSignatures = expvar.NewMap("amppkg_reused_signatures")
+
+// The number of packaging requests refused because the signing queue was full
+// (see Config.SigningQueueDepth), by URLSet.
+var signingQueueFull = expvar.NewMap("amppkg_signing_queue_full")
+
+// The number of freshly signed exchanges that failed verification (see
+// Config.VerifySignedExchanges), by URLSet.
+var failedVerifications = expvar.NewMap("amppkg_failed_verifications")
+
+// How long to tell clients to wait before retrying, while in read-only mode.
+const readOnlyRetryAfterSecs = 60
 
 // Overrideable for testing.
 var getTransformerRequest = func(r *rtv.RTVCache, s, u string) *rpb.Request {
@@ -98,12 +173,41 @@ var getTransformerRequest = func(r *rtv.RTVCache, s, u string) *rpb.Request {
 		AllowedFormats: []rpb.Request_HtmlFormat{rpb.Request_AMP}}
 }
 
+// Adds the given field names (or comma-separated lists of them) to the Vary
+// header, as a single value, skipping any it already lists. Field names are
+// compared case-insensitively, and "*" subsumes all others, per
+// https://tools.ietf.org/html/rfc7231#section-7.1.4.
+func addVary(header http.Header, fields ...string) {
+	var names []string
+	seen := map[string]bool{}
+	for _, value := range append(header["Vary"], fields...) {
+		for _, name := range strings.Split(value, ",") {
+			name = util.TrimHeaderValue(name)
+			if name == "" || seen[strings.ToLower(name)] {
+				continue
+			}
+			if name == "*" {
+				header.Set("Vary", "*")
+				return
+			}
+			seen[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		header.Set("Vary", strings.Join(names, ", "))
+	}
+}
+
 // Roughly matches the protocol grammar
 // (https://tools.ietf.org/html/rfc7230#section-6.7), which is defined in terms
 // of token (https://tools.ietf.org/html/rfc7230#section-3.2.6). This differs
 // in that it allows multiple slashes, as well as initial and terminal slashes.
 var protocol = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9a-zA-Z/]+$")
 
+// Matches an ETag produced by exchangeETag, weak or not.
+var exchangeETagPattern = regexp.MustCompile(`^(W/)?"[A-Za-z0-9_-]{43}(\.[A-Za-z0-9_-]*)?"$`)
+
 // Gets all values of the named header, joined on comma.
 func GetJoined(h http.Header, name string) string {
 	if values, ok := h[http.CanonicalHeaderKey(name)]; ok {
@@ -132,6 +236,65 @@ type Signer struct {
 	overrideBaseURL         *url.URL
 	requireHeaders          bool
 	forwardedRequestHeaders []string
+	// If non-nil and returns true, the signer is in read-only mode, and
+	// performs no origin fetches or signing.
+	isReadOnly func() bool
+	// The lifetime of signatures, before capping by the document's max-age.
+	signatureLifetime time.Duration
+	// If non-nil, the base URL of an external (e.g. CDN-hosted) copy of the
+	// cert chains, under which cert-urls are generated.
+	certURLBase *url.URL
+	// If non-nil, records each request, for prioritizing re-signs.
+	popularity *popularity.Tracker
+	clock      util.Clock
+	// The maximum number of origin requests per packaging request.
+	maxOriginRequests int
+	// The record size with which to MI-encode payloads.
+	miRecordSize int
+	// If non-nil, fetchAllowlists[i] supplies additional fetch hosts for
+	// urlSets[i].
+	fetchAllowlists []urlmatch.HostAllowlist
+	// If non-nil, serves the latest signature for each sign URL, from the
+	// per-exchange validity URLs.
+	validityMap *validitymap.ValidityMap
+	// If non-nil, recently signed exchanges, for re-signing without
+	// refetching.
+	resignable *exchangeCache
+	// If non-nil, the source of randomness for signatures, rather than
+	// crypto/rand.
+	rand io.Reader
+	// If positive, the largest SXG to produce, in bytes.
+	maxExchangeSize int
+	// If non-nil, recently signed exchanges, for serving again while the
+	// document is unchanged.
+	signedExchanges *signatureCache
+	// If non-nil, bounds the documents being signed at once.
+	signingPool *signingPool
+	// If true, each SXG is verified before it's served.
+	verifyExchanges bool
+	// If true, output=bundle requests are served Web Bundles.
+	webBundles bool
+	// Transports for URLSets that set a FetchProxy or FetchTimeouts.
+	transports *fetchTransports
+	// If non-nil, refuses fetches from private addresses.
+	privateFetches *privateAddressGuard
+	// If non-nil, resolves the hosts that fetches connect to.
+	resolver *fetchResolver
+	// Consecutive fetch failures by origin host.
+	circuits *circuitBreaker
+	// Fetches in flight by origin host.
+	fetchSlots *fetchLimiter
+	// The User-Agent and From headers sent on fetches. From is omitted if
+	// empty.
+	fetchUserAgent string
+	fetchFrom      string
+	// If non-nil, concurrent identical fetches share one response.
+	fetches *fetchGroup
+	// The most response header bytes and fields to accept from origins.
+	maxFetchHeaderBytes int
+	maxFetchHeaders     int
+	// Matches redirect targets against urlSets and fetchAllowlists.
+	redirectMatcher *urlmatch.Matcher
 }
 
 func noRedirects(req *http.Request, via []*http.Request) error {
@@ -140,30 +303,297 @@ func noRedirects(req *http.Request, via []*http.Request) error {
 
 func New(certHandler certcache.CertHandler, key crypto.PrivateKey, urlSets []util.URLSet,
 	rtvCache *rtv.RTVCache, shouldPackage func() error, overrideBaseURL *url.URL,
-	requireHeaders bool, forwardedRequestHeaders []string) (*Signer, error) {
+	requireHeaders bool, forwardedRequestHeaders []string, isReadOnly func() bool,
+	signatureLifetime time.Duration, certURLBase *url.URL) (*Signer, error) {
 	client := http.Client{
 		CheckRedirect: noRedirects,
-		// TODO(twifkak): Load-test and see if default transport settings are okay.
-		Timeout: 60 * time.Second,
+		Transport:     newPooledTransport(util.DefaultFetchPool, util.DefaultMaxFetchHeaderBytes),
+		Timeout:       util.DefaultFetchTimeouts.Total,
+	}
+
+	// Fail at startup, rather than on each fetch, if FetchTLS files are
+	// missing or invalid.
+	for i := range urlSets {
+		if urlSets[i].FetchTLS != nil {
+			if _, err := fetchTLSConfig(urlSets[i].FetchTLS, nil); err != nil {
+				return nil, errors.Wrapf(err, "loading URLSet.%d.FetchTLS", i)
+			}
+		}
+	}
+
+	if signatureLifetime <= 0 || signatureLifetime > util.MaxSignatureLifetime {
+		signatureLifetime = util.MaxSignatureLifetime
+	}
+
+	this := &Signer{
+		certHandler:             certHandler,
+		key:                     key,
+		client:                  &client,
+		urlSets:                 urlSets,
+		rtvCache:                rtvCache,
+		shouldPackage:           shouldPackage,
+		overrideBaseURL:         overrideBaseURL,
+		requireHeaders:          requireHeaders,
+		forwardedRequestHeaders: forwardedRequestHeaders,
+		isReadOnly:              isReadOnly,
+		signatureLifetime:       signatureLifetime,
+		certURLBase:             certURLBase,
+		clock:                   util.SystemClock{},
+		maxOriginRequests:       util.DefaultMaxOriginRequests,
+		miRecordSize:            util.MaxMIRecordSize,
+		transports:              newFetchTransports(),
+		fetchSlots:              newFetchLimiter(),
+		fetchUserAgent:          defaultUserAgent(),
+		maxFetchHeaderBytes:     util.DefaultMaxFetchHeaderBytes,
+		maxFetchHeaders:         util.DefaultMaxFetchHeaders,
+		redirectMatcher:         urlmatch.New(urlSets),
+	}
+	this.circuits = newCircuitBreaker(func() time.Time { return this.clock.Now() })
+	return this, nil
+}
+
+// Configures the Signer to record the URLs it's asked to sign in tracker.
+// Must be called before serving.
+func (this *Signer) TrackPopularity(tracker *popularity.Tracker) {
+	this.popularity = tracker
+}
+
+// Configures the Signer to make at most n origin requests (the fetch, plus
+// each redirect followed) per packaging request, so that no document can turn
+// one inbound request into many outbound ones. Must be called before serving.
+func (this *Signer) LimitOriginRequests(n int) {
+	if n > 0 {
+		this.maxOriginRequests = n
+	}
+}
+
+// Configures the Signer to refuse origin responses with more than maxBytes of
+// headers, or more than maxCount header fields, if positive. Must be called
+// before serving.
+func (this *Signer) LimitFetchHeaders(maxBytes int, maxCount int) {
+	if maxBytes > 0 {
+		this.maxFetchHeaderBytes = maxBytes
+		if transport, ok := this.client.Transport.(*http.Transport); ok {
+			transport.MaxResponseHeaderBytes = int64(maxBytes)
+		}
+	}
+	if maxCount > 0 {
+		this.maxFetchHeaders = maxCount
+	}
+}
+
+// Configures the Signer to refuse to fetch from loopback, private, and
+// link-local addresses, other than those in allowed, so that sign URLs can't
+// be used to probe internal networks. Fetches via a proxy are checked by the
+// addresses the fetched host resolves to, as the proxy, which may itself be
+// private, connects to it. Fetches from a FetchBackend aren't checked, as they
+// connect where the config says. Must be called before serving.
+func (this *Signer) BlockPrivateFetches(allowed []*net.IPNet) {
+	this.privateFetches = newPrivateAddressGuard(allowed)
+}
+
+// Configures the Signer to coalesce concurrent identical fetches, so that a
+// burst of requests for one document makes one origin fetch, whose response
+// they share. Must be called before serving.
+func (this *Signer) CoalesceFetches() {
+	this.fetches = newFetchGroup()
+}
+
+// Configures the User-Agent sent on fetches, if userAgent is non-empty, and a
+// From header, if from is non-empty, so that publishers can tell packager
+// fetches apart in their logs and WAF rules. Must be called before serving.
+func (this *Signer) IdentifyFetches(userAgent string, from string) {
+	if userAgent != "" {
+		this.fetchUserAgent = userAgent
+	}
+	this.fetchFrom = from
+}
+
+// Configures the connection pool and TLS session cache shared by fetches.
+// Must be called before serving.
+func (this *Signer) UseFetchPool(pool util.FetchPool) {
+	this.client.Transport = newPooledTransport(pool, this.maxFetchHeaderBytes)
+}
+
+// Configures the Signer to connect to the given IPs for the hosts in
+// overrides, e.g. to test an origin cutover before changing DNS, and to cache
+// the addresses of other hosts for cacheTTL, if positive, so that fetches
+// don't look each up anew. Must be called before serving.
+func (this *Signer) ResolveFetchHosts(overrides map[string]net.IP, cacheTTL time.Duration) {
+	if len(overrides) == 0 && cacheTTL <= 0 {
+		return
+	}
+	this.resolver = newFetchResolver(overrides, cacheTTL, func() time.Time { return this.clock.Now() })
+}
+
+// Configures the Signer to remember recently signed exchanges, totalling at
+// most maxBytes, so that repeat requests for a document that hasn't changed on
+// the origin reuse its digest and signature, rather than transforming,
+// MI-encoding, and signing it again. Must be called before serving.
+func (this *Signer) CacheSignatures(maxBytes int) {
+	this.signedExchanges = newSignatureCache(maxBytes)
+}
+
+// Configures the Signer to transform, MI-encode, and sign at most workers
+// documents at once, if positive. Up to queueDepth more wait their turn; past
+// that, requests are refused with a 503, so that load spikes can't exhaust
+// memory. Must be called before serving.
+func (this *Signer) LimitConcurrentSigning(workers int, queueDepth int) {
+	if workers > 0 {
+		this.signingPool = newSigningPool(workers, queueDepth)
+	}
+}
+
+// Configures the Signer to verify each SXG it signs, as a browser would,
+// before serving it, and to respond 500 instead if it's invalid. This costs a
+// copy of the SXG in memory and a signature verification, so is meant for
+// diagnosing cert, clock, or config problems. Must be called before serving.
+func (this *Signer) VerifyExchanges() {
+	this.verifyExchanges = true
+}
+
+// Configures the Signer to serve requests with an output=bundle param an
+// unsigned Web Bundle of the document and its same-origin subresources,
+// instead of an SXG. Must be called before serving.
+func (this *Signer) ServeWebBundles() {
+	this.webBundles = true
+}
+
+// Configures the Signer to MI-encode payloads with the given record size, if
+// positive, rather than util.MaxMIRecordSize. Smaller records let clients
+// verify the start of a large page sooner, at the cost of 32 bytes per record.
+// Must be called before serving.
+func (this *Signer) UseMIRecordSize(n int) {
+	if n > 0 {
+		this.miRecordSize = n
 	}
+}
+
+// Configures the Signer to refuse to produce SXGs larger than n bytes, if
+// positive, as caches won't serve them. Must be called before serving.
+func (this *Signer) LimitExchangeSize(n int) {
+	this.maxExchangeSize = n
+}
+
+// Configures the Signer to also fetch from hosts listed by allowlists[i], for
+// each URLSet i with a non-nil entry. Must be called before serving.
+func (this *Signer) UseFetchAllowlists(allowlists []urlmatch.HostAllowlist) {
+	this.fetchAllowlists = allowlists
+	this.redirectMatcher = urlmatch.NewWithAllowlists(this.urlSets, allowlists)
+}
+
+// Configures the Signer to give each exchange its own validity URL, and to
+// record its signature in validityMap to serve from there. Must be called
+// before serving.
+func (this *Signer) UseValidityMap(validityMap *validitymap.ValidityMap) {
+	this.validityMap = validityMap
+}
 
-	return &Signer{certHandler, key, &client, urlSets, rtvCache, shouldPackage, overrideBaseURL, requireHeaders, forwardedRequestHeaders}, nil
+// Configures the Signer to remember the headers of the n most recently signed
+// exchanges, so that /priv/resign can give them fresh signatures without
+// refetching them. Must be called before serving.
+func (this *Signer) RememberExchanges(n int) {
+	this.resignable = newExchangeCache(n)
 }
 
-func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request) (*http.Request, *http.Response, *util.HTTPError) {
+// Configures the Signer to read the time from clock, and the randomness for
+// its signatures from rand, rather than the system's. Given a fixed clock, a
+// rand that always yields the same bytes (e.g. testing.FixedRand), and an
+// origin whose responses don't vary (including their Date header), identical
+// requests produce byte-identical SXGs, so that integration tests can compare
+// them against golden files. Not for production use. Must be called before
+// serving.
+func (this *Signer) SignDeterministically(clock util.Clock, rand io.Reader) {
+	this.clock = clock
+	this.rand = rand
+}
+
+// The origin requests remaining for a single packaging request. Anything that
+// contacts the origin on its behalf must spend from it first.
+type originRequestBudget struct {
+	limit, spent int
+}
+
+// Returns true and counts one request if the budget allows it.
+func (this *originRequestBudget) spend() bool {
+	if this.spent >= this.limit {
+		return false
+	}
+	this.spent++
+	return true
+}
+
+// Carries the originRequestBudget of a packaging request in its context.
+type originRequestBudgetKey struct{}
+
+// Returns the budget of the packaging request that req belongs to, e.g. that
+// of the document for a subresource signed on its behalf, or else a new one.
+// The returned request carries the budget, for any such subrequests.
+func (this *Signer) originRequestBudgetFor(req *http.Request) (*originRequestBudget, *http.Request) {
+	if budget, ok := req.Context().Value(originRequestBudgetKey{}).(*originRequestBudget); ok {
+		return budget, req
+	}
+	budget := &originRequestBudget{limit: this.maxOriginRequests}
+	return budget, req.WithContext(context.WithValue(req.Context(), originRequestBudgetKey{}, budget))
+}
+
+// One hop of a redirect chain followed while fetching.
+type redirectHop struct {
+	url        string
+	statusCode int
+	// Time since the start of the fetch at which the redirect was received.
+	elapsed time.Duration
+}
+
+func formatRedirectChain(chain []redirectHop, final *http.Response, elapsed time.Duration) string {
+	var ret strings.Builder
+	for _, hop := range chain {
+		fmt.Fprintf(&ret, "%q -%d (%v)-> ", hop.url, hop.statusCode, hop.elapsed)
+	}
+	if final != nil {
+		fmt.Fprintf(&ret, "%q %d (%v)", final.Request.URL.String(), final.StatusCode, elapsed)
+	}
+	return ret.String()
+}
+
+func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request, urlSet *util.URLSet, budget *originRequestBudget) (*http.Request, *http.Response, *util.HTTPError) {
 	ampURL := fetch.String()
+	id := util.RequestID(serveHTTPReq)
+	if urlSet.CircuitBreaker != nil {
+		if remaining := this.circuits.openFor(fetch.Host); remaining > 0 {
+			return nil, nil, util.NewHTTPError(http.StatusBadGateway, "Not fetching ", ampURL, "; the circuit for ", fetch.Host, " is open for another ", remaining.Round(time.Second)).WithCode("origin_circuit_open")
+		}
+	}
+	if !budget.spend() {
+		originBudgetExhausted.Add(urlSetLabel(urlSet), 1)
+		return nil, nil, util.NewHTTPError(http.StatusBadGateway, "Not fetching ", ampURL, "; origin request budget exhausted")
+	}
 
-	log.Printf("Fetching URL: %q\n", ampURL)
+	log.Printf("Fetching URL: %q (request ID %q)\n", ampURL, id)
 	req, err := http.NewRequest(http.MethodGet, ampURL, nil)
 	if err != nil {
 		return nil, nil, util.NewHTTPError(http.StatusInternalServerError, "Error building request: ", err)
 	}
-	req.Header.Set("User-Agent", userAgent)
-	// copy forwardedRequestHeaders
-	for _, header := range this.forwardedRequestHeaders {
-		if http.CanonicalHeaderKey(header) == "Host" {
-			req.Host = serveHTTPReq.Host
-		} else if value := GetJoined(serveHTTPReq.Header, header); value != "" {
+	req = withConnectionMetrics(req)
+	req.Header.Set("User-Agent", this.fetchUserAgent)
+	if this.fetchFrom != "" {
+		req.Header.Set("From", this.fetchFrom)
+	}
+	req.Header.Set("Accept-Encoding", fetchAcceptEncoding)
+	// copy forwardedRequestHeaders, and those of the URLSet
+	for _, headers := range [][]string{this.forwardedRequestHeaders, urlSet.ForwardedRequestHeaders} {
+		for _, header := range headers {
+			if http.CanonicalHeaderKey(header) == "Host" {
+				req.Host = serveHTTPReq.Host
+			} else if value := GetJoined(serveHTTPReq.Header, header); value != "" {
+				req.Header.Set(header, value)
+			}
+		}
+	}
+	for header, value := range urlSet.FetchHeaders {
+		if header == "Host" {
+			req.Host = value
+		} else {
 			req.Header.Set(header, value)
 		}
 	}
@@ -188,18 +618,173 @@ func (this *Signer) fetchURL(fetch *url.URL, serveHTTPReq *http.Request) (*http.
 		}
 		req.Header.Set("X-Forwarded-Host", xfh)
 	}
-	// Set conditional headers that were included in ServeHTTP's Request.
-	for header := range util.ConditionalRequestHeaders {
-		if value := GetJoined(serveHTTPReq.Header, header); value != "" {
-			req.Header.Set(header, value)
+	if id != "" {
+		req.Header.Set(util.RequestIDHeader, id)
+	}
+	req.Header.Set(purposeHeader, purposeValue)
+	if isRefetch(serveHTTPReq) {
+		// Ask any caches in front of the origin to revalidate.
+		req.Header.Set("Cache-Control", "no-cache")
+		req.Header.Set("Pragma", "no-cache")
+	} else {
+		// Set conditional headers that were included in ServeHTTP's Request.
+		for header := range util.ConditionalRequestHeaders {
+			value := GetJoined(serveHTTPReq.Header, header)
+			if header == "If-None-Match" {
+				// Revalidate the SXG's ETag against the origin's.
+				value = originIfNoneMatch(value)
+			}
+			if value != "" {
+				req.Header.Set(header, value)
+			}
 		}
 	}
-	resp, err := this.client.Do(req)
+
+	send := func() (*http.Response, *util.HTTPError) {
+		return this.sendFetch(req, serveHTTPReq, urlSet, budget)
+	}
+	var resp *http.Response
+	var httpErr *util.HTTPError
+	if this.fetches != nil {
+		resp, httpErr = this.fetches.do(req, serveHTTPReq, urlSet, send)
+	} else {
+		resp, httpErr = send()
+	}
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+	return req, resp, nil
+}
+
+// Sends the fetch built by fetchURL, following redirects and retrying per
+// urlSet, and returns its response, with the body decoded.
+func (this *Signer) sendFetch(req *http.Request, serveHTTPReq *http.Request, urlSet *util.URLSet, budget *originRequestBudget) (*http.Response, *util.HTTPError) {
+	fetch := req.URL
+	ampURL := fetch.String()
+	id := util.RequestID(serveHTTPReq)
+	release, httpErr := this.acquireFetchSlot(serveHTTPReq, fetch.Host, urlSet)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	// Record the redirect chain (if redirects are followed), so that
+	// publishers can see why a fetch ended up somewhere unexpected.
+	start := time.Now()
+	var chain []redirectHop
+	client, err := this.fetchClient(urlSet)
 	if err != nil {
-		return nil, nil, util.NewHTTPError(http.StatusBadGateway, "Error fetching: ", err)
+		release()
+		return nil, util.NewHTTPError(http.StatusInternalServerError, "Error configuring fetch client: ", err)
+	}
+	client.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		chain = append(chain, redirectHop{via[len(via)-1].URL.String(), next.Response.StatusCode, time.Since(start)})
+		if len(urlSet.PinnedSPKIHashes) > 0 {
+			if err := checkPinnedSPKI(next.Response.TLS, urlSet.PinnedSPKIHashes); err != nil {
+				return errors.Wrapf(err, "redirect from %s", via[len(via)-1].URL)
+			}
+		}
+		if len(chain) > urlSet.MaxRedirects {
+			if urlSet.MaxRedirects > 0 {
+				log.Printf("Not following redirect to %q; MaxRedirects (%d) reached.\n", next.URL, urlSet.MaxRedirects)
+			}
+			return http.ErrUseLastResponse
+		}
+		if err := this.redirectMatcher.MatchRedirect(next.URL, urlSet); err != nil {
+			log.Printf("Not following redirect to %q: %v\n", next.URL, err)
+			return http.ErrUseLastResponse
+		}
+		if !budget.spend() {
+			log.Printf("Not following redirect to %q; MaxOriginRequests (%d) reached (request ID %q).\n", next.URL, budget.limit, id)
+			originBudgetExhausted.Add(urlSetLabel(urlSet), 1)
+			return http.ErrUseLastResponse
+		}
+		// http.Client re-sends all but a few credential headers to other
+		// hosts, so keep the URLSet's secrets from them.
+		if next.URL.Host != fetch.Host {
+			for header := range urlSet.FetchHeaders {
+				next.Header.Del(header)
+			}
+		}
+		return nil
+	}
+	resp, err := client.Do(req)
+	if retries := urlSet.FetchRetries; retries != nil {
+		retried := false
+		// Jittered, so that packagers retrying at once don't retry in
+		// lockstep.
+		backoff := retry.Policy{InitialBackoff: retries.BackoffDuration(), Jitter: true}
+		for attempt := 1; attempt <= retries.Count && isRetryable(resp, err); attempt++ {
+			delay := backoff.Backoff(attempt - 1)
+			if time.Since(start)+delay > retries.WithinDuration() {
+				log.Printf("Not retrying fetch of %q after %s; FetchRetries.Within (%v) reached (request ID %q).\n", ampURL, describeFailedFetch(resp, err), retries.WithinDuration(), id)
+				break
+			}
+			if deadline, ok := serveHTTPReq.Context().Deadline(); ok && time.Now().Add(delay).After(deadline) {
+				log.Printf("Not retrying fetch of %q after %s; the request deadline is too near (request ID %q).\n", ampURL, describeFailedFetch(resp, err), id)
+				break
+			}
+			if !budget.spend() {
+				log.Printf("Not retrying fetch of %q after %s; MaxOriginRequests (%d) reached (request ID %q).\n", ampURL, describeFailedFetch(resp, err), budget.limit, id)
+				originBudgetExhausted.Add(urlSetLabel(urlSet), 1)
+				break
+			}
+			log.Printf("Retrying fetch of %q in %v after %s (request ID %q).\n", ampURL, delay, describeFailedFetch(resp, err), id)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-serveHTTPReq.Context().Done():
+				timer.Stop()
+				release()
+				return nil, util.NewHTTPError(http.StatusBadGateway, "Error fetching: ", serveHTTPReq.Context().Err(), " while waiting to retry")
+			}
+			fetchRetries.Add(urlSetLabel(urlSet), 1)
+			retried = true
+			chain = nil
+			resp, err = client.Do(req)
+		}
+		if retried && !isRetryable(resp, err) {
+			fetchRetriesRecovered.Add(urlSetLabel(urlSet), 1)
+		}
+	}
+	// Fetches cut short by a canceled or expired request say nothing about
+	// the origin, and would let impatient clients open its circuit.
+	if urlSet.CircuitBreaker != nil && serveHTTPReq.Context().Err() == nil && !isCanceled(err) {
+		this.circuits.record(fetch.Host, urlSet.CircuitBreaker, isRetryable(resp, err))
+	}
+	if urlSet.MaxRedirects > 0 && len(chain) > 0 {
+		log.Printf("Fetch of %q followed redirects: %s\n", ampURL, formatRedirectChain(chain, resp, time.Since(start)))
+	}
+	if isFetchHeaderOverflow(err) {
+		release()
+		return nil, util.NewHTTPError(http.StatusBadGateway, "Not packaging because the response from ", ampURL, " has over MaxFetchHeaderBytes (", this.maxFetchHeaderBytes, ") of headers: ", err).WithCode("fetch_headers_too_large")
+	}
+	if err != nil {
+		release()
+		return nil, util.NewHTTPError(http.StatusBadGateway, "Error fetching: ", err)
+	}
+	resp.Body = slotBody{resp.Body, release}
+	if fields := countHeaderFields(resp.Header); fields > this.maxFetchHeaders {
+		resp.Body.Close()
+		return nil, util.NewHTTPError(http.StatusBadGateway, "Not packaging because the response from ", ampURL, " has ", fields, " header fields, over MaxFetchHeaders (", this.maxFetchHeaders, ")").WithCode("fetch_headers_too_large")
+	}
+	if urlSet.RefuseRedirects && isRedirect(resp) {
+		resp.Body.Close()
+		return nil, util.NewHTTPError(http.StatusBadGateway, "Not packaging because ", resp.Request.URL, " redirected to ", resp.Header.Get("Location"), ", which wasn't followed, and RefuseRedirects is set").WithCode("redirect_refused")
+	}
+	if len(urlSet.PinnedSPKIHashes) > 0 {
+		if err := checkPinnedSPKI(resp.TLS, urlSet.PinnedSPKIHashes); err != nil {
+			resp.Body.Close()
+			return nil, util.NewHTTPError(http.StatusBadGateway, "Error verifying origin: ", err)
+		}
 	}
 	util.RemoveHopByHopHeaders(resp.Header)
-	return req, resp, nil
+	if err := decodeContentEncoding(resp); err != nil {
+		resp.Body.Close()
+		return nil, util.NewHTTPError(http.StatusBadGateway, "Error decoding ", ampURL, ": ", err)
+	}
+	return resp, nil
 }
 
 // Some Content-Security-Policy (CSP) configurations have the ability to break
@@ -262,6 +847,14 @@ func MutateFetchedContentSecurityPolicy(fetched string) string {
 }
 
 func (this *Signer) genCertURL(cert *x509.Certificate, signURL *url.URL) (*url.URL, error) {
+	if this.certURLBase != nil {
+		// Use the same content-addressed name as the cert cache, so
+		// the CDN can mirror it.
+		ret := *this.certURLBase
+		ret.Path = strings.TrimSuffix(ret.Path, "/") + "/" + util.CertName(cert)
+		ret.RawPath = ""
+		return &ret, nil
+	}
 	var baseURL *url.URL
 	if this.overrideBaseURL != nil {
 		baseURL = this.overrideBaseURL
@@ -277,38 +870,164 @@ func (this *Signer) genCertURL(cert *x509.Certificate, signURL *url.URL) (*url.U
 	return ret, nil
 }
 
+// True if resp is a redirect that the client didn't follow.
+func isRedirect(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Header.Get("Location") != ""
+	}
+	return false
+}
+
+type refetchKeyType struct{}
+
+var refetchKey = refetchKeyType{}
+
+func isRefetch(req *http.Request) bool {
+	refetch, _ := req.Context().Value(refetchKey).(bool)
+	return refetch
+}
+
+// Like ServeHTTP, but packages a fresh copy of the document, e.g. right after
+// the publisher corrects it: conditional request headers aren't forwarded, so
+// the origin can't respond 304, and caches in front of it are asked to
+// revalidate. For use by the admin repackage endpoint.
+func (this *Signer) ServeRefetch(resp http.ResponseWriter, req *http.Request) {
+	this.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), refetchKey, true)))
+}
+
+// True iff the request has the only-if-cached directive, per
+// https://tools.ietf.org/html/rfc7234#section-5.2.1.7.
+func onlyIfCached(req *http.Request) bool {
+	for _, directive := range strings.Split(GetJoined(req.Header, "Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "only-if-cached") {
+			return true
+		}
+	}
+	return false
+}
+
+// Serves the latest exchange for signURL from the signature cache, without
+// fetching from the origin or counting toward popularity, e.g. for a
+// self-check. Responds 504 if there's none that the request accepts, per
+// only-if-cached.
+func (this *Signer) serveOnlyIfCached(resp http.ResponseWriter, req *http.Request, signURL *url.URL, urlSet *util.URLSet) {
+	var act string
+	var transformVersion int64
+	var err error
+	if this.requireHeaders {
+		act, transformVersion = amp_cache_transform.ShouldSendSXG(GetJoined(req.Header, "AMP-Cache-Transform"))
+	} else {
+		transformVersion, err = transformer.SelectVersion(nil)
+	}
+	sxgVersion := accept.AcceptedSxgVersion
+	if this.requireHeaders || urlSet.NonSXGFallback != "" {
+		sxgVersion, _ = accept.NegotiateVersion(GetJoined(req.Header, "Accept"))
+	}
+	if (this.requireHeaders && act == "") || err != nil || sxgVersion == "" {
+		util.NewHTTPError(http.StatusGatewayTimeout, "Not serving from cache because the request doesn't negotiate an SXG").WithCode("not_cached").LogAndRespond(resp, req)
+		return
+	}
+	now := this.clock.Now()
+	certs, err := this.chooseCerts(urlSet, now)
+	if err != nil {
+		util.NewHTTPError(http.StatusGatewayTimeout, "Not serving from cache because ", err).WithCode("not_cached").LogAndRespond(resp, req)
+		return
+	}
+	var cached *signedExchange
+	ok := false
+	if this.signedExchanges != nil {
+		cached, ok = this.signedExchanges.getLatest(exchangeVariantOf(signURL, sxgVersion, transformVersion), certs, now)
+	}
+	if !ok {
+		util.NewHTTPError(http.StatusGatewayTimeout, "Not serving from cache because none is cached for ", signURL).WithCode("not_cached").LogAndRespond(resp, req)
+		return
+	}
+	// The origin's validators aren't known without fetching it.
+	this.writeSignedExchange(resp, req, act, sxgVersion, cached, http.Header{}, now)
+}
+
 func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	resp.Header().Add("Vary", "Accept, AMP-Cache-Transform")
+	req = util.WithRequestID(req)
+	if this.requireHeaders {
+		// The SXG version and transform variant are negotiated from
+		// these, as is whether to sign at all.
+		addVary(resp.Header(), "Accept", "AMP-Cache-Transform")
+	}
+
+	if this.isReadOnly != nil && this.isReadOnly() {
+		// The signature cache can't serve without a fresh fetch, so the
+		// best the packager can do is ask the frontend to keep serving
+		// what it has cached.
+		resp.Header().Set("Retry-After", strconv.Itoa(readOnlyRetryAfterSecs))
+		util.NewHTTPError(http.StatusServiceUnavailable, "Not packaging because the packager is in read-only mode").WithCode("read_only").LogAndRespond(resp, req)
+		return
+	}
 
 	if err := req.ParseForm(); err != nil {
-		util.NewHTTPError(http.StatusBadRequest, "Form input parsing failed: ", err).LogAndRespond(resp)
+		util.NewHTTPError(http.StatusBadRequest, "Form input parsing failed: ", err).LogAndRespond(resp, req)
 		return
 	}
-	var fetch, sign string
 	params := mux.Params(req)
+	if params["resign"] != "" {
+		this.serveResign(resp, req)
+		return
+	}
+	var fetch, sign string
 	if inPathSignURL := params["signURL"]; inPathSignURL != "" {
 		sign = inPathSignURL
 	} else {
 		if len(req.Form["fetch"]) > 1 {
-			util.NewHTTPError(http.StatusBadRequest, "More than 1 fetch param").LogAndRespond(resp)
+			util.NewHTTPError(http.StatusBadRequest, "More than 1 fetch param").LogAndRespond(resp, req)
 			return
 		}
 		if len(req.Form["sign"]) != 1 {
-			util.NewHTTPError(http.StatusBadRequest, "Not exactly 1 sign param").LogAndRespond(resp)
+			util.NewHTTPError(http.StatusBadRequest, "Not exactly 1 sign param").LogAndRespond(resp, req)
 			return
 		}
 		fetch = req.FormValue("fetch")
 		sign = req.FormValue("sign")
 	}
-	fetchURL, signURL, errorOnStatefulHeaders, httpErr := parseURLs(fetch, sign, this.urlSets)
+	output := req.FormValue("output")
+	if output != "" && output != subresourcesOutput && (output != webBundleOutput || !this.webBundles) {
+		util.NewHTTPError(http.StatusBadRequest, "Unsupported output param: ", output).LogAndRespond(resp, req)
+		return
+	}
+	fetchURL, signURL, urlSet, httpErr := parseURLs(fetch, sign, this.urlSets, this.fetchAllowlists)
 	if httpErr != nil {
-		httpErr.LogAndRespond(resp)
+		httpErr.LogAndRespond(resp, req)
+		return
+	}
+	// If non-nil, the response is signed as-is, rather than as an AMP
+	// document.
+	resource := urlSet.AuxiliaryResourceFor(signURL.EscapedPath())
+	if urlSet.NonSXGFallback != "" {
+		// Whether to sign depends on it, even if it's not required.
+		addVary(resp.Header(), "Accept")
+	}
+	if urlSet.NonSXGFallback == util.NonSXGRedirect && output == "" && !accept.CanSatisfy(GetJoined(req.Header, "Accept")) {
+		log.Println("Redirecting to sign URL because Accept request header lacks a supported SXG version.")
+		http.Redirect(resp, req, signURL.String(), http.StatusFound)
 		return
 	}
+	if onlyIfCached(req) {
+		this.serveOnlyIfCached(resp, req, signURL, urlSet)
+		return
+	}
+	// HEAD requests are probes, rather than demand.
+	if this.popularity != nil && req.Method != http.MethodHead {
+		if fetch != "" {
+			this.popularity.Record(fetchURL.String(), signURL.String())
+		} else {
+			this.popularity.Record("", signURL.String())
+		}
+	}
 
-	fetchReq, fetchResp, httpErr := this.fetchURL(fetchURL, req)
+	// Shared with the subresources signed on its behalf.
+	budget, req := this.originRequestBudgetFor(req)
+	fetchReq, fetchResp, httpErr := this.fetchURL(fetchURL, req, urlSet, budget)
 	if httpErr != nil {
-		httpErr.LogAndRespond(resp)
+		httpErr.LogAndRespond(resp, req)
 		return
 	}
 
@@ -323,6 +1042,11 @@ func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		proxy(resp, fetchResp, nil)
 		return
 	}
+	if output == webBundleOutput {
+		// Bundles are unsigned, so don't depend on SXG negotiation.
+		this.serveWebBundle(resp, req, fetchReq, fetchResp, signURL, urlSet, resource, budget)
+		return
+	}
 	var act string
 	var transformVersion int64
 	if this.requireHeaders {
@@ -341,22 +1065,42 @@ func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 			proxy(resp, fetchResp, nil)
 		}
 	}
-	if this.requireHeaders && !accept.CanSatisfy(GetJoined(req.Header, "Accept")) {
-		log.Printf("Not packaging because Accept request header lacks application/signed-exchange;v=%s.\n", accept.AcceptedSxgVersion)
-		proxy(resp, fetchResp, nil)
-		return
+	sxgVersion := accept.AcceptedSxgVersion
+	if this.requireHeaders || urlSet.NonSXGFallback != "" {
+		var sxgRequested bool
+		sxgVersion, sxgRequested = accept.NegotiateVersion(GetJoined(req.Header, "Accept"))
+		if sxgVersion == "" && sxgRequested && urlSet.NonSXGFallback == "" {
+			// The client wants an SXG, but not one we can produce,
+			// so an unsigned response wouldn't do either.
+			resp.Header().Set(supportedSxgVersionsHeader, strings.Join(accept.SupportedSxgVersions, ","))
+			util.NewHTTPError(http.StatusNotAcceptable, "Not packaging because Accept request header lacks a supported SXG version: ", GetJoined(req.Header, "Accept")).WithCode("unsupported_sxg_version").LogAndRespond(resp, req)
+			return
+		}
+		if sxgVersion == "" {
+			log.Println("Not packaging because Accept request header lacks a supported SXG version.")
+			proxy(resp, fetchResp, nil)
+			return
+		}
 	}
 
 	switch fetchResp.StatusCode {
 	case 200:
 		// If fetchURL returns an OK status, then validate, munge, and package.
-		if err := validateFetch(fetchReq, fetchResp); err != nil {
+		if httpErr := checkNotSignedExchange(fetchResp, nil); httpErr != nil {
+			httpErr.LogAndRespond(resp, req)
+			return
+		}
+		contentTypes := urlSet.ContentTypes()
+		if resource != nil {
+			contentTypes = []string{resource.ContentType}
+		}
+		if err := validateFetch(fetchReq, fetchResp, contentTypes); err != nil {
 			log.Println("Not packaging because of invalid fetch: ", err)
 			proxy(resp, fetchResp, nil)
 			return
 		}
 		for header := range statefulResponseHeaders {
-			if errorOnStatefulHeaders && GetJoined(fetchResp.Header, header) != "" {
+			if urlSet.Sign.ErrorOnStatefulHeaders && GetJoined(fetchResp.Header, header) != "" {
 				log.Println("Not packaging because ErrorOnStatefulHeaders = True and fetch response contains stateful header: ", header)
 				proxy(resp, fetchResp, nil)
 				return
@@ -373,15 +1117,47 @@ func (this *Signer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		this.serveSignedExchange(resp, fetchResp, signURL, act, transformVersion)
+		if output == subresourcesOutput {
+			this.serveSubresources(resp, req, fetchResp, signURL, urlSet, resource, transformVersion, sxgVersion)
+			return
+		}
+		this.serveSignedExchange(resp, req, fetchResp, fetch, signURL, urlSet, resource, act, transformVersion, sxgVersion)
 
 	case 304:
 		// If fetchURL returns a 304, then also return a 304 with appropriate headers.
 		for header := range statusNotModifiedHeaders {
-			if value := GetJoined(fetchResp.Header, header); value != "" {
+			if header == "Vary" {
+				addVary(resp.Header(), fetchResp.Header[header]...)
+			} else if value := GetJoined(fetchResp.Header, header); value != "" {
 				resp.Header().Set(header, value)
 			}
 		}
+		// If the caller revalidated an SXG, the origin has confirmed the
+		// document it was signed from, so identify the SXG rather than
+		// the document. If it did so by date alone, the origin's ETag
+		// would keep caches from matching the 304 to the SXG, per
+		// https://tools.ietf.org/html/rfc7234#section-4.3.4.
+		ifNoneMatch := GetJoined(req.Header, "If-None-Match")
+		revalidatesSXG := false
+		if etag := notModifiedETag(ifNoneMatch, fetchResp.Header.Get("ETag")); etag != "" {
+			resp.Header().Set("ETag", etag)
+			revalidatesSXG = true
+		} else if ifNoneMatch == "" && req.Header.Get("If-Modified-Since") != "" {
+			resp.Header().Del("ETag")
+			revalidatesSXG = true
+		}
+		if revalidatesSXG {
+			// A cache applies this 304's freshness to its stored SXG
+			// (https://tools.ietf.org/html/rfc7234#section-4.3.4),
+			// whose signature may expire long before the origin's
+			// max-age, and isn't known here, so give it none, as
+			// writeSignedExchange does.
+			resp.Header().Set("Cache-Control", "no-transform, max-age=0")
+			resp.Header().Del("Expires")
+		}
+		if lastModified := fetchResp.Header.Get("Last-Modified"); lastModified != "" {
+			resp.Header().Set("Last-Modified", lastModified)
+		}
 		resp.WriteHeader(http.StatusNotModified)
 
 	default:
@@ -415,30 +1191,211 @@ func formatLinkHeader(preloads []*rpb.Metadata_Preload) (string, error) {
 	return strings.Join(values, ","), nil
 }
 
+// The maximum length of a document to sign for the URLSet, including via the
+// large document pipeline.
+func bodyLimit(urlSet *util.URLSet) int {
+	if urlSet.LargeDocumentMaxLength > urlSet.BodyLength() {
+		return urlSet.LargeDocumentMaxLength
+	}
+	return urlSet.BodyLength()
+}
+
+// A name for the URLSet, for use in metrics.
+func urlSetLabel(urlSet *util.URLSet) string {
+	if urlSet.Sign.Domain != "" {
+		return urlSet.Sign.Domain
+	}
+	return urlSet.Sign.DomainRE
+}
+
+// Waits for a signing worker, if the signing pool is enabled, and returns a
+// func that releases it. If it can't, responds with an error and returns false.
+// Subresources signed on behalf of a document share its worker.
+func (this *Signer) acquireSigningWorker(resp http.ResponseWriter, req *http.Request, urlSet *util.URLSet) (func(), bool) {
+	if this.signingPool == nil || isSubresourceRequest(req) {
+		return func() {}, true
+	}
+	release, err := this.signingPool.acquire(req.Context())
+	if err == errSigningQueueFull {
+		signingQueueFull.Add(urlSetLabel(urlSet), 1)
+		util.NewHTTPError(http.StatusServiceUnavailable, "Not packaging because ", err).WithCode("overloaded").LogAndRespond(resp, req)
+		return nil, false
+	} else if err != nil {
+		util.NewHTTPError(http.StatusServiceUnavailable, "Not packaging because the request ended while waiting to be signed: ", err).LogAndRespond(resp, req)
+		return nil, false
+	}
+	return release, true
+}
+
+// Waits for a slot to fetch from host, per urlSet.FetchConcurrency, and
+// returns a func that releases it, or an error to respond with if none frees
+// up in time.
+func (this *Signer) acquireFetchSlot(req *http.Request, host string, urlSet *util.URLSet) (func(), *util.HTTPError) {
+	if urlSet.FetchConcurrency == nil {
+		return func() {}, nil
+	}
+	release, err := this.fetchSlots.acquire(req.Context(), host, urlSet.FetchConcurrency)
+	if err == errFetchQueueTimeout {
+		fetchConcurrencyRefused.Add(host, 1)
+		return nil, util.NewHTTPError(http.StatusServiceUnavailable, "Not fetching from ", host, " because ", urlSet.FetchConcurrency.Max, " fetches are already in flight and ", err).WithCode("origin_overloaded")
+	} else if err != nil {
+		return nil, util.NewHTTPError(http.StatusServiceUnavailable, "Not fetching because the request ended while waiting for a fetch slot: ", err)
+	}
+	return release, nil
+}
+
 // serveSignedExchange does the actual work of transforming, packaging and signed and writing to the response.
-func (this *Signer) serveSignedExchange(resp http.ResponseWriter, fetchResp *http.Response, signURL *url.URL, act string, transformVersion int64) {
+func (this *Signer) serveSignedExchange(resp http.ResponseWriter, req *http.Request, fetchResp *http.Response, fetch string, signURL *url.URL, urlSet *util.URLSet, resource *util.AuxiliaryResource, act string, transformVersion int64, sxgVersion string) {
 	// After this, fetchResp.Body is consumed, and attempts to read or proxy it will result in an empty body.
-	fetchBody, err := ioutil.ReadAll(io.LimitReader(fetchResp.Body, maxBodyLength))
+	maxBodyLength := urlSet.BodyLength()
+	body := newBodyReader(fetchResp)
+	within, err := body.readWithin(maxBodyLength)
 	if err != nil {
-		util.NewHTTPError(http.StatusBadGateway, "Error reading body: ", err).LogAndRespond(resp)
+		util.NewHTTPError(http.StatusBadGateway, "Error reading body: ", err).LogAndRespond(resp, req)
 		return
 	}
+	if !within && urlSet.LargeDocumentMaxLength > maxBodyLength {
+		// Route it to the large document pipeline, shedding load
+		// rather than queueing if it's full.
+		select {
+		case largeDocumentSlots <- struct{}{}:
+			defer func() { <-largeDocumentSlots }()
+		default:
+			util.NewHTTPError(http.StatusServiceUnavailable, "Too many large documents in flight").WithCode("overloaded").LogAndRespond(resp, req)
+			return
+		}
+		largeDocuments.Add(urlSetLabel(urlSet), 1)
+		within, err = body.readWithin(urlSet.LargeDocumentMaxLength)
+		if err != nil {
+			util.NewHTTPError(http.StatusBadGateway, "Error reading body: ", err).LogAndRespond(resp, req)
+			return
+		}
+	}
+	if !within {
+		// Signing a truncated document would break it, so proxy the
+		// whole thing unsigned.
+		log.Printf("Not packaging because the body is longer than %d bytes.\n", bodyLimit(urlSet))
+		proxy(resp, fetchResp, body.body)
+		return
+	}
+	fetchBody := body.body
+	payloadSizes.Observe(urlSetLabel(urlSet), int64(len(fetchBody)))
+	if httpErr := checkNotSignedExchange(fetchResp, fetchBody); httpErr != nil {
+		httpErr.LogAndRespond(resp, req)
+		return
+	}
+	if urlSet.AMPOnly && resource == nil {
+		if err := checkAMPDocument(fetchBody); err != nil {
+			log.Println("Not packaging because AMPOnly is set and the body doesn't look like AMP:", err)
+			proxy(resp, fetchResp, fetchBody)
+			return
+		}
+	}
 
-	// Perform local transformations.
-	r := getTransformerRequest(this.rtvCache, string(fetchBody), signURL.String())
-	r.Version = transformVersion
-	transformed, metadata, err := transformer.Process(r)
+	now := this.clock.Now()
+	certs, err := this.chooseCerts(urlSet, now)
 	if err != nil {
-		log.Println("Not packaging due to transformer error:", err)
+		log.Printf("Not packaging because %v.\n", err)
 		proxy(resp, fetchResp, fetchBody)
 		return
 	}
+	// Built before the cache lookup, as the AMP runtime version it names
+	// affects the transformed document.
+	var transformReq *rpb.Request
+	if resource == nil {
+		transformReq = getTransformerRequest(this.rtvCache, string(fetchBody), signURL.String())
+		transformReq.Version = transformVersion
+	}
+	var cacheKey signedExchangeKey
+	if this.signedExchanges != nil {
+		cacheKey = signedExchangeKeyOf(signURL, sxgVersion, transformVersion, transformReq.GetRtv(), fetchResp, fetchBody)
+		if cached, ok := this.signedExchanges.get(cacheKey, certs, now); ok && !isRefetch(req) {
+			reusedSignatures.Add(urlSetLabel(urlSet), 1)
+			this.writeSignedExchange(resp, req, act, sxgVersion, cached, fetchResp.Header, now)
+			return
+		}
+	}
+	// Releases the signing worker, if any. Called before the SXG is written,
+	// so that slow clients don't hold up signing.
+	release, ok := this.acquireSigningWorker(resp, req, urlSet)
+	if !ok {
+		return
+	}
+	defer release()
 
-	// Validate and format Link header.
-	linkHeader, err := formatLinkHeader(metadata.Preloads)
-	if err != nil {
-		log.Println("Not packaging due to Link header error:", err)
-		proxy(resp, fetchResp, fetchBody)
+	// Auxiliary resources are signed as-is, without preloads, and aren't
+	// limited by a transformed max age.
+	transformed, linkHeader, maxAgeSecs := string(fetchBody), "", int32(-1)
+	if resource == nil {
+		// Perform local transformations.
+		var metadata *rpb.Metadata
+		transformed, metadata, err = transformer.Process(transformReq)
+		if err != nil {
+			log.Println("Not packaging due to transformer error:", err)
+			proxy(resp, fetchResp, fetchBody)
+			return
+		}
+
+		// Validate and format Link header.
+		linkHeader, err = formatLinkHeader(metadata.Preloads)
+		if err != nil {
+			log.Println("Not packaging due to Link header error:", err)
+			proxy(resp, fetchResp, fetchBody)
+			return
+		}
+		if urlSet.SubstituteSubresources {
+			if values := this.allowedAltSXGs(req, signURL, fetchBody, sxgVersion, transformVersion, metadata.Preloads); len(values) > 0 {
+				if linkHeader != "" {
+					values = append([]string{linkHeader}, values...)
+				}
+				linkHeader = strings.Join(values, ",")
+			}
+		}
+		maxAgeSecs = metadata.MaxAgeSecs
+	}
+
+	// If set, the signature must expire by then, per the ShortTTL policy.
+	var ttlExpiry time.Time
+	if shortTTL := urlSet.ShortTTL; shortTTL != nil {
+		if ttl, ok := originTTL(fetchResp); ok && ttl < shortTTL.ThresholdDuration() {
+			shortTTLDocuments.Add(urlSetLabel(urlSet), 1)
+			switch {
+			case shortTTL.Policy == util.ShortTTLRefuse, shortTTL.Policy == util.ShortTTLShorten && ttl <= 0:
+				log.Printf("Not packaging because the origin TTL of %v is under the ShortTTL threshold of %s.\n", ttl, shortTTL.Threshold)
+				proxy(resp, fetchResp, fetchBody)
+				return
+			case shortTTL.Policy == util.ShortTTLShorten:
+				ttlExpiry = now.Add(ttl)
+			default:
+				log.Printf("Packaging despite the origin TTL of %v being under the ShortTTL threshold of %s.\n", ttl, shortTTL.Threshold)
+			}
+		}
+	}
+
+	// Expires - Date must be <= 604800 seconds, per
+	// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.5.
+	duration := this.signatureLifetime
+	if lifetime := urlSet.SignatureDuration(); lifetime > 0 {
+		duration = lifetime
+	}
+	lifetime := newExchangeLifetime(now.Add(-urlSet.BackdateDuration(duration)), duration)
+	if maxAgeSecs >= 0 {
+		lifetime.limit(lifetime.date.Add(time.Duration(maxAgeSecs) * time.Second))
+	}
+	if !ttlExpiry.IsZero() {
+		lifetime.limit(ttlExpiry)
+	}
+	this.limitByCerts(lifetime, certs)
+
+	if req.Method == http.MethodHead {
+		// The exchange would be discarded, so stop short of building it.
+		// Its length isn't known without doing so.
+		release()
+		setExchangeHeaders(resp.Header(), act, sxgVersion, lifetime, certs, GetJoined(fetchResp.Header, "Cache-Control"), now)
+		if lastModified := fetchResp.Header.Get("Last-Modified"); lastModified != "" {
+			resp.Header().Set("Last-Modified", lastModified)
+		}
+		resp.WriteHeader(http.StatusOK)
 		return
 	}
 
@@ -450,6 +1407,14 @@ func (this *Signer) serveSignedExchange(resp http.ResponseWriter, fetchResp *htt
 		fetchResp.Header.Del(header)
 	}
 
+	// Remove headers the URLSet doesn't sign. Those set below are signed
+	// regardless.
+	for header := range fetchResp.Header {
+		if !alwaysSignedHeaders[header] && !urlSet.SignsHeader(header) {
+			fetchResp.Header.Del(header)
+		}
+	}
+
 	// Set Link header if formatting returned a valid value, otherwise, delete
 	// it to ensure there are no privacy-violating Link:rel=preload headers.
 	if linkHeader != "" {
@@ -461,6 +1426,14 @@ func (this *Signer) serveSignedExchange(resp http.ResponseWriter, fetchResp *htt
 	// Set content length.
 	fetchResp.Header.Set("Content-Length", strconv.Itoa(len(transformed)))
 
+	// Don't let caches of the inner response outlast the signature.
+	if cacheControl := GetJoined(fetchResp.Header, "Cache-Control"); cacheControl != "" {
+		fetchResp.Header.Set("Cache-Control", lifetime.capCacheControl(cacheControl, now))
+	}
+	if expires := fetchResp.Header.Get("Expires"); expires != "" {
+		fetchResp.Header.Set("Expires", lifetime.capExpires(expires))
+	}
+
 	// Set general security headers.
 	fetchResp.Header.Set("X-Content-Type-Options", "nosniff")
 
@@ -470,94 +1443,412 @@ func (this *Signer) serveSignedExchange(resp http.ResponseWriter, fetchResp *htt
 		MutateFetchedContentSecurityPolicy(
 			fetchResp.Header.Get("Content-Security-Policy")))
 
-	exchange := signedexchange.NewExchange(
-		accept.SxgVersion /*uri=*/, signURL.String() /*method=*/, "GET",
-		http.Header{}, fetchResp.StatusCode, fetchResp.Header, []byte(transformed))
-	if err := exchange.MiEncodePayload(miRecordSize); err != nil {
-		util.NewHTTPError(http.StatusInternalServerError, "Error MI-encoding: ", err).LogAndRespond(resp)
+	// The signature covers the payload only via its Digest header, so the
+	// exchange is built without the payload, which is written after it
+	// from the in-memory body.
+	libraryVersion := accept.LibraryVersion(sxgVersion)
+	encoding := miEncoding(libraryVersion)
+	if fetchResp.Header.Get(encoding.DigestHeaderName()) != "" {
+		util.NewHTTPError(http.StatusInternalServerError, "Error MI-encoding: response already has ", encoding.DigestHeaderName(), " header").LogAndRespond(resp, req)
 		return
 	}
-	cert := this.certHandler.GetLatestCert()
-	certURL, err := this.genCertURL(cert, signURL)
+	payload := newMIPayload(transformed, this.miRecordSize, encoding)
+	fetchResp.Header.Add("Content-Encoding", encoding.ContentEncoding())
+	fetchResp.Header.Add(encoding.DigestHeaderName(), payload.digest())
+	// fetchURL removed these already, but they must never be signed, so
+	// check the final set.
+	util.RemoveHopByHopHeaders(fetchResp.Header)
+	trimmed, err := limitSignedHeaders(fetchResp.Header, urlSet, encoding.DigestHeaderName())
+	if trimmed {
+		trimmedSignedHeaders.Add(urlSetLabel(urlSet), 1)
+	}
 	if err != nil {
-		util.NewHTTPError(http.StatusInternalServerError, "Error building cert URL: ", err).LogAndRespond(resp)
+		// As with MaxSXGSize, it's too late to proxy.
+		util.NewHTTPError(http.StatusBadGateway, "Not packaging because ", err).WithCode("signed_headers_too_large").WithCategory(util.ErrorNotCacheable).LogAndRespond(resp, req)
 		return
 	}
-	now := time.Now()
-	validityHRef, err := url.Parse(util.ValidityMapPath)
-	if err != nil {
-		util.NewHTTPError(http.StatusInternalServerError, "Error building validity href: ", err).LogAndRespond(resp)
+	exchange := signedexchange.NewExchange(
+		libraryVersion /*uri=*/, signURL.String() /*method=*/, "GET",
+		http.Header{}, fetchResp.StatusCode, fetchResp.Header, nil)
+	// Check MaxSXGSize before signing too, so that the key isn't used for
+	// an SXG that's never served. The signature isn't serialized yet, so
+	// this is a lower bound; the exact size is checked below.
+	var unsignedHeaders bytes.Buffer
+	if err := exchange.Write(&unsignedHeaders); err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error serializing exchange: ", err).LogAndRespond(resp, req)
+		return
 	}
-	// Expires - Date must be <= 604800 seconds, per
-	// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.5.
-	duration := 7 * 24 * time.Hour
-	if maxAge := time.Duration(metadata.MaxAgeSecs) * time.Second; maxAge < duration {
-		duration = maxAge
+	if this.rejectOversizedExchange(resp, req, urlSet, int64(unsignedHeaders.Len())+payload.encodedLen()) {
+		return
 	}
-	date := now.Add(-24 * time.Hour)
-	signer := signedexchange.Signer{
-		Date:        date,
-		Expires:     date.Add(duration),
-		Certs:       []*x509.Certificate{cert},
-		CertUrl:     certURL,
-		ValidityUrl: signURL.ResolveReference(validityHRef),
-		PrivKey:     this.key,
-		// TODO(twifkak): Should we make Rand user-configurable? The
-		// default is to use getrandom(2) if available, else
-		// /dev/urandom.
+	if httpErr := this.signExchange(exchange, signURL, payload.digest(), lifetime, certs); httpErr != nil {
+		httpErr.LogAndRespond(resp, req)
+		return
 	}
-	if err := exchange.AddSignatureHeader(&signer); err != nil {
-		util.NewHTTPError(http.StatusInternalServerError, "Error signing exchange: ", err).LogAndRespond(resp)
+	var exchangeHeaders bytes.Buffer
+	if err := exchange.Write(&exchangeHeaders); err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error serializing exchange: ", err).LogAndRespond(resp, req)
 		return
 	}
-	var body bytes.Buffer
-	if err := exchange.Write(&body); err != nil {
-		util.NewHTTPError(http.StatusInternalServerError, "Error serializing exchange: ", err).LogAndRespond(resp)
+	if this.rejectOversizedExchange(resp, req, urlSet, int64(exchangeHeaders.Len())+payload.encodedLen()) {
+		return
 	}
+	if this.verifyExchanges {
+		if err := verifyExchange(exchangeHeaders.Bytes(), payload, certs, now); err != nil {
+			failedVerifications.Add(urlSetLabel(urlSet), 1)
+			util.NewHTTPError(http.StatusInternalServerError, "Not serving the SXG because ", err).WithCode("verification_failed").LogAndRespond(resp, req)
+			return
+		}
+	}
+	recordSignatures(signURL, certs)
+	if this.resignable != nil {
+		this.resignable.add(signURL.String(), payload.digest(), &resignableExchange{
+			fetch, libraryVersion, fetchResp.StatusCode, fetchResp.Header.Clone(), now, lifetime.expires.Sub(lifetime.date)})
+	}
+	if this.popularity != nil {
+		this.popularity.RecordExpiry(signURL.String(), lifetime.expires)
+	}
+	if this.validityMap != nil {
+		this.validityMap.Record(signURL.String(), payload.digest(), exchange.SignatureHeaderValue, lifetime.expires)
+	}
+	signed := &signedExchange{cacheKey, exchangeVariantOf(signURL, sxgVersion, transformVersion), exchangeHeaders.Bytes(), payload, lifetime, certs, lifetime.reusableUntil(GetJoined(fetchResp.Header, "Cache-Control"))}
+	if this.signedExchanges != nil {
+		this.signedExchanges.add(signed)
+	}
+	release()
+	this.writeSignedExchange(resp, req, act, sxgVersion, signed, fetchResp.Header, now)
+}
+
+// Responds with an error, and returns true, if an SXG of the given size
+// exceeds MaxSXGSize. It's too late to proxy by then, and caches would reject
+// the SXG, so this tells the publisher why it'll never be served.
+func (this *Signer) rejectOversizedExchange(resp http.ResponseWriter, req *http.Request, urlSet *util.URLSet, size int64) bool {
+	if this.maxExchangeSize <= 0 || size <= int64(this.maxExchangeSize) {
+		return false
+	}
+	oversizedExchanges.Add(urlSetLabel(urlSet), 1)
+	util.NewHTTPError(http.StatusBadGateway, "Not packaging because the SXG would be ", size, " bytes, more than MaxSXGSize of ", this.maxExchangeSize).WithCode("sxg_too_large").WithCategory(util.ErrorNotCacheable).LogAndRespond(resp, req)
+	return true
+}
 
+// Writes the signed exchange, with outer response headers as of now. Its
+// validators include those of the origin's response, with originHeader, so
+// that callers can revalidate it against the origin.
+func (this *Signer) writeSignedExchange(resp http.ResponseWriter, req *http.Request, act string, sxgVersion string, exchange *signedExchange, originHeader http.Header, now time.Time) {
+	setExchangeHeaders(resp.Header(), act, sxgVersion, exchange.lifetime, exchange.certs, innerCacheControl(exchange.headers), now)
+	if lastModified := originHeader.Get("Last-Modified"); lastModified != "" {
+		resp.Header().Set("Last-Modified", lastModified)
+	}
+	etag := exchangeETag(exchange.headers, originHeader.Get("ETag"))
+	resp.Header().Set("ETag", etag)
+	if etagMatches(GetJoined(req.Header, "If-None-Match"), etag) {
+		// The caller's SXG may have an earlier signature (see
+		// exchangeETag), which expires sooner, and a 304 updates its
+		// freshness (https://tools.ietf.org/html/rfc7234#section-4.3.4),
+		// so give it none.
+		resp.Header().Set("Cache-Control", "no-transform, max-age=0")
+		resp.Header().Del("Content-Type")
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	resp.Header().Set("Content-Length", strconv.FormatInt(int64(len(exchange.headers))+exchange.payload.encodedLen(), 10))
+	if _, err := resp.Write(exchange.headers); err != nil {
+		log.Println("Error writing response:", err)
+		return
+	}
+	if _, err := exchange.payload.WriteTo(resp); err != nil {
+		log.Println("Error writing response:", err)
+		return
+	}
+}
+
+// Sets the outer response headers for an SXG signed with certs for lifetime,
+// with the given inner Cache-Control, other than those that depend on its
+// bytes.
+func setExchangeHeaders(header http.Header, act string, sxgVersion string, lifetime *exchangeLifetime, certs *signingCerts, cacheControl string, now time.Time) {
 	// If requireHeaders was true when constructing signer, the
 	// AMP-Cache-Transform outer response header is required (and has already
 	// been validated)
 	if act != "" {
-		resp.Header().Set("AMP-Cache-Transform", act)
-	}
-
-	resp.Header().Set("Content-Type", accept.SxgContentType)
-	// We set a zero freshness lifetime on the SXG, so that naive caching
-	// intermediaries won't inhibit the update of this resource on AMP
-	// caches. AMP caches are recommended to base their update strategies
-	// on a combination of inner and outer resource lifetime.
-	//
-	// If you change this code to set a Cache-Control based on the inner
-	// resource, you need to ensure that its max-age is no longer than the
-	// lifetime of the signature (6 days, per above). Maybe an even tighter
-	// bound than that, based on data about client clock skew.
-	resp.Header().Set("Cache-Control", "no-transform, max-age=0")
-	resp.Header().Set("X-Content-Type-Options", "nosniff")
-	if _, err := resp.Write(body.Bytes()); err != nil {
-		log.Println("Error writing response:", err)
-		return
+		header.Set("AMP-Cache-Transform", act)
+	}
+
+	header.Set("Content-Type", accept.ContentType(sxgVersion))
+	// Caches may serve the SXG while its signature is valid, and the
+	// document is fresh, per exchangeLifetime.maxAge.
+	header.Set("Cache-Control", fmt.Sprintf("public, no-transform, max-age=%d", lifetime.maxAge(cacheControl, now)))
+	header.Set("X-Content-Type-Options", "nosniff")
+	setSignatureHeaders(header, lifetime, certs)
+}
+
+// Sets the X-AmpPkg-Signature-* headers, for an exchange signed with certs
+// for lifetime.
+func setSignatureHeaders(header http.Header, lifetime *exchangeLifetime, certs *signingCerts) {
+	header.Set(signatureDateHeader, lifetime.date.UTC().Format(http.TimeFormat))
+	header.Set(signatureExpiresHeader, lifetime.expires.UTC().Format(http.TimeFormat))
+	certNames := util.CertName(certs.cert)
+	if certs.secondaryCert != nil {
+		certNames += "," + util.CertName(certs.secondaryCert)
 	}
+	header.Set(signatureCertHeader, certNames)
 }
 
-// Proxy the content unsigned. If body is non-nil, it is used in place of fetchResp.Body.
+// Returns the inner Cache-Control of the SXG with the given serialized headers,
+// or "" if it has none.
+func innerCacheControl(exchangeHeaders []byte) string {
+	exchange, err := signedexchange.ReadExchange(bytes.NewReader(exchangeHeaders))
+	if err != nil {
+		return ""
+	}
+	return GetJoined(exchange.ResponseHeaders, "Cache-Control")
+}
+
+// Returns a weak ETag for the SXG with the given serialized headers, derived
+// from its signed headers, other than Date. They commit to the payload, via
+// its Digest, but not to the signature, which is randomized and changes on
+// every re-signing, nor to the origin's Date, which changes on every fetch. So
+// SXGs of the same response match even when their bytes don't; they differ
+// only in their signature's validity, which a cache checks for itself.
+//
+// If the origin's response had an ETag, it's appended, so that a request
+// conditioned on this ETag can be revalidated against the origin (see
+// originIfNoneMatch), without re-signing.
+func exchangeETag(exchangeHeaders []byte, originETag string) string {
+	h := sha256.New()
+	if exchange, err := signedexchange.ReadExchange(bytes.NewReader(exchangeHeaders)); err == nil {
+		fmt.Fprintf(h, "%s\n%d\n", exchange.RequestURI, exchange.ResponseStatus)
+		writeHeadersExceptDate(h, exchange.ResponseHeaders)
+	} else {
+		h.Write(exchangeHeaders)
+	}
+	etag := base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	if originETag != "" {
+		etag += "." + base64.RawURLEncoding.EncodeToString([]byte(originETag))
+	}
+	return `W/"` + etag + `"`
+}
+
+// Returns the origin's ETag appended to an exchangeETag, or "" if it has none.
+func originETagOf(etag string) string {
+	etag = strings.TrimPrefix(etag, "W/")
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return ""
+	}
+	i := strings.IndexByte(etag, '.')
+	if i < 0 {
+		return ""
+	}
+	originETag, err := base64.RawURLEncoding.DecodeString(etag[i+1 : len(etag)-1])
+	if err != nil {
+		return ""
+	}
+	return string(originETag)
+}
+
+// Returns the If-None-Match value with which to revalidate against the origin:
+// that of the caller, with each exchangeETag replaced by the origin's ETag
+// within it. Those with none are dropped, as the origin can't match them.
+func originIfNoneMatch(ifNoneMatch string) string {
+	var candidates []string
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = util.TrimHeaderValue(candidate)
+		if candidate == "" {
+			continue
+		}
+		if !exchangeETagPattern.MatchString(candidate) {
+			candidates = append(candidates, candidate)
+		} else if originETag := originETagOf(candidate); originETag != "" {
+			candidates = append(candidates, originETag)
+		}
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// Returns the ETag for a 304 from the origin, in response to a request with
+// the given If-None-Match: the first of its exchangeETags that appended the
+// origin's ETag, or "" if none did (e.g. the caller revalidated the origin's
+// ETag directly).
+func notModifiedETag(ifNoneMatch string, originETag string) string {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = util.TrimHeaderValue(candidate)
+		if !exchangeETagPattern.MatchString(candidate) {
+			continue
+		}
+		if appended := originETagOf(candidate); appended != "" && (originETag == "" || etagMatches(appended, strings.TrimPrefix(originETag, "W/"))) {
+			return "W/" + strings.TrimPrefix(candidate, "W/")
+		}
+	}
+	return ""
+}
+
+// Returns true iff the If-None-Match value lists etag, or is "*", using the
+// weak comparison required by
+// https://tools.ietf.org/html/rfc7232#section-3.2.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = util.TrimHeaderValue(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// The certs with which to sign an exchange.
+type signingCerts struct {
+	cert *x509.Certificate
+	key  crypto.PrivateKey
+	// If non-nil, the exchange is signed with this too, per URLSet.DualSign
+	// or NextCert.DualSignOverlap.
+	secondaryCert *x509.Certificate
+	secondaryKey  crypto.PrivateKey
+}
+
+// Returns the certs with which to sign for urlSet at now, or an error if the
+// latest cert expires too soon for a signature to be useful.
+func (this *Signer) chooseCerts(urlSet *util.URLSet, now time.Time) (*signingCerts, error) {
+	certs := &signingCerts{cert: this.certHandler.GetLatestCert(), key: this.key}
+	if keyed, ok := this.certHandler.(certcache.KeyedCertHandler); ok {
+		certs.cert, certs.key = keyed.GetLatestCertAndKey()
+	}
+	// Browsers reject signatures that outlive the cert, so they're clamped
+	// to its expiry by limitByCerts. Don't bother signing if that leaves
+	// too little lifetime to be useful.
+	if remaining := certs.cert.NotAfter.Sub(now); remaining < minSignatureLifetime {
+		return nil, errors.Errorf("the cert expires at %v, in less than %v", certs.cert.NotAfter, minSignatureLifetime)
+	}
+	if dual, ok := this.certHandler.(certcache.DualCertHandler); ok && urlSet.DualSign {
+		certs.secondaryCert, certs.secondaryKey = dual.GetSecondaryCertAndKey()
+	} else if overlap, ok := this.certHandler.(certcache.OverlapCertHandler); ok {
+		// Around a cert rotation, every URLSet is signed with both.
+		certs.secondaryCert, certs.secondaryKey = overlap.GetOverlapCertAndKey()
+	}
+	if certs.secondaryCert != nil && certs.secondaryCert.NotAfter.Sub(now) < minSignatureLifetime {
+		log.Printf("Not signing with the secondary cert because it expires at %v, in less than %v.\n", certs.secondaryCert.NotAfter, minSignatureLifetime)
+		certs.secondaryCert = nil
+	}
+	return certs, nil
+}
+
+// Ends lifetime by the expiry of each of certs, and of its OCSP response, as
+// both signatures share the exchange's date and expiry.
+func (this *Signer) limitByCerts(lifetime *exchangeLifetime, certs *signingCerts) {
+	for _, signingCert := range []*x509.Certificate{certs.cert, certs.secondaryCert} {
+		if signingCert == nil {
+			continue
+		}
+		lifetime.limit(signingCert.NotAfter)
+		if nextUpdate, ok := this.ocspNextUpdate(signingCert); ok {
+			lifetime.limit(nextUpdate)
+		}
+	}
+}
+
+// Sets the exchange's Signature header, valid for lifetime, signed by the
+// primary cert and, if set, the secondary. digest is its Digest header value.
+func (this *Signer) signExchange(exchange *signedexchange.Exchange, signURL *url.URL, digest string, lifetime *exchangeLifetime, certs *signingCerts) *util.HTTPError {
+	certURL, err := this.genCertURL(certs.cert, signURL)
+	if err != nil {
+		return util.NewHTTPError(http.StatusInternalServerError, "Error building cert URL: ", err)
+	}
+	validityURL := signURL.ResolveReference(&url.URL{Path: util.ValidityMapPath})
+	if this.validityMap != nil {
+		validityURL = validitymap.ValidityURL(signURL, digest)
+	}
+	signer := signedexchange.Signer{
+		Date:        lifetime.date,
+		Expires:     lifetime.expires,
+		Certs:       []*x509.Certificate{certs.cert},
+		CertUrl:     certURL,
+		ValidityUrl: validityURL,
+		PrivKey:     certs.key,
+		// If nil, the default is to use getrandom(2) if available, else
+		// /dev/urandom.
+		Rand: this.rand,
+	}
+	if err := exchange.AddSignatureHeader(&signer); err != nil {
+		return util.NewHTTPError(http.StatusInternalServerError, "Error signing exchange: ", err)
+	}
+	if certs.secondaryCert != nil {
+		primarySignature := exchange.SignatureHeaderValue
+		secondaryCertURL, err := this.genCertURL(certs.secondaryCert, signURL)
+		if err != nil {
+			return util.NewHTTPError(http.StatusInternalServerError, "Error building secondary cert URL: ", err)
+		}
+		signer.Certs, signer.CertUrl, signer.PrivKey = []*x509.Certificate{certs.secondaryCert}, secondaryCertURL, certs.secondaryKey
+		if err := exchange.AddSignatureHeader(&signer); err != nil {
+			return util.NewHTTPError(http.StatusInternalServerError, "Error signing exchange with secondary cert: ", err)
+		}
+		// The Signature header is a list; Chrome validates only the
+		// first signature it can, so the primary goes first.
+		exchange.SignatureHeaderValue = primarySignature + ", " + exchange.SignatureHeaderValue
+	}
+	return nil
+}
+
+// Returns the NextUpdate of the OCSP response for cert, if the cert handler
+// can describe it.
+func (this *Signer) ocspNextUpdate(cert *x509.Certificate) (time.Time, bool) {
+	describer, ok := this.certHandler.(certcache.CertDescriber)
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, info := range describer.DescribeCerts() {
+		if info.Serial == cert.SerialNumber.String() && info.OCSPNextUpdate != nil {
+			return *info.OCSPNextUpdate, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Records the signatures made by signExchange with certs, once they're to be
+// served. An SXG rejected before then (e.g. by MaxSXGSize) never leaves the
+// process, so its signatures aren't counted.
+func recordSignatures(signURL *url.URL, certs *signingCerts) {
+	recordSignature(signURL, certs.key, certs.cert)
+	if certs.secondaryCert != nil {
+		recordSignature(signURL, certs.secondaryKey, certs.secondaryCert)
+	}
+}
+
+// Counts the signature in the amppkg_signatures metric, and records it in the
+// log, prefixed with "AUDIT:", for key-usage tracking.
+func recordSignature(signURL *url.URL, key crypto.PrivateKey, cert *x509.Certificate) {
+	keyID := "unknown"
+	if signer, ok := key.(crypto.Signer); ok {
+		if id, err := util.KeyID(signer.Public()); err == nil {
+			keyID = id
+		}
+	}
+	serial := cert.SerialNumber.Text(16)
+	signatures.Add(keyID+"/"+serial, 1)
+	log.Printf("AUDIT: Signed %q with key %s, cert serial %s.\n", signURL.String(), keyID, serial)
+}
+
+// Proxy the content unsigned. If body is non-nil, it is the already-read
+// prefix of fetchResp.Body, and is followed by any remainder.
 // TODO(twifkak): Take a look at the source code to httputil.ReverseProxy and
 // see what else needs to be implemented.
 func proxy(resp http.ResponseWriter, fetchResp *http.Response, body []byte) {
 	for k, v := range fetchResp.Header {
-		resp.Header()[k] = v
+		if k == "Vary" {
+			// Keep the request headers the packager varies on, too.
+			addVary(resp.Header(), v...)
+		} else {
+			resp.Header()[k] = v
+		}
 	}
 	resp.WriteHeader(fetchResp.StatusCode)
 	if body != nil {
-		resp.Write(body)
-	} else {
-		bytesCopied, err := io.Copy(resp, fetchResp.Body)
-		if err != nil {
-			if bytesCopied == 0 {
-				util.NewHTTPError(http.StatusInternalServerError, "Error copying response body").LogAndRespond(resp)
-			} else {
-				log.Printf("Error copying response body, %d bytes into stream\n", bytesCopied)
-			}
+		if _, err := resp.Write(body); err != nil {
+			log.Println("Error writing response body:", err)
+			return
 		}
 	}
+	bytesCopied, err := io.Copy(resp, fetchResp.Body)
+	if err != nil {
+		// The status has already been sent, so it's too late to
+		// respond with an error.
+		log.Printf("Error copying response body, %d bytes into stream: %v\n", bytesCopied+int64(len(body)), err)
+	}
 }
@@ -16,28 +16,54 @@ package signer
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/pem"
+	"expvar"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/cbor"
+	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/WICG/webpackage/go/signedexchange/mice"
 	"github.com/WICG/webpackage/go/signedexchange/structuredheader"
 	"github.com/ampproject/amppackager/packager/accept"
 	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/popularity"
 	"github.com/ampproject/amppackager/packager/rtv"
 	pkgt "github.com/ampproject/amppackager/packager/testing"
+	"github.com/ampproject/amppackager/packager/urlmatch"
 	"github.com/ampproject/amppackager/packager/util"
+	"github.com/ampproject/amppackager/packager/validitymap"
 	"github.com/ampproject/amppackager/transformer"
 	rpb "github.com/ampproject/amppackager/transformer/request"
 	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -67,6 +93,33 @@ func (this fakeCertHandler) IsHealthy() error {
 	return nil
 }
 
+// Signs with pkgt.Certs and, for URLSets with DualSign, pkgt.B3Certs2.
+type fakeDualCertHandler struct {
+	fakeCertHandler
+}
+
+func (this fakeDualCertHandler) GetLatestCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	return pkgt.Certs[0], pkgt.Key
+}
+
+func (this fakeDualCertHandler) GetSecondaryCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	return pkgt.B3Certs2[0], pkgt.B3Key2
+}
+
+// Signs with pkgt.Certs and, for all URLSets, pkgt.B3Certs2, as during a
+// rotation overlap.
+type fakeOverlapCertHandler struct {
+	fakeCertHandler
+}
+
+func (this fakeOverlapCertHandler) GetLatestCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	return pkgt.Certs[0], pkgt.Key
+}
+
+func (this fakeOverlapCertHandler) GetOverlapCertAndKey() (*x509.Certificate, crypto.PrivateKey) {
+	return pkgt.B3Certs2[0], pkgt.B3Key2
+}
+
 type SignerSuite struct {
 	suite.Suite
 	httpServer, tlsServer *httptest.Server
@@ -74,15 +127,22 @@ type SignerSuite struct {
 	shouldPackage         error
 	fakeHandler           func(resp http.ResponseWriter, req *http.Request)
 	lastRequest           *http.Request
+	clock                 *pkgt.FakeClock
+	readOnly              bool
+	signatureLifetime     time.Duration
+	certURLBase           *url.URL
+	popularity            *popularity.Tracker
 }
 
 func (this *SignerSuite) new(urlSets []util.URLSet) http.Handler {
 	forwardedRequestHeaders := []string{"Host", "X-Foo"}
-	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, forwardedRequestHeaders)
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, forwardedRequestHeaders, func() bool { return this.readOnly }, this.signatureLifetime, this.certURLBase)
 	this.Require().NoError(err)
 	// Accept the self-signed certificate generated by the test server.
 	handler.client = this.httpsClient
-	return mux.New(nil, handler, nil, nil)
+	handler.clock = this.clock
+	handler.TrackPopularity(this.popularity)
+	return mux.New(mux.Handlers{Signer: handler})
 }
 
 func (this *SignerSuite) get(t *testing.T, handler http.Handler, target string) *http.Response {
@@ -159,6 +219,14 @@ func (this *SignerSuite) TearDownSuite() {
 
 func (this *SignerSuite) SetupTest() {
 	this.shouldPackage = nil
+	this.readOnly = false
+	this.signatureLifetime = 0
+	this.certURLBase = nil
+	this.popularity = nil
+	this.lastRequest = nil
+	// Within the test cert's validity period, with room for a full-length
+	// signature.
+	this.clock = pkgt.NewFakeClock(pkgt.Certs[0].NotBefore.Add(24 * time.Hour))
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
 		this.lastRequest = req
 		resp.Header().Set("Content-Type", "text/html")
@@ -181,10 +249,12 @@ func (this *SignerSuite) TestSimple() {
 			"&sign="+url.QueryEscape(this.httpSignURL()+fakePath))
 
 	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
-	this.Assert().Equal(userAgent, this.lastRequest.Header.Get("User-Agent"))
+	this.Assert().Equal(defaultUserAgent(), this.lastRequest.Header.Get("User-Agent"))
 	this.Assert().Equal("1.1 amppkg", this.lastRequest.Header.Get("Via"))
 	this.Assert().Equal(`host="example.com"`, this.lastRequest.Header.Get("Forwarded"))
 	this.Assert().Equal("example.com", this.lastRequest.Header.Get("X-Forwarded-Host"))
+	this.Assert().Regexp("^[0-9a-f]{32}$", this.lastRequest.Header.Get("X-AmpPkg-Request-Id"))
+	this.Assert().Equal("sxg-packaging", this.lastRequest.Header.Get("X-AmpPkg-Purpose"))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 	this.Assert().Equal(fmt.Sprintf(`google;v="%d"`, transformer.SupportedVersions[0].Max), resp.Header.Get("AMP-Cache-Transform"))
 	this.Assert().Equal("nosniff", resp.Header.Get("X-Content-Type-Options"))
@@ -206,7 +276,6 @@ func (this *SignerSuite) TestSimple() {
 	this.Assert().Contains(exchange.SignatureHeaderValue, "cert-url=\""+this.httpSignURL()+"/amppkg/cert/"+pkgt.CertName+"\"")
 	certHash, _ := base64.RawURLEncoding.DecodeString(pkgt.CertName)
 	this.Assert().Contains(exchange.SignatureHeaderValue, "cert-sha256=*"+base64.StdEncoding.EncodeToString(certHash[:])+"*")
-	// TODO(twifkak): Control date, and test for expires and sig.
 
 	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
 	this.Require().NoError(err)
@@ -215,13 +284,14 @@ func (this *SignerSuite) TestSimple() {
 	this.Require().True(ok)
 	expires, ok := signatures[0].Params["expires"].(int64)
 	this.Require().True(ok)
+	this.Assert().Equal(this.clock.Now().Add(-24*time.Hour).Unix(), date)
 	this.Assert().Equal(int64(604800), expires-date)
 
 	// The response header values are untested here, as that is covered by signedexchange tests.
 
 	// For small enough bodies, the only thing that MICE does is add a record size prefix.
 	var payloadPrefix bytes.Buffer
-	binary.Write(&payloadPrefix, binary.BigEndian, uint64(miRecordSize))
+	binary.Write(&payloadPrefix, binary.BigEndian, uint64(util.MaxMIRecordSize))
 	this.Assert().Equal(append(payloadPrefix.Bytes(), transformedBody...), exchange.Payload)
 }
 
@@ -246,7 +316,7 @@ func (this *SignerSuite) TestFetchSignWithForwardedRequestHeaders() {
 		"/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath)+"&sign="+url.QueryEscape(this.httpSignURL_CertSubjectCN()+fakePath),
 		"www.example.com", header)
 	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
-	this.Assert().Equal(userAgent, this.lastRequest.Header.Get("User-Agent"))
+	this.Assert().Equal(defaultUserAgent(), this.lastRequest.Header.Get("User-Agent"))
 	this.Assert().Equal("1.1 amppkg", this.lastRequest.Header.Get("Via"))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 	this.Assert().Equal(fmt.Sprintf(`google;v="%d"`, transformer.SupportedVersions[0].Max), resp.Header.Get("AMP-Cache-Transform"))
@@ -270,10 +340,77 @@ func (this *SignerSuite) TestFetchSignWithForwardedRequestHeaders() {
 	certHash, _ := base64.RawURLEncoding.DecodeString(pkgt.CertName)
 	this.Assert().Contains(exchange.SignatureHeaderValue, "cert-sha256=*"+base64.StdEncoding.EncodeToString(certHash[:])+"*")
 	var payloadPrefix bytes.Buffer
-	binary.Write(&payloadPrefix, binary.BigEndian, uint64(miRecordSize))
+	binary.Write(&payloadPrefix, binary.BigEndian, uint64(util.MaxMIRecordSize))
 	this.Assert().Equal(append(payloadPrefix.Bytes(), transformedBody...), exchange.Payload)
 }
 
+func (this *SignerSuite) TestURLSetForwardedRequestHeaders() {
+	urlSets := []util.URLSet{{
+		Sign:                    &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		ForwardedRequestHeaders: []string{"Accept-Language", "X-Publisher-Auth"},
+	}}
+	header := http.Header{"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"Accept-Language": {"fr"}, "X-Publisher-Auth": {"secret"}, "X-Foo": {"foo"}, "X-Bar": {"bar"}}
+	resp := pkgt.GetH(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), header)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("fr", this.lastRequest.Header.Get("Accept-Language"))
+	this.Assert().Equal("secret", this.lastRequest.Header.Get("X-Publisher-Auth"))
+	// Along with the top-level ForwardedRequestHeaders.
+	this.Assert().Equal("foo", this.lastRequest.Header.Get("X-Foo"))
+	this.Assert().Empty(this.lastRequest.Header.Get("X-Bar"))
+}
+
+func (this *SignerSuite) TestFetchHeaders() {
+	urlSets := []util.URLSet{{
+		Sign:         &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		FetchHeaders: map[string]string{"X-Amppkg-Token": "secret", "X-Foo": "fixed", "Host": "render.example.com"},
+	}}
+	header := http.Header{"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"X-Foo": {"foo"}}
+	resp := pkgt.GetH(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), header)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("secret", this.lastRequest.Header.Get("X-AmpPkg-Token"))
+	// Overriding the forwarded request header.
+	this.Assert().Equal("fixed", this.lastRequest.Header.Get("X-Foo"))
+	this.Assert().Equal("render.example.com", this.lastRequest.Host)
+}
+
+func (this *SignerSuite) TestFetchHeadersNotSentAcrossHosts() {
+	otherHost := strings.Replace(this.httpHost(), "127.0.0.1", "localhost", 1)
+	urlSets := []util.URLSet{{
+		Sign:         &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch:        &util.URLPattern{[]string{"http"}, `(127\.0\.0\.1|localhost):\d+`, "", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		FetchHeaders: map[string]string{"X-Amppkg-Token": "secret"},
+		MaxRedirects: 2,
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/amp/same-host":
+			resp.Header().Set("Location", fakePath)
+			resp.WriteHeader(302)
+		case "/amp/other-host":
+			resp.Header().Set("Location", "http://"+otherHost+fakePath)
+			resp.WriteHeader(302)
+		default:
+			this.lastRequest = req
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Write(fakeBody)
+		}
+	}
+	get := func(path string) {
+		resp := this.get(this.T(), this.new(urlSets), "/priv/doc?fetch="+url.QueryEscape(this.httpURL()+path)+"&sign="+url.QueryEscape(this.httpSignURL()+path))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Require().Equal(fakePath, this.lastRequest.URL.Path)
+	}
+
+	get("/amp/same-host")
+	this.Assert().Equal("secret", this.lastRequest.Header.Get("X-AmpPkg-Token"))
+
+	get("/amp/other-host")
+	this.Assert().Equal(otherHost, this.lastRequest.Host)
+	this.Assert().Empty(this.lastRequest.Header.Get("X-AmpPkg-Token"))
+}
+
 func (this *SignerSuite) TestForwardedHost() {
 	urlSets := []util.URLSet{{
 		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
@@ -293,302 +430,2426 @@ func (this *SignerSuite) TestForwardedHost() {
 	this.Assert().Equal("www.example.com,example.com", this.lastRequest.Header.Get("X-Forwarded-Host"))
 }
 
-func (this *SignerSuite) TestEscapeQueryParamsInFetchAndSign() {
+func (this *SignerSuite) TestPropagatesRequestID() {
 	urlSets := []util.URLSet{{
-		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, nil},
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, boolPtr(true)},
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
 	}}
-	resp := this.get(this.T(), this.new(urlSets),
-		"/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath+"?<hi>")+
-			"&sign="+url.QueryEscape(this.httpSignURL()+fakePath+"?<hi>"))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-	this.Assert().Equal(fakePath+"?%3Chi%3E", this.lastRequest.URL.String())
+	header := http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"X-AmpPkg-Request-Id": {"abc-123"}}
+	this.getFRH(this.T(), this.new(urlSets),
+		"/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath)+
+			"&sign="+url.QueryEscape(this.httpSignURL()+fakePath),
+		"example.com", header)
+
+	this.Assert().Equal("abc-123", this.lastRequest.Header.Get("X-AmpPkg-Request-Id"))
+	this.Assert().Equal("sxg-packaging", this.lastRequest.Header.Get("X-AmpPkg-Purpose"))
+}
+
+func (this *SignerSuite) TestNegotiatesSxgVersion() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	certFetcher := func(string) ([]byte, error) {
+		chain, err := certurl.NewCertChain(pkgt.Certs, []byte("ocsp"), nil)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = chain.Write(&buf)
+		return buf.Bytes(), err
+	}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, 0, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	for _, v := range []string{"b1", "b2", "b3"} {
+		resp := pkgt.GetH(this.T(), mux.New(mux.Handlers{Signer: handler}),
+			"/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath)+"&sign="+url.QueryEscape(this.httpSignURL()+fakePath),
+			http.Header{"AMP-Cache-Transform": {"google"}, "Accept": {`application/signed-exchange;v="b0,` + v + `"`}})
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		this.Assert().Equal("application/signed-exchange;v="+v, resp.Header.Get("Content-Type"))
+
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err, v)
+		this.Assert().Equal(accept.LibraryVersion(v), exchange.Version)
+		payload, ok := exchange.Verify(this.clock.Now(), certFetcher, log.New(ioutil.Discard, "", 0))
+		this.Require().True(ok, v)
+		this.Assert().Equal(transformedBody, payload)
+	}
+}
+
+func (this *SignerSuite) TestSignDeterministically() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	// Otherwise, the origin's Date would vary.
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header()["Date"] = nil
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, 0, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.SignDeterministically(this.clock, pkgt.FixedRand(7))
+	var bodies [][]byte
+	for i := 0; i < 2; i++ {
+		resp := this.get(this.T(), mux.New(mux.Handlers{Signer: handler}),
+			"/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath)+"&sign="+url.QueryEscape(this.httpSignURL()+fakePath))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		body, err := ioutil.ReadAll(resp.Body)
+		this.Require().NoError(err)
+		bodies = append(bodies, body)
+	}
+	this.Assert().Equal(bodies[0], bodies[1])
+}
+
+func (this *SignerSuite) TestDualSign() {
+	certFetcher := func(certURL string) ([]byte, error) {
+		certs := pkgt.Certs
+		if strings.HasSuffix(certURL, "/"+util.CertName(pkgt.B3Certs2[0])) {
+			certs = pkgt.B3Certs2
+		}
+		chain, err := certurl.NewCertChain(certs, []byte("ocsp"), nil)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = chain.Write(&buf)
+		return buf.Bytes(), err
+	}
+	for _, dualSign := range []bool{false, true} {
+		urlSets := []util.URLSet{{
+			Sign:     &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+			DualSign: dualSign,
+		}}
+		handler, err := New(fakeDualCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+		this.Require().NoError(err)
+		handler.client = this.httpsClient
+		handler.clock = this.clock
+		resp := this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+		this.Require().NoError(err)
+		if !dualSign {
+			this.Assert().Len(signatures, 1)
+			continue
+		}
+		this.Require().Len(signatures, 2)
+		this.Assert().Contains(signatures[1].Params["cert-url"], util.CertName(pkgt.B3Certs2[0]))
+
+		// Each signature is valid on its own.
+		for _, signature := range strings.Split(exchange.SignatureHeaderValue, ", ") {
+			exchange.SignatureHeaderValue = signature
+			payload, ok := exchange.Verify(this.clock.Now(), certFetcher, log.New(ioutil.Discard, "", 0))
+			this.Require().True(ok, signature)
+			this.Assert().Equal(transformedBody, payload)
+		}
+	}
+}
 
+func (this *SignerSuite) TestDualSignsDuringRotationOverlap() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err := New(fakeOverlapCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	resp := this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(this.httpSignURL()+fakePath+"?%3Chi%3E", exchange.RequestURI)
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	this.Require().Len(signatures, 2)
+	this.Assert().Contains(signatures[0].Params["cert-url"], util.CertName(pkgt.Certs[0]))
+	this.Assert().Contains(signatures[1].Params["cert-url"], util.CertName(pkgt.B3Certs2[0]))
 }
 
-func (this *SignerSuite) TestDisallowInvalidCharsSign() {
+func (this *SignerSuite) TestNotAcceptableSxgVersion() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
-	resp := this.get(this.T(), this.new(urlSets),
-		"/priv/doc?&sign="+url.QueryEscape(this.httpSignURL()+fakePath+"<hi>"))
-	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+	resp := pkgt.GetH(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"text/html, application/signed-exchange;v=b0"}})
+	this.Assert().Equal(http.StatusNotAcceptable, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("b3,b2,b1", resp.Header.Get("X-AmpPkg-Sxg-Versions"))
 }
 
-func (this *SignerSuite) TestNoFetchParam() {
+func (this *SignerSuite) TestNonSXGFallback() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign:           &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		NonSXGFallback: util.NonSXGProxy,
+	}}
+	// The fallback applies even if the Accept header isn't required.
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, false, nil, nil, 0, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	for _, acceptHeader := range []string{"text/html", "text/html, application/signed-exchange;v=b0"} {
+		resp := pkgt.GetH(this.T(), server, target, http.Header{"Accept": {acceptHeader}})
+		this.Assert().Equal(http.StatusOK, resp.StatusCode, acceptHeader)
+		this.Assert().Equal("text/html", resp.Header.Get("Content-Type"), acceptHeader)
+		this.Assert().Equal("Accept", resp.Header.Get("Vary"), acceptHeader)
+		body, _ := ioutil.ReadAll(resp.Body)
+		this.Assert().Equal(fakeBody, body, acceptHeader)
+	}
+
+	resp := this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	this.Assert().Equal("application/signed-exchange;v="+accept.AcceptedSxgVersion, resp.Header.Get("Content-Type"))
+
+	urlSets[0].NonSXGFallback = util.NonSXGRedirect
+	this.lastRequest = nil
+	resp = pkgt.GetH(this.T(), this.new(urlSets), target, http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"text/html, application/signed-exchange;v=b0"}})
+	this.Assert().Equal(http.StatusFound, resp.StatusCode)
+	this.Assert().Equal(this.httpsURL()+fakePath, resp.Header.Get("Location"))
+	this.Assert().Equal("Accept, AMP-Cache-Transform", resp.Header.Get("Vary"))
+	// The redirect doesn't need the document.
+	this.Assert().Nil(this.lastRequest)
+}
+
+func (this *SignerSuite) TestSignatureLifetime() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	this.signatureLifetime = 48 * time.Hour
 	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
-	this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	this.Require().NotEmpty(signatures)
+	date, ok := signatures[0].Params["date"].(int64)
+	this.Require().True(ok)
+	expires, ok := signatures[0].Params["expires"].(int64)
+	this.Require().True(ok)
+	this.Assert().Equal(int64(48*60*60), expires-date)
 }
 
-func (this *SignerSuite) TestSignAsPathParam() {
+func (this *SignerSuite) TestCertURLBase() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
-	resp := this.get(this.T(), this.new(urlSets), `/priv/doc/`+this.httpsURL()+fakePath)
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.certURLBase = urlOrDie("https://cdn.example.com/certs/")
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
-	this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
+	this.Assert().Contains(exchange.SignatureHeaderValue, `cert-url="https://cdn.example.com/certs/`+pkgt.CertName+`"`)
 }
 
-func (this *SignerSuite) TestSignAsPathParamWithQuery() {
+func (this *SignerSuite) TestClampsSignatureToCertExpiry() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, nil},
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
-	resp := this.get(this.T(), this.new(urlSets), `/priv/doc/`+this.httpsURL()+fakePath+"?amp=1")
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.clock = pkgt.NewFakeClock(pkgt.Certs[0].NotAfter.Add(-3 * 24 * time.Hour))
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(fakePath+"?amp=1", this.lastRequest.URL.String())
-	this.Assert().Equal(this.httpsURL()+fakePath+"?amp=1", exchange.RequestURI)
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	this.Require().NotEmpty(signatures)
+	expires, ok := signatures[0].Params["expires"].(int64)
+	this.Require().True(ok)
+	this.Assert().Equal(pkgt.Certs[0].NotAfter.Unix(), expires)
 }
 
-// Ensure that the server doesn't attempt to percent-decode the sign URL.
-func (this *SignerSuite) TestSignAsPathParamWithUnusualPctEncoding() {
+func (this *SignerSuite) TestProxiesUnsignedNearCertExpiry() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
-	resp := this.get(this.T(), this.new(urlSets), `/priv/doc/`+this.httpsURL()+fakePath+`%2A`)
+	this.clock = pkgt.NewFakeClock(pkgt.Certs[0].NotAfter.Add(-30 * time.Minute))
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
 	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-
-	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(fakePath+"%2A", this.lastRequest.URL.String())
-	this.Assert().Equal(this.httpsURL()+fakePath+"%2A", exchange.RequestURI)
+	this.Assert().Equal(fakeBody, body)
 }
 
-func (this *SignerSuite) TestPreservesContentType() {
+func (this *SignerSuite) TestAMPOnly() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign:    &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		AMPOnly: true,
+	}}
+	ampBody := []byte("<!doctype html><html amp><body>Hello</body></html>")
+	jsonBody := []byte(`{"html": "amp"}`)
+	for _, test := range []struct {
+		body   []byte
+		signed bool
+	}{{ampBody, true}, {jsonBody, false}} {
+		body := test.body
+		this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Write(body)
+		}
+		resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		if test.signed {
+			this.Assert().Equal("application/signed-exchange;v=b3", resp.Header.Get("Content-Type"))
+		} else {
+			this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+			got, err := ioutil.ReadAll(resp.Body)
+			this.Require().NoError(err)
+			this.Assert().Equal(body, got)
+		}
+	}
+}
+
+func (this *SignerSuite) TestShortTTL() {
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html;charset=utf-8;v=5")
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", "public, max-age=3600, s-maxage=300")
 		resp.Write(fakeBody)
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	for _, test := range []struct {
+		threshold, policy string
+		signed            bool
+		expires           time.Time
+	}{
+		{"5m", util.ShortTTLRefuse, true, this.clock.Now().Add(6 * 24 * time.Hour)},
+		{"10m", util.ShortTTLRefuse, false, time.Time{}},
+		{"10m", util.ShortTTLShorten, true, this.clock.Now().Add(5 * time.Minute)},
+		{"10m", util.ShortTTLWarn, true, this.clock.Now().Add(6 * 24 * time.Hour)},
+	} {
+		urlSets := []util.URLSet{{
+			Sign:     &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+			ShortTTL: &util.ShortTTLConfig{Threshold: test.threshold, Policy: test.policy},
+		}}
+		resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		if !test.signed {
+			this.Assert().Equal("text/html", resp.Header.Get("Content-Type"), "%s %s", test.threshold, test.policy)
+			continue
+		}
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err, "%s %s", test.threshold, test.policy)
+		signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+		this.Require().NoError(err)
+		this.Require().NotEmpty(signatures)
+		expires, ok := signatures[0].Params["expires"].(int64)
+		this.Require().True(ok)
+		this.Assert().Equal(test.expires.Unix(), expires, "%s %s", test.threshold, test.policy)
+	}
+}
 
+func (this *SignerSuite) TestCapsInnerCacheControl() {
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", "public, max-age=31536000, s-maxage=60")
+		resp.Header().Set("Expires", "Fri, 01 Jan 2100 00:00:00 GMT")
+		resp.Write(fakeBody)
+	}
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal("text/html;charset=utf-8;v=5", exchange.ResponseHeaders.Get("Content-Type"))
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	this.Require().NotEmpty(signatures)
+	expires, ok := signatures[0].Params["expires"].(int64)
+	this.Require().True(ok)
+
+	// max-age is lowered to the signature's remaining lifetime; s-maxage is
+	// already shorter.
+	remaining := expires - this.clock.Now().Unix()
+	this.Assert().Equal(fmt.Sprintf("public, max-age=%d, s-maxage=60", remaining), exchange.ResponseHeaders.Get("Cache-Control"))
+	// As is Expires.
+	this.Assert().Equal(time.Unix(expires, 0).UTC().Format(http.TimeFormat), exchange.ResponseHeaders.Get("Expires"))
 }
 
-func (this *SignerSuite) TestRemovesLinkHeaders() {
+func (this *SignerSuite) TestOuterResponseHeaders() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	// The origin's Date differs on every fetch, but isn't part of the ETag.
+	date := 0
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Link", "rel=preload;<http://1.2.3.4/>")
+		date++
+		resp.Header().Set("Date", time.Unix(int64(date), 0).UTC().Format(http.TimeFormat))
+		resp.Header().Set("Content-Type", "text/html")
 		resp.Write(fakeBody)
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, 0, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.SignDeterministically(this.clock, pkgt.FixedRand(7))
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
 
-	exchange, err := signedexchange.ReadExchange(resp.Body)
+	resp := this.get(this.T(), server, target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Link"))
+	this.Assert().Equal(strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+	// Fresh until an hour before the signature expires.
+	expires, err := http.ParseTime(resp.Header.Get("X-AmpPkg-Signature-Expires"))
+	this.Require().NoError(err)
+	this.Assert().Equal(fmt.Sprintf("public, no-transform, max-age=%d", expires.Unix()-this.clock.Now().Unix()-3600), resp.Header.Get("Cache-Control"))
+	etag := resp.Header.Get("ETag")
+	this.Assert().Regexp(`^W/"[A-Za-z0-9_-]{43}"$`, etag)
+
+	for _, ifNoneMatch := range []string{etag, `"other", ` + strings.TrimPrefix(etag, "W/"), "*"} {
+		resp = pkgt.GetH(this.T(), server, target, http.Header{
+			"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+			"If-None-Match": {ifNoneMatch}})
+		this.Assert().Equal(http.StatusNotModified, resp.StatusCode, ifNoneMatch)
+		this.Assert().Equal(etag, resp.Header.Get("ETag"), ifNoneMatch)
+		this.Assert().Equal("no-transform, max-age=0", resp.Header.Get("Cache-Control"), ifNoneMatch)
+		body, err := ioutil.ReadAll(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Empty(body, ifNoneMatch)
+	}
+
+	// A later signature of the same response still matches.
+	this.clock.Advance(time.Hour)
+	resp = pkgt.GetH(this.T(), server, target, http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"If-None-Match": {etag}})
+	this.Assert().Equal(http.StatusNotModified, resp.StatusCode)
+	this.Assert().Equal(etag, resp.Header.Get("ETag"))
 }
 
-func (this *SignerSuite) TestRemovesStatefulHeaders() {
+func (this *SignerSuite) TestRevalidatesAgainstOrigin() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Set-Cookie", "yum yum yum")
+		this.lastRequest = req
+		resp.Header().Set("ETag", `"v1"`)
+		resp.Header().Set("Last-Modified", lastModified)
+		resp.Header().Set("Cache-Control", "max-age=31536000")
+		resp.Header().Set("Expires", "Tue, 02 Jan 2035 15:04:05 GMT")
+		if strings.Contains(req.Header.Get("If-None-Match"), `"v1"`) || req.Header.Get("If-Modified-Since") == lastModified {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
 		resp.Write(fakeBody)
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(lastModified, resp.Header.Get("Last-Modified"))
+	etag := resp.Header.Get("ETag")
+	this.Assert().Regexp(`^W/"[A-Za-z0-9_-]{43}\.[A-Za-z0-9_-]+"$`, etag)
+
+	resp = pkgt.GetH(this.T(), this.new(urlSets), target, http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"If-None-Match": {`"other", ` + etag}})
+	this.Assert().Equal(`"other", "v1"`, this.lastRequest.Header.Get("If-None-Match"))
+	this.Assert().Equal(http.StatusNotModified, resp.StatusCode)
+	this.Assert().Equal(etag, resp.Header.Get("ETag"))
+	this.Assert().Equal(lastModified, resp.Header.Get("Last-Modified"))
+	// The 304 doesn't freshen the SXG past its signature.
+	this.Assert().Equal("no-transform, max-age=0", resp.Header.Get("Cache-Control"))
+	this.Assert().Empty(resp.Header.Get("Expires"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Empty(body)
+
+	resp = pkgt.GetH(this.T(), this.new(urlSets), target, http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"If-Modified-Since": {lastModified}})
+	this.Assert().Equal(http.StatusNotModified, resp.StatusCode)
+	this.Assert().Empty(resp.Header.Get("ETag"))
+	this.Assert().Equal(lastModified, resp.Header.Get("Last-Modified"))
+	this.Assert().Equal("no-transform, max-age=0", resp.Header.Get("Cache-Control"))
+	this.Assert().Empty(resp.Header.Get("Expires"))
+}
 
+func (this *SignerSuite) TestSignatureMetadataHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Set-Cookie"))
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	date, ok := signatures[0].Params["date"].(int64)
+	this.Require().True(ok)
+	expires, ok := signatures[0].Params["expires"].(int64)
+	this.Require().True(ok)
+
+	this.Assert().Equal(time.Unix(date, 0).UTC().Format(http.TimeFormat), resp.Header.Get("X-AmpPkg-Signature-Date"))
+	this.Assert().Equal(time.Unix(expires, 0).UTC().Format(http.TimeFormat), resp.Header.Get("X-AmpPkg-Signature-Expires"))
+	certName := resp.Header.Get("X-AmpPkg-Signature-Cert")
+	this.Assert().Equal(util.CertName(pkgt.Certs[0]), certName)
+	this.Assert().Contains(signatures[0].Params["cert-url"], certName)
 }
 
-func (this *SignerSuite) TestMutatesCspHeaders() {
+func (this *SignerSuite) TestHead() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{
-			[]string{"https"},
-			"",
-			this.httpsHost(),
-			stringPtr("/amp/.*"),
-			[]string{},
-			stringPtr(""),
-			false,
-			2000,
-			nil}}}
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	got := this.get(this.T(), this.new(urlSets), target)
+	this.Require().Equal(http.StatusOK, got.StatusCode, "incorrect status: %#v", got)
+
+	req := httptest.NewRequest(http.MethodHead, target, nil)
+	req.Header.Set("AMP-Cache-Transform", "google")
+	req.Header.Set("Accept", "application/signed-exchange;v="+accept.AcceptedSxgVersion)
+	rec := httptest.NewRecorder()
+	this.new(urlSets).ServeHTTP(rec, req)
+	head := rec.Result()
+	this.Require().Equal(http.StatusOK, head.StatusCode, "incorrect status: %#v", head)
+	// The origin is still fetched and validated.
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+	for _, header := range []string{"Content-Type", "Cache-Control", "AMP-Cache-Transform", "X-AmpPkg-Signature-Date", "X-AmpPkg-Signature-Expires", "X-AmpPkg-Signature-Cert"} {
+		this.Assert().NotEmpty(head.Header.Get(header), header)
+		this.Assert().Equal(got.Header.Get(header), head.Header.Get(header), header)
+	}
+	this.Assert().Empty(head.Header.Get("Content-Length"))
+	body, err := ioutil.ReadAll(head.Body)
+	this.Require().NoError(err)
+	this.Assert().Empty(body)
+}
+
+func (this *SignerSuite) TestCountsSignatures() {
+	keyID, err := util.KeyID(pkgt.Key.(crypto.Signer).Public())
+	this.Require().NoError(err)
+	label := keyID + "/" + pkgt.Certs[0].SerialNumber.Text(16)
+	count := func() int64 {
+		if v, ok := signatures.Get(label).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	this.Assert().Equal(before+1, count())
+
+	// Unsigned responses aren't counted.
+	this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/notamp"))
+	this.Assert().Equal(before+1, count())
+}
+
+func (this *SignerSuite) TestTracksPopularity() {
+	urlSets := []util.URLSet{{
+		Fetch: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	this.popularity = popularity.New(10, time.Hour)
+	handler := this.new(urlSets)
+	this.get(this.T(), handler, "/priv/doc?fetch="+url.QueryEscape(this.httpsURL()+fakePath)+"&sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.get(this.T(), handler, "/priv/doc?fetch="+url.QueryEscape(this.httpsURL()+fakePath)+"&sign="+url.QueryEscape(this.httpsURL()+fakePath))
+
+	top := this.popularity.Top(10)
+	this.Require().Len(top, 1)
+	this.Assert().Equal(this.httpsURL()+fakePath, top[0].Sign)
+	this.Assert().Equal(this.httpsURL()+fakePath, top[0].Fetch)
+	this.Assert().InDelta(2, top[0].Score, 0.01)
+	this.Assert().NotNil(top[0].Expires)
+}
+
+func (this *SignerSuite) TestPinnedSPKIHashes() {
+	urlSets := []util.URLSet{{
+		Sign:             &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		PinnedSPKIHashes: []string{spkiHash(this.tlsServer.Certificate())},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestPinnedSPKIHashesMismatch() {
+	urlSets := []util.URLSet{{
+		Sign:             &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		PinnedSPKIHashes: []string{spkiHash(pkgt.Certs[0])},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestPinnedSPKIHashesRequiresTLS() {
+	urlSets := []util.URLSet{{
+		Sign:             &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch:            &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		PinnedSPKIHashes: []string{spkiHash(this.tlsServer.Certificate())},
+	}}
+	resp := this.get(this.T(), this.new(urlSets),
+		"/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath)+
+			"&sign="+url.QueryEscape(this.httpSignURL()+fakePath))
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestReadOnly() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler := this.new(urlSets)
+	this.readOnly = true
+	resp := this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("60", resp.Header.Get("Retry-After"))
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+	this.Assert().Nil(this.lastRequest)
+
+	// It can be toggled at runtime.
+	this.readOnly = false
+	resp = this.get(this.T(), handler, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().NotNil(this.lastRequest)
+}
+
+func (this *SignerSuite) TestEscapeQueryParamsInFetchAndSign() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, boolPtr(true)},
+	}}
+	resp := this.get(this.T(), this.new(urlSets),
+		"/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath+"?<hi>")+
+			"&sign="+url.QueryEscape(this.httpSignURL()+fakePath+"?<hi>"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(fakePath+"?%3Chi%3E", this.lastRequest.URL.String())
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(this.httpSignURL()+fakePath+"?%3Chi%3E", exchange.RequestURI)
+}
+
+type fakeAllowlist map[string]bool
+
+func (this fakeAllowlist) Contains(host string) bool { return this[host] }
+
+func (this *SignerSuite) TestFetchAllowlist() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"http"}, "", "origin.example.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	target := "/priv/doc?fetch=" + url.QueryEscape(this.httpURL()+fakePath) + "&sign=" + url.QueryEscape(this.httpSignURL()+fakePath)
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.UseFetchAllowlists([]urlmatch.HostAllowlist{fakeAllowlist{this.httpHost(): true}})
+	resp = this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+}
+
+func (this *SignerSuite) TestValidityMap() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	validityMap, err := validitymap.New()
+	this.Require().NoError(err)
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.UseValidityMap(validityMap)
+	server := mux.New(mux.Handlers{Signer: handler, ValidityMap: validityMap})
+
+	// Serving the recorded signature is tested in validitymap_test.go, as
+	// it depends on the validity map's clock.
+	signURL, err := url.Parse(this.httpsURL() + fakePath)
+	this.Require().NoError(err)
+	resp := this.get(this.T(), server, "/priv/doc?sign="+url.QueryEscape(signURL.String()))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	// It's specific to the payload, as the signature covers only that.
+	digest := exchange.ResponseHeaders.Get("Digest")
+	this.Require().NotEmpty(digest)
+	validityURL := validitymap.ValidityURL(signURL, digest)
+	this.Assert().Contains(exchange.SignatureHeaderValue, `validity-url="`+validityURL.String()+`"`)
+
+}
+
+func (this *SignerSuite) TestDisallowInvalidCharsSign() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := this.get(this.T(), this.new(urlSets),
+		"/priv/doc?&sign="+url.QueryEscape(this.httpSignURL()+fakePath+"<hi>"))
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestNoFetchParam() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+	this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
+}
+
+func (this *SignerSuite) TestSignAsPathParam() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), `/priv/doc/`+this.httpsURL()+fakePath)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+	this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
+}
+
+func (this *SignerSuite) TestSignAsPathParamWithQuery() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(".*"), false, 2000, nil},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), `/priv/doc/`+this.httpsURL()+fakePath+"?amp=1")
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakePath+"?amp=1", this.lastRequest.URL.String())
+	this.Assert().Equal(this.httpsURL()+fakePath+"?amp=1", exchange.RequestURI)
+}
+
+// Ensure that the server doesn't attempt to percent-decode the sign URL.
+func (this *SignerSuite) TestSignAsPathParamWithUnusualPctEncoding() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), `/priv/doc/`+this.httpsURL()+fakePath+`%2A`)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakePath+"%2A", this.lastRequest.URL.String())
+	this.Assert().Equal(this.httpsURL()+fakePath+"%2A", exchange.RequestURI)
+}
+
+func (this *SignerSuite) TestPreservesContentType() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html;charset=utf-8;v=5")
+		resp.Write(fakeBody)
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("text/html;charset=utf-8;v=5", exchange.ResponseHeaders.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestRemovesLinkHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Link", "rel=preload;<http://1.2.3.4/>")
+		resp.Write(fakeBody)
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Link"))
+}
+
+func (this *SignerSuite) TestRemovesStatefulHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Set-Cookie", "yum yum yum")
+		resp.Write(fakeBody)
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Set-Cookie"))
+}
+
+func (this *SignerSuite) TestSignedHeaders() {
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("ETag", "superrad")
+		resp.Header().Set("X-Frobnicate", "yes")
+		resp.Header().Set("Set-Cookie", "yum yum yum")
+		resp.Write(fakeBody)
+	}
+	for _, test := range []struct {
+		signedHeaders       []string
+		present, notPresent []string
+	}{
+		// By default, all but the stateful ones.
+		{nil, []string{"Content-Type", "Date", "ETag", "X-Frobnicate"}, []string{"Set-Cookie"}},
+		{[]string{"X-Frobnicate"}, []string{"Content-Type", "X-Frobnicate"}, []string{"Date", "ETag"}},
+		{[]string{"*"}, []string{"Content-Type", "Date", "ETag", "X-Frobnicate"}, []string{"Set-Cookie"}},
+	} {
+		urlSets := []util.URLSet{{
+			Sign:          &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+			SignedHeaders: test.signedHeaders,
+		}}
+		resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		for _, header := range append(test.present, "Content-Security-Policy", "Digest", "X-Content-Type-Options") {
+			this.Assert().Contains(exchange.ResponseHeaders, http.CanonicalHeaderKey(header), "%v", test.signedHeaders)
+		}
+		for _, header := range test.notPresent {
+			this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey(header), "%v", test.signedHeaders)
+		}
+	}
+}
+
+func (this *SignerSuite) TestMutatesCspHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{
+			[]string{"https"},
+			"",
+			this.httpsHost(),
+			stringPtr("/amp/.*"),
+			[]string{},
+			stringPtr(""),
+			false,
+			2000,
+			nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// Expect base-uri and block-all-mixed-content to remain unmodified.
+		// Expect require-sri-for to be stripped.
+		// Expect script-src to be overwritten.
+		resp.Header().Set(
+			"Content-Security-Policy",
+			"base-uri http://*.example.com; "+
+				"block-all-mixed-content; "+
+				"require-sri-for script; "+
+				"script-src https://notallowed.org/")
+		resp.Write(fakeBody)
+	}
+
+	resp := this.get(
+		this.T(),
+		this.new(urlSets),
+		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(
+		http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(
+		"base-uri http://*.example.com;"+
+			"block-all-mixed-content;"+
+			"default-src * blob: data:;"+
+			"report-uri https://csp-collector.appspot.com/csp/amp;"+
+			"script-src blob: https://cdn.ampproject.org/rtv/ https://cdn.ampproject.org/v0.js https://cdn.ampproject.org/v0/ https://cdn.ampproject.org/viewer/;"+
+			"style-src 'unsafe-inline' https://cdn.materialdesignicons.com https://cloud.typography.com https://fast.fonts.net https://fonts.googleapis.com https://maxcdn.bootstrapcdn.com https://p.typekit.net https://pro.fontawesome.com https://use.fontawesome.com https://use.typekit.net;"+
+			"object-src 'none'",
+		exchange.ResponseHeaders.Get("Content-Security-Policy"))
+}
+
+func (this *SignerSuite) TestAddsLinkHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte("<html amp><head><link rel=stylesheet href=foo><script src=bar>"))
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<foo>;rel=preload;as=style,<bar>;rel=preload;as=script", exchange.ResponseHeaders.Get("Link"))
+}
+
+func (this *SignerSuite) TestEscapesLinkHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// This shouldn't happen for valid AMP, and AMP Caches should
+		// verify the Link header so that it wouldn't be ingested.
+		// However, it would be nice to limit the impact that could be
+		// caused by transformation of an invalid AMP, e.g. on a
+		// same-origin impression.
+		resp.Write([]byte(`<html amp><head><script src="https://foo.com/a,b>c?d>e|f">`))
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<https://foo.com/a,b%3Ec?d%3Ee%7Cf>;rel=preload;as=script", exchange.ResponseHeaders.Get("Link"))
+}
+
+func (this *SignerSuite) TestDecodesCompressedFetch() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	labeled := true
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
+		resp.Header().Set("Content-Type", "text/html")
+		if labeled {
+			resp.Header().Set("Content-Encoding", "gzip")
+		}
+		gz := gzip.NewWriter(resp)
+		gz.Write(fakeBody)
+		gz.Close()
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("gzip, deflate, br", this.lastRequest.Header.Get("Accept-Encoding"))
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("mi-sha256-03", exchange.ResponseHeaders.Get("Content-Encoding"))
+	var payloadPrefix bytes.Buffer
+	binary.Write(&payloadPrefix, binary.BigEndian, uint64(util.MaxMIRecordSize))
+	this.Assert().Equal(append(payloadPrefix.Bytes(), transformedBody...), exchange.Payload)
+
+	// A compressed body must say so.
+	labeled = false
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestRemovesHopByHopHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Connection", "PROXY-AUTHENTICATE, Server")
+		resp.Header().Set("Proxy-Authenticate", "Basic")
+		resp.Header().Set("Server", "thing")
+		resp.Header().Set("Transfer-Encoding", "chunked") // Also removed, per RFC 2616.
+		resp.Write([]byte("<html amp><head><link rel=stylesheet href=foo><script src=bar>"))
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Content-Type"))
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Connection"))
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Proxy-Authenticate"))
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Server"))
+	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Transfer-Encoding"))
+}
+
+func (this *SignerSuite) TestRemovesHopByHopHeadersWhenSigningAll() {
+	urlSets := []util.URLSet{{
+		Sign:          &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		SignedHeaders: []string{"*"}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Connection", " x-foo ,Keep-Alive")
+		resp.Header().Set("Keep-Alive", "timeout=5")
+		resp.Header().Set("TE", "trailers")
+		resp.Header().Set("Upgrade", "h2c")
+		resp.Header().Set("X-Foo", "foo")
+		resp.Header().Set("X-Bar", "bar")
+		resp.Write(fakeBody)
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("bar", exchange.ResponseHeaders.Get("X-Bar"))
+	for _, header := range []string{"Connection", "Keep-Alive", "TE", "Upgrade", "X-Foo"} {
+		this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey(header))
+	}
+}
+
+func (this *SignerSuite) TestLimitsDuration() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte("<html amp><body><amp-script script max-age=4000>"))
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	this.Require().NotEmpty(signatures)
+	date, ok := signatures[0].Params["date"].(int64)
+	this.Require().True(ok)
+	expires, ok := signatures[0].Params["expires"].(int64)
+	this.Require().True(ok)
+	this.Assert().Equal(int64(4000), expires-date)
+}
+
+func (this *SignerSuite) TestDoesNotExtendDuration() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte("<html amp><body><amp-script script max-age=700000>"))
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	this.Require().NotEmpty(signatures)
+	date, ok := signatures[0].Params["date"].(int64)
+	this.Require().True(ok)
+	expires, ok := signatures[0].Params["expires"].(int64)
+	this.Require().True(ok)
+	this.Assert().Equal(int64(604800), expires-date)
+}
+
+func (this *SignerSuite) TestLargeDocument() {
+	largeBody := []byte("<html amp><head></head><body>" + strings.Repeat("a", util.DefaultMaxBodyLength) + "</body></html>")
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(largeBody)
+	}
+
+	// By default, the body is proxied unsigned, rather than truncated.
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(largeBody, body)
+
+	// With LargeDocumentMaxLength, it is signed in full.
+	urlSets[0].LargeDocumentMaxLength = 2 * util.DefaultMaxBodyLength
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err = ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+	exchange, err := signedexchange.ReadExchange(bytes.NewReader(body))
+	this.Require().NoError(err)
+	this.Assert().Equal(strconv.Itoa(len(largeBody)), exchange.ResponseHeaders.Get("Content-Length"))
+
+	// Likewise, with a higher MaxBodyLength.
+	urlSets[0].LargeDocumentMaxLength = 0
+	urlSets[0].MaxBodyLength = 2 * util.DefaultMaxBodyLength
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+
+	// Beyond LargeDocumentMaxLength, it is again proxied unsigned.
+	urlSets[0].MaxBodyLength = 0
+	urlSets[0].LargeDocumentMaxLength = util.DefaultMaxBodyLength + 10
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err = ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(largeBody, body)
+}
+
+func (this *SignerSuite) TestMaxBodyLength() {
+	urlSets := []util.URLSet{{
+		Sign:          &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		MaxBodyLength: len(fakeBody) - 1,
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body)
+
+	urlSets[0].MaxBodyLength = len(fakeBody)
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+}
+
+func (this *SignerSuite) TestChunkedBody() {
+	// Flushing mid-body makes the origin send it chunked, without a
+	// Content-Length.
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody[:len(fakeBody)/2])
+		resp.(http.Flusher).Flush()
+		resp.Write(fakeBody[len(fakeBody)/2:])
+	}
+	urlSets := []util.URLSet{{
+		Sign:          &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		MaxBodyLength: len(fakeBody),
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().Equal(accept.SxgContentType, resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	exchange, err := signedexchange.ReadExchange(bytes.NewReader(body))
+	this.Require().NoError(err)
+	var payloadPrefix bytes.Buffer
+	binary.Write(&payloadPrefix, binary.BigEndian, uint64(util.MaxMIRecordSize))
+	this.Assert().Equal(append(payloadPrefix.Bytes(), transformedBody...), exchange.Payload)
+
+	// Over the limit, the whole body is proxied, rather than a truncated one
+	// signed.
+	urlSets[0].MaxBodyLength = len(fakeBody) - 1
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err = ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(fakeBody, body)
+}
+
+func (this *SignerSuite) TestErrorNoCache() {
+	urlSets := []util.URLSet{{
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	// Missing sign param generates an error.
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath))
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+}
+
+func (this *SignerSuite) TestProxyUnsignedIfRedirect() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Header().Set("Set-Cookie", "yum yum yum")
+		resp.Header().Set("Location", "/login")
+		resp.WriteHeader(301)
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(301, resp.StatusCode)
+	this.Assert().Equal("yum yum yum", resp.Header.Get("set-cookie"))
+	this.Assert().Equal("/login", resp.Header.Get("location"))
+}
+
+func (this *SignerSuite) TestFollowsRedirectsUpToMaxRedirects() {
+	urlSets := []util.URLSet{{
+		Sign:         &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		MaxRedirects: 1,
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/amp/redirect1":
+			resp.Header().Set("Location", "/amp/redirect2")
+			resp.WriteHeader(302)
+		case "/amp/redirect2":
+			resp.Header().Set("Location", fakePath)
+			resp.WriteHeader(301)
+		default:
+			this.lastRequest = req
+			resp.Header().Set("Content-Type", "text/html")
+			resp.Write(fakeBody)
+		}
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/amp/redirect2"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+
+	// Exceeding MaxRedirects proxies the last redirect unsigned.
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/amp/redirect1"))
+	this.Assert().Equal(301, resp.StatusCode)
+	this.Assert().Equal(fakePath, resp.Header.Get("Location"))
+}
+
+func (this *SignerSuite) TestFollowsOnlyMatchingRedirects() {
+	urlSets := []util.URLSet{{
+		Sign:         &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		MaxRedirects: 2,
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
+		resp.Header().Set("Location", "/login")
+		resp.WriteHeader(302)
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(302, resp.StatusCode)
+	this.Assert().Equal("/login", resp.Header.Get("Location"))
+	this.Assert().Equal(fakePath, this.lastRequest.URL.Path)
+}
+
+func (this *SignerSuite) TestRefuseRedirects() {
+	urlSets := []util.URLSet{{
+		Sign:            &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		RefuseRedirects: true,
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/amp/redirect" {
+			resp.Header().Set("Location", fakePath)
+			resp.WriteHeader(301)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/amp/redirect"))
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), "redirect_refused")
+
+	// Redirects within MaxRedirects are still followed.
+	urlSets[0].MaxRedirects = 1
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/amp/redirect"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode)
+}
+
+func (this *SignerSuite) TestOriginRequestBudgetLimitsRedirects() {
+	urlSets := []util.URLSet{{
+		Sign:         &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		MaxRedirects: 5,
+	}}
+	requests := 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.URL.Path == "/amp/redirect1" {
+			resp.Header().Set("Location", "/amp/redirect2")
+			resp.WriteHeader(302)
+			return
+		}
+		resp.Header().Set("Location", fakePath)
+		resp.WriteHeader(301)
+	}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.LimitOriginRequests(2)
+	count := func() int64 {
+		if v, ok := originBudgetExhausted.Get(this.httpsHost()).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+
+	// The budget is spent on the fetch and one redirect, so the second
+	// redirect is proxied unsigned, despite MaxRedirects.
+	resp := this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/amp/redirect1"))
+	this.Assert().Equal(301, resp.StatusCode)
+	this.Assert().Equal(fakePath, resp.Header.Get("Location"))
+	this.Assert().Equal(2, requests)
+	this.Assert().Equal(before+1, count())
+}
+
+func (this *SignerSuite) TestFetchesViaProxy() {
+	var tunneled []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		tunneled = append(tunneled, req.Host)
+		origin, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			origin.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		go func() { io.Copy(origin, conn); origin.Close() }()
+		go func() { io.Copy(conn, origin); conn.Close() }()
+	}))
+	defer proxy.Close()
+
+	urlSets := []util.URLSet{{
+		Sign:       &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		FetchProxy: proxy.URL,
+	}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal([]string{this.httpsHost()}, tunneled)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+
+	tunneled = nil
+	urlSets[0].FetchProxy = util.DirectFetchProxy
+	resp = this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Empty(tunneled)
+}
+
+func (this *SignerSuite) TestFetchBackend() {
+	urlSets := []util.URLSet{{
+		Sign:         &util.URLPattern{[]string{"https"}, "", "example.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		FetchBackend: this.httpsURL(),
+	}}
+	target := "/priv/doc?sign=" + url.QueryEscape("https://example.com"+fakePath)
+
+	// The test server's cert is valid for example.com.
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().NotNil(this.lastRequest)
+	this.Assert().Equal("example.com", this.lastRequest.Host)
+	this.Assert().NotNil(this.lastRequest.TLS)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+
+	this.lastRequest = nil
+	urlSets[0].FetchBackend = this.httpServer.URL
+	resp = this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().NotNil(this.lastRequest)
+	this.Assert().Equal("example.com", this.lastRequest.Host)
+	this.Assert().Nil(this.lastRequest.TLS)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("https://example.com"+fakePath, exchange.RequestURI)
+}
+
+func (this *SignerSuite) TestFetchBackendUnixSocket() {
+	dir, err := ioutil.TempDir("", "amppkg")
+	this.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "app.sock")
+	listener, err := net.Listen("unix", socket)
+	this.Require().NoError(err)
+	server := &http.Server{Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		this.fakeHandler(resp, req)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	urlSets := []util.URLSet{{
+		Sign:         &util.URLPattern{[]string{"https"}, "", "example.com", stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		FetchBackend: "unix:" + socket,
+	}}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape("https://example.com"+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().NotNil(this.lastRequest)
+	this.Assert().Equal("example.com", this.lastRequest.Host)
+	this.Assert().Equal(fakePath, this.lastRequest.URL.String())
+}
+
+func (this *SignerSuite) TestFetchTLS() {
+	var peerCerts []*x509.Certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		peerCerts = req.TLS.PeerCertificates
+		this.fakeHandler(resp, req)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	this.Require().NoError(err)
+
+	caFile, err := ioutil.TempFile("", "amppkg-ca")
+	this.Require().NoError(err)
+	defer os.Remove(caFile.Name())
+	this.Require().NoError(pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	this.Require().NoError(caFile.Close())
+
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", serverURL.Host, stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	target := "/priv/doc?sign=" + url.QueryEscape(server.URL+fakePath)
+	get := func() *http.Response {
+		handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+		this.Require().NoError(err)
+		// Unlike this.new, trust only the system roots, unless FetchTLS
+		// says otherwise.
+		handler.client = &http.Client{CheckRedirect: noRedirects}
+		handler.clock = this.clock
+		return this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), target)
+	}
+
+	resp := get()
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+
+	urlSets[0].FetchTLS = &util.FetchTLSConfig{CAFile: caFile.Name()}
+	resp = get()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Empty(peerCerts)
+
+	urlSets[0].FetchTLS = &util.FetchTLSConfig{CAFile: caFile.Name(), CertFile: "../../testdata/b3/fullchain.cert", KeyFile: "../../testdata/b3/server.privkey"}
+	resp = get()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().NotEmpty(peerCerts)
+	this.Assert().Equal(pkgt.Certs[0].Raw, peerCerts[0].Raw)
+
+	urlSets[0].FetchTLS = &util.FetchTLSConfig{InsecureSkipVerify: true}
+	resp = get()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	urlSets[0].FetchTLS = &util.FetchTLSConfig{CAFile: "/nonexistent.pem"}
+	_, err = New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, nil, nil, true, nil, nil, 0, nil)
+	if this.Assert().Error(err) {
+		this.Assert().Contains(err.Error(), "loading URLSet.0.FetchTLS: reading CAFile")
+	}
+}
+
+func (this *SignerSuite) TestBlockPrivateFetches() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	get := func(allowed ...string) *http.Response {
+		handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+		this.Require().NoError(err)
+		handler.client = this.httpsClient
+		handler.clock = this.clock
+		var networks []*net.IPNet
+		for _, cidr := range allowed {
+			_, network, err := net.ParseCIDR(cidr)
+			this.Require().NoError(err)
+			networks = append(networks, network)
+		}
+		handler.BlockPrivateFetches(networks)
+		return this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), target)
+	}
+
+	this.lastRequest = nil
+	resp := get()
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Nil(this.lastRequest)
+
+	resp = get("10.0.0.0/8", "127.0.0.0/8")
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	// The FetchBackend is exempt.
+	urlSets[0].FetchBackend = this.httpsURL()
+	resp = get()
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestBlockPrivateFetchesWithDefaultTransport() {
+	_, port, err := net.SplitHostPort(this.httpsHost())
+	this.Require().NoError(err)
+	host := "example.com:" + port
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", host, stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	target := "/priv/doc?sign=" + url.QueryEscape("https://"+host+fakePath)
+	get := func(allowed ...*net.IPNet) *http.Response {
+		handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+		this.Require().NoError(err)
+		handler.clock = this.clock
+		// The default transport has a Proxy func, which returns nil for
+		// direct connections. Trust the test server's cert.
+		transport := handler.client.Transport.(*http.Transport)
+		this.Require().NotNil(transport.Proxy)
+		transport.TLSClientConfig = this.httpsClient.Transport.(*http.Transport).TLSClientConfig.Clone()
+		handler.ResolveFetchHosts(map[string]net.IP{"example.com": net.ParseIP("127.0.0.1")}, time.Minute)
+		handler.BlockPrivateFetches(allowed)
+		return this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), target)
+	}
+
+	// The resolved address of the direct connection is checked.
+	this.lastRequest = nil
+	resp := get()
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Nil(this.lastRequest)
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	this.Require().NoError(err)
+	resp = get(loopback)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().NotNil(this.lastRequest)
+}
+
+func (this *SignerSuite) TestResolveFetchHosts() {
+	_, port, err := net.SplitHostPort(this.httpsHost())
+	this.Require().NoError(err)
+	host := "example.com:" + port
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", host, stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.ResolveFetchHosts(map[string]net.IP{"example.com": net.ParseIP("127.0.0.1")}, time.Minute)
+
+	// The test server's cert is valid for example.com.
+	resp := this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), "/priv/doc?sign="+url.QueryEscape("https://"+host+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Require().NotNil(this.lastRequest)
+	this.Assert().Equal(host, this.lastRequest.Host)
+}
+
+func (this *SignerSuite) TestReusesFetchConnections() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	count := func(key string) int64 {
+		if v, ok := fetchConnections.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	handler := this.new(urlSets)
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	resp := this.get(this.T(), handler, target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	reused, opened := count("reused"), count("new")
+	resp = this.get(this.T(), handler, target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(reused+1, count("reused"))
+	this.Assert().Equal(opened, count("new"))
+}
+
+func (this *SignerSuite) TestFetchTimeouts() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	urlSets[0].FetchTimeouts = &util.FetchTimeoutsConfig{ResponseHeader: "50ms"}
+	resp = this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+
+	urlSets[0].FetchTimeouts = &util.FetchTimeoutsConfig{Total: "50ms"}
+	resp = this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+
+	urlSets[0].FetchTimeouts = &util.FetchTimeoutsConfig{ResponseHeader: "1s", Total: "2s"}
+	resp = this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestRetriesFetches() {
+	urlSets := []util.URLSet{{
+		Sign:         &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		FetchRetries: &util.FetchRetriesConfig{Count: 2, Backoff: "1ms"},
+	}}
+	failures, requests := 0, 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests <= failures {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	count := func(m *expvar.Map) int64 {
+		if v, ok := m.Get(this.httpsHost()).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	retriesBefore, recoveredBefore := count(fetchRetries), count(fetchRetriesRecovered)
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	failures = 2
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(3, requests)
+	this.Assert().Equal(retriesBefore+2, count(fetchRetries))
+	this.Assert().Equal(recoveredBefore+1, count(fetchRetriesRecovered))
+
+	// Beyond Count, the last response is proxied.
+	failures, requests = 3, 0
+	resp = this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(3, requests)
+	this.Assert().Equal(recoveredBefore+1, count(fetchRetriesRecovered))
+
+	// Retries spend the origin request budget.
+	failures, requests = 1, 0
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.LimitOriginRequests(1)
+	resp = this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), target)
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(1, requests)
+
+	// As does Within.
+	urlSets[0].FetchRetries = &util.FetchRetriesConfig{Count: 2, Backoff: "1s", Within: "100ms"}
+	failures, requests = 1, 0
+	resp = this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(1, requests)
+}
+
+func (this *SignerSuite) TestCircuitBreaker() {
+	urlSets := []util.URLSet{{
+		Sign:           &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		CircuitBreaker: &util.CircuitBreakerConfig{Failures: 2, CoolDown: "1m"},
+	}}
+	failing, requests := true, 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		if failing {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	handler := this.new(urlSets)
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	for i := 0; i < 2; i++ {
+		resp := this.get(this.T(), handler, target)
+		this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	}
+	this.Assert().Equal(2, requests)
+	this.Assert().NotNil(openCircuits.Get(this.httpsHost()))
+
+	// The circuit is open, so the origin isn't fetched.
+	resp := this.get(this.T(), handler, target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(2, requests)
+
+	// After the cool-down, it's tried again.
+	failing = false
+	this.clock.Advance(time.Minute)
+	resp = this.get(this.T(), handler, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(3, requests)
+	this.Assert().Nil(openCircuits.Get(this.httpsHost()))
+}
+
+func (this *SignerSuite) TestFetchConcurrency() {
+	urlSets := []util.URLSet{{
+		Sign:             &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		FetchConcurrency: &util.FetchConcurrencyConfig{Max: 1, QueueTimeout: "10ms"},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	count := func() int64 {
+		if v, ok := fetchConcurrencyRefused.Get(this.httpsHost()).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+
+	// As if another document were being fetched.
+	release, err := handler.fetchSlots.acquire(context.Background(), this.httpsHost(), urlSets[0].FetchConcurrency)
+	this.Require().NoError(err)
+	resp := this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), "origin_overloaded")
+	this.Assert().Equal(before+1, count())
+	this.Assert().Nil(this.lastRequest)
+
+	release()
+	resp = this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	// The slot is released once the body is read.
+	this.Assert().Len(handler.fetchSlots.byKey[slotKey{this.httpsHost(), urlSets[0].FetchConcurrency.Max, false}], 0)
+}
+
+func (this *SignerSuite) TestIdentifiesFetches() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	resp := this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Regexp(`^amppkg/\S+ \(\+https://github.com/ampproject/amppackager\)$`, this.lastRequest.Header.Get("User-Agent"))
+	this.Assert().NotContains(this.lastRequest.Header, "From")
+
+	handler.IdentifyFetches("ExamplePackager/1.0", "ops@example.com")
+	resp = this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("ExamplePackager/1.0", this.lastRequest.Header.Get("User-Agent"))
+	this.Assert().Equal("ops@example.com", this.lastRequest.Header.Get("From"))
+}
+
+func (this *SignerSuite) TestCoalescesFetches() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	requests := 0
+	proceed := make(chan struct{})
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		<-proceed
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.CoalesceFetches()
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	waiters := func() int {
+		handler.fetches.mu.Lock()
+		defer handler.fetches.mu.Unlock()
+		for _, call := range handler.fetches.calls {
+			return call.waiters
+		}
+		return -1
+	}
+
+	responses := make(chan *http.Response, 3)
+	for i := 0; i < 3; i++ {
+		go func() { responses <- this.get(this.T(), server, target) }()
+	}
+	for waiters() < 2 {
+		runtime.Gosched()
+	}
+	close(proceed)
+	for i := 0; i < 3; i++ {
+		resp := <-responses
+		this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		exchange, err := signedexchange.ReadExchange(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Equal(this.httpsURL()+fakePath, exchange.RequestURI)
+	}
+	this.Assert().Equal(1, requests)
+}
+
+func (this *SignerSuite) TestLimitsFetchHeaders() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	cookies, padding := 0, 0
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		for i := 0; i < cookies; i++ {
+			resp.Header().Add("Set-Cookie", fmt.Sprintf("c%d=v", i))
+		}
+		if padding > 0 {
+			resp.Header().Set("X-Padding", strings.Repeat("a", padding))
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	// Don't limit the suite's shared transport.
+	client := *this.httpsClient
+	client.Transport = this.httpsClient.Transport.(*http.Transport).Clone()
+	handler.client = &client
+	handler.clock = this.clock
+	handler.LimitFetchHeaders(4096, 8)
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+
+	cookies = 4
+	resp := this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	cookies = 10
+	resp = this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), "fetch_headers_too_large")
+
+	cookies, padding = 0, 8192
+	resp = this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err = ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), "fetch_headers_too_large")
+}
+
+func (this *SignerSuite) TestURLSetSignatureTiming() {
+	urlSets := []util.URLSet{{
+		Sign:              &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		SignatureLifetime: "2h",
+		Backdate:          "10m",
+	}}
+	this.signatureLifetime = 48 * time.Hour
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Require().NoError(err)
+	this.Require().NotEmpty(signatures)
+	date, ok := signatures[0].Params["date"].(int64)
+	this.Require().True(ok)
+	expires, ok := signatures[0].Params["expires"].(int64)
+	this.Require().True(ok)
+	this.Assert().Equal(this.clock.Now().Add(-10*time.Minute).Unix(), date)
+	this.Assert().Equal(int64(2*60*60), expires-date)
+}
+
+func (this *SignerSuite) TestMIRecordSize() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.UseMIRecordSize(16)
+
+	resp := this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Require().True(len(exchange.Payload) > 8)
+	this.Assert().Equal(uint64(16), binary.BigEndian.Uint64(exchange.Payload[:8]))
+	decoder, err := mice.Draft03Encoding.NewDecoder(bytes.NewReader(exchange.Payload), exchange.ResponseHeaders.Get("Digest"), 16)
+	this.Require().NoError(err)
+	payload, err := ioutil.ReadAll(decoder)
+	this.Require().NoError(err)
+	this.Assert().Equal(transformedBody, payload)
+}
+
+func (this *SignerSuite) TestMaxExchangeSize() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	count := func() int64 {
+		if v, ok := oversizedExchanges.Get(this.httpsHost()).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+
+	resp := this.get(this.T(), server, target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	size, err := strconv.Atoi(resp.Header.Get("Content-Length"))
+	this.Require().NoError(err)
+
+	handler.LimitExchangeSize(size)
+	resp = this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(before, count())
+
+	handler.LimitExchangeSize(size - 1)
+	resp = this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), "sxg_too_large")
+	this.Assert().Equal(before+1, count())
+
+	// Far over the limit, the SXG is rejected before it's signed.
+	signed := func() int64 {
+		var total int64
+		signatures.Do(func(kv expvar.KeyValue) { total += kv.Value.(*expvar.Int).Value() })
+		return total
+	}
+	signedBefore := signed()
+	handler.LimitExchangeSize(100)
+	resp = this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(before+2, count())
+	this.Assert().Equal(signedBefore, signed())
+}
+
+func (this *SignerSuite) TestLimitsSignedHeaders() {
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Cache-Control", "public, max-age=60")
+		resp.Header().Set("Content-Language", strings.Repeat("en-US, ", 100))
+		resp.Write(fakeBody)
+	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	urlSets := []util.URLSet{{
+		Sign:                 &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		MaxSignedHeaderBytes: 1000,
+	}}
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), "signed_headers_too_large")
+
+	urlSets[0].TrimSignedHeaders = true
+	resp = this.get(this.T(), this.new(urlSets), target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Empty(exchange.ResponseHeaders.Get("Content-Language"))
+	this.Assert().NotEmpty(exchange.ResponseHeaders.Get("Cache-Control"))
+}
+
+func (this *SignerSuite) TestCachesSignatures() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.CacheSignatures(1 << 20)
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	count := func() int64 {
+		if v, ok := reusedSignatures.Get(this.httpsHost()).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+	date := 0
+	cacheControl := ""
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		// Differs between otherwise identical responses.
+		date++
+		resp.Header().Set("Date", time.Unix(int64(date), 0).UTC().Format(http.TimeFormat))
+		if cacheControl != "" {
+			resp.Header().Set("Cache-Control", cacheControl)
+		}
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	getBody := func() []byte {
+		resp := this.get(this.T(), server, target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		body, err := ioutil.ReadAll(resp.Body)
+		this.Require().NoError(err)
+		return body
+	}
+
+	first := getBody()
+	this.clock.Advance(time.Minute)
+	this.Assert().Equal(first, getBody())
+	this.Assert().Equal(before+1, count())
+
+	// Refetches sign afresh.
+	resp := pkgt.GetH(this.T(), http.HandlerFunc(handler.ServeRefetch), target, http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion}})
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	refetched, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().NotEqual(first, refetched)
+	this.Assert().Equal(refetched, getBody())
+
+	// Once it's no longer reusable, it's signed again.
+	this.clock.Advance(7 * 24 * time.Hour)
+	this.Assert().NotEqual(refetched, getBody())
+	this.Assert().Equal(before+2, count())
+
+	// One whose inner max-age was capped to its whole lifetime isn't
+	// reused, as a cache receiving it later would outlive the signature.
+	cacheControl = "max-age=31536000"
+	capped := getBody()
+	this.clock.Advance(time.Minute)
+	this.Assert().NotEqual(capped, getBody())
+	this.Assert().Equal(before+2, count())
+}
+
+func (this *SignerSuite) TestOnlyIfCached() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.CacheSignatures(1 << 20)
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	fetches := 0
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		// Expect base-uri and block-all-mixed-content to remain unmodified.
-		// Expect require-sri-for to be stripped.
-		// Expect script-src to be overwritten.
-		resp.Header().Set(
-			"Content-Security-Policy",
-			"base-uri http://*.example.com; "+
-				"block-all-mixed-content; "+
-				"require-sri-for script; "+
-				"script-src https://notallowed.org/")
+		fetches++
+		resp.Header().Set("Content-Type", "text/html")
 		resp.Write(fakeBody)
 	}
+	getOnlyIfCached := func() *http.Response {
+		return pkgt.GetH(this.T(), server, target, http.Header{
+			"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+			"Cache-Control": {"only-if-cached"}})
+	}
 
-	resp := this.get(
-		this.T(),
-		this.new(urlSets),
-		"/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(
-		http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-	exchange, err := signedexchange.ReadExchange(resp.Body)
+	// Nothing is cached yet, and the origin isn't asked.
+	resp := getOnlyIfCached()
+	this.Assert().Equal(http.StatusGatewayTimeout, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(0, fetches)
+
+	resp = this.get(this.T(), server, target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	signed, err := ioutil.ReadAll(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal(
-		"base-uri http://*.example.com;"+
-			"block-all-mixed-content;"+
-			"default-src * blob: data:;"+
-			"report-uri https://csp-collector.appspot.com/csp/amp;"+
-			"script-src blob: https://cdn.ampproject.org/rtv/ https://cdn.ampproject.org/v0.js https://cdn.ampproject.org/v0/ https://cdn.ampproject.org/viewer/;"+
-			"style-src 'unsafe-inline' https://cdn.materialdesignicons.com https://cloud.typography.com https://fast.fonts.net https://fonts.googleapis.com https://maxcdn.bootstrapcdn.com https://p.typekit.net https://pro.fontawesome.com https://use.fontawesome.com https://use.typekit.net;"+
-			"object-src 'none'",
-		exchange.ResponseHeaders.Get("Content-Security-Policy"))
+	this.Require().Equal(1, fetches)
+
+	// Then the same SXG is served, still without asking the origin.
+	this.clock.Advance(time.Minute)
+	resp = getOnlyIfCached()
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(signed, body)
+	this.Assert().Equal(1, fetches)
+
+	// Until reverse proxies would stop serving it.
+	this.clock.Advance(7 * 24 * time.Hour)
+	resp = getOnlyIfCached()
+	this.Assert().Equal(http.StatusGatewayTimeout, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(1, fetches)
 }
 
-func (this *SignerSuite) TestAddsLinkHeaders() {
+func (this *SignerSuite) TestRestoresSavedSignatures() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
-	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Write([]byte("<html amp><head><link rel=stylesheet href=foo><script src=bar>"))
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	newHandler := func() *Signer {
+		handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+		this.Require().NoError(err)
+		handler.client = this.httpsClient
+		handler.clock = this.clock
+		handler.CacheSignatures(1 << 20)
+		return handler
+	}
+	dir, err := ioutil.TempDir("", "amppkg-signatures")
+	this.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "signatures")
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	getBody := func(handler *Signer) []byte {
+		resp := this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		body, err := ioutil.ReadAll(resp.Body)
+		this.Require().NoError(err)
+		return body
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 
-	exchange, err := signedexchange.ReadExchange(resp.Body)
+	// Nothing to restore on the first start.
+	first := newHandler()
+	loaded, err := first.LoadSignatures(snapshot)
 	this.Require().NoError(err)
-	this.Assert().Equal("<foo>;rel=preload;as=style,<bar>;rel=preload;as=script", exchange.ResponseHeaders.Get("Link"))
+	this.Assert().Equal(0, loaded)
+	signed := getBody(first)
+	this.Require().NoError(first.SaveSignatures(snapshot))
+
+	// After a restart, the same SXG is served rather than signed afresh.
+	this.clock.Advance(time.Minute)
+	second := newHandler()
+	loaded, err = second.LoadSignatures(snapshot)
+	this.Require().NoError(err)
+	this.Assert().Equal(1, loaded)
+	this.Assert().Equal(signed, getBody(second))
 }
 
-func (this *SignerSuite) TestEscapesLinkHeaders() {
+func (this *SignerSuite) TestSubstitutesSubresources() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign:                   &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		AuxiliaryResources:     []util.AuxiliaryResource{{PathRE: `/style\.css`, ContentType: "text/css"}, {PathRE: `/counter\.js`, ContentType: "text/javascript"}},
+		SubstituteSubresources: true,
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.CacheSignatures(1 << 20)
+	server := mux.New(mux.Handlers{Signer: handler})
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/style.css" {
+			resp.Header().Set("Content-Type", "text/css")
+			resp.Write([]byte("body { color: green }"))
+			return
+		}
+		if req.URL.Path == "/counter.js" {
+			resp.Header().Set("Content-Type", "text/javascript")
+			resp.Write([]byte("let count = 0;"))
+			return
+		}
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		// This shouldn't happen for valid AMP, and AMP Caches should
-		// verify the Link header so that it wouldn't be ingested.
-		// However, it would be nice to limit the impact that could be
-		// caused by transformation of an invalid AMP, e.g. on a
-		// same-origin impression.
-		resp.Write([]byte(`<html amp><head><script src="https://foo.com/a,b>c?d>e|f">`))
+		// Only the auxiliary resources are substituted, whether preloaded
+		// or referenced in the body.
+		resp.Write([]byte("<html amp><head><link rel=stylesheet href=/style.css><script src=/other.js></script></head>" +
+			"<body><amp-script layout=container src=/counter.js></amp-script>"))
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-
+	resp := this.get(this.T(), server, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Equal("<https://foo.com/a,b%3Ec?d%3Ee%7Cf>;rel=preload;as=script", exchange.ResponseHeaders.Get("Link"))
+
+	// The header-integrity is that of the SXG served for the subresource.
+	resp = this.get(this.T(), server, "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/style.css"))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	subresource, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	var signedHeaders bytes.Buffer
+	this.Require().NoError(subresource.DumpExchangeHeaders(&signedHeaders))
+	integrity := sha256.Sum256(signedHeaders.Bytes())
+	this.Assert().Regexp("^"+regexp.QuoteMeta("</style.css>;rel=preload;as=style,</other.js>;rel=preload;as=script,"+
+		"<"+this.httpsURL()+`/style.css>;rel="allowed-alt-sxg";header-integrity="sha256-`+base64.StdEncoding.EncodeToString(integrity[:])+`",`+
+		"<"+this.httpsURL()+`/counter.js>;rel="allowed-alt-sxg";header-integrity="sha256-`)+`[A-Za-z0-9+/]{43}="$`,
+		exchange.ResponseHeaders.Get("Link"))
 }
 
-func (this *SignerSuite) TestRemovesHopByHopHeaders() {
+func (this *SignerSuite) TestSubresourcesShareOriginRequestBudget() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign:                   &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		AuxiliaryResources:     []util.AuxiliaryResource{{PathRE: `/style[0-9]\.css`, ContentType: "text/css"}},
+		SubstituteSubresources: true,
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.CacheSignatures(1 << 20)
+	// The document, and one of its two subresources.
+	handler.LimitOriginRequests(2)
+	var fetched []string
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		fetched = append(fetched, req.URL.Path)
+		if strings.HasSuffix(req.URL.Path, ".css") {
+			resp.Header().Set("Content-Type", "text/css")
+			resp.Write([]byte("body { color: green }"))
+			return
+		}
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Connection", "PROXY-AUTHENTICATE, Server")
-		resp.Header().Set("Proxy-Authenticate", "Basic")
-		resp.Header().Set("Server", "thing")
-		resp.Header().Set("Transfer-Encoding", "chunked") // Also removed, per RFC 2616.
-		resp.Write([]byte("<html amp><head><link rel=stylesheet href=foo><script src=bar>"))
+		resp.Write([]byte("<html amp><head><link rel=stylesheet href=/style1.css><link rel=stylesheet href=/style2.css>"))
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
-
+	resp := this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 	exchange, err := signedexchange.ReadExchange(resp.Body)
 	this.Require().NoError(err)
-	this.Assert().Contains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Content-Type"))
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Connection"))
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Proxy-Authenticate"))
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Server"))
-	this.Assert().NotContains(exchange.ResponseHeaders, http.CanonicalHeaderKey("Transfer-Encoding"))
+	this.Assert().Equal([]string{fakePath, "/style1.css"}, fetched)
+	this.Assert().Contains(exchange.ResponseHeaders.Get("Link"), "/style1.css>;rel=\"allowed-alt-sxg\"")
+	this.Assert().NotContains(exchange.ResponseHeaders.Get("Link"), "/style2.css>;rel=\"allowed-alt-sxg\"")
 }
 
-func (this *SignerSuite) TestLimitsDuration() {
+func (this *SignerSuite) TestSubresourcesOutput() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign:               &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		AuxiliaryResources: []util.AuxiliaryResource{
+			{PathRE: `/style\.css`, ContentType: "text/css"},
+			{PathRE: `/counter\.js`, ContentType: "text/javascript"},
+			{PathRE: `/font\.woff2`, ContentType: "font/woff2"},
+		},
+	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/style.css" {
+			resp.Header().Set("Content-Type", "text/css")
+			resp.Write([]byte("body { color: green }"))
+			return
+		}
+		if req.URL.Path == "/counter.js" {
+			resp.Header().Set("Content-Type", "text/javascript")
+			resp.Write([]byte("let count = 0;"))
+			return
+		}
+		if req.URL.Path == "/font.woff2" {
+			resp.Header().Set("Content-Type", "font/woff2")
+			resp.Write([]byte("wOF2"))
+			return
+		}
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Write([]byte("<html amp><body><amp-script script max-age=4000>"))
+		resp.Write([]byte("<html amp><head><link rel=stylesheet href=/style.css><script src=/other.js></script>" +
+			"<style amp-custom>@font-face { font-family: f; src: url('/font.woff2') }</style></head>" +
+			"<body><amp-script layout=container src=/counter.js></amp-script>"))
+	}
+	type part struct {
+		header textproto.MIMEHeader
+		body   []byte
+	}
+	parts := func(target string) []part {
+		resp := this.get(this.T(), this.new(urlSets), target)
+		this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+		mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		this.Require().NoError(err)
+		this.Require().Equal("multipart/mixed", mediaType)
+		var parts []part
+		reader := multipart.NewReader(resp.Body, params["boundary"])
+		for {
+			p, err := reader.NextPart()
+			if err == io.EOF {
+				return parts
+			}
+			this.Require().NoError(err)
+			body, err := ioutil.ReadAll(p)
+			this.Require().NoError(err)
+			parts = append(parts, part{p.Header, body})
+		}
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
 
-	exchange, err := signedexchange.ReadExchange(resp.Body)
+	// Only the auxiliary resources are signed: the stylesheet, the font it
+	// uses, and the amp-script.
+	got := parts("/priv/doc?output=subresources&sign=" + url.QueryEscape(this.httpsURL()+fakePath))
+	this.Require().Len(got, 3)
+	this.Assert().Equal(this.httpsURL()+"/font.woff2", got[1].header.Get("Content-Location"))
+	this.Assert().Equal(this.httpsURL()+"/counter.js", got[2].header.Get("Content-Location"))
+	this.Assert().Equal(this.httpsURL()+"/style.css", got[0].header.Get("Content-Location"))
+	this.Assert().Equal("application/signed-exchange;v=b3", got[0].header.Get("Content-Type"))
+	integrity, err := headerIntegrityOf(got[0].body)
 	this.Require().NoError(err)
-	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	this.Assert().Equal(integrity, got[0].header.Get("X-AmpPkg-Header-Integrity"))
+	exchange, err := signedexchange.ReadExchange(bytes.NewReader(got[0].body))
 	this.Require().NoError(err)
-	this.Require().NotEmpty(signatures)
-	date, ok := signatures[0].Params["date"].(int64)
-	this.Require().True(ok)
-	expires, ok := signatures[0].Params["expires"].(int64)
-	this.Require().True(ok)
-	this.Assert().Equal(int64(4000), expires-date)
+	this.Assert().Equal(this.httpsURL()+"/style.css", exchange.RequestURI)
+	this.Assert().Equal("text/css", exchange.ResponseHeaders.Get("Content-Type"))
+
+	// Auxiliary resources have no subresources.
+	this.Assert().Empty(parts("/priv/doc?output=subresources&sign=" + url.QueryEscape(this.httpsURL()+"/style.css")))
 }
 
-func (this *SignerSuite) TestDoesNotExtendDuration() {
+func (this *SignerSuite) TestWebBundle() {
 	urlSets := []util.URLSet{{
-		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+		Sign:               &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		AuxiliaryResources: []util.AuxiliaryResource{{PathRE: `/style\.css`, ContentType: "text/css"}},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	server := mux.New(mux.Handlers{Signer: handler})
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/style.css" {
+			resp.Header().Set("Content-Type", "text/css")
+			resp.Header().Set("Set-Cookie", "yum=yum")
+			resp.Write([]byte("body { color: green }"))
+			return
+		}
 		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Write([]byte("<html amp><body><amp-script script max-age=700000>"))
+		resp.Write([]byte("<html amp><head><link rel=stylesheet href=/style.css><script src=/other.js>"))
 	}
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	target := "/priv/doc?output=bundle&sign=" + url.QueryEscape(this.httpsURL()+fakePath)
 
-	exchange, err := signedexchange.ReadExchange(resp.Body)
+	// Unless enabled, the output param is refused.
+	resp := pkgt.Get(this.T(), server, target)
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+
+	// Bundles don't depend on the Accept header.
+	handler.ServeWebBundles()
+	resp = pkgt.Get(this.T(), server, target)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/webbundle", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
 	this.Require().NoError(err)
-	signatures, err := structuredheader.ParseParameterisedList(exchange.SignatureHeaderValue)
+	primary, exchanges := readWebBundle(this.T(), body)
+	this.Assert().Equal(this.httpsURL()+fakePath, primary)
+	this.Require().Len(exchanges, 2)
+	document := exchanges[this.httpsURL()+fakePath]
+	this.Assert().Equal([]string{"</style.css>;rel=preload;as=style,</other.js>;rel=preload;as=script"}, document.headers["link"])
+	this.Assert().Contains(string(document.body), "<html amp>")
+	style := exchanges[this.httpsURL()+"/style.css"]
+	this.Assert().Equal([]string{"text/css"}, style.headers["content-type"])
+	this.Assert().NotContains(style.headers, "set-cookie")
+	this.Assert().Equal("body { color: green }", string(style.body))
+}
+
+func (this *SignerSuite) TestSigningQueueFull() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
 	this.Require().NoError(err)
-	this.Require().NotEmpty(signatures)
-	date, ok := signatures[0].Params["date"].(int64)
-	this.Require().True(ok)
-	expires, ok := signatures[0].Params["expires"].(int64)
-	this.Require().True(ok)
-	this.Assert().Equal(int64(604800), expires-date)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	handler.LimitConcurrentSigning(1, 0)
+	server := mux.New(mux.Handlers{Signer: handler})
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	count := func() int64 {
+		if v, ok := signingQueueFull.Get(this.httpsHost()).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+
+	// As if another document were being signed.
+	release, err := handler.signingPool.acquire(context.Background())
+	this.Require().NoError(err)
+	resp := this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), "overloaded")
+	this.Assert().Equal(before+1, count())
+
+	// As are bundles, which are transformed all the same.
+	handler.ServeWebBundles()
+	resp = pkgt.Get(this.T(), server, "/priv/doc?output=bundle&sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusServiceUnavailable, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal(before+2, count())
+
+	release()
+	resp = this.get(this.T(), server, target)
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	// The worker is released once the SXG is written.
+	this.Assert().Len(handler.signingPool.workers, 0)
 }
 
-func (this *SignerSuite) TestErrorNoCache() {
+func (this *SignerSuite) TestVerifyExchanges() {
 	urlSets := []util.URLSet{{
-		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
-	// Missing sign param generates an error.
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath))
-	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
-	this.Assert().Equal("no-store", resp.Header.Get("Cache-Control"))
+	count := func() int64 {
+		if v, ok := failedVerifications.Get(this.httpsHost()).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+fakePath)
+	// The second key doesn't match the cert.
+	for _, key := range []crypto.PrivateKey{pkgt.Key, pkgt.B3Key2} {
+		handler, err := New(fakeCertHandler{}, key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+		this.Require().NoError(err)
+		handler.client = this.httpsClient
+		handler.clock = this.clock
+		handler.VerifyExchanges()
+		resp := this.get(this.T(), mux.New(mux.Handlers{Signer: handler}), target)
+		if key == pkgt.Key {
+			this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+			this.Assert().Equal(before, count())
+			continue
+		}
+		this.Assert().Equal(http.StatusInternalServerError, resp.StatusCode, "incorrect status: %#v", resp)
+		body, err := ioutil.ReadAll(resp.Body)
+		this.Require().NoError(err)
+		this.Assert().Contains(string(body), "verification_failed")
+		this.Assert().Equal(before+1, count())
+	}
 }
 
-func (this *SignerSuite) TestProxyUnsignedIfRedirect() {
+func (this *SignerSuite) TestProxiesNon200Unsigned() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
 	}}
 	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
-		resp.Header().Set("Set-Cookie", "yum yum yum")
-		resp.Header().Set("Location", "/login")
-		resp.WriteHeader(301)
+		resp.Header().Set("Cache-Control", "public, max-age=60")
+		resp.Header().Set("Content-Type", "text/html")
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte("<html><body>Not found"))
 	}
+	target := "/priv/doc?sign=" + url.QueryEscape(this.httpsURL()+"/amp/gone.html")
 
-	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
-	this.Assert().Equal(301, resp.StatusCode)
-	this.Assert().Equal("yum yum yum", resp.Header.Get("set-cookie"))
-	this.Assert().Equal("/login", resp.Header.Get("location"))
+	// Browsers and caches reject SXGs of non-200 responses.
+	resp := this.get(this.T(), this.new(urlSets), target)
+	this.Assert().Equal(http.StatusNotFound, resp.StatusCode)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal("<html><body>Not found", string(body))
+}
+
+func (this *SignerSuite) TestResign() {
+	urlSets := []util.URLSet{{
+		Sign:  &util.URLPattern{[]string{"https"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		Fetch: &util.URLPattern{[]string{"http"}, "", this.httpHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, boolPtr(true)},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	server := mux.New(mux.Handlers{Signer: handler})
+	signURL := this.httpSignURL() + fakePath
+	resign := func(digest string) *http.Response {
+		return this.get(this.T(), server, "/priv/resign?sign="+url.QueryEscape(signURL)+"&digest="+url.QueryEscape(digest))
+	}
+
+	resp := this.get(this.T(), server, "/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath)+"&sign="+url.QueryEscape(signURL))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	digest := exchange.ResponseHeaders.Get("Digest")
+	this.Require().NotEqual("", digest)
+
+	// Exchanges aren't remembered unless configured.
+	this.Assert().Equal(http.StatusNotFound, resign(digest).StatusCode)
+
+	handler.RememberExchanges(10)
+	resp = this.get(this.T(), server, "/priv/doc?fetch="+url.QueryEscape(this.httpURL()+fakePath)+"&sign="+url.QueryEscape(signURL))
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	lastRequest := this.lastRequest
+
+	certFetcher := func(string) ([]byte, error) {
+		chain, err := certurl.NewCertChain(pkgt.Certs, []byte("ocsp"), nil)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = chain.Write(&buf)
+		return buf.Bytes(), err
+	}
+	this.clock.Advance(8 * 24 * time.Hour)
+	_, ok := exchange.Verify(this.clock.Now(), certFetcher, log.New(ioutil.Discard, "", 0))
+	this.Require().False(ok)
+
+	resp = resign(digest)
+	this.Require().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/cbor", resp.Header.Get("Content-Type"))
+	this.Assert().True(lastRequest == this.lastRequest, "origin was refetched")
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	decoder := cbor.NewDecoder(bytes.NewReader(body))
+	_, err = decoder.DecodeMapHeader()
+	this.Require().NoError(err)
+	_, err = decoder.DecodeTextString()
+	this.Require().NoError(err)
+	_, err = decoder.DecodeArrayHeader()
+	this.Require().NoError(err)
+	signature, err := decoder.DecodeByteString()
+	this.Require().NoError(err)
+	exchange.SignatureHeaderValue = string(signature)
+	payload, ok := exchange.Verify(this.clock.Now(), certFetcher, log.New(ioutil.Discard, "", 0))
+	this.Require().True(ok)
+	this.Assert().Equal(transformedBody, payload)
+
+	this.Assert().Equal(http.StatusNotFound, resign("mi-sha256-03=bogus").StatusCode)
+	this.Assert().Equal(http.StatusBadRequest, this.get(this.T(), server, "/priv/resign?sign="+url.QueryEscape(signURL)).StatusCode)
+
+	// Past maxResignAge, the exchange must be refetched.
+	this.clock.Advance(maxResignAge)
+	this.Assert().Equal(http.StatusNotFound, resign(digest).StatusCode)
 }
 
 func (this *SignerSuite) TestProxyUnsignedIfNotModified() {
@@ -610,6 +2871,25 @@ func (this *SignerSuite) TestProxyUnsignedIfNotModified() {
 	this.Assert().Equal("superrad", resp.Header.Get("etag"))
 }
 
+func (this *SignerSuite) TestServeRefetch() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, true, nil, nil, this.signatureLifetime, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+
+	resp := pkgt.GetH(this.T(), http.HandlerFunc(handler.ServeRefetch), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath), http.Header{
+		"AMP-Cache-Transform": {"google"}, "Accept": {"application/signed-exchange;v=" + accept.AcceptedSxgVersion},
+		"If-None-Match": {"superrad"}})
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/signed-exchange;v="+accept.AcceptedSxgVersion, resp.Header.Get("Content-Type"))
+	this.Assert().Equal("", this.lastRequest.Header.Get("If-None-Match"))
+	this.Assert().Equal("no-cache", this.lastRequest.Header.Get("Cache-Control"))
+	this.Assert().Equal("no-cache", this.lastRequest.Header.Get("Pragma"))
+}
+
 func (this *SignerSuite) TestProxyUnsignedIfShouldntPackage() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
@@ -743,6 +3023,82 @@ func (this *SignerSuite) TestProxyUnsignedOnVariants04() {
 	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
 }
 
+func (this *SignerSuite) TestAuxiliaryResource() {
+	urlSets := []util.URLSet{{
+		Sign:               &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+		AMPOnly:            true,
+		AuxiliaryResources: []util.AuxiliaryResource{{PathRE: `/manifest\.json`, ContentType: "application/manifest+json"}},
+	}}
+	manifest := []byte(`{"name": "Pine Trees", "start_url": "/amp/"}`)
+	contentType := "application/manifest+json"
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		this.lastRequest = req
+		resp.Header().Set("Content-Type", contentType)
+		resp.Write(manifest)
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/manifest.json"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("/manifest.json", this.lastRequest.URL.String())
+	this.Require().Equal("application/signed-exchange;v=b3", resp.Header.Get("Content-Type"))
+
+	exchange, err := signedexchange.ReadExchange(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Equal(contentType, exchange.ResponseHeaders.Get("Content-Type"))
+	this.Assert().Empty(exchange.ResponseHeaders.Get("Link"))
+	certFetcher := func(string) ([]byte, error) {
+		chain, err := certurl.NewCertChain(pkgt.Certs, []byte("ocsp"), nil)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = chain.Write(&buf)
+		return buf.Bytes(), err
+	}
+	payload, ok := exchange.Verify(this.clock.Now(), certFetcher, log.New(ioutil.Discard, "", 0))
+	this.Require().True(ok)
+	// Signed as-is, without transformation.
+	this.Assert().Equal(manifest, payload)
+
+	// Any other Content-Type is proxied unsigned.
+	contentType = "text/html"
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/manifest.json"))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("text/html", resp.Header.Get("Content-Type"))
+
+	// Other paths outside Sign.PathRE are still rejected.
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+"/other.json"))
+	this.Assert().Equal(http.StatusBadRequest, resp.StatusCode, "incorrect status: %#v", resp)
+}
+
+func (this *SignerSuite) TestVary() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Header().Set("Vary", "accept, Accept-Encoding")
+		resp.Write([]byte("<html><body>Not AMP."))
+	}
+	// The origin's Vary is merged with the packager's, rather than
+	// replacing it.
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal([]string{"Accept, AMP-Cache-Transform, Accept-Encoding"}, resp.Header["Vary"])
+
+	// If the response isn't negotiated, it doesn't vary.
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write(fakeBody)
+	}
+	handler, err := New(fakeCertHandler{}, pkgt.Key, urlSets, &rtv.RTVCache{}, func() error { return this.shouldPackage }, nil, false, nil, nil, 0, nil)
+	this.Require().NoError(err)
+	handler.client = this.httpsClient
+	handler.clock = this.clock
+	resp = pkgt.Get(this.T(), mux.New(mux.Handlers{Signer: handler}), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusOK, resp.StatusCode, "incorrect status: %#v", resp)
+	this.Assert().Equal("application/signed-exchange;v="+accept.AcceptedSxgVersion, resp.Header.Get("Content-Type"))
+	this.Assert().NotContains(resp.Header, "Vary")
+}
+
 func (this *SignerSuite) TestProxyUnsignedIfNotAMP() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil}}}
@@ -775,6 +3131,32 @@ func (this *SignerSuite) TestProxyUnsignedIfWrongAMP() {
 	this.Assert().Equal(wrongAMPBody, body, "incorrect body: %#v", resp)
 }
 
+func (this *SignerSuite) TestErrorIfAlreadySignedExchange() {
+	urlSets := []util.URLSet{{
+		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
+	}}
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "application/signed-exchange;v=b3")
+		resp.Write([]byte("sxg1-b3\x00"))
+	}
+	resp := this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), "already_signed_exchange")
+
+	// Mislabeled as HTML.
+	this.fakeHandler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/html")
+		resp.Write([]byte("sxg1-b3\x00"))
+	}
+	resp = this.get(this.T(), this.new(urlSets), "/priv/doc?sign="+url.QueryEscape(this.httpsURL()+fakePath))
+	this.Assert().Equal(http.StatusBadGateway, resp.StatusCode, "incorrect status: %#v", resp)
+	body, err = ioutil.ReadAll(resp.Body)
+	this.Require().NoError(err)
+	this.Assert().Contains(string(body), "already_signed_exchange")
+}
+
 func (this *SignerSuite) TestProxyTransformError() {
 	urlSets := []util.URLSet{{
 		Sign: &util.URLPattern{[]string{"https"}, "", this.httpsHost(), stringPtr("/amp/.*"), []string{}, stringPtr(""), false, 2000, nil},
@@ -838,6 +3220,26 @@ func (this *SignerSuite) TestProxyHeadersUnaltered() {
 	this.Assert().Empty(resp.Header)
 }
 
+func TestAddVary(t *testing.T) {
+	for _, test := range []struct {
+		existing []string
+		fields   []string
+		expected []string
+	}{
+		{nil, []string{"Accept", "AMP-Cache-Transform"}, []string{"Accept, AMP-Cache-Transform"}},
+		{[]string{"Accept, AMP-Cache-Transform"}, []string{"accept-encoding, ACCEPT", ""}, []string{"Accept, AMP-Cache-Transform, accept-encoding"}},
+		{[]string{"Accept"}, []string{"*"}, []string{"*"}},
+		{nil, nil, nil},
+	} {
+		header := http.Header{}
+		if test.existing != nil {
+			header["Vary"] = test.existing
+		}
+		addVary(header, test.fields...)
+		assert.Equal(t, test.expected, header["Vary"], "%v + %v", test.existing, test.fields)
+	}
+}
+
 func TestSignerSuite(t *testing.T) {
 	suite.Run(t, new(SignerSuite))
 }
@@ -0,0 +1,340 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/version"
+	"github.com/ampproject/amppackager/packager/accept"
+	"github.com/ampproject/amppackager/packager/mux"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/ampproject/amppackager/transformer"
+	rpb "github.com/ampproject/amppackager/transformer/request"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// The most subresources to substitute or bundle per document. Each is fetched
+// while the document waits.
+const maxSubresources = 8
+
+// The value of the output param that requests the SXGs of a document's
+// subresources, rather than of the document.
+const subresourcesOutput = "subresources"
+
+// Labels each SXG served for output=subresources with its header-integrity,
+// for use in the document's Link rel=allowed-alt-sxg header.
+const headerIntegrityHeader = "X-AmpPkg-Header-Integrity"
+
+// Marks the context of a request to sign a subresource on behalf of a
+// document.
+type subresourceRequestKey struct{}
+
+// True if req is to sign a subresource on behalf of a document, which already
+// holds a signing worker.
+func isSubresourceRequest(req *http.Request) bool {
+	return req.Context().Value(subresourceRequestKey{}) != nil
+}
+
+// An in-memory http.ResponseWriter, for signing a subresource as if it had
+// been requested from the packager.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (this *bufferedResponse) Header() http.Header { return this.header }
+
+func (this *bufferedResponse) Write(b []byte) (int, error) {
+	if this.status == 0 {
+		this.status = http.StatusOK
+	}
+	return this.body.Write(b)
+}
+
+func (this *bufferedResponse) WriteHeader(status int) {
+	if this.status == 0 {
+		this.status = status
+	}
+}
+
+// A same-origin subresource of a document, which the packager signs as one of
+// the AuxiliaryResources of urlSet.
+type subresource struct {
+	url      *url.URL
+	urlSet   *util.URLSet
+	resource *util.AuxiliaryResource
+}
+
+// Returns the same-origin subresources of the document that its URLSet signs
+// as AuxiliaryResources, up to maxSubresources: those it references (see
+// subresourceURLsOf), then those the transformer preloads.
+func (this *Signer) subresourcesOf(signURL *url.URL, document []byte, preloads []*rpb.Metadata_Preload) []subresource {
+	refs := subresourceURLsOf(document)
+	for _, preload := range preloads {
+		refs = append(refs, preload.Url)
+	}
+	var subresources []subresource
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		if len(subresources) == maxSubresources {
+			break
+		}
+		subURL, err := signURL.Parse(ref)
+		if err != nil || subURL.Scheme != signURL.Scheme || subURL.Host != signURL.Host {
+			continue
+		}
+		subURL.Fragment = ""
+		if seen[subURL.String()] {
+			continue
+		}
+		seen[subURL.String()] = true
+		_, _, urlSet, httpErr := parseURLs("", subURL.String(), this.urlSets, this.fetchAllowlists)
+		if httpErr != nil {
+			continue
+		}
+		if resource := urlSet.AuxiliaryResourceFor(subURL.EscapedPath()); resource != nil {
+			subresources = append(subresources, subresource{subURL, urlSet, resource})
+		}
+	}
+	return subresources
+}
+
+// Matches a url() in CSS, capturing its URL, quoted or not.
+var cssURL = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^"'\s)]+))\s*\)`)
+
+// Returns the URLs, as written, of the CSS, JS, and fonts that the HTML
+// document references: stylesheets and preloads (<link rel=stylesheet,
+// preload, or modulepreload>), scripts (<script src> and <amp-script src>),
+// and the url()s within its <style>s, such as @font-face sources.
+func subresourceURLsOf(document []byte) []string {
+	var urls []string
+	z := html.NewTokenizer(bytes.NewReader(document))
+	inStyle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return urls
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := map[string]string{}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(val)
+			}
+			switch string(name) {
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+					if rel == "stylesheet" || rel == "preload" || rel == "modulepreload" {
+						if href := attrs["href"]; href != "" {
+							urls = append(urls, href)
+						}
+						break
+					}
+				}
+			case "script", "amp-script":
+				if src := attrs["src"]; src != "" {
+					urls = append(urls, src)
+				}
+			case "style":
+				inStyle = true
+			}
+		case html.EndTagToken:
+			inStyle = false
+		case html.TextToken:
+			if inStyle {
+				for _, match := range cssURL.FindAllStringSubmatch(string(z.Text()), -1) {
+					urls = append(urls, match[1]+match[2]+match[3])
+				}
+			}
+		}
+	}
+}
+
+// Returns Link header values that allow the AMP cache to substitute SXGs for
+// the document's subresources, per
+// https://github.com/WICG/webpackage/blob/master/explainers/signed-exchange-subresource-substitution.md:
+// one rel=allowed-alt-sxg value for each. Its header-integrity commits to the
+// subresource's SXG, so this signs it now, via the signature cache, from which
+// the same SXG is served when the cache requests it. Those that can't be
+// signed, or that the signature cache won't serve again, are skipped.
+func (this *Signer) allowedAltSXGs(req *http.Request, signURL *url.URL, document []byte, sxgVersion string, transformVersion int64, preloads []*rpb.Metadata_Preload) []string {
+	// Only SXG b3 supports substitution.
+	if this.signedExchanges == nil || accept.LibraryVersion(sxgVersion) != version.Version1b3 {
+		return nil
+	}
+	var values []string
+	for _, sub := range this.subresourcesOf(signURL, document, preloads) {
+		integrity, err := this.headerIntegrity(req, sub, sxgVersion, transformVersion)
+		if err != nil {
+			log.Printf("Not substituting subresource %s: %v\n", sub.url, err)
+			continue
+		}
+		values = append(values, "<"+sub.url.String()+`>;rel="allowed-alt-sxg";header-integrity="`+integrity+`"`)
+	}
+	return values
+}
+
+// Signs the subresource at subURL as the packager would if req had been for
+// it, and returns its SXG.
+func (this *Signer) signSubresource(req *http.Request, subURL *url.URL, sxgVersion string) ([]byte, error) {
+	subReq, err := http.NewRequest(http.MethodGet, "/priv/doc?"+url.Values{"sign": {subURL.String()}}.Encode(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "building request")
+	}
+	subReq = subReq.WithContext(context.WithValue(req.Context(), subresourceRequestKey{}, true))
+	// Don't inherit the document's sign URL, if it was in the path.
+	subReq = mux.WithParams(subReq, map[string]string{})
+	for _, name := range []string{"Accept", "AMP-Cache-Transform"} {
+		if values, ok := req.Header[http.CanonicalHeaderKey(name)]; ok {
+			subReq.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	resp := &bufferedResponse{header: http.Header{}}
+	this.ServeHTTP(resp, subReq)
+	if resp.status != http.StatusOK || resp.header.Get("Content-Type") != accept.ContentType(sxgVersion) {
+		return nil, errors.Errorf("got status %d, Content-Type %q", resp.status, resp.header.Get("Content-Type"))
+	}
+	return resp.body.Bytes(), nil
+}
+
+// Signs the subresource as the packager would if req had been for it, and
+// returns the header-integrity of the SXG that the signature cache will serve
+// for it: the SHA-256 of its CBOR-encoded signed headers. Those include the
+// origin's Date, so an SXG signed afresh wouldn't match; hence it's an error
+// if the cache won't serve this one again, e.g. as its max-age spans its
+// signature's lifetime (see exchangeLifetime.reusableUntil).
+func (this *Signer) headerIntegrity(req *http.Request, sub subresource, sxgVersion string, transformVersion int64) (string, error) {
+	if _, err := this.signSubresource(req, sub.url, sxgVersion); err != nil {
+		return "", err
+	}
+	now := this.clock.Now()
+	certs, err := this.chooseCerts(sub.urlSet, now)
+	if err != nil {
+		return "", err
+	}
+	cached, ok := this.signedExchanges.getLatest(exchangeVariantOf(sub.url, sxgVersion, transformVersion), certs, now)
+	if !ok {
+		return "", errors.New("the signature cache won't serve its SXG again")
+	}
+	return headerIntegrityOf(cached.headers)
+}
+
+// Returns the header-integrity of the SXG, or of its serialized headers
+// alone.
+func headerIntegrityOf(sxg []byte) (string, error) {
+	exchange, err := signedexchange.ReadExchange(bytes.NewReader(sxg))
+	if err != nil {
+		return "", errors.Wrap(err, "parsing SXG")
+	}
+	var signedHeaders bytes.Buffer
+	if err := exchange.DumpExchangeHeaders(&signedHeaders); err != nil {
+		return "", errors.Wrap(err, "encoding signed headers")
+	}
+	sum := sha256.Sum256(signedHeaders.Bytes())
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// Serves the SXGs of the document's subresources (see subresourcesOf) as a
+// multipart/mixed response, one per part, so that a frontend can serve them
+// as alternates alongside the document's SXG. Each part is labeled with the
+// subresource's URL, in Content-Location, and its header-integrity.
+// Subresources that can't be signed are left out, so the response may have no
+// parts, as for documents that are signed as-is.
+func (this *Signer) serveSubresources(resp http.ResponseWriter, req *http.Request, fetchResp *http.Response, signURL *url.URL, urlSet *util.URLSet, resource *util.AuxiliaryResource, transformVersion int64, sxgVersion string) {
+	var document []byte
+	var preloads []*rpb.Metadata_Preload
+	if resource == nil && fetchResp.StatusCode == http.StatusOK {
+		limit := urlSet.BodyLength()
+		body := newBodyReader(fetchResp)
+		within, err := body.readWithin(limit)
+		if err != nil {
+			util.NewHTTPError(http.StatusBadGateway, "Error reading body: ", err).LogAndRespond(resp, req)
+			return
+		}
+		if !within {
+			util.NewHTTPError(http.StatusBadGateway, "Not signing subresources because the body is longer than ", limit, " bytes").LogAndRespond(resp, req)
+			return
+		}
+		release, ok := this.acquireSigningWorker(resp, req, urlSet)
+		if !ok {
+			return
+		}
+		defer release()
+		transformReq := getTransformerRequest(this.rtvCache, string(body.body), signURL.String())
+		transformReq.Version = transformVersion
+		_, metadata, err := transformer.Process(transformReq)
+		if err != nil {
+			util.NewHTTPError(http.StatusBadGateway, "Not signing subresources due to transformer error: ", err).LogAndRespond(resp, req)
+			return
+		}
+		document, preloads = body.body, metadata.Preloads
+	}
+
+	var parts bytes.Buffer
+	mw := multipart.NewWriter(&parts)
+	for _, sub := range this.subresourcesOf(signURL, document, preloads) {
+		sxg, err := this.signSubresource(req, sub.url, sxgVersion)
+		if err == nil {
+			var integrity string
+			integrity, err = headerIntegrityOf(sxg)
+			if err == nil {
+				err = writeSubresourcePart(mw, sub.url, sxgVersion, integrity, sxg)
+			}
+		}
+		if err != nil {
+			log.Printf("Not serving subresource %s: %v\n", sub.url, err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error writing multipart response: ", err).LogAndRespond(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	resp.Header().Set("Content-Length", strconv.Itoa(parts.Len()))
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.WriteHeader(http.StatusOK)
+	if _, err := parts.WriteTo(resp); err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
+
+func writeSubresourcePart(mw *multipart.Writer, subURL *url.URL, sxgVersion string, integrity string, sxg []byte) error {
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {accept.ContentType(sxgVersion)},
+		"Content-Location":    {subURL.String()},
+		headerIntegrityHeader: {integrity},
+	})
+	if err != nil {
+		return errors.Wrap(err, "creating part")
+	}
+	_, err = part.Write(sxg)
+	return errors.Wrap(err, "writing part")
+}
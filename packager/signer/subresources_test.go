@@ -0,0 +1,47 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubresourceURLsOf(t *testing.T) {
+	document := `<html amp><head>
+		<link rel="preload" as="font" href="/fonts/a.woff2">
+		<link rel="Alternate Stylesheet" href="/alt.css">
+		<link rel=canonical href=/canonical.html>
+		<script async src="https://cdn.ampproject.org/v0.js"></script>
+		<style amp-custom>
+			@font-face { src: url("/fonts/b.woff2"), url('/fonts/c.woff') }
+			body { background: url(/bg.png) }
+		</style>
+		<noscript><style>a { color: red }</style></noscript>
+	</head><body>
+		<p>url(/not-css.png)</p>
+		<amp-script layout=container src="/counter.js"></amp-script>
+	</body></html>`
+	assert.Equal(t, []string{
+		"/fonts/a.woff2",
+		"/alt.css",
+		"https://cdn.ampproject.org/v0.js",
+		"/fonts/b.woff2",
+		"/fonts/c.woff",
+		"/bg.png",
+		"/counter.js",
+	}, subresourceURLsOf([]byte(document)))
+}
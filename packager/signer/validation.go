@@ -2,228 +2,88 @@
 package signer
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"mime"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/ampproject/amppackager/packager/urlmatch"
 	"github.com/ampproject/amppackager/packager/util"
 	"github.com/pkg/errors"
 	"github.com/pquerna/cachecontrol"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"golang.org/x/net/html"
 )
 
 // Converts an URL string into an URL object with an unambiguous interpretation.
 func parseURL(rawURL string, name string) (*url.URL, *util.HTTPError) {
-	if rawURL == "" {
-		return nil, util.NewHTTPError(http.StatusBadRequest, name, " URL is unspecified")
-	}
-	ret, err := url.Parse(rawURL)
+	ret, err := urlmatch.ParseURL(rawURL, name)
 	if err != nil {
-		return nil, util.NewHTTPError(http.StatusBadRequest, "Error parsing ", name, " URL: ", err)
-	}
-	if !ret.IsAbs() {
-		// Relative URLs don't make sense. For a fetch URL, it's not
-		// clear what from what base URL the signer should resolve it
-		// before fetching. For a sign URL, relative URLs are
-		// disallowed by the SXG spec:
-		// https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#application-signed-exchange
-		return nil, util.NewHTTPError(http.StatusBadRequest, name, " URL is relative")
+		return nil, util.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
-	// Evaluate "/..", by resolving the URL as a reference from itself.
-	// This prevents malformed URLs from eluding the PathRE protections.
-	ret = ret.ResolveReference(ret)
-	// Escape special characters in the query component such as "<" or "|"
-	// (but not "&" or "=").
-	ret.RawQuery = url.PathEscape(ret.RawQuery)
 	return ret, nil
 }
 
-// Returns true iff the given pattern matches the entire test string.
-func regexpFullMatch(pattern string, test string) bool {
-	// This is how regexp/exec_test.go turns a partial pattern into a full pattern.
-	fullRe := `\A(?:` + pattern + `)\z`
-	matches, _ := regexp.MatchString(fullRe, test)
-	return matches
-}
-
-// Implements the URL-matching common to both fetchURLMatches and signURLMatches.
-func urlMatches(url *url.URL, pattern util.URLPattern) error {
-	if url.Opaque != "" {
-		// Opaque URLs are unfetchable, and also disallowed by the spec
-		// as sign URLs.
-		return errors.New("URL is opaque")
-	}
-	if url.User != nil {
-		// The `user:pass@` portion of a URL is not technically
-		// disallowed by the spec, but is a weird enough request that
-		// it seems wise to disable this capability by default (i.e.
-		// more likely a sign of attack than a legitimate request).
-		// Please open an issue if you have a legitimate need for this
-		// in a fetch/sign URL.
-		return errors.New("URL contains user")
-	}
-	// PathRE matches the path component of the URL, including the
-	// beginning slash.
-	if !regexpFullMatch(*pattern.PathRE, url.EscapedPath()) {
-		return errors.New("PathRE doesn't match")
-	}
-	// If any of PathExcludeRE matches, the URL does not match.
-	for _, re := range pattern.PathExcludeRE {
-		if regexpFullMatch(re, url.EscapedPath()) {
-			return errors.Errorf("PathExcludeRE matches: %s", re)
-		}
-	}
-	// QueryRE matches the query component of the URL, *not* including the
-	// beginning question mark.
-	if !regexpFullMatch(*pattern.QueryRE, url.RawQuery) {
-		return errors.New("QueryRE doesn't match")
-	}
-	if len(url.String()) > pattern.MaxLength {
-		return errors.New("URL too long")
-	}
-	return nil
-}
-
-// True iff actualScheme is an element of expectedSchemes.
-func schemeMatches(actualScheme string, expectedSchemes []string) bool {
-	for _, expectedScheme := range expectedSchemes {
-		if actualScheme == expectedScheme {
-			return true
-		}
-	}
-	return false
-}
-
-// True iff url matches pattern, as defined by an [URLSet.Fetch] block in the
-// config file. The format of this URLPattern is validated by
-// validateFetchURLPattern in config.go.
-func fetchURLMatches(url *url.URL, pattern *util.URLPattern) error {
-	// If the fetch block is not specified, then this particular URLSet is
-	// a "sign-only" config. That is: only the sign URL should be passed to
-	// the Signer; this will be used as the fetch URL as well.
-	if pattern == nil {
-		if url == nil {
-			return nil
-		} else {
-			return errors.New("If URLSet.Fetch is unspecified, then so should ?fetch= be.")
-		}
-	}
-	// The fetch block may specify which schemes are allowed.
-	if !schemeMatches(url.Scheme, pattern.Scheme) {
-		return errors.New("Scheme doesn't match")
-	}
-	// The fetch block may specify either Domain or DomainRE.
-	if pattern.Domain != "" && url.Host != pattern.Domain {
-		return errors.New("Domain doesn't match")
-	}
-	if pattern.DomainRE != "" && !regexpFullMatch(pattern.DomainRE, url.Host) {
-		return errors.New("DomainRE doesn't match")
-	}
-	return urlMatches(url, *pattern)
-}
-
-// Determines if b is either a valid byte of a fallback URL, per
-// https://wicg.github.io/webpackage/draft-yasskin-http-origin-signed-responses.html#seccons-content-sniffing
-// item 3.1, or is the U+0025 (%) character.
-func isFallbackURLCodePoint(b byte) bool {
-	// https://url.spec.whatwg.org/#url-code-points, but in codepoint order:
-	//
-	// U+0021 (!), U+0024 ($), U+0026 (&), U+0027 ('), U+0028 LEFT PARENTHESIS,
-	// U+0029 RIGHT PARENTHESIS, U+002A (*), U+002B (+), U+002C (,), U+002D (-),
-	// U+002E (.), U+002F (/), ASCII digits (U+0030 - U+0039), U+003A (:),
-	// U+003B (;), U+003D (=), U+003F (?), U+0040 (@),
-	// ASCII upper alpha (U+0041 - U+005A), U+005F (_),
-	// ASCII lower alpha (U+0061 - U+007A), U+007E (~)
-
-	// Vaguely ordered most to least common, to aid short-circuiting:
-	return (b >= 'a' && b <= 'z') || b == '_' || b == '~' ||
-		(b >= '!' && b <= 'Z' && b != '"' /*x22*/ && b != '#' /*x23*/ && b != '<' /*x3C*/ && b != '>' /*x3E*/)
-}
-
-// True iff url matches pattern, as defined by an [URLSet.Sign] block in the
-// config file. The format of this URLPattern is validated by
-// validateSignURLPattern in config.go.
-func signURLMatches(url *url.URL, pattern *util.URLPattern) error {
-	for _, b := range []byte(url.String()) {
-		if !isFallbackURLCodePoint(b) {
-			return errors.New("Contains invalid byte")
-		}
-	}
-
-	// The sign block may not specify which schemes are allowed. Only HTTPS
-	// is allowed:
-	// https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#rfc.section.5.3
-	if url.Scheme != "https" {
-		return errors.New("Scheme doesn't match")
-	}
-	// The sign block may only specify Domain. DomainRE would only be
-	// useful for wildcard SXG certificates. Please open an issue if you
-	// have a valid wildcard SXG certificate and a legitimate need for
-	// this. This should be implemented with some thought into how to
-	// ensure that the sign URL matches the fetch URL.
-	if url.Host != pattern.Domain {
-		return errors.New("Domain doesn't match")
-	}
-	return urlMatches(url, *pattern)
-}
-
-// True iff the given fetchURL and signURL match the given set (as specified by
-// an [[URLSet]] block in the config file), and, if SamePath is true (default),
-// fetchURL and signURL match each other.
-func urlsMatch(fetchURL *url.URL, signURL *url.URL, set util.URLSet) error {
-	if err := fetchURLMatches(fetchURL, set.Fetch); err != nil {
-		return errors.Wrap(err, "fetch URL")
-	}
-	if err := signURLMatches(signURL, set.Sign); err != nil {
-		return errors.Wrap(err, "sign URL")
-	}
-	theyMatch := set.Fetch == nil || !*set.Fetch.SamePath || fetchURL.RequestURI() == signURL.RequestURI()
-	if !theyMatch {
-		return errors.New("fetch and sign paths don't match")
-	}
-	return nil
-}
-
 // If the given fetch and sign URLs are valid, and match at least one of the
 // urlSets (as specified by the [[URLSet]] blocks in the config file), then
-// this returns the parsed URLs as well as a bool containing the value of
-// ErrorOnStatefulHeaders for the first matching URLSet. Otherwise, returns an
-// error.
-func parseURLs(fetch string, sign string, urlSets []util.URLSet) (*url.URL, *url.URL, bool, *util.HTTPError) {
+// this returns the parsed URLs as well as the first matching URLSet.
+// allowlists[i], if present and non-nil, supplies additional fetch hosts for
+// urlSets[i]. Otherwise, returns an error.
+func parseURLs(fetch string, sign string, urlSets []util.URLSet, allowlists []urlmatch.HostAllowlist) (*url.URL, *url.URL, *util.URLSet, *util.HTTPError) {
 	var fetchURL *url.URL
 	var err *util.HTTPError
 	if fetch != "" {
 		fetchURL, err = parseURL(fetch, "fetch")
 		if err != nil {
 			// TODO(twifkak): Use errors.Wrap() after changing return types to error.
-			return nil, nil, false, err
+			return nil, nil, nil, err
 		}
 	}
 	signURL, err := parseURL(sign, "sign")
 	if err != nil {
 		// TODO(twifkak): Use errors.Wrap() after changing return types to error.
-		return nil, nil, false, err
+		return nil, nil, nil, err
 	}
 
-	errs := []string{}
-	for _, set := range urlSets {
-		err := urlsMatch(fetchURL, signURL, set)
-		if err == nil {
-			if fetchURL == nil {
-				fetchURL = signURL
-			}
-			return fetchURL, signURL, set.Sign.ErrorOnStatefulHeaders, nil
-		}
-		errs = append(errs, err.Error())
+	urlSet, matchErr := urlmatch.NewWithAllowlists(urlSets, allowlists).MatchURLs(fetchURL, signURL)
+	if matchErr != nil {
+		return nil, nil, nil, util.NewHTTPError(http.StatusBadRequest, matchErr.Error())
+	}
+	if fetchURL == nil {
+		fetchURL = signURL
 	}
-	return nil, nil, false, util.NewHTTPError(http.StatusBadRequest, "fetch/sign URLs do not match config; caused by: ", strings.Join(errs, ", "))
+	return fetchURL, signURL, urlSet, nil
+}
+
+// Returns how long a shared cache may consider the response fresh, per the
+// s-maxage of its Cache-Control header, else its max-age. Returns false if it
+// has neither, or they can't be parsed.
+func originTTL(resp *http.Response) (time.Duration, bool) {
+	directives, err := cacheobject.ParseResponseCacheControl(GetJoined(resp.Header, "Cache-Control"))
+	if err != nil {
+		return 0, false
+	}
+	if directives.SMaxAge >= 0 {
+		return time.Duration(directives.SMaxAge) * time.Second, true
+	}
+	if directives.MaxAge >= 0 {
+		return time.Duration(directives.MaxAge) * time.Second, true
+	}
+	return 0, false
 }
 
 // Given a request/response pair for the fetch from the packager to the backend
 // content server, validates that the response is fit for including in an AMP
-// SXG.
-func validateFetch(req *http.Request, resp *http.Response) error {
+// SXG. contentTypes are the media types it may have: the URLSet's
+// AllowedContentTypes for AMP documents, or that of an auxiliary resource.
+func validateFetch(req *http.Request, resp *http.Response, contentTypes []string) error {
 	// Validate response is publicly-cacheable, per
 	// https://tools.ietf.org/html/draft-yasskin-http-origin-signed-responses-03#section-6.1, as referenced by
 	// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-6.
@@ -240,7 +100,7 @@ func validateFetch(req *http.Request, resp *http.Response) error {
 	}
 
 	// Validate that no Content-Encoding is specified. Otherwise, it was
-	// encoded as something that http.Client was unable to decode (e.g. br).
+	// encoded as something that decodeContentEncoding doesn't support (e.g. br).
 	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
 		return errors.Errorf("Invalid Content-Encoding: %s", encoding)
 	}
@@ -249,12 +109,19 @@ func validateFetch(req *http.Request, resp *http.Response) error {
 	// params (such as charset); we just want to verify we're not
 	// misinterpreting the server's intent. We override the Content-Type
 	// later for unambiguous interpretation by the browser.
-	contentType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	actualContentType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
 	if err != nil {
 		return errors.Wrap(err, "Parsing Content-Type")
 	}
-	if contentType != "text/html" {
-		return errors.Errorf("Wrong Content-Type: %s", contentType)
+	allowed := false
+	for _, contentType := range contentTypes {
+		if actualContentType == contentType {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return errors.Errorf("Wrong Content-Type: %s", actualContentType)
 	}
 
 	// Don't allow charset other than utf-8, as this overrides <meta charset>.
@@ -264,3 +131,96 @@ func validateFetch(req *http.Request, resp *http.Response) error {
 	}
 	return nil
 }
+
+// Every application/signed-exchange body starts with "sxg1", followed by a
+// version-specific suffix (e.g. "-b3\x00").
+var signedExchangeMagic = []byte("sxg1")
+
+// Returns an error if the fetch response appears to already be a signed
+// exchange, either by its Content-Type or, if body is non-nil, by its magic
+// string. Signing it would produce an exchange-of-an-exchange, which no
+// browser can use. This typically means the fetch was routed back through a
+// frontend that packages documents.
+func checkNotSignedExchange(resp *http.Response, body []byte) *util.HTTPError {
+	if contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && contentType == "application/signed-exchange" {
+		return util.NewHTTPError(http.StatusBadGateway, "Fetch response is already a signed exchange: Content-Type: ", resp.Header.Get("Content-Type")).WithCode("already_signed_exchange")
+	}
+	if bytes.HasPrefix(body, signedExchangeMagic) {
+		return util.NewHTTPError(http.StatusBadGateway, "Fetch response is already a signed exchange: body starts with ", string(signedExchangeMagic)).WithCode("already_signed_exchange")
+	}
+	return nil
+}
+
+// Returns the pin-sha256 of the given cert's public key, as in HPKP: the
+// base64 encoding of the SHA-256 of its DER-encoded SubjectPublicKeyInfo.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Returns an error unless the connection is TLS and one of its verified
+// chains (or, absent verification, its peer certs) includes a cert whose
+// public key matches one of the pins. This is a check against DNS hijacking
+// of the fetch host; any such compromise would otherwise result in signing
+// the attacker's content as the publisher.
+func checkPinnedSPKI(connState *tls.ConnectionState, pins []string) error {
+	if connState == nil {
+		return errors.New("fetch was not over TLS")
+	}
+	chains := connState.VerifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{connState.PeerCertificates}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			hash := spkiHash(cert)
+			for _, pin := range pins {
+				if hash == pin {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("no cert in the origin's chain matches PinnedSPKIHashes")
+}
+
+// Returns the next token that isn't a comment or whitespace.
+func nextSignificantToken(tokenizer *html.Tokenizer) html.Token {
+	for {
+		tokenType := tokenizer.Next()
+		token := tokenizer.Token()
+		if tokenType == html.CommentToken || tokenType == html.TextToken && strings.TrimSpace(token.Data) == "" {
+			continue
+		}
+		return token
+	}
+}
+
+// Returns an error unless the body looks like an AMP document: UTF-8 text
+// starting (after any BOM, whitespace, and comments) with <!doctype html>,
+// followed by <html amp> or <html ⚡>. This guards URLSets marked AMPOnly
+// against signing binary or JSON bodies mislabeled as text/html.
+func checkAMPDocument(body []byte) error {
+	body = bytes.TrimPrefix(body, []byte("\uFEFF"))
+	if !utf8.Valid(body) {
+		return errors.New("body is not valid UTF-8")
+	}
+	if bytes.IndexByte(body, 0) != -1 {
+		return errors.New("body contains a NUL byte")
+	}
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	doctype := nextSignificantToken(tokenizer)
+	if doctype.Type != html.DoctypeToken || !strings.EqualFold(doctype.Data, "html") {
+		return errors.New("body doesn't start with <!doctype html>")
+	}
+	root := nextSignificantToken(tokenizer)
+	if root.Type != html.StartTagToken || root.Data != "html" {
+		return errors.New("body doesn't start with an <html> tag after the doctype")
+	}
+	for _, attr := range root.Attr {
+		if attr.Key == "amp" || attr.Key == "\u26a1" {
+			return nil
+		}
+	}
+	return errors.New("<html> tag lacks the amp attribute")
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signer
+
+import (
+	"bytes"
+	"crypto/x509"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange"
+	"github.com/WICG/webpackage/go/signedexchange/certurl"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// Verifies the exchange serialized as headers followed by payload, as a
+// browser would at now. Its cert-urls must name one of certs, whose chain is
+// used in place of fetching them, so this doesn't catch a misrouted cert-url
+// or a bad OCSP response; see the selfcheck package for that.
+func verifyExchange(headers []byte, payload *miPayload, certs *signingCerts, now time.Time) error {
+	var serialized bytes.Buffer
+	serialized.Write(headers)
+	if _, err := payload.WriteTo(&serialized); err != nil {
+		return errors.Wrap(err, "serializing payload")
+	}
+	exchange, err := signedexchange.ReadExchange(&serialized)
+	if err != nil {
+		return errors.Wrap(err, "parsing exchange")
+	}
+	fetchCert := func(certURL string) ([]byte, error) {
+		for _, cert := range []*x509.Certificate{certs.cert, certs.secondaryCert} {
+			if cert == nil || !strings.Contains(certURL, util.CertName(cert)) {
+				continue
+			}
+			// The verifier requires an OCSP response, but doesn't
+			// check it.
+			chain, err := certurl.NewCertChain([]*x509.Certificate{cert}, []byte("unchecked"), nil)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			if err := chain.Write(&buf); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}
+		return nil, errors.Errorf("cert-url %s names none of the signing certs", certURL)
+	}
+	// The verifier explains failures via its logger.
+	var reasons bytes.Buffer
+	if _, ok := exchange.Verify(now, fetchCert, log.New(&reasons, "", 0)); !ok {
+		return errors.Errorf("verification failed: %q", reasons.String())
+	}
+	return nil
+}
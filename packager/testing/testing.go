@@ -21,7 +21,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/WICG/webpackage/go/signedexchange"
 	"github.com/ampproject/amppackager/packager/util"
@@ -120,3 +122,38 @@ func GetBHH(t *testing.T, handler http.Handler, target string, host string, body
 	handler.ServeHTTP(rec, req)
 	return rec.Result()
 }
+
+// A util.Clock that only moves when told to.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (this *FakeClock) Now() time.Time {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.now
+}
+
+// Moves the clock forward by d.
+func (this *FakeClock) Advance(d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.now = this.now.Add(d)
+}
+
+// A source of "randomness" that yields the given byte forever, so that
+// signatures made with it are reproducible, e.g. for comparison against golden
+// files. See signer.SignDeterministically.
+type FixedRand byte
+
+func (this FixedRand) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(this)
+	}
+	return len(p), nil
+}
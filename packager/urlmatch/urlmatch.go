@@ -0,0 +1,360 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Decides which URLs the packager will sign, per the [[URLSet]] blocks of its
+// config. Frontends can use this to pre-filter the URLs they send to
+// /priv/doc, with exactly the rules the packager enforces:
+//
+//	config, err := util.ReadConfig(configBytes)
+//	...
+//	matcher := urlmatch.New(config.URLSet)
+//	if decision, reason := matcher.Match(url); decision == urlmatch.Reject {
+//		log.Println("Not packaging", url, "because", reason)
+//	}
+//
+// A Package decision is necessary but not sufficient for the packager to
+// respond with a signed exchange; it may still proxy the document unsigned,
+// e.g. if the fetched response isn't publicly cacheable or isn't valid AMP.
+package urlmatch
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+type Decision int
+
+const (
+	// The URL is invalid or matches no URLSet; /priv/doc responds 400.
+	Reject Decision = iota
+	// The URL matches a URLSet; /priv/doc fetches and tries to package it.
+	Package
+)
+
+func (this Decision) String() string {
+	switch this {
+	case Reject:
+		return "reject"
+	case Package:
+		return "package"
+	default:
+		return fmt.Sprintf("Decision(%d)", int(this))
+	}
+}
+
+// Converts an URL string into an URL object with an unambiguous
+// interpretation, as the packager does with the fetch and sign params. name
+// ("fetch" or "sign") is used in error messages.
+func ParseURL(rawURL string, name string) (*url.URL, error) {
+	if rawURL == "" {
+		return nil, errors.Errorf("%s URL is unspecified", name)
+	}
+	ret, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing %s URL", name)
+	}
+	if !ret.IsAbs() {
+		// Relative URLs don't make sense. For a fetch URL, it's not
+		// clear what from what base URL the signer should resolve it
+		// before fetching. For a sign URL, relative URLs are
+		// disallowed by the SXG spec:
+		// https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#application-signed-exchange
+		return nil, errors.Errorf("%s URL is relative", name)
+	}
+	// Evaluate "/..", by resolving the URL as a reference from itself.
+	// This prevents malformed URLs from eluding the PathRE protections.
+	ret = ret.ResolveReference(ret)
+	// Escape special characters in the query component such as "<" or "|"
+	// (but not "&" or "=").
+	ret.RawQuery = url.PathEscape(ret.RawQuery)
+	return ret, nil
+}
+
+// Returns true iff the given pattern matches the entire test string.
+func regexpFullMatch(pattern string, test string) bool {
+	// This is how regexp/exec_test.go turns a partial pattern into a full pattern.
+	fullRe := `\A(?:` + pattern + `)\z`
+	matches, _ := regexp.MatchString(fullRe, test)
+	return matches
+}
+
+// Implements the URL-matching common to both fetchURLMatches and signURLMatches.
+func urlMatches(url *url.URL, pattern util.URLPattern) error {
+	if url.Opaque != "" {
+		// Opaque URLs are unfetchable, and also disallowed by the spec
+		// as sign URLs.
+		return errors.New("URL is opaque")
+	}
+	if url.User != nil {
+		// The `user:pass@` portion of a URL is not technically
+		// disallowed by the spec, but is a weird enough request that
+		// it seems wise to disable this capability by default (i.e.
+		// more likely a sign of attack than a legitimate request).
+		// Please open an issue if you have a legitimate need for this
+		// in a fetch/sign URL.
+		return errors.New("URL contains user")
+	}
+	// PathRE matches the path component of the URL, including the
+	// beginning slash.
+	if !regexpFullMatch(*pattern.PathRE, url.EscapedPath()) {
+		return errors.New("PathRE doesn't match")
+	}
+	// If any of PathExcludeRE matches, the URL does not match.
+	for _, re := range pattern.PathExcludeRE {
+		if regexpFullMatch(re, url.EscapedPath()) {
+			return errors.Errorf("PathExcludeRE matches: %s", re)
+		}
+	}
+	// QueryRE matches the query component of the URL, *not* including the
+	// beginning question mark.
+	if !regexpFullMatch(*pattern.QueryRE, url.RawQuery) {
+		return errors.New("QueryRE doesn't match")
+	}
+	if len(url.String()) > pattern.MaxLength {
+		return errors.New("URL too long")
+	}
+	return nil
+}
+
+// True iff actualScheme is an element of expectedSchemes.
+func schemeMatches(actualScheme string, expectedSchemes []string) bool {
+	for _, expectedScheme := range expectedSchemes {
+		if actualScheme == expectedScheme {
+			return true
+		}
+	}
+	return false
+}
+
+// True iff url matches pattern, as defined by an [URLSet.Fetch] block in the
+// config file. The format of this URLPattern is validated by
+// validateFetchURLPattern in config.go.
+func fetchURLMatches(url *url.URL, pattern *util.URLPattern) error {
+	// If the fetch block is not specified, then this particular URLSet is
+	// a "sign-only" config. That is: only the sign URL should be passed to
+	// the Signer; this will be used as the fetch URL as well.
+	if pattern == nil {
+		if url == nil {
+			return nil
+		} else {
+			return errors.New("If URLSet.Fetch is unspecified, then so should ?fetch= be.")
+		}
+	}
+	if url == nil {
+		return errors.New("If URLSet.Fetch is specified, then so should ?fetch= be.")
+	}
+	// The fetch block may specify which schemes are allowed.
+	if !schemeMatches(url.Scheme, pattern.Scheme) {
+		return errors.New("Scheme doesn't match")
+	}
+	// The fetch block may specify either Domain or DomainRE.
+	if pattern.Domain != "" && url.Host != pattern.Domain {
+		return errors.New("Domain doesn't match")
+	}
+	if pattern.DomainRE != "" && !regexpFullMatch(pattern.DomainRE, url.Host) {
+		return errors.New("DomainRE doesn't match")
+	}
+	return urlMatches(url, *pattern)
+}
+
+// Determines if b is either a valid byte of a fallback URL, per
+// https://wicg.github.io/webpackage/draft-yasskin-http-origin-signed-responses.html#seccons-content-sniffing
+// item 3.1, or is the U+0025 (%) character.
+func isFallbackURLCodePoint(b byte) bool {
+	// https://url.spec.whatwg.org/#url-code-points, but in codepoint order:
+	//
+	// U+0021 (!), U+0024 ($), U+0026 (&), U+0027 ('), U+0028 LEFT PARENTHESIS,
+	// U+0029 RIGHT PARENTHESIS, U+002A (*), U+002B (+), U+002C (,), U+002D (-),
+	// U+002E (.), U+002F (/), ASCII digits (U+0030 - U+0039), U+003A (:),
+	// U+003B (;), U+003D (=), U+003F (?), U+0040 (@),
+	// ASCII upper alpha (U+0041 - U+005A), U+005F (_),
+	// ASCII lower alpha (U+0061 - U+007A), U+007E (~)
+
+	// Vaguely ordered most to least common, to aid short-circuiting:
+	return (b >= 'a' && b <= 'z') || b == '_' || b == '~' ||
+		(b >= '!' && b <= 'Z' && b != '"' /*x22*/ && b != '#' /*x23*/ && b != '<' /*x3C*/ && b != '>' /*x3E*/)
+}
+
+// True iff url matches pattern, as defined by an [URLSet.Sign] block in the
+// config file. The format of this URLPattern is validated by
+// validateSignURLPattern in config.go.
+func signURLMatches(url *url.URL, pattern *util.URLPattern) error {
+	for _, b := range []byte(url.String()) {
+		if !isFallbackURLCodePoint(b) {
+			return errors.New("Contains invalid byte")
+		}
+	}
+
+	// The sign block may not specify which schemes are allowed. Only HTTPS
+	// is allowed:
+	// https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#rfc.section.5.3
+	if url.Scheme != "https" {
+		return errors.New("Scheme doesn't match")
+	}
+	// The sign block may only specify Domain. DomainRE would only be
+	// useful for wildcard SXG certificates. Please open an issue if you
+	// have a valid wildcard SXG certificate and a legitimate need for
+	// this. This should be implemented with some thought into how to
+	// ensure that the sign URL matches the fetch URL.
+	if url.Host != pattern.Domain {
+		return errors.New("Domain doesn't match")
+	}
+	return urlMatches(url, *pattern)
+}
+
+// True iff the given fetchURL and signURL match the given set (as specified by
+// an [[URLSet]] block in the config file), and, if SamePath is true (default),
+// fetchURL and signURL match each other. If allowlist is non-nil, fetch hosts
+// it contains match regardless of the Fetch block's Domain or DomainRE. Paths
+// of the set's AuxiliaryResources match regardless of the PathREs.
+func urlsMatch(fetchURL *url.URL, signURL *url.URL, set util.URLSet, allowlist HostAllowlist) error {
+	fetchPattern, signPattern := set.Fetch, set.Sign
+	if fetchPattern != nil && fetchURL != nil && allowlist != nil && allowlist.Contains(fetchURL.Host) {
+		allowed := *fetchPattern
+		allowed.Domain, allowed.DomainRE = fetchURL.Host, ""
+		fetchPattern = &allowed
+	}
+	if resource := set.AuxiliaryResourceFor(signURL.EscapedPath()); resource != nil {
+		aux := *signPattern
+		aux.PathRE = &resource.PathRE
+		signPattern = &aux
+		// Otherwise, the fetch path is independent, and must match the
+		// Fetch block's own PathRE.
+		if fetchPattern != nil && *fetchPattern.SamePath {
+			auxFetch := *fetchPattern
+			auxFetch.PathRE = &resource.PathRE
+			fetchPattern = &auxFetch
+		}
+	}
+	if err := fetchURLMatches(fetchURL, fetchPattern); err != nil {
+		return errors.Wrap(err, "fetch URL")
+	}
+	if err := signURLMatches(signURL, signPattern); err != nil {
+		return errors.Wrap(err, "sign URL")
+	}
+	theyMatch := set.Fetch == nil || !*set.Fetch.SamePath || fetchURL.RequestURI() == signURL.RequestURI()
+	if !theyMatch {
+		return errors.New("fetch and sign paths don't match")
+	}
+	return nil
+}
+
+// A dynamic list of fetch hosts, as configured by URLSet.FetchAllowlist, e.g.
+// an *allowlist.Allowlist.
+type HostAllowlist interface {
+	Contains(host string) bool
+}
+
+type Matcher struct {
+	urlSets    []util.URLSet
+	allowlists []HostAllowlist
+}
+
+// urlSets should come from a validated config, e.g. util.ReadConfig.
+func New(urlSets []util.URLSet) *Matcher {
+	return &Matcher{urlSets, nil}
+}
+
+// Like New, but allowlists[i], if present and non-nil, supplies additional
+// fetch hosts for urlSets[i].
+func NewWithAllowlists(urlSets []util.URLSet, allowlists []HostAllowlist) *Matcher {
+	return &Matcher{urlSets, allowlists}
+}
+
+// Decides whether the packager would package a request for the given sign URL
+// without a fetch URL, i.e. /priv/doc?sign=<sign> or /priv/doc/<sign>. The
+// reason describes the matching URLSet, or why none match.
+func (this *Matcher) Match(sign string) (Decision, string) {
+	return this.MatchFetch("", sign)
+}
+
+// Like Match, but for /priv/doc?fetch=<fetch>&sign=<sign>. An empty fetch is
+// equivalent to Match(sign).
+func (this *Matcher) MatchFetch(fetch string, sign string) (Decision, string) {
+	var fetchURL *url.URL
+	if fetch != "" {
+		var err error
+		if fetchURL, err = ParseURL(fetch, "fetch"); err != nil {
+			return Reject, err.Error()
+		}
+	}
+	signURL, err := ParseURL(sign, "sign")
+	if err != nil {
+		return Reject, err.Error()
+	}
+	i, err := this.matchURLs(fetchURL, signURL)
+	if err != nil {
+		return Reject, err.Error()
+	}
+	return Package, fmt.Sprintf("matches URLSet %d", i)
+}
+
+// Returns the first URLSet that matches the given URLs, as parsed by ParseURL.
+// fetchURL may be nil if there is no fetch URL.
+func (this *Matcher) MatchURLs(fetchURL *url.URL, signURL *url.URL) (*util.URLSet, error) {
+	i, err := this.matchURLs(fetchURL, signURL)
+	if err != nil {
+		return nil, err
+	}
+	return &this.urlSets[i], nil
+}
+
+// Returns nil iff a fetch for set, as returned by MatchURLs, may follow a
+// redirect to target: it must match the set's Fetch block, including any
+// allowlisted hosts, or, if the set has none, its Sign block, just as a fetch
+// URL would. Unlike a fetch URL, its path needn't match the sign URL's.
+func (this *Matcher) MatchRedirect(target *url.URL, set *util.URLSet) error {
+	var allowlist HostAllowlist
+	for i := range this.urlSets {
+		if &this.urlSets[i] == set && i < len(this.allowlists) {
+			allowlist = this.allowlists[i]
+		}
+	}
+	pattern := set.Fetch
+	if pattern == nil {
+		pattern = set.Sign
+	}
+	matched := *pattern
+	if set.Fetch != nil && allowlist != nil && allowlist.Contains(target.Host) {
+		matched.Domain, matched.DomainRE = target.Host, ""
+	}
+	if resource := set.AuxiliaryResourceFor(target.EscapedPath()); resource != nil {
+		matched.PathRE = &resource.PathRE
+	}
+	if set.Fetch == nil {
+		return errors.Wrap(signURLMatches(target, &matched), "redirect URL")
+	}
+	return errors.Wrap(fetchURLMatches(target, &matched), "redirect URL")
+}
+
+func (this *Matcher) matchURLs(fetchURL *url.URL, signURL *url.URL) (int, error) {
+	errs := []string{}
+	for i := range this.urlSets {
+		var allowlist HostAllowlist
+		if i < len(this.allowlists) {
+			allowlist = this.allowlists[i]
+		}
+		err := urlsMatch(fetchURL, signURL, this.urlSets[i], allowlist)
+		if err == nil {
+			return i, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return 0, errors.Errorf("fetch/sign URLs do not match config; caused by: %s", strings.Join(errs, ", "))
+}
@@ -0,0 +1,268 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package urlmatch
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func urlOrDie(spec string) *url.URL {
+	url, err := url.Parse(spec)
+	if err != nil {
+		panic(err)
+	}
+	return url
+}
+
+func TestParseURL(t *testing.T) {
+	_, err := ParseURL("", "sign")
+	assert.EqualError(t, err, "sign URL is unspecified")
+	_, err = ParseURL("abc-@#79!%^/", "fetch")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Error parsing fetch URL")
+	}
+	_, err = ParseURL("abc/def", "sign")
+	assert.EqualError(t, err, "sign URL is relative")
+
+	parsed, err := ParseURL("http://foo.com/bar/../baz?a=<b>", "sign")
+	require.NoError(t, err)
+	assert.Equal(t, "http://foo.com/baz?a=%3Cb%3E", parsed.String())
+}
+
+func TestFetchURLMatches(t *testing.T) {
+	assert.NoError(t, fetchURLMatches(nil, nil))
+	assert.NoError(t, fetchURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}))
+	assert.NoError(t, fetchURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, Domain: "example.com", PathRE: stringPtr("/"), QueryRE: stringPtr(""), MaxLength: 2000}))
+	assert.NoError(t, fetchURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, DomainRE: "example.*", PathRE: stringPtr("/"), QueryRE: stringPtr(""), MaxLength: 2000}))
+
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://example.com/"), nil),
+		"If URLSet.Fetch is unspecified, then so should ?fetch= be.")
+	assert.EqualError(t, fetchURLMatches(nil,
+		&util.URLPattern{Scheme: []string{"http"}, PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"If URLSet.Fetch is specified, then so should ?fetch= be.")
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Scheme: []string{"https"}, PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"Scheme doesn't match")
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, Domain: "wrongexample.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"Domain doesn't match")
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://example.com:1234/"),
+		&util.URLPattern{Scheme: []string{"http"}, Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"Domain doesn't match")
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, DomainRE: "xample", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"DomainRE doesn't match")
+
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http:example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"URL is opaque")
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://user@example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"URL contains user")
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"PathRE doesn't match")
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, PathRE: stringPtr(".*"), PathExcludeRE: []string{"/"}, QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"PathExcludeRE matches: /")
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://example.com/?sessid=foo"),
+		&util.URLPattern{Scheme: []string{"http"}, PathRE: stringPtr(".*"), QueryRE: stringPtr(""), MaxLength: 2000}),
+		"QueryRE doesn't match")
+	assert.EqualError(t, fetchURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Scheme: []string{"http"}, PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 10}),
+		"URL too long")
+}
+
+func TestIsFallbackURLCodePoint(t *testing.T) {
+	// https://url.spec.whatwg.org/#url-code-points + "%", in codepoint order:
+	validURLCodepoints := `!$%&'()*+,-./0123456789:;=?@ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz~`
+	for b := 0; b < 0x100; b++ {
+		expected := strings.ContainsRune(validURLCodepoints, rune(b))
+		assert.Equal(t, expected, isFallbackURLCodePoint(byte(b)), "char: %#v", string(rune(b)))
+	}
+}
+
+func TestSignURLMatches(t *testing.T) {
+	assert.NoError(t, signURLMatches(urlOrDie("https://example.com/"),
+		&util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}))
+
+	assert.EqualError(t, signURLMatches(urlOrDie("http://example.com/"),
+		&util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"Scheme doesn't match")
+	assert.EqualError(t, signURLMatches(urlOrDie("https://wrongexample.com/"),
+		&util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}),
+		"Domain doesn't match")
+}
+
+func TestURLsMatch(t *testing.T) {
+	config := util.URLSet{
+		Fetch: &util.URLPattern{
+			Scheme: []string{"http"}, Domain: "fetch.com",
+			PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000,
+			SamePath: boolPtr(true)},
+		Sign: &util.URLPattern{
+			Domain: "sign.com",
+			PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000},
+	}
+
+	assert.NoError(t, urlsMatch(urlOrDie("http://fetch.com/"), urlOrDie("https://sign.com/"), config, nil))
+
+	assert.EqualError(t, urlsMatch(urlOrDie("https://fetch.com/"), urlOrDie("https://sign.com/"), config, nil),
+		"fetch URL: Scheme doesn't match")
+	assert.EqualError(t, urlsMatch(urlOrDie("http://fetch.com/"), urlOrDie("http://sign.com/"), config, nil),
+		"sign URL: Scheme doesn't match")
+	assert.EqualError(t, urlsMatch(urlOrDie("http://fetch.com/"), urlOrDie("https://sign.com/other"), config, nil),
+		"fetch and sign paths don't match")
+
+	*config.Fetch.SamePath = false
+	assert.NoError(t, urlsMatch(urlOrDie("http://fetch.com/"), urlOrDie("https://sign.com/other"), config, nil))
+}
+
+func TestMatch(t *testing.T) {
+	matcher := New([]util.URLSet{
+		{Sign: &util.URLPattern{Domain: "example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000}},
+		{
+			Fetch: &util.URLPattern{Scheme: []string{"http"}, Domain: "origin.example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+			Sign:  &util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		},
+	})
+
+	decision, reason := matcher.Match("https://example.com/amp/page.html")
+	assert.Equal(t, Package, decision)
+	assert.Equal(t, "matches URLSet 0", reason)
+
+	decision, reason = matcher.MatchFetch("http://origin.example.com/page.html", "https://example.com/page.html")
+	assert.Equal(t, Package, decision)
+	assert.Equal(t, "matches URLSet 1", reason)
+
+	decision, reason = matcher.Match("https://example.com/page.html")
+	assert.Equal(t, Reject, decision)
+	assert.Equal(t, "fetch/sign URLs do not match config; caused by: sign URL: PathRE doesn't match, fetch URL: If URLSet.Fetch is specified, then so should ?fetch= be.", reason)
+
+	decision, reason = matcher.Match("https://example.com/amp/page.html?sessid=123")
+	assert.Equal(t, Reject, decision)
+	assert.Contains(t, reason, "QueryRE doesn't match")
+
+	decision, reason = matcher.Match("/amp/page.html")
+	assert.Equal(t, Reject, decision)
+	assert.Equal(t, "sign URL is relative", reason)
+}
+
+func TestMatchURLs(t *testing.T) {
+	matcher := New([]util.URLSet{
+		{Sign: &util.URLPattern{Domain: "wrongexample.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000}},
+		{Sign: &util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(".*"), MaxLength: 2000, ErrorOnStatefulHeaders: true}},
+	})
+	urlSet, err := matcher.MatchURLs(nil, urlOrDie("https://example.com/"))
+	require.NoError(t, err)
+	assert.True(t, urlSet.Sign.ErrorOnStatefulHeaders)
+
+	_, err = matcher.MatchURLs(nil, urlOrDie("https://badexample.com/"))
+	assert.EqualError(t, err, "fetch/sign URLs do not match config; caused by: sign URL: Domain doesn't match, sign URL: Domain doesn't match")
+}
+
+type fakeAllowlist map[string]bool
+
+func (this fakeAllowlist) Contains(host string) bool { return this[host] }
+
+func TestMatchWithAllowlists(t *testing.T) {
+	urlSets := []util.URLSet{{
+		Fetch: &util.URLPattern{Scheme: []string{"https"}, Domain: "origin.example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+		Sign:  &util.URLPattern{Domain: "example.com", PathRE: stringPtr(".*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}}
+	matcher := NewWithAllowlists(urlSets, []HostAllowlist{fakeAllowlist{"other.example.net": true}})
+
+	decision, _ := matcher.MatchFetch("https://origin.example.com/page.html", "https://example.com/page.html")
+	assert.Equal(t, Package, decision)
+	decision, _ = matcher.MatchFetch("https://other.example.net/page.html", "https://example.com/page.html")
+	assert.Equal(t, Package, decision)
+
+	// The rest of the Fetch block still applies.
+	decision, reason := matcher.MatchFetch("http://other.example.net/page.html", "https://example.com/page.html")
+	assert.Equal(t, Reject, decision)
+	assert.Contains(t, reason, "Scheme doesn't match")
+
+	decision, reason = matcher.MatchFetch("https://unlisted.example.net/page.html", "https://example.com/page.html")
+	assert.Equal(t, Reject, decision)
+	assert.Contains(t, reason, "Domain doesn't match")
+
+	// Without the allowlist, only the Domain matches.
+	decision, _ = New(urlSets).MatchFetch("https://other.example.net/page.html", "https://example.com/page.html")
+	assert.Equal(t, Reject, decision)
+}
+
+func TestMatchAuxiliaryResources(t *testing.T) {
+	matcher := New([]util.URLSet{{
+		Fetch:              &util.URLPattern{Scheme: []string{"https"}, Domain: "origin.example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+		Sign:               &util.URLPattern{Domain: "example.com", PathRE: stringPtr("/amp/.*"), PathExcludeRE: []string{"/private/.*"}, QueryRE: stringPtr(""), MaxLength: 2000},
+		AuxiliaryResources: []util.AuxiliaryResource{{PathRE: `/manifest\.json|/private/manifest\.json`, ContentType: "application/manifest+json"}},
+	}})
+
+	decision, _ := matcher.MatchFetch("https://origin.example.com/manifest.json", "https://example.com/manifest.json")
+	assert.Equal(t, Package, decision)
+
+	decision, reason := matcher.MatchFetch("https://origin.example.com/private/manifest.json", "https://example.com/private/manifest.json")
+	assert.Equal(t, Reject, decision)
+	assert.Contains(t, reason, "PathExcludeRE matches")
+
+	decision, reason = matcher.MatchFetch("https://origin.example.com/other.json", "https://example.com/other.json")
+	assert.Equal(t, Reject, decision)
+	assert.Contains(t, reason, "PathRE doesn't match")
+}
+
+func TestMatchRedirect(t *testing.T) {
+	urlSets := []util.URLSet{{
+		Fetch: &util.URLPattern{Scheme: []string{"https"}, Domain: "origin.example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000, SamePath: boolPtr(true)},
+		Sign:  &util.URLPattern{Domain: "example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+	}, {
+		Sign:               &util.URLPattern{Domain: "example.com", PathRE: stringPtr("/amp/.*"), QueryRE: stringPtr(""), MaxLength: 2000},
+		AuxiliaryResources: []util.AuxiliaryResource{{PathRE: `/manifest\.json`, ContentType: "application/manifest+json"}},
+	}}
+	matcher := NewWithAllowlists(urlSets, []HostAllowlist{fakeAllowlist{"other.example.net": true}})
+
+	assert.NoError(t, matcher.MatchRedirect(urlOrDie("https://origin.example.com/amp/other.html"), &urlSets[0]))
+	assert.NoError(t, matcher.MatchRedirect(urlOrDie("https://other.example.net/amp/other.html"), &urlSets[0]))
+	assert.EqualError(t, matcher.MatchRedirect(urlOrDie("https://evil.example.net/amp/other.html"), &urlSets[0]), "redirect URL: Domain doesn't match")
+	assert.EqualError(t, matcher.MatchRedirect(urlOrDie("https://origin.example.com/login"), &urlSets[0]), "redirect URL: PathRE doesn't match")
+
+	// Sign-only sets fetch from the sign URL, so redirects must match the
+	// Sign block.
+	assert.NoError(t, matcher.MatchRedirect(urlOrDie("https://example.com/amp/other.html"), &urlSets[1]))
+	assert.NoError(t, matcher.MatchRedirect(urlOrDie("https://example.com/manifest.json"), &urlSets[1]))
+	assert.EqualError(t, matcher.MatchRedirect(urlOrDie("http://example.com/amp/other.html"), &urlSets[1]), "redirect URL: Scheme doesn't match")
+	assert.EqualError(t, matcher.MatchRedirect(urlOrDie("https://other.example.net/amp/other.html"), &urlSets[1]), "redirect URL: Domain doesn't match")
+}
+
+func TestDecisionString(t *testing.T) {
+	assert.Equal(t, "package", Package.String())
+	assert.Equal(t, "reject", Reject.String())
+}
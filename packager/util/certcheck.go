@@ -0,0 +1,115 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Returns nil if each cert in the chain is issued by the one after it, as the
+// cert-chain format requires. Otherwise, returns an error that explains how to
+// fix the chain.
+func CheckCertChainOrder(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("Cert chain is empty")
+	}
+	for i := 0; i+1 < len(certs); i++ {
+		if certs[i].CheckSignatureFrom(certs[i+1]) == nil {
+			continue
+		}
+		for j, issuer := range certs {
+			if j != i && certs[i].CheckSignatureFrom(issuer) == nil {
+				return chainOrderError(certs, i, j)
+			}
+		}
+		// E.g. a root that belongs at the end, or a reversed chain.
+		if certs[i+1].CheckSignatureFrom(certs[i]) == nil {
+			return chainOrderError(certs, i+1, i)
+		}
+		return errors.Errorf("Cert chain is broken: cert %d (%q) is not issued by cert %d (%q); remove unrelated certs, and include the intermediates from your CA",
+			i, certs[i].Subject.CommonName, i+1, certs[i+1].Subject.CommonName)
+	}
+	return nil
+}
+
+// Returns an error if the chain is only a leaf that isn't self-signed, so has
+// no issuer to verify OCSP responses against. Only a warning, as the packager
+// can still start; it reports unhealthy until the issuer is added.
+func CheckCertChainComplete(certs []*x509.Certificate) error {
+	if len(certs) == 1 && !bytes.Equal(certs[0].RawIssuer, certs[0].RawSubject) {
+		return errors.Errorf("Cert chain contains only the leaf; append its issuer (%q), e.g. by using fullchain.pem rather than cert.pem",
+			certs[0].Issuer.CommonName)
+	}
+	return nil
+}
+
+func chainOrderError(certs []*x509.Certificate, subject, issuer int) error {
+	return errors.Errorf("Cert chain is out of order: cert %d (%q) is issued by cert %d (%q); order it leaf first, each cert followed by its issuer",
+		subject, certs[subject].Subject.CommonName, issuer, certs[issuer].Subject.CommonName)
+}
+
+// Returns nil if the cert is within its validity window at now, else an error
+// saying when it becomes or became valid.
+func CheckValidityWindow(cert *x509.Certificate, now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return errors.Errorf("Certificate is not valid until %s; if it should be, check the system clock", cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return errors.Errorf("Certificate expired at %s; renew it", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Returns each reason that certs (leaf first) and key can't be used to sign
+// exchanges for domains at time now, in the order they were checked. This
+// excludes CheckCertChainComplete, which is only a warning. The
+// packager checks a subset of these at startup, via the same functions; this
+// also checks what the packager tolerates in development mode or repairs on
+// its own (e.g. by auto-renewing an expiring cert). It doesn't check OCSP, as
+// that requires a network fetch.
+func CheckCertificate(certs []*x509.Certificate, key crypto.PrivateKey, domains []string, now time.Time) []error {
+	if len(certs) == 0 {
+		return []error{errors.New("No cert found")}
+	}
+	var problems []error
+	if err := CanSignHttpExchanges(certs[0]); err != nil {
+		problems = append(problems, err)
+	}
+	if err := CheckValidityWindow(certs[0], now); err != nil {
+		problems = append(problems, err)
+	}
+	if err := ValidateSigningKey(key); err != nil {
+		problems = append(problems, err)
+	} else if err := KeyMatchesCertificate(certs[0], key); err != nil {
+		problems = append(problems, errors.Wrap(err, "Key does not match the cert; use the key that the CSR was generated from"))
+	}
+	if uncovered := UncoveredDomains(certs[0], domains); len(uncovered) > 0 {
+		problems = append(problems, errors.Errorf("Cert does not cover [%s]; its subjectAltNames are [%s]",
+			strings.Join(uncovered, ", "), strings.Join(certs[0].DNSNames, ", ")))
+	}
+	if err := CheckCertChainOrder(certs); err != nil {
+		problems = append(problems, err)
+	}
+	if len(certs[0].OCSPServer) == 0 {
+		problems = append(problems, errors.New("Cert has no OCSP responder URL; signed exchanges require a stapled OCSP response, so get one from a CA that supports OCSP"))
+	}
+	return problems
+}
@@ -15,21 +15,37 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pelletier/go-toml"
 	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpguts"
 )
 
 type Config struct {
 	LocalOnly bool
 	Port      int
-	CertFile  string // This must be the full certificate chain.
+	CertFile  string // The full certificate chain, or just the leaf if it has AIA issuer URLs.
 	KeyFile   string // Just for the first cert, obviously.
 	CSRFile   string // Certificate Signing Request.
 
+	// The passphrase for KeyFile, if encrypted. If unset, it's read from
+	// the AMPPKG_KEY_PASSPHRASE environment variable, or else prompted for
+	// on the terminal.
+	KeyPassphrase string
+
 	// When set, both CertFile and NewCertFile will be read/write. CertFile and
 	// NewCertFile will be set when both are valid and that once CertFile becomes
 	// invalid, NewCertFile will replace it (CertFile = NewCertFile) and NewCertFile
@@ -39,13 +55,777 @@ type Config struct {
 	NewCertFile             string // The new full certificate chain replacing the expired one.
 	OCSPCache               string
 	ForwardedRequestHeaders []string
-	URLSet                  []URLSet
-	ACMEConfig              *ACMEConfig
+	// Routes that the server should not expose, e.g. because the cert
+	// chain is served from a CDN instead. Each must be one of the keys of
+	// Routes.
+	DisabledRoutes []string
+	// Under AWS Lambda, the private routes (doc, admin, metrics, and
+	// version) are disabled unless this is set, as a function URL or API
+	// Gateway is reachable from the open internet by default.
+	LambdaPrivateRoutes bool
+	URLSet              []URLSet
+	ACMEConfig          *ACMEConfig
+
+	// While this file exists, the packager is in read-only mode: it
+	// performs no origin fetches or signing, responding 503 to /priv/doc
+	// so that the frontend keeps serving its cached SXGs, but continues to
+	// serve the cert chain. Create or remove the file to toggle it at
+	// runtime, e.g. during origin maintenance or a key rotation freeze.
+	ReadOnlyFile string
+
+	// The path to a file containing the bearer token required by the
+	// admin endpoints under /priv-amppkg/. If unset, they respond 404.
+	AdminTokenFile string
+
+	// The path to an html/template for error pages, executed with an
+	// ErrorPageData, e.g. for a deployment's branding. If unset, a plain
+	// default is used.
+	ErrorPageTemplate string
+
+	// If true, all error responses are JSON, as they are for clients that
+	// accept application/json but not text/html.
+	JSONErrors bool
+
+	// The lifetime of signatures, as a Go duration string, e.g. "24h". At
+	// most, and by default, 7 days.
+	SignatureLifetime string
+
+	// A cert/key pair to rotate to at a set time. Unlike NewCertFile, this
+	// supports a change of key.
+	NextCert *NextCertConfig
+
+	// A second cert/key pair, e.g. from another CA, to sign with alongside
+	// CertFile/KeyFile in URLSets that set DualSign. Both cert chains are
+	// served throughout.
+	SecondaryCert *SecondaryCertConfig
+
+	// The base URL of an externally hosted copy of the cert chains, e.g.
+	// "https://cdn.example.com/amppkg/cert". If set, the cert-url of each
+	// signature is this, plus "/" and the cert's content-addressed name (as
+	// served under /amppkg/cert/), instead of a URL on the sign domain.
+	CertURLBase string
+
+	// The directory to write the cert chains to, e.g. a mounted bucket, for
+	// serving from CertURLBase. Each chain is written under its
+	// content-addressed name whenever it or its OCSP response changes.
+	CertChainDir string
+
+	// If positive, the number of most-requested signed URLs to track, for
+	// prioritizing re-signs. They're listed at the popular-urls admin
+	// endpoint.
+	PopularURLs int
+
+	// Deadlines for calls to external services.
+	Deadlines *DeadlinesConfig
+
+	// Timeouts for origin fetches, for URLSets that don't set their own.
+	FetchTimeouts *FetchTimeoutsConfig
+
+	// The pool of connections to origins, shared by all fetches.
+	FetchPool *FetchPoolConfig
+
+	// Fetches may not connect to loopback, private, or link-local
+	// addresses, lest sign URLs be used to probe internal networks,
+	// except those in these CIDR ranges, e.g. ["10.1.0.0/16"].
+	AllowedFetchNetworks []string
+
+	// IPs to connect to for the given origin hosts, rather than those in
+	// DNS, e.g. {"www.example.com" = "203.0.113.7"}, to test an origin
+	// cutover before changing DNS.
+	FetchHosts map[string]string
+
+	// If set, how long to cache the addresses of origin hosts, as a Go
+	// duration string, e.g. "30s", so that high request rates don't send
+	// each fetch to the resolver.
+	DNSCacheTTL string
+
+	// If true, concurrent fetches of the same document, with the same
+	// request headers, share one origin fetch and its response.
+	CoalesceFetches bool
+
+	// The maximum number of origin requests that a single packaging
+	// request may make: the fetch, plus each redirect followed. If 0,
+	// defaults to DefaultMaxOriginRequests.
+	MaxOriginRequests int
+
+	// The most bytes of response headers, and the most header fields, to
+	// accept from the origin; fetches whose responses have more fail with
+	// a 502. If 0, default to DefaultMaxFetchHeaderBytes and
+	// DefaultMaxFetchHeaders.
+	MaxFetchHeaderBytes int
+	MaxFetchHeaders     int
+
+	// The maximum length of a document to sign, in bytes, for URLSets
+	// that don't set their own MaxBodyLength. If 0, defaults to
+	// DefaultMaxBodyLength.
+	MaxBodyLength int
+
+	// The proxy through which to fetch from origins, for URLSets that
+	// don't set their own FetchProxy: an http, https, or socks5 URL, e.g.
+	// "http://proxy.example.com:3128", or "direct" for none. If unset, the
+	// HTTPS_PROXY, HTTP_PROXY, and NO_PROXY environment variables apply.
+	FetchProxy string
+
+	// The User-Agent to send on fetches, so that publishers can tell
+	// packager traffic apart in their logs and WAF rules. If unset, an
+	// "amppkg/<version>" string.
+	FetchUserAgent string
+
+	// If set, a contact email address for the operator, sent on fetches as
+	// the From header.
+	FetchFrom string
+
+	// If positive, the number of recently signed exchanges whose headers
+	// to remember, so that /priv/resign can give them fresh signatures
+	// without refetching them.
+	ResignableExchanges int
+
+	// If positive, the total size in bytes of recently signed exchanges to
+	// remember, so that repeat requests for a document that hasn't changed
+	// on the origin reuse its signature, until reverse proxies would stop
+	// serving it.
+	SignatureCacheBytes int
+
+	// If set, the path of a file to which the signature cache (see
+	// SignatureCacheBytes) is saved every SignatureCacheSaveInterval and on
+	// shutdown, and from which it's restored on startup, so that restarts
+	// don't empty it.
+	SignatureCacheFile string
+
+	// The size of the records into which payloads are MI-encoded, in
+	// bytes. If 0, defaults to MaxMIRecordSize.
+	MIRecordSize int
+
+	// If positive, the maximum number of documents to transform,
+	// MI-encode, and sign at once. Others wait in a queue of up to
+	// SigningQueueDepth; past that, they're refused with a 503.
+	SigningWorkers    int
+	SigningQueueDepth int
+
+	// If true, each SXG is verified, as a browser would, before it's
+	// served; those that fail are refused with a 500.
+	VerifySignedExchanges bool
+
+	// If true, /priv/doc requests with an output=bundle param are served
+	// an unsigned Web Bundle of the document and its same-origin
+	// subresources, rather than an SXG.
+	WebBundles bool
+
+	// If positive, the largest SXG to produce, in bytes. Documents whose
+	// SXG would be larger are refused with an error, rather than signed,
+	// as caches won't serve them.
+	MaxSXGSize int
+
+	// If true, stop signing once the OCSP response is older than browsers
+	// accept (7 days), even if its NextUpdate hasn't passed, rather than
+	// producing SXGs that fail verification. Always the case for a cert
+	// with the OCSP must-staple extension.
+	RequireFreshOCSP bool
+
+	// Requirements on the cert's embedded Signed Certificate Timestamps,
+	// which Chrome enforces when verifying SXGs.
+	CT *CTConfig
+
+	// If set, periodically re-request and verify a sample of recently
+	// signed URLs. Requires PopularURLs.
+	SelfCheck *SelfCheckConfig
+
+	// Named overrides, selected with the -profile flag.
+	Profile map[string]*ProfileConfig
+}
+
+// A staged rotation to a new cert/key pair. Both cert chains are served by
+// the cert cache throughout, so that they're resolvable during the overlap,
+// but signing switches from CertFile/KeyFile to these at SwitchTime.
+type NextCertConfig struct {
+	CertFile   string // The full certificate chain.
+	KeyFile    string // If encrypted, its passphrase is read from the environment or terminal, as for KeyFile.
+	SwitchTime time.Time
+	// If set, a Go duration string, e.g. "48h". For this long on either
+	// side of SwitchTime, exchanges are signed with both certs, the one
+	// being switched from or to second, so that they remain valid
+	// whichever cert caches and CDNs have.
+	DualSignOverlap string
+}
+
+// Returns the parsed DualSignOverlap, or 0 if unset. Assumes the config has
+// been validated.
+func (this *NextCertConfig) DualSignOverlapDuration() time.Duration {
+	overlap, _ := time.ParseDuration(this.DualSignOverlap)
+	return overlap
+}
+
+// A cert/key pair that signs alongside the primary one, so that exchanges
+// remain verifiable if either CA's cert is distrusted or revoked. Chrome
+// validates only one signature per exchange (the first it can), but the
+// format allows several.
+type SecondaryCertConfig struct {
+	CertFile string // The full certificate chain.
+	KeyFile  string // If encrypted, its passphrase is read from the environment or terminal, as for KeyFile.
+}
+
+// Checked against the leaf cert at startup and on reload.
+type CTConfig struct {
+	// The base64-encoded IDs of qualifying CT logs (as in Chrome's log
+	// list). If empty, SCTs from any log count.
+	LogIDs []string
+	// The number of distinct qualifying logs that must have issued
+	// embedded SCTs. Defaults to DefaultMinSCTs.
+	MinSCTs int
+	// If true, refuse to start with a cert that falls short; otherwise,
+	// log a warning.
+	Enforce bool
+}
+
+// The default SelfCheck.Interval.
+const DefaultSelfCheckInterval = 5 * time.Minute
+
+// The default SelfCheck.SampleSize.
+const DefaultSelfCheckSampleSize = 3
+
+type SelfCheckConfig struct {
+	// How often to check, as a Go duration string. Defaults to
+	// DefaultSelfCheckInterval.
+	Interval string
+	// How many URLs to check each time. Defaults to
+	// DefaultSelfCheckSampleSize.
+	SampleSize int
+	// If true, request each sign URL itself, as an AMP cache would, so
+	// that the frontend's routing to the packager is checked too.
+	// Otherwise, request /priv/doc from the packager, on localhost.
+	Public bool
+}
+
+// Returns the parsed Interval, or DefaultSelfCheckInterval if unset. Assumes
+// the config has been validated.
+func (this *SelfCheckConfig) IntervalDuration() time.Duration {
+	if this.Interval == "" {
+		return DefaultSelfCheckInterval
+	}
+	interval, _ := time.ParseDuration(this.Interval)
+	return interval
 }
 
+// Returns SampleSize, or DefaultSelfCheckSampleSize if unset.
+func (this *SelfCheckConfig) Samples() int {
+	if this.SampleSize > 0 {
+		return this.SampleSize
+	}
+	return DefaultSelfCheckSampleSize
+}
+
+func validateSelfCheck(config *Config) error {
+	selfCheck := config.SelfCheck
+	if selfCheck == nil {
+		return nil
+	}
+	if config.PopularURLs <= 0 {
+		return errors.New("SelfCheck requires PopularURLs, from which it samples")
+	}
+	if config.SignatureCacheBytes <= 0 {
+		return errors.New("SelfCheck requires SignatureCacheBytes, from which the samples are served without refetching them")
+	}
+	if selfCheck.Interval != "" {
+		if interval, err := time.ParseDuration(selfCheck.Interval); err != nil || interval < time.Minute {
+			return errors.Errorf("SelfCheck.Interval %q must be a duration of at least 1m", selfCheck.Interval)
+		}
+	}
+	if selfCheck.SampleSize < 0 {
+		return errors.New("SelfCheck.SampleSize must not be negative")
+	}
+	return nil
+}
+
+// Deadlines for calls to external services, as Go duration strings, e.g.
+// "30s". Each must be positive; unset ones default to DefaultDeadlines.
+type DeadlinesConfig struct {
+	OCSP string // Each request to the OCSP responder.
+	ACME string // Each request to the ACME CA.
+}
+
+type Deadlines struct {
+	OCSP, ACME time.Duration
+}
+
+var DefaultDeadlines = Deadlines{
+	OCSP: 60 * time.Second,
+	ACME: 30 * time.Second,
+}
+
+// Settings for the pool of connections to origins, which all fetches share.
+// Unset ones default to DefaultFetchPool.
+type FetchPoolConfig struct {
+	MaxIdleConns        int    // Idle connections kept, across all origins.
+	MaxIdleConnsPerHost int    // Idle connections kept, per origin host.
+	IdleConnTimeout     string // How long an idle connection is kept, as a Go duration string.
+	TLSSessionCacheSize int    // TLS sessions cached for resumption, across all origins.
+}
+
+type FetchPool struct {
+	MaxIdleConns, MaxIdleConnsPerHost int
+	IdleConnTimeout                   time.Duration
+	TLSSessionCacheSize               int
+}
+
+// Unlike http.DefaultTransport, which keeps 2 idle connections per host, these
+// allow reuse under concurrent load on a few origins.
+var DefaultFetchPool = FetchPool{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 16,
+	IdleConnTimeout:     90 * time.Second,
+	TLSSessionCacheSize: 128,
+}
+
+// Timeouts for origin fetches, as Go duration strings, e.g. "5s". Each must be
+// positive; unset ones default to those of Config.FetchTimeouts, and then to
+// DefaultFetchTimeouts.
+type FetchTimeoutsConfig struct {
+	Dial           string // Connecting to the origin, or to FetchProxy.
+	TLSHandshake   string // The TLS handshake with the origin.
+	ResponseHeader string // Waiting for the response headers, once the request is sent.
+	Total          string // The whole fetch, including redirects and reading the body.
+}
+
+type FetchTimeouts struct {
+	Dial, TLSHandshake, ResponseHeader, Total time.Duration
+}
+
+// A ResponseHeader of 0 leaves it to Total.
+var DefaultFetchTimeouts = FetchTimeouts{
+	Dial:         30 * time.Second,
+	TLSHandshake: 10 * time.Second,
+	Total:        60 * time.Second,
+}
+
+// The default Config.MaxOriginRequests, enough for the fetch and a few
+// redirects, as URLSet.MaxRedirects is typically small.
+const DefaultMaxOriginRequests = 10
+
+// The defaults for Config.MaxFetchHeaderBytes and MaxFetchHeaders: ample for
+// real origins, but far short of the 10MB that Go would otherwise buffer.
+const (
+	DefaultMaxFetchHeaderBytes = 256 << 10
+	DefaultMaxFetchHeaders     = 256
+)
+
+// The maximum (and default) Config.MIRecordSize, as defined at:
+// https://cs.chromium.org/chromium/src/content/browser/loader/merkle_integrity_source_stream.cc?l=18&rcl=591949795043a818e50aba8a539094c321a4220c
+// The maximum is cheapest in terms of network usage, and probably CPU on both
+// server and client. The memory usage difference is negligible.
+const MaxMIRecordSize = 16 << 10
+
+// The default Config.MaxBodyLength. The signer holds the whole document in
+// memory (MICE requires processing it in reverse order), so this bounds memory
+// per request. It's mostly arbitrary, though there's no benefit to a limit
+// greater than that of AMP Caches.
+const DefaultMaxBodyLength = 4 * 1 << 20
+
 type URLSet struct {
 	Fetch *URLPattern
 	Sign  *URLPattern
+	// The maximum number of redirects to follow when fetching. Defaults
+	// to 0, meaning redirects are proxied unsigned, as-is. Each redirect
+	// followed must match the Fetch block (or, if unset, the Sign block),
+	// as the fetch URL does; those that don't aren't followed.
+	MaxRedirects int
+	// Request headers to copy from the request to the packager onto its
+	// fetches for this URLSet, in addition to Config.ForwardedRequestHeaders,
+	// e.g. ["Accept-Language", "X-Publisher-Auth"], so that the origin can
+	// vary or authenticate them. The same headers are disallowed.
+	ForwardedRequestHeaders []string
+	// Headers to set on every fetch for this URLSet, e.g.
+	// {"X-AmpPkg-Token" = "secret"}, so that the origin can reserve its
+	// packaging path for the packager. They override any forwarded request
+	// header of the same name. "Host" overrides the fetch's Host header.
+	// They aren't sent on redirects to other hosts.
+	FetchHeaders map[string]string
+	// The proxy through which to fetch this URLSet's documents, as for
+	// Config.FetchProxy, which it defaults to.
+	FetchProxy string
+	// The internal backend to fetch this URLSet's documents from, as an
+	// http or https URL without a path, e.g. "http://10.0.0.5:8081", or as
+	// "unix:" and the absolute path of a Unix socket that serves plain
+	// HTTP, e.g. "unix:/run/app.sock", so that the packager needn't reach
+	// the origin via its public address. Fetches keep the sign URL's path
+	// and Host header; those to an https backend verify its cert against
+	// that Host. FetchProxy doesn't apply.
+	FetchBackend string
+	// HTTP/2 settings for this URLSet's fetches.
+	FetchHTTP2 *FetchHTTP2Config
+	// TLS settings for this URLSet's fetches, e.g. for a staging origin
+	// with private PKI.
+	FetchTLS *FetchTLSConfig
+	// Timeouts for this URLSet's fetches, so that a slow origin can't
+	// hold up requests for the full default timeouts. Unset ones default
+	// to those of Config.FetchTimeouts.
+	FetchTimeouts *FetchTimeoutsConfig
+	// If true, an origin redirect that isn't followed, per MaxRedirects,
+	// fails the request with a 502, rather than being proxied unsigned.
+	RefuseRedirects bool
+	// The maximum length of a document to sign, in bytes. Longer ones are
+	// proxied unsigned. Defaults to Config.MaxBodyLength.
+	MaxBodyLength int
+	// Documents larger than MaxBodyLength, up to this many bytes, are
+	// routed to a separate "large document" pipeline, which processes
+	// only a few at a time in order to bound memory usage, as each is
+	// still held whole in memory. Defaults to 0,
+	// meaning such documents are proxied unsigned, as are documents larger
+	// than this.
+	LargeDocumentMaxLength int
+	// If set, fetches must be over TLS, to an origin whose cert chain
+	// includes a public key with one of these pin-sha256 hashes (the
+	// base64-encoded SHA-256 of its SubjectPublicKeyInfo, as in HPKP).
+	PinnedSPKIHashes []string
+	// If true, documents are only signed if the body looks like an AMP
+	// document: UTF-8 text starting with <!doctype html> and <html amp>
+	// (or <html ⚡>). Others are proxied unsigned.
+	AMPOnly bool
+	// How to handle documents whose origin TTL is very short. If unset,
+	// they're signed like any other.
+	ShortTTL *ShortTTLConfig
+	// How to retry fetches that fail transiently. If unset, they aren't
+	// retried.
+	FetchRetries *FetchRetriesConfig
+	// When to fail fast on fetches from an origin host that keeps failing.
+	// If unset, each fetch is tried.
+	CircuitBreaker *CircuitBreakerConfig
+	// How many fetches may be in flight at once to each origin host. If
+	// unset, there's no limit.
+	FetchConcurrency *FetchConcurrencyConfig
+	// The lifetime of signatures, as a Go duration string, e.g. "1h",
+	// overriding Config.SignatureLifetime for this URLSet. At most 7 days.
+	SignatureLifetime string
+	// How long before now to date signatures, as a Go duration string, so
+	// that clients with slow clocks accept them. The lifetime runs from this
+	// date, so it must be shorter than the lifetime. Defaults to "24h", or
+	// half the lifetime if that's shorter.
+	Backdate string
+	// If true, exchanges are signed with SecondaryCert as well as the
+	// primary cert, and carry both signatures.
+	DualSign bool
+	// If set, fetch URLs whose host is listed by this source match the
+	// Fetch block as if it had that Domain, so that hosts can be added
+	// without a config deploy.
+	FetchAllowlist *FetchAllowlistConfig
+	// Same-origin resources other than AMP documents, such as a web app
+	// manifest or amp-web-push helper pages, to sign as-is. Their paths
+	// need not match Sign.PathRE or Fetch.PathRE.
+	AuxiliaryResources []AuxiliaryResource
+	// The origin response headers to include in the signed exchange, e.g.
+	// ["Content-Type", "Cache-Control"]. Others are dropped, as extraneous
+	// headers bloat the exchange, and some break validation. ["*"]
+	// includes all but the stateful ones that are always dropped, as
+	// does the default, so that upgrading doesn't silently drop headers
+	// such as X-Frame-Options or Cross-Origin-Opener-Policy. The headers
+	// the packager sets itself (Content-Encoding, Content-Length,
+	// Content-Security-Policy, Digest, Link, and X-Content-Type-Options)
+	// are always included, as is Content-Type.
+	SignedHeaders []string
+	// The most headers, and the most bytes of header names and values, to
+	// include in the signed exchange, as clients reject exchanges with
+	// pathological header sets. Defaults to 0, meaning no limit. Those over
+	// either limit fail with a 502, unless TrimSignedHeaders is set.
+	MaxSignedHeaders     int
+	MaxSignedHeaderBytes int
+	// If true, exchanges over MaxSignedHeaders or MaxSignedHeaderBytes drop
+	// origin headers, largest first, until they're within both. The headers
+	// that are always included are never dropped, so if they alone are over
+	// a limit, the request still fails.
+	TrimSignedHeaders bool
+	// The media types of documents to sign, e.g. ["text/html"]. They're
+	// processed as AMP HTML, so each must be one of HTMLContentTypes.
+	// Responses of other types, such as images, JSON, or octet-streams,
+	// are proxied unsigned. Defaults to DefaultAllowedContentTypes.
+	// AuxiliaryResources, which are signed as-is, are instead limited to
+	// their own ContentType.
+	AllowedContentTypes []string
+	// What to serve clients whose Accept header doesn't ask for a supported
+	// SXG version: NonSXGProxy or NonSXGRedirect. This applies even when
+	// the packager isn't configured to require the Accept header, so that
+	// such clients never get an exchange they can't parse. Defaults to "",
+	// meaning that, if the Accept header is required, clients that don't
+	// ask for an SXG at all get the document unsigned, and those that ask
+	// for an unsupported version get a 406.
+	NonSXGFallback string
+	// If true, each same-origin stylesheet, script, font or other
+	// subresource that the document references or preloads, and that
+	// matches one of AuxiliaryResources, is signed along with it, and listed
+	// in a Link rel=allowed-alt-sxg header with the header-integrity of its
+	// SXG, so that the AMP cache may substitute that SXG for it. Requires
+	// Config.SignatureCacheBytes: the header-integrity is that of the SXG in
+	// this instance's cache, so it only matches while that SXG is what gets
+	// served, and subresources whose SXG won't be are left out.
+	SubstituteSubresources bool
+}
+
+// The ways of serving a client that can't accept an SXG.
+const (
+	// Proxy the fetched document unsigned.
+	NonSXGProxy = "proxy"
+	// Redirect to the sign URL, without fetching. Only use this if the
+	// publisher's frontend routes such requests for the sign URL to the
+	// origin, rather than back to the packager.
+	NonSXGRedirect = "redirect"
+)
+
+// The media types of documents signed by URLSets that don't set
+// AllowedContentTypes.
+var DefaultAllowedContentTypes = []string{"text/html"}
+
+// The media types that AllowedContentTypes may list: those that can be
+// processed as AMP HTML.
+var HTMLContentTypes = map[string]bool{"text/html": true, "application/xhtml+xml": true}
+
+// A resource to sign without AMP validation or transformation.
+type AuxiliaryResource struct {
+	// A full-match regexp on the path of the sign URL (and, if SamePath,
+	// the fetch URL), e.g. `/manifest\.json`. PathExcludeRE still
+	// applies.
+	PathRE string
+	// The media type the response must have, e.g.
+	// "application/manifest+json". Parameters other than charset=utf-8
+	// are not allowed.
+	ContentType string
+
+	// PathRE, compiled as a full match by validation.
+	pathRE *regexp.Regexp
+}
+
+// The ways of handling a document whose origin TTL is under the threshold.
+const (
+	// Proxy it unsigned.
+	ShortTTLRefuse = "refuse"
+	// Sign it, with the signature expiring when the origin TTL does. If
+	// that's immediately (e.g. max-age=0), proxy it unsigned.
+	ShortTTLShorten = "shorten"
+	// Sign it as usual, and log a warning.
+	ShortTTLWarn = "warn"
+)
+
+// Applies to documents whose origin TTL (the s-maxage of the Cache-Control
+// response header, else its max-age) is under Threshold. Those without either
+// directive are signed as usual. Either way, such documents are counted in the
+// amppkg_short_ttl_documents metric.
+type ShortTTLConfig struct {
+	Threshold string // A Go duration string, e.g. "10m".
+	Policy    string // One of ShortTTLRefuse, ShortTTLShorten, and ShortTTLWarn. Defaults to ShortTTLWarn.
+}
+
+// TLS settings for origin fetches. Files are read at startup.
+type FetchTLSConfig struct {
+	// A PEM bundle of CA certs to trust, in addition to the system's.
+	CAFile string
+	// A PEM cert chain and its key, to present to the origin for mutual
+	// TLS. Both or neither must be set.
+	CertFile string
+	KeyFile  string
+	// If true, the origin's cert isn't verified. For development only:
+	// amppkg refuses to start with it unless -development is set.
+	InsecureSkipVerify bool
+}
+
+// HTTP/2 settings for origin fetches. By default, fetches use HTTP/2 with
+// origins that offer it during the TLS handshake.
+type FetchHTTP2Config struct {
+	// If true, fetches use HTTP/1.1, for origins that misbehave over
+	// HTTP/2.
+	Disable bool
+	// If positive, the most fetches in flight at once to each origin
+	// host, i.e. the concurrent streams on its HTTP/2 connection. Others
+	// wait for one to finish.
+	MaxConcurrentStreams int
+}
+
+// The defaults for FetchRetries.Backoff and Within.
+const (
+	DefaultFetchRetryBackoff = 100 * time.Millisecond
+	DefaultFetchRetryWithin  = 5 * time.Second
+)
+
+// Retries of fetches that fail with a network error, including a timeout or a
+// truncated response, or get a 502, 503, or 504 from the origin.
+// Each waits Backoff, doubling after each retry, with jitter.
+type FetchRetriesConfig struct {
+	Count   int    // The most retries per fetch.
+	Backoff string // A Go duration string. Defaults to DefaultFetchRetryBackoff.
+	// No retry starts later than this after the first attempt, as a Go
+	// duration string, so that retries don't outlast the request to the
+	// packager. Defaults to DefaultFetchRetryWithin.
+	Within string
+}
+
+// The default CircuitBreaker.CoolDown.
+const DefaultCircuitBreakerCoolDown = 30 * time.Second
+
+// After Failures consecutive failed fetches from an origin host (network
+// errors, including timeouts, or 502s, 503s, or 504s, after any FetchRetries),
+// fetches from it fail fast with a 502 for CoolDown. After that, one fetch is
+// let through as a trial, while others still fail fast: if it fails, the
+// circuit opens again.
+type CircuitBreakerConfig struct {
+	Failures int
+	CoolDown string // A Go duration string. Defaults to DefaultCircuitBreakerCoolDown.
+}
+
+// The default FetchConcurrency.QueueTimeout.
+const DefaultFetchQueueTimeout = time.Second
+
+// At most Max fetches from an origin host are in flight at once, each holding
+// its slot until its body is read or closed. Others wait up to QueueTimeout
+// for a slot, and are then refused with a 503. URLSets fetching from the same
+// host with the same Max share its slots.
+type FetchConcurrencyConfig struct {
+	Max          int
+	QueueTimeout string // A Go duration string. Defaults to DefaultFetchQueueTimeout.
+}
+
+// The default FetchAllowlist.RefreshInterval.
+const DefaultAllowlistRefreshInterval = 10 * time.Minute
+
+// The shortest allowed FetchAllowlist.RefreshInterval, to avoid hammering the
+// source.
+const MinAllowlistRefreshInterval = time.Minute
+
+// A source of hosts eligible for fetching, in addition to the Fetch block's
+// Domain or DomainRE. Exactly one of DNSTXT and URL must be set.
+type FetchAllowlistConfig struct {
+	// A DNS name whose TXT records list hosts, separated by spaces or
+	// commas.
+	DNSTXT string
+	// An https URL whose body lists hosts, one per line.
+	URL string
+	// How often to re-read the list, as a Go duration string. Defaults to
+	// DefaultAllowlistRefreshInterval. If a read fails, the last list stays
+	// in effect.
+	RefreshInterval string
+}
+
+// Returns the parsed RefreshInterval, or DefaultAllowlistRefreshInterval if
+// unset. Assumes the config has been validated.
+func (this *FetchAllowlistConfig) RefreshDuration() time.Duration {
+	if this.RefreshInterval == "" {
+		return DefaultAllowlistRefreshInterval
+	}
+	interval, _ := time.ParseDuration(this.RefreshInterval)
+	return interval
+}
+
+// Returns the first AuxiliaryResource whose PathRE matches the given escaped
+// path, or nil if none do. Assumes the config has been validated.
+func (this *URLSet) AuxiliaryResourceFor(path string) *AuxiliaryResource {
+	for i := range this.AuxiliaryResources {
+		if this.AuxiliaryResources[i].matches(path) {
+			return &this.AuxiliaryResources[i]
+		}
+	}
+	return nil
+}
+
+func compileFullMatch(pathRE string) (*regexp.Regexp, error) {
+	return regexp.Compile(`\A(?:` + pathRE + `)\z`)
+}
+
+// Returns true iff PathRE fully matches the given escaped path. Uses the regexp
+// compiled by validation, if any; else (e.g. for a URLSet constructed
+// directly), compiles it anew.
+func (this *AuxiliaryResource) matches(path string) bool {
+	re := this.pathRE
+	if re == nil {
+		var err error
+		if re, err = compileFullMatch(this.PathRE); err != nil {
+			return false
+		}
+	}
+	return re.MatchString(path)
+}
+
+// Returns true iff the origin response header with the given name is to be
+// signed, per SignedHeaders. Names are compared case-insensitively.
+func (this *URLSet) SignsHeader(name string) bool {
+	if this.SignedHeaders == nil {
+		return true
+	}
+	for _, signed := range this.SignedHeaders {
+		if signed == "*" || strings.EqualFold(signed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns AllowedContentTypes, or DefaultAllowedContentTypes if unset.
+func (this *URLSet) ContentTypes() []string {
+	if this.AllowedContentTypes != nil {
+		return this.AllowedContentTypes
+	}
+	return DefaultAllowedContentTypes
+}
+
+// Returns MaxBodyLength, or DefaultMaxBodyLength if unset.
+func (this *URLSet) BodyLength() int {
+	if this.MaxBodyLength > 0 {
+		return this.MaxBodyLength
+	}
+	return DefaultMaxBodyLength
+}
+
+// Returns the parsed SignatureLifetime, or 0 if unset. Assumes the config has
+// been validated.
+func (this *URLSet) SignatureDuration() time.Duration {
+	lifetime, _ := time.ParseDuration(this.SignatureLifetime)
+	return lifetime
+}
+
+// Returns the parsed Backdate or, if unset, DefaultBackdate clamped to half of
+// the given signature lifetime, so that signatures don't expire on arrival.
+// Assumes the config has been validated.
+func (this *URLSet) BackdateDuration(lifetime time.Duration) time.Duration {
+	if this.Backdate == "" {
+		if DefaultBackdate > lifetime/2 {
+			return lifetime / 2
+		}
+		return DefaultBackdate
+	}
+	backdate, _ := time.ParseDuration(this.Backdate)
+	return backdate
+}
+
+// Returns the parsed Threshold. Assumes the config has been validated.
+func (this *ShortTTLConfig) ThresholdDuration() time.Duration {
+	threshold, _ := time.ParseDuration(this.Threshold)
+	return threshold
+}
+
+// Returns the parsed Backoff, or DefaultFetchRetryBackoff if unset. Assumes
+// the config has been validated.
+func (this *FetchRetriesConfig) BackoffDuration() time.Duration {
+	if this.Backoff == "" {
+		return DefaultFetchRetryBackoff
+	}
+	backoff, _ := time.ParseDuration(this.Backoff)
+	return backoff
+}
+
+// Returns the parsed CoolDown, or DefaultCircuitBreakerCoolDown if unset.
+// Assumes the config has been validated.
+func (this *CircuitBreakerConfig) CoolDownDuration() time.Duration {
+	return durationOr(this.CoolDown, DefaultCircuitBreakerCoolDown)
+}
+
+// Returns the parsed QueueTimeout, or DefaultFetchQueueTimeout if unset.
+// Assumes the config has been validated.
+func (this *FetchConcurrencyConfig) QueueTimeoutDuration() time.Duration {
+	return durationOr(this.QueueTimeout, DefaultFetchQueueTimeout)
+}
+
+// Returns the parsed Within, or DefaultFetchRetryWithin if unset. Assumes the
+// config has been validated.
+func (this *FetchRetriesConfig) WithinDuration() time.Duration {
+	if this.Within == "" {
+		return DefaultFetchRetryWithin
+	}
+	within, _ := time.ParseDuration(this.Within)
+	return within
 }
 
 type URLPattern struct {
@@ -178,6 +958,256 @@ func ValidateFetchURLPattern(pattern *URLPattern) error {
 	return nil
 }
 
+// Also sets defaults.
+func validateShortTTL(shortTTL *ShortTTLConfig) error {
+	if shortTTL == nil {
+		return nil
+	}
+	if threshold, err := time.ParseDuration(shortTTL.Threshold); err != nil || threshold <= 0 {
+		return errors.Errorf("ShortTTL.Threshold %q must be a positive duration", shortTTL.Threshold)
+	}
+	switch shortTTL.Policy {
+	case "":
+		shortTTL.Policy = ShortTTLWarn
+	case ShortTTLRefuse, ShortTTLShorten, ShortTTLWarn:
+	default:
+		return errors.Errorf("ShortTTL.Policy %q must be one of %q, %q, and %q", shortTTL.Policy, ShortTTLRefuse, ShortTTLShorten, ShortTTLWarn)
+	}
+	return nil
+}
+
+func validateFetchRetries(retries *FetchRetriesConfig) error {
+	if retries == nil {
+		return nil
+	}
+	if retries.Count < 1 {
+		return errors.New("FetchRetries.Count must be positive")
+	}
+	if retries.Backoff != "" {
+		if backoff, err := time.ParseDuration(retries.Backoff); err != nil || backoff <= 0 {
+			return errors.Errorf("FetchRetries.Backoff %q must be a positive duration", retries.Backoff)
+		}
+	}
+	if retries.Within != "" {
+		if within, err := time.ParseDuration(retries.Within); err != nil || within <= 0 {
+			return errors.Errorf("FetchRetries.Within %q must be a positive duration", retries.Within)
+		}
+	}
+	return nil
+}
+
+func validateCircuitBreaker(breaker *CircuitBreakerConfig) error {
+	if breaker == nil {
+		return nil
+	}
+	if breaker.Failures < 1 {
+		return errors.New("CircuitBreaker.Failures must be positive")
+	}
+	if breaker.CoolDown != "" {
+		if coolDown, err := time.ParseDuration(breaker.CoolDown); err != nil || coolDown <= 0 {
+			return errors.Errorf("CircuitBreaker.CoolDown %q must be a positive duration", breaker.CoolDown)
+		}
+	}
+	return nil
+}
+
+func validateFetchConcurrency(concurrency *FetchConcurrencyConfig) error {
+	if concurrency == nil {
+		return nil
+	}
+	if concurrency.Max < 1 {
+		return errors.New("FetchConcurrency.Max must be positive")
+	}
+	if concurrency.QueueTimeout != "" {
+		if timeout, err := time.ParseDuration(concurrency.QueueTimeout); err != nil || timeout < 0 {
+			return errors.Errorf("FetchConcurrency.QueueTimeout %q must be a non-negative duration", concurrency.QueueTimeout)
+		}
+	}
+	return nil
+}
+
+// Validates the URLSet's SignatureLifetime and Backdate, given the lifetime
+// that applies if it doesn't set its own.
+func validateSignatureTiming(urlSet *URLSet, defaultLifetime time.Duration) error {
+	lifetime := defaultLifetime
+	if urlSet.SignatureLifetime != "" {
+		var err error
+		lifetime, err = time.ParseDuration(urlSet.SignatureLifetime)
+		if err != nil || lifetime <= 0 || lifetime > MaxSignatureLifetime {
+			return errors.Errorf("SignatureLifetime %q must be a positive duration of at most %v", urlSet.SignatureLifetime, MaxSignatureLifetime)
+		}
+	}
+	if urlSet.Backdate != "" {
+		backdate, err := time.ParseDuration(urlSet.Backdate)
+		if err != nil || backdate < 0 {
+			return errors.Errorf("Backdate %q must be a non-negative duration", urlSet.Backdate)
+		}
+	}
+	if backdate := urlSet.BackdateDuration(lifetime); backdate >= lifetime {
+		return errors.Errorf("Backdate (%v) must be shorter than the signature lifetime (%v), which runs from it", backdate, lifetime)
+	}
+	return nil
+}
+
+func validateFetchAllowlist(urlSet *URLSet) error {
+	allowlist := urlSet.FetchAllowlist
+	if allowlist == nil {
+		return nil
+	}
+	if urlSet.Fetch == nil {
+		return errors.New("FetchAllowlist requires a Fetch block")
+	}
+	if (allowlist.DNSTXT == "") == (allowlist.URL == "") {
+		return errors.New("FetchAllowlist must set exactly one of DNSTXT and URL")
+	}
+	if allowlist.URL != "" {
+		if u, err := url.Parse(allowlist.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.Errorf("FetchAllowlist.URL %q must be an absolute https URL", allowlist.URL)
+		}
+	}
+	if allowlist.RefreshInterval != "" {
+		if interval, err := time.ParseDuration(allowlist.RefreshInterval); err != nil || interval < MinAllowlistRefreshInterval {
+			return errors.Errorf("FetchAllowlist.RefreshInterval %q must be a duration of at least %v", allowlist.RefreshInterval, MinAllowlistRefreshInterval)
+		}
+	}
+	return nil
+}
+
+// Also normalizes each ContentType, and compiles each PathRE.
+func validateAuxiliaryResources(urlSet *URLSet) error {
+	for i := range urlSet.AuxiliaryResources {
+		resource := &urlSet.AuxiliaryResources[i]
+		if resource.PathRE == "" {
+			return errors.Errorf("AuxiliaryResources.%d.PathRE must be set", i)
+		}
+		pathRE, err := compileFullMatch(resource.PathRE)
+		if err != nil {
+			return errors.Wrapf(err, "parsing AuxiliaryResources.%d.PathRE", i)
+		}
+		contentType, params, err := mime.ParseMediaType(resource.ContentType)
+		if err != nil {
+			return errors.Wrapf(err, "parsing AuxiliaryResources.%d.ContentType", i)
+		}
+		if contentType == "application/signed-exchange" {
+			return errors.Errorf("AuxiliaryResources.%d.ContentType must not be %s", i, contentType)
+		}
+		for name, value := range params {
+			if name != "charset" || strings.ToLower(value) != "utf-8" {
+				return errors.Errorf("AuxiliaryResources.%d.ContentType must not have parameter %s=%s", i, name, value)
+			}
+		}
+		resource.ContentType = contentType
+		resource.pathRE = pathRE
+	}
+	return nil
+}
+
+func validateSignedHeaders(urlSet *URLSet) error {
+	for i, name := range urlSet.SignedHeaders {
+		if name == "*" {
+			continue
+		}
+		if !httpguts.ValidHeaderFieldName(name) {
+			return errors.Errorf("SignedHeaders.%d (%q) is not a valid header name", i, name)
+		}
+		urlSet.SignedHeaders[i] = http.CanonicalHeaderKey(name)
+	}
+	if urlSet.MaxSignedHeaders < 0 {
+		return errors.New("MaxSignedHeaders must not be negative")
+	}
+	if urlSet.MaxSignedHeaderBytes < 0 {
+		return errors.New("MaxSignedHeaderBytes must not be negative")
+	}
+	return nil
+}
+
+func validateFetchHeaders(urlSet *URLSet) error {
+	if len(urlSet.FetchHeaders) == 0 {
+		return nil
+	}
+	canonical := make(map[string]string, len(urlSet.FetchHeaders))
+	for name, value := range urlSet.FetchHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return errors.Errorf("FetchHeaders %q is not a valid header name", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return errors.Errorf("FetchHeaders.%s has an invalid value", name)
+		}
+		if msg := haveInvalidForwardedRequestHeader(name); msg != "" {
+			return errors.Errorf("FetchHeaders must not %s", msg)
+		}
+		canonical[http.CanonicalHeaderKey(name)] = value
+	}
+	urlSet.FetchHeaders = canonical
+	return nil
+}
+
+func validateAllowedContentTypes(urlSet *URLSet) error {
+	if urlSet.AllowedContentTypes != nil && len(urlSet.AllowedContentTypes) == 0 {
+		return errors.New("AllowedContentTypes must not be empty")
+	}
+	for i, value := range urlSet.AllowedContentTypes {
+		contentType, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			return errors.Wrapf(err, "parsing AllowedContentTypes.%d", i)
+		}
+		if len(params) > 0 {
+			return errors.Errorf("AllowedContentTypes.%d must not have parameters", i)
+		}
+		if !HTMLContentTypes[contentType] {
+			return errors.Errorf("AllowedContentTypes.%d must be text/html or application/xhtml+xml, not %s, as documents are processed as AMP HTML; sign other types via AuxiliaryResources", i, contentType)
+		}
+		urlSet.AllowedContentTypes[i] = contentType
+	}
+	return nil
+}
+
+func validatePinnedSPKIHashes(urlSet *URLSet) error {
+	if len(urlSet.PinnedSPKIHashes) == 0 {
+		return nil
+	}
+	for _, pin := range urlSet.PinnedSPKIHashes {
+		if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+			return errors.Errorf("PinnedSPKIHashes contains invalid hash %q; must be a base64-encoded SHA-256", pin)
+		}
+	}
+	if urlSet.Fetch != nil {
+		for _, scheme := range urlSet.Fetch.Scheme {
+			if scheme != "https" {
+				return errors.New(`PinnedSPKIHashes requires Fetch.Scheme = ["https"]`)
+			}
+		}
+	}
+	return nil
+}
+
+// The FetchBackend scheme for Unix sockets.
+const UnixFetchBackendScheme = "unix"
+
+func validateFetchBackend(urlSet *URLSet) error {
+	if urlSet.FetchBackend == "" {
+		return nil
+	}
+	backend, err := url.Parse(urlSet.FetchBackend)
+	if err == nil && backend.Scheme == UnixFetchBackendScheme {
+		if backend.Opaque != "" || backend.Host != "" || !filepath.IsAbs(backend.Path) || backend.RawQuery != "" || backend.Fragment != "" {
+			return errors.Errorf("FetchBackend %q must be unix: and an absolute path, e.g. unix:/run/app.sock", urlSet.FetchBackend)
+		}
+		if len(urlSet.PinnedSPKIHashes) > 0 {
+			return errors.Errorf("FetchBackend %q can't be a Unix socket, as PinnedSPKIHashes is set", urlSet.FetchBackend)
+		}
+		return nil
+	}
+	if err != nil || (backend.Scheme != "http" && backend.Scheme != "https") || backend.Hostname() == "" ||
+		backend.User != nil || (backend.Path != "" && backend.Path != "/") || backend.RawQuery != "" || backend.Fragment != "" {
+		return errors.Errorf("FetchBackend %q must be an http or https URL without a path, e.g. http://10.0.0.5:8081, or a unix: socket path", urlSet.FetchBackend)
+	}
+	if backend.Scheme != "https" && len(urlSet.PinnedSPKIHashes) > 0 {
+		return errors.Errorf("FetchBackend %q must be https, as PinnedSPKIHashes is set", urlSet.FetchBackend)
+	}
+	return nil
+}
+
 func ValidateForwardedRequestHeaders(hs []string) error {
 	for _, h := range hs {
 		if msg := haveInvalidForwardedRequestHeader(h); msg != "" {
@@ -187,8 +1217,355 @@ func ValidateForwardedRequestHeaders(hs []string) error {
 	return nil
 }
 
+// Returns true iff ReadOnlyFile exists.
+func (config *Config) IsReadOnly() bool {
+	if config.ReadOnlyFile == "" {
+		return false
+	}
+	_, err := os.Stat(config.ReadOnlyFile)
+	return err == nil
+}
+
+// How long ReadOnlyChecker reuses each check of ReadOnlyFile; i.e. how soon
+// creating or removing it takes effect.
+const ReadOnlyCheckInterval = time.Second
+
+// Returns an IsReadOnly that reuses its result for ReadOnlyCheckInterval, so
+// that it can be called on every request without a stat each time. Returns nil
+// if ReadOnlyFile is unset.
+func (config *Config) ReadOnlyChecker(clock Clock) func() bool {
+	if config.ReadOnlyFile == "" {
+		return nil
+	}
+	var mu sync.Mutex
+	var checked time.Time
+	var readOnly bool
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if now := clock.Now(); checked.IsZero() || now.Sub(checked) >= ReadOnlyCheckInterval || now.Before(checked) {
+			readOnly, checked = config.IsReadOnly(), now
+		}
+		return readOnly
+	}
+}
+
+// Returns a copy of config for loading NextCert: CertFile and KeyFile are
+// replaced by those of NextCert, it gets its own OCSPCache, and auto-renewal
+// is disabled. Returns nil if NextCert is unset.
+func (config *Config) ForNextCert() *Config {
+	if config.NextCert == nil {
+		return nil
+	}
+	next := *config
+	next.CertFile = config.NextCert.CertFile
+	next.KeyFile = config.NextCert.KeyFile
+	next.KeyPassphrase = ""
+	next.NewCertFile = ""
+	next.OCSPCache = config.OCSPCache + ".next"
+	next.NextCert = nil
+	return &next
+}
+
+// Returns a copy of config for loading SecondaryCert, as ForNextCert does for
+// NextCert. Returns nil if SecondaryCert is unset.
+func (config *Config) ForSecondaryCert() *Config {
+	if config.SecondaryCert == nil {
+		return nil
+	}
+	secondary := *config
+	secondary.CertFile = config.SecondaryCert.CertFile
+	secondary.KeyFile = config.SecondaryCert.KeyFile
+	secondary.KeyPassphrase = ""
+	secondary.NewCertFile = ""
+	secondary.OCSPCache = config.OCSPCache + ".secondary"
+	secondary.NextCert = nil
+	secondary.SecondaryCert = nil
+	return &secondary
+}
+
+// The names of the routes that may be listed in DisabledRoutes.
+const (
+	DocRoute      = "doc"
+	CertRoute     = "cert"
+	ValidityRoute = "validity"
+	HealthzRoute  = "healthz"
+	MetricsRoute  = "metrics"
+	VersionRoute  = "version"
+	AdminRoute    = "admin"
+)
+
+var Routes = map[string]bool{
+	DocRoute:      true,
+	CertRoute:     true,
+	ValidityRoute: true,
+	HealthzRoute:  true,
+	MetricsRoute:  true,
+	VersionRoute:  true,
+	AdminRoute:    true,
+}
+
+func ValidateDisabledRoutes(routes []string) error {
+	for _, route := range routes {
+		if !Routes[route] {
+			return errors.Errorf("DisabledRoutes contains unknown route %q", route)
+		}
+	}
+	return nil
+}
+
+// The routes that mustn't be exposed to the open internet, and so are disabled
+// under Lambda unless LambdaPrivateRoutes is set.
+var PrivateRoutes = []string{DocRoute, MetricsRoute, VersionRoute, AdminRoute}
+
+// True iff the named route is listed in config.DisabledRoutes.
+func (config *Config) IsRouteDisabled(route string) bool {
+	for _, disabled := range config.DisabledRoutes {
+		if disabled == route {
+			return true
+		}
+	}
+	return false
+}
+
+// The maximum lifetime of a signature, per
+// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.5.
+const MaxSignatureLifetime = 7 * 24 * time.Hour
+
+// The default URLSet.Backdate, to allow for clients whose clocks are up to a
+// day behind.
+const DefaultBackdate = 24 * time.Hour
+
+// How often the signature cache is saved to SignatureCacheFile.
+const SignatureCacheSaveInterval = 5 * time.Minute
+
+// Returns the parsed SignatureLifetime, or MaxSignatureLifetime if unset.
+// Assumes the config has been validated.
+func (config *Config) SignatureDuration() time.Duration {
+	if config.SignatureLifetime == "" {
+		return MaxSignatureLifetime
+	}
+	lifetime, _ := time.ParseDuration(config.SignatureLifetime)
+	return lifetime
+}
+
+// Returns the longest SignatureLifetime of the config or any URLSet, i.e. how
+// long exchanges signed with a cert may remain valid. Assumes the config has
+// been validated.
+func (config *Config) MaxSignatureDuration() time.Duration {
+	lifetime := config.SignatureDuration()
+	for i := range config.URLSet {
+		if urlSetLifetime := config.URLSet[i].SignatureDuration(); urlSetLifetime > lifetime {
+			lifetime = urlSetLifetime
+		}
+	}
+	return lifetime
+}
+
+// Returns the parsed Deadlines, with defaults for those unset. Assumes the
+// config has been validated.
+func (config *Config) DeadlineDurations() Deadlines {
+	deadlines := DefaultDeadlines
+	if d := config.Deadlines; d != nil {
+		deadlines.OCSP = durationOr(d.OCSP, deadlines.OCSP)
+		deadlines.ACME = durationOr(d.ACME, deadlines.ACME)
+	}
+	return deadlines
+}
+
+// Returns the parsed AllowedFetchNetworks. Assumes the config has been
+// validated.
+func (config *Config) AllowedFetchIPNets() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range config.AllowedFetchNetworks {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Returns the parsed FetchPool, with defaults for those unset. Assumes the
+// config has been validated.
+func (config *Config) FetchPoolSettings() FetchPool {
+	pool := DefaultFetchPool
+	if p := config.FetchPool; p != nil {
+		if p.MaxIdleConns > 0 {
+			pool.MaxIdleConns = p.MaxIdleConns
+		}
+		if p.MaxIdleConnsPerHost > 0 {
+			pool.MaxIdleConnsPerHost = p.MaxIdleConnsPerHost
+		}
+		pool.IdleConnTimeout = durationOr(p.IdleConnTimeout, pool.IdleConnTimeout)
+		if p.TLSSessionCacheSize > 0 {
+			pool.TLSSessionCacheSize = p.TLSSessionCacheSize
+		}
+	}
+	return pool
+}
+
+// Returns the parsed FetchHosts. Assumes the config has been validated.
+func (config *Config) FetchHostIPs() map[string]net.IP {
+	ips := map[string]net.IP{}
+	for host, ip := range config.FetchHosts {
+		ips[host] = net.ParseIP(ip)
+	}
+	return ips
+}
+
+// Returns the parsed DNSCacheTTL, or 0 if unset. Assumes the config has been
+// validated.
+func (config *Config) DNSCacheDuration() time.Duration {
+	return durationOr(config.DNSCacheTTL, 0)
+}
+
+// Returns the parsed FetchTimeouts, with defaults for those unset. Assumes the
+// config has been validated.
+func (this *URLSet) FetchTimeoutDurations() FetchTimeouts {
+	timeouts := DefaultFetchTimeouts
+	if t := this.FetchTimeouts; t != nil {
+		timeouts.Dial = durationOr(t.Dial, timeouts.Dial)
+		timeouts.TLSHandshake = durationOr(t.TLSHandshake, timeouts.TLSHandshake)
+		timeouts.ResponseHeader = durationOr(t.ResponseHeader, timeouts.ResponseHeader)
+		timeouts.Total = durationOr(t.Total, timeouts.Total)
+	}
+	return timeouts
+}
+
+func durationOr(value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, _ := time.ParseDuration(value)
+	return d
+}
+
+func validateFetchTLS(fetchTLS *FetchTLSConfig) error {
+	if fetchTLS != nil && (fetchTLS.CertFile == "") != (fetchTLS.KeyFile == "") {
+		return errors.New("FetchTLS.CertFile and KeyFile must be set together")
+	}
+	return nil
+}
+
+func validateFetchHTTP2(h2 *FetchHTTP2Config) error {
+	if h2 != nil && h2.MaxConcurrentStreams < 0 {
+		return errors.New("FetchHTTP2.MaxConcurrentStreams must not be negative")
+	}
+	return nil
+}
+
+func validateFetchPool(p *FetchPoolConfig) error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxIdleConns < 0 || p.MaxIdleConnsPerHost < 0 || p.TLSSessionCacheSize < 0 {
+		return errors.New("FetchPool.MaxIdleConns, MaxIdleConnsPerHost, and TLSSessionCacheSize must not be negative")
+	}
+	if p.IdleConnTimeout != "" {
+		if timeout, err := time.ParseDuration(p.IdleConnTimeout); err != nil || timeout <= 0 {
+			return errors.Errorf("FetchPool.IdleConnTimeout %q must be a positive duration", p.IdleConnTimeout)
+		}
+	}
+	return nil
+}
+
+func validateFetchTimeouts(t *FetchTimeoutsConfig) error {
+	if t == nil {
+		return nil
+	}
+	for _, field := range [][2]string{{"Dial", t.Dial}, {"TLSHandshake", t.TLSHandshake}, {"ResponseHeader", t.ResponseHeader}, {"Total", t.Total}} {
+		if field[1] == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(field[1]); err != nil || duration <= 0 {
+			return errors.Errorf("FetchTimeouts.%s %q must be a positive duration", field[0], field[1])
+		}
+	}
+	return nil
+}
+
+// Returns t, with those unset taken from defaults.
+func inheritFetchTimeouts(t *FetchTimeoutsConfig, defaults *FetchTimeoutsConfig) *FetchTimeoutsConfig {
+	if defaults == nil {
+		return t
+	}
+	if t == nil {
+		return defaults
+	}
+	inherited := *t
+	for _, field := range []struct {
+		value *string
+		def   string
+	}{{&inherited.Dial, defaults.Dial}, {&inherited.TLSHandshake, defaults.TLSHandshake}, {&inherited.ResponseHeader, defaults.ResponseHeader}, {&inherited.Total, defaults.Total}} {
+		if *field.value == "" {
+			*field.value = field.def
+		}
+	}
+	return &inherited
+}
+
+func validateDeadlines(d *DeadlinesConfig) error {
+	if d == nil {
+		return nil
+	}
+	for _, field := range [][2]string{{"OCSP", d.OCSP}, {"ACME", d.ACME}} {
+		if field[1] == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(field[1]); err != nil || duration <= 0 {
+			return errors.Errorf("Deadlines.%s %q must be a positive duration", field[0], field[1])
+		}
+	}
+	return nil
+}
+
+// The FetchProxy value for fetching without a proxy, regardless of the
+// environment.
+const DirectFetchProxy = "direct"
+
+// Checks that proxy is empty, DirectFetchProxy, or a URL of a proxy scheme
+// that net/http supports.
+func ValidateFetchProxy(proxy string) error {
+	if proxy == "" || proxy == DirectFetchProxy {
+		return nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" || proxyURL.Hostname() == "" {
+		return errors.Errorf("FetchProxy %q must be %q or a URL such as http://proxy.example.com:3128", proxy, DirectFetchProxy)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+		return nil
+	}
+	return errors.Errorf("FetchProxy %q must have scheme http, https, or socks5", proxy)
+}
+
+// Returns the parsed CertURLBase, or nil if unset. Assumes the config has
+// been validated.
+func (config *Config) CertURLBaseURL() *url.URL {
+	if config.CertURLBase == "" {
+		return nil
+	}
+	base, _ := url.Parse(config.CertURLBase)
+	return base
+}
+
 // ReadConfig reads the config file specified at --config and validates it.
 func ReadConfig(configBytes []byte) (*Config, error) {
+	return ReadConfigProfile(configBytes, "")
+}
+
+// Like ReadConfig, but first applies the named profile, unless it's empty.
+func ReadConfigProfile(configBytes []byte, profile string) (*Config, error) {
+	return readConfig(configBytes, profile, true)
+}
+
+// Like ReadConfigProfile, but for use with a generated cert (see amppkg -dev),
+// so CertFile, its key, and OCSPCache are optional.
+func ReadDevConfigProfile(configBytes []byte, profile string) (*Config, error) {
+	return readConfig(configBytes, profile, false)
+}
+
+func readConfig(configBytes []byte, profile string, requireCert bool) (*Config, error) {
 	tree, err := toml.LoadBytes(configBytes)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to parse TOML")
@@ -199,23 +1576,181 @@ func ReadConfig(configBytes []byte) (*Config, error) {
 	}
 	// TODO(twifkak): Return an error if the TOML includes any fields that aren't part of the Config struct.
 
+	for name, p := range config.Profile {
+		if err := validateProfile(name, p); err != nil {
+			return nil, err
+		}
+	}
+	if profile != "" {
+		if err := config.applyProfile(profile); err != nil {
+			return nil, err
+		}
+	}
+
 	if config.Port == 0 {
 		config.Port = 8080
 	}
-	if config.CertFile == "" {
+	if config.CertFile == "" && requireCert {
 		return nil, errors.New("must specify CertFile")
 	}
-	if config.KeyFile == "" {
+	if config.KeyFile == "" && requireCert {
 		return nil, errors.New("must specify KeyFile")
 	}
-	if config.OCSPCache == "" {
+	if config.OCSPCache == "" && requireCert {
 		return nil, errors.New("must specify OCSPCache")
 	}
+	if config.NextCert != nil {
+		if config.NextCert.CertFile == "" {
+			return nil, errors.New("must specify NextCert.CertFile")
+		}
+		if config.NextCert.KeyFile == "" {
+			return nil, errors.New("must specify NextCert.KeyFile")
+		}
+		if config.NextCert.SwitchTime.IsZero() {
+			return nil, errors.New("must specify NextCert.SwitchTime")
+		}
+		if overlap := config.NextCert.DualSignOverlap; overlap != "" {
+			if d, err := time.ParseDuration(overlap); err != nil || d < 0 {
+				return nil, errors.Errorf("NextCert.DualSignOverlap %q must be a non-negative duration", overlap)
+			}
+		}
+	}
+	if config.SecondaryCert != nil {
+		if config.SecondaryCert.CertFile == "" {
+			return nil, errors.New("must specify SecondaryCert.CertFile")
+		}
+		if config.SecondaryCert.KeyFile == "" {
+			return nil, errors.New("must specify SecondaryCert.KeyFile")
+		}
+		if config.NextCert != nil {
+			// To rotate either, reload the certs via the admin
+			// endpoint instead.
+			return nil, errors.New("must not specify both NextCert and SecondaryCert")
+		}
+	}
+	if config.SignatureLifetime != "" {
+		lifetime, err := time.ParseDuration(config.SignatureLifetime)
+		if err != nil {
+			return nil, errors.Errorf("SignatureLifetime %q must be a valid duration", config.SignatureLifetime)
+		}
+		if lifetime <= 0 || lifetime > MaxSignatureLifetime {
+			return nil, errors.Errorf("SignatureLifetime %q must be positive and at most %v", config.SignatureLifetime, MaxSignatureLifetime)
+		}
+	}
+	if config.CertURLBase != "" {
+		base, err := url.Parse(config.CertURLBase)
+		if err != nil || base.Scheme != "https" || base.Host == "" || base.RawQuery != "" || base.Fragment != "" {
+			return nil, errors.Errorf("CertURLBase %q must be an https URL without query or fragment", config.CertURLBase)
+		}
+	}
+	if config.CertChainDir != "" {
+		if stat, err := os.Stat(config.CertChainDir); err != nil || !stat.Mode().IsDir() {
+			return nil, errors.Errorf("CertChainDir must be an existing directory: %s", config.CertChainDir)
+		}
+	}
+	if config.CT != nil {
+		if config.CT.MinSCTs < 0 {
+			return nil, errors.New("CT.MinSCTs must not be negative")
+		}
+		if config.CT.MinSCTs == 0 {
+			config.CT.MinSCTs = DefaultMinSCTs
+		}
+		for i, id := range config.CT.LogIDs {
+			if decoded, err := base64.StdEncoding.DecodeString(id); err != nil || len(decoded) != ctLogIDLength {
+				return nil, errors.Errorf("CT.LogIDs.%d %q must be a base64-encoded SHA-256", i, id)
+			}
+		}
+	}
+	if err := validateDeadlines(config.Deadlines); err != nil {
+		return nil, err
+	}
+	if config.PopularURLs < 0 {
+		return nil, errors.New("PopularURLs must not be negative")
+	}
+	if err := validateSelfCheck(&config); err != nil {
+		return nil, err
+	}
+	if config.MaxOriginRequests < 0 {
+		return nil, errors.New("MaxOriginRequests must not be negative")
+	}
+	if config.MaxFetchHeaderBytes < 0 {
+		return nil, errors.New("MaxFetchHeaderBytes must not be negative")
+	}
+	if config.MaxFetchHeaders < 0 {
+		return nil, errors.New("MaxFetchHeaders must not be negative")
+	}
+	if config.MaxBodyLength < 0 {
+		return nil, errors.New("MaxBodyLength must not be negative")
+	}
+	if config.ResignableExchanges < 0 {
+		return nil, errors.New("ResignableExchanges must not be negative")
+	}
+	if config.SignatureCacheBytes < 0 {
+		return nil, errors.New("SignatureCacheBytes must not be negative")
+	}
+	if config.SignatureCacheFile != "" && config.SignatureCacheBytes == 0 {
+		return nil, errors.New("SignatureCacheFile requires SignatureCacheBytes")
+	}
+	if config.SigningWorkers < 0 {
+		return nil, errors.New("SigningWorkers must not be negative")
+	}
+	if config.SigningQueueDepth < 0 {
+		return nil, errors.New("SigningQueueDepth must not be negative")
+	}
+	if config.SigningQueueDepth > 0 && config.SigningWorkers == 0 {
+		return nil, errors.New("SigningQueueDepth requires SigningWorkers")
+	}
+	if config.MaxSXGSize < 0 {
+		return nil, errors.New("MaxSXGSize must not be negative")
+	}
+	if config.MIRecordSize < 0 || config.MIRecordSize > MaxMIRecordSize {
+		// MICE forbids a record size of 0, and Chrome rejects any above
+		// its maximum.
+		return nil, errors.Errorf("MIRecordSize must be between 1 and %d", MaxMIRecordSize)
+	}
 	if len(config.ForwardedRequestHeaders) > 0 {
 		if err := ValidateForwardedRequestHeaders(config.ForwardedRequestHeaders); err != nil {
 			return nil, err
 		}
 	}
+	if err := ValidateFetchProxy(config.FetchProxy); err != nil {
+		return nil, err
+	}
+	if !httpguts.ValidHeaderFieldValue(config.FetchUserAgent) {
+		return nil, errors.Errorf("FetchUserAgent %q is not a valid header value", config.FetchUserAgent)
+	}
+	if config.FetchFrom != "" {
+		if addr, err := mail.ParseAddress(config.FetchFrom); err != nil || addr.Name != "" {
+			return nil, errors.Errorf("FetchFrom %q must be an email address", config.FetchFrom)
+		}
+	}
+	if err := validateFetchTimeouts(config.FetchTimeouts); err != nil {
+		return nil, err
+	}
+	if err := validateFetchPool(config.FetchPool); err != nil {
+		return nil, err
+	}
+	for _, cidr := range config.AllowedFetchNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, errors.Errorf("AllowedFetchNetworks contains invalid CIDR %q", cidr)
+		}
+	}
+	for host, ip := range config.FetchHosts {
+		if host == "" || strings.ContainsAny(host, ":/") {
+			return nil, errors.Errorf("FetchHosts key %q must be a host name, without a port", host)
+		}
+		if net.ParseIP(ip) == nil {
+			return nil, errors.Errorf("FetchHosts.%s %q must be an IP address", host, ip)
+		}
+	}
+	if config.DNSCacheTTL != "" {
+		if ttl, err := time.ParseDuration(config.DNSCacheTTL); err != nil || ttl <= 0 {
+			return nil, errors.Errorf("DNSCacheTTL %q must be a positive duration", config.DNSCacheTTL)
+		}
+	}
+	if err := ValidateDisabledRoutes(config.DisabledRoutes); err != nil {
+		return nil, err
+	}
 	ocspDir := filepath.Dir(config.OCSPCache)
 	if stat, err := os.Stat(ocspDir); os.IsNotExist(err) || !stat.Mode().IsDir() {
 		return nil, errors.Errorf("OCSPCache parent directory must exist: %s", ocspDir)
@@ -233,6 +1768,84 @@ func ReadConfig(configBytes []byte) (*Config, error) {
 		if err := ValidateSignURLPattern(config.URLSet[i].Sign); err != nil {
 			return nil, errors.Wrapf(err, "parsing URLSet.%d.Sign", i)
 		}
+		if config.URLSet[i].MaxRedirects < 0 {
+			return nil, errors.Errorf("URLSet.%d.MaxRedirects must not be negative", i)
+		}
+		if config.URLSet[i].MaxBodyLength < 0 {
+			return nil, errors.Errorf("URLSet.%d.MaxBodyLength must not be negative", i)
+		}
+		if config.URLSet[i].MaxBodyLength == 0 {
+			config.URLSet[i].MaxBodyLength = config.MaxBodyLength
+		}
+		if config.URLSet[i].LargeDocumentMaxLength < 0 {
+			return nil, errors.Errorf("URLSet.%d.LargeDocumentMaxLength must not be negative", i)
+		}
+		if err := validatePinnedSPKIHashes(&config.URLSet[i]); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateShortTTL(config.URLSet[i].ShortTTL); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateFetchRetries(config.URLSet[i].FetchRetries); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateCircuitBreaker(config.URLSet[i].CircuitBreaker); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateFetchConcurrency(config.URLSet[i].FetchConcurrency); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateSignatureTiming(&config.URLSet[i], config.SignatureDuration()); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateAuxiliaryResources(&config.URLSet[i]); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateFetchAllowlist(&config.URLSet[i]); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := ValidateForwardedRequestHeaders(config.URLSet[i].ForwardedRequestHeaders); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateFetchHeaders(&config.URLSet[i]); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := ValidateFetchProxy(config.URLSet[i].FetchProxy); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if config.URLSet[i].FetchProxy == "" {
+			config.URLSet[i].FetchProxy = config.FetchProxy
+		}
+		if err := validateFetchBackend(&config.URLSet[i]); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateFetchTLS(config.URLSet[i].FetchTLS); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateFetchHTTP2(config.URLSet[i].FetchHTTP2); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateFetchTimeouts(config.URLSet[i].FetchTimeouts); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		config.URLSet[i].FetchTimeouts = inheritFetchTimeouts(config.URLSet[i].FetchTimeouts, config.FetchTimeouts)
+		if err := validateSignedHeaders(&config.URLSet[i]); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		if err := validateAllowedContentTypes(&config.URLSet[i]); err != nil {
+			return nil, errors.Wrapf(err, "parsing URLSet.%d", i)
+		}
+		switch config.URLSet[i].NonSXGFallback {
+		case "", NonSXGProxy, NonSXGRedirect:
+		default:
+			return nil, errors.Errorf("URLSet.%d.NonSXGFallback %q must be one of %q and %q", i, config.URLSet[i].NonSXGFallback, NonSXGProxy, NonSXGRedirect)
+		}
+		if config.URLSet[i].DualSign && config.SecondaryCert == nil {
+			return nil, errors.Errorf("URLSet.%d.DualSign requires SecondaryCert", i)
+		}
+		if config.URLSet[i].SubstituteSubresources && config.SignatureCacheBytes == 0 {
+			return nil, errors.Errorf("URLSet.%d.SubstituteSubresources requires SignatureCacheBytes", i)
+		}
 	}
 	return &config, nil
 }
@@ -0,0 +1,171 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The fields available to error page templates, and in JSON error responses.
+// Deliberately excludes the internal error message, which may reveal details
+// of the origin or of the packager's config; that's only logged, alongside the
+// request ID.
+type ErrorPageData struct {
+	Status     int    `json:"status"`     // e.g. 503
+	StatusText string `json:"statusText"` // e.g. "Service Unavailable"
+	// A stable, machine-readable code, e.g. "read_only". Defaults to the
+	// status text in snake case, e.g. "service_unavailable".
+	Code      string `json:"code"`
+	RequestID string `json:"requestId,omitempty"`
+	// The broad reason, e.g. ErrorFetchFailure. Defaults to one for the
+	// status: ErrorConfigMismatch for 4xx, ErrorFetchFailure for 502,
+	// and ErrorSignFailure for 500; otherwise empty.
+	Category string `json:"category,omitempty"`
+	// A description of the category, or else the status text. Not the
+	// internal error message.
+	Message string `json:"message"`
+}
+
+var errorCategoryMessages = map[string]string{
+	ErrorConfigMismatch: "The request doesn't match the packager's configuration.",
+	ErrorFetchFailure:   "The document couldn't be fetched from the origin, or isn't signable.",
+	ErrorNotCacheable:   "The signed exchange wouldn't be served by caches.",
+	ErrorSignFailure:    "The document couldn't be signed.",
+}
+
+var defaultErrorPageTemplate = template.Must(template.New("error").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>Error code: {{.Code}}{{if .RequestID}}<br>Request ID: {{.RequestID}}{{end}}</p>
+</body>
+</html>
+`))
+
+var errorPageTemplate = defaultErrorPageTemplate
+
+// If true, all clients get errors as JSON.
+var jsonErrors = false
+
+// Makes all error responses JSON, regardless of the Accept header, e.g. for
+// a CDN edge that branches on them. Must be called before serving.
+func UseJSONErrors() {
+	jsonErrors = true
+}
+
+// Replaces the HTML error page with the html/template in the given file, e.g.
+// for a deployment's branding. It's executed with an ErrorPageData. Must be
+// called before serving.
+func LoadErrorPageTemplate(path string) error {
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s", path)
+	}
+	// Catch references to nonexistent fields now, rather than on the first
+	// error.
+	sample := ErrorPageData{http.StatusBadGateway, http.StatusText(http.StatusBadGateway), "bad_gateway", "0123456789abcdef",
+		ErrorFetchFailure, errorCategoryMessages[ErrorFetchFailure]}
+	if err := tmpl.Execute(ioutil.Discard, sample); err != nil {
+		return errors.Wrapf(err, "executing %s", path)
+	}
+	errorPageTemplate = tmpl
+	return nil
+}
+
+// Returns true if the client is an API caller, which gets errors as JSON: an
+// admin endpoint, or a client that accepts JSON but not HTML. All clients are,
+// if UseJSONErrors was called.
+func wantsJSON(req *http.Request) bool {
+	if jsonErrors || strings.HasPrefix(req.URL.EscapedPath(), AdminPathPrefix) {
+		return true
+	}
+	accept := strings.Join(req.Header["Accept"], ",")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// E.g. "I'm a teapot" -> "i_m_a_teapot".
+func defaultErrorCode(statusText string) string {
+	return strings.Trim(nonAlphanumerics.ReplaceAllString(strings.ToLower(statusText), "_"), "_")
+}
+
+var nonAlphanumerics = regexp.MustCompile("[^a-z0-9]+")
+
+func defaultErrorCategory(statusCode int) string {
+	switch {
+	case statusCode >= 400 && statusCode < 500:
+		return ErrorConfigMismatch
+	case statusCode == http.StatusBadGateway:
+		return ErrorFetchFailure
+	case statusCode == http.StatusInternalServerError:
+		return ErrorSignFailure
+	}
+	return ""
+}
+
+// Responds with the status, along with a body describing it: an HTML error
+// page (see LoadErrorPageTemplate), or JSON for API callers. If code is empty,
+// the default for the status is used.
+func WriteErrorPage(resp http.ResponseWriter, req *http.Request, statusCode int, code string) {
+	writeErrorPage(resp, req, statusCode, code, "")
+}
+
+// As WriteErrorPage, but if category is non-empty, it's used in place of the
+// default for the status.
+func writeErrorPage(resp http.ResponseWriter, req *http.Request, statusCode int, code string, category string) {
+	data := ErrorPageData{
+		Status:     statusCode,
+		StatusText: http.StatusText(statusCode),
+		Code:       code,
+		RequestID:  RequestID(req),
+		Category:   category,
+	}
+	if data.Code == "" {
+		data.Code = defaultErrorCode(data.StatusText)
+	}
+	if data.Category == "" {
+		data.Category = defaultErrorCategory(statusCode)
+	}
+	data.Message = errorCategoryMessages[data.Category]
+	if data.Message == "" {
+		data.Message = data.StatusText
+	}
+	var body bytes.Buffer
+	if wantsJSON(req) {
+		// Marshaling these fields can't fail.
+		encoded, _ := json.Marshal(data)
+		body.Write(encoded)
+		resp.Header().Set("Content-Type", "application/json")
+	} else {
+		if err := errorPageTemplate.Execute(&body, data); err != nil {
+			log.Println("Error executing error page template:", err)
+			body.Reset()
+			defaultErrorPageTemplate.Execute(&body, data)
+		}
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.WriteHeader(statusCode)
+	resp.Write(body.Bytes())
+}
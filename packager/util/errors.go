@@ -32,10 +32,42 @@ import (
 type HTTPError struct {
 	internalMsg string
 	statusCode  int
+	code        string
+	category    string
 }
 
+// The broad reasons for an error response, for callers to branch on (see
+// ErrorPageData).
+const (
+	// The request doesn't match the config, e.g. its URLs match no URLSet.
+	ErrorConfigMismatch = "config-mismatch"
+	// The origin couldn't be fetched, or responded with something the
+	// packager won't sign.
+	ErrorFetchFailure = "fetch-failure"
+	// The SXG wouldn't be served by caches, e.g. because it's too large.
+	ErrorNotCacheable = "not-cacheable"
+	// The packager failed to sign the document.
+	ErrorSignFailure = "sign-failure"
+)
+
 func NewHTTPError(statusCode int, msg ...interface{}) *HTTPError {
-	return &HTTPError{fmt.Sprint(msg...), statusCode}
+	return &HTTPError{internalMsg: fmt.Sprint(msg...), statusCode: statusCode}
+}
+
+// Sets the stable, machine-readable code in the response, e.g. "read_only",
+// in place of the default one for the status code (see ErrorPageData).
+// Returns e, for chaining.
+func (e *HTTPError) WithCode(code string) *HTTPError {
+	e.code = code
+	return e
+}
+
+// Sets the category in the response, e.g. ErrorNotCacheable, in place of the
+// default one for the status code (see ErrorPageData). Returns e, for
+// chaining.
+func (e *HTTPError) WithCategory(category string) *HTTPError {
+	e.category = category
+	return e
 }
 
 // Implements the error interface.
@@ -43,8 +75,11 @@ func (e *HTTPError) Error() string {
 	return e.internalMsg
 }
 
-func (e *HTTPError) LogAndRespond(resp http.ResponseWriter) {
-	log.Println(e.internalMsg)
+// Logs the internal message, and responds with an error page that excludes
+// it; see WriteErrorPage.
+func (e *HTTPError) LogAndRespond(resp http.ResponseWriter, req *http.Request) {
+	req = WithRequestID(req)
+	log.Printf("%s (request ID %q)\n", e.internalMsg, RequestID(req))
 	resp.Header().Set("Cache-Control", "no-store")
-	http.Error(resp, http.StatusText(e.statusCode), e.statusCode)
+	writeErrorPage(resp, req, e.statusCode, e.code, e.category)
 }
@@ -2,9 +2,11 @@ package util
 
 import (
 	"bytes"
+	"io/ioutil"
 	"log"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -30,10 +32,98 @@ func (this *ErrorsSuite) TestError() {
 
 func (this *ErrorsSuite) TestLogAndRespond() {
 	resp := httptest.NewRecorder()
-	NewHTTPError(418, "Coffee grinder is broken").LogAndRespond(resp)
+	req := httptest.NewRequest("GET", "/priv/doc", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	NewHTTPError(418, "Coffee grinder is broken").LogAndRespond(resp, req)
 	this.Assert().Equal(418, resp.Code)
 	this.Assert().Equal("no-store", resp.Header().Get("Cache-Control"))
-	this.Assert().Equal("I'm a teapot\n", resp.Body.String())
+	this.Assert().Equal("text/html; charset=utf-8", resp.Header().Get("Content-Type"))
+	this.Assert().Contains(resp.Body.String(), "<h1>418 I&#39;m a teapot</h1>")
+	this.Assert().Contains(resp.Body.String(), "Error code: i_m_a_teapot")
+	this.Assert().Contains(resp.Body.String(), "Request ID: abc-123")
+	this.Assert().NotContains(resp.Body.String(), "Coffee grinder")
+	this.Assert().Contains(this.logOut.String(), `Coffee grinder is broken (request ID "abc-123")`)
+}
+
+func (this *ErrorsSuite) TestLogAndRespondJSON() {
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/priv/doc", nil)
+	req.Header.Set("Accept", "application/json")
+	req = WithRequestID(req)
+	NewHTTPError(503, "Not packaging because reasons").WithCode("read_only").LogAndRespond(resp, req)
+	this.Assert().Equal(503, resp.Code)
+	this.Assert().Equal("application/json", resp.Header().Get("Content-Type"))
+	this.Assert().JSONEq(`{"status": 503, "statusText": "Service Unavailable", "code": "read_only", "requestId": "`+RequestID(req)+`", "message": "Service Unavailable"}`, resp.Body.String())
+	this.Assert().Contains(this.logOut.String(), `Not packaging because reasons (request ID "`+RequestID(req)+`")`)
+}
+
+func (this *ErrorsSuite) TestLogAndRespondJSONCategory() {
+	defer func() { jsonErrors = false }()
+	UseJSONErrors()
+	for _, test := range []struct {
+		err             *HTTPError
+		category, label string
+	}{
+		{NewHTTPError(400, "Not exactly 1 sign param"), ErrorConfigMismatch, "default for 4xx"},
+		{NewHTTPError(502, "Error fetching"), ErrorFetchFailure, "default for 502"},
+		{NewHTTPError(500, "Error signing"), ErrorSignFailure, "default for 500"},
+		{NewHTTPError(502, "Too large").WithCode("sxg_too_large").WithCategory(ErrorNotCacheable), ErrorNotCacheable, "explicit"},
+	} {
+		resp := httptest.NewRecorder()
+		// Regardless of the Accept header.
+		test.err.LogAndRespond(resp, httptest.NewRequest("GET", "/priv/doc", nil))
+		this.Assert().Equal("application/json", resp.Header().Get("Content-Type"), test.label)
+		this.Assert().Contains(resp.Body.String(), `"category":"`+test.category+`"`, test.label)
+		this.Assert().Contains(resp.Body.String(), `"message":"`+errorCategoryMessages[test.category]+`"`, test.label)
+	}
+}
+
+func (this *ErrorsSuite) TestWriteErrorPageAdminIsJSON() {
+	resp := httptest.NewRecorder()
+	WriteErrorPage(resp, httptest.NewRequest("GET", AdminPathPrefix+"certs", nil), 404, "")
+	this.Assert().Equal("application/json", resp.Header().Get("Content-Type"))
+	this.Assert().Contains(resp.Body.String(), `"code":"not_found"`)
+}
+
+func (this *ErrorsSuite) TestLoadErrorPageTemplate() {
+	dir, err := ioutil.TempDir("", "errors_test")
+	this.Require().NoError(err)
+	defer os.RemoveAll(dir)
+	defer func() { errorPageTemplate = defaultErrorPageTemplate }()
+
+	path := filepath.Join(dir, "error.html")
+	this.Require().NoError(ioutil.WriteFile(path, []byte(`<p>Example Co: {{.Code}} {{.RequestID}}</p>`), 0644))
+	this.Require().NoError(LoadErrorPageTemplate(path))
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	WriteErrorPage(resp, req, 502, "")
+	this.Assert().Equal(502, resp.Code)
+	this.Assert().Equal("<p>Example Co: bad_gateway abc-123</p>", resp.Body.String())
+
+	this.Require().NoError(ioutil.WriteFile(path, []byte(`{{.Details}}`), 0644))
+	this.Assert().Contains(errorString(LoadErrorPageTemplate(path)), "can't evaluate field Details")
+	this.Assert().Contains(errorString(LoadErrorPageTemplate(filepath.Join(dir, "missing.html"))), "parsing")
+}
+
+func (this *ErrorsSuite) TestRequestID() {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	this.Assert().Equal("abc-123", RequestID(req))
+
+	req.Header.Set(RequestIDHeader, "abc 123\r\nX-Injected: 1")
+	this.Assert().Regexp("^[0-9a-f]{32}$", RequestID(req))
+	this.Assert().NotEqual(RequestID(req), RequestID(req))
+	req = WithRequestID(req)
+	this.Assert().Equal(RequestID(req), RequestID(req))
+	this.Assert().Equal(req, WithRequestID(req))
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
 }
 
 func TestErrorsSuite(t *testing.T) {
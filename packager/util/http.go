@@ -66,12 +66,17 @@ var notForwardedRequestHeader = map[string]bool{
 }
 
 // Remove hop-by-hop headers, per https://tools.ietf.org/html/rfc7230#section-6.1.
+// TE is also removed, as it's connection-specific, and so forbidden in HTTP/2
+// responses and signed exchanges alike, per
+// https://tools.ietf.org/html/rfc7540#section-8.1.2.2.
 func RemoveHopByHopHeaders(h http.Header) {
 	if connections, ok := h[http.CanonicalHeaderKey("Connection")]; ok {
 		for _, connection := range connections {
-			headerNames := Comma.Split(connection, -1)
+			headerNames := Comma.Split(TrimHeaderValue(connection), -1)
 			for _, headerName := range headerNames {
-				h.Del(headerName)
+				if headerName != "" {
+					h.Del(headerName)
+				}
 			}
 		}
 	}
@@ -79,6 +84,7 @@ func RemoveHopByHopHeaders(h http.Header) {
 	for headerName, _ := range legacyHeaders {
 		h.Del(headerName)
 	}
+	h.Del("TE")
 }
 
 func haveInvalidForwardedRequestHeader(h string) string {
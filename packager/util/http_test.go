@@ -1,6 +1,7 @@
 package util
 
 import (
+	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,3 +15,20 @@ func TestQuotedString(t *testing.T) {
 	assert.Equal(t, `"abc"`, valueFrom(QuotedString("abc")))
 	assert.Equal(t, `"abc\"\\"`, valueFrom(QuotedString(`abc"\`)))
 }
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":        {" x-foo ,KEEP-ALIVE", "x-bar"},
+		"Content-Type":      {"text/html"},
+		"Keep-Alive":        {"timeout=5"},
+		"Te":                {"trailers"},
+		"Trailer":           {"Expires"},
+		"Transfer-Encoding": {"chunked"},
+		"Upgrade":           {"h2c"},
+		"X-Bar":             {"bar"},
+		"X-Baz":             {"baz"},
+		"X-Foo":             {"foo"},
+	}
+	RemoveHopByHopHeaders(h)
+	assert.Equal(t, http.Header{"Content-Type": {"text/html"}, "X-Baz": {"baz"}}, h)
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// Returns s if re matches exactly the strings beginning with s (e.g.
+// "/foo/.*"), and ok=false otherwise.
+func prefixOnly(re string) (s string, ok bool) {
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	parsed = parsed.Simplify()
+	subs := []*syntax.Regexp{parsed}
+	if parsed.Op == syntax.OpConcat {
+		subs = parsed.Sub
+	}
+	var prefix strings.Builder
+	for i, sub := range subs {
+		switch sub.Op {
+		case syntax.OpBeginText, syntax.OpEmptyMatch:
+		case syntax.OpLiteral:
+			if sub.Flags&syntax.FoldCase != 0 {
+				return "", false
+			}
+			prefix.WriteString(string(sub.Rune))
+		case syntax.OpStar:
+			// Escaped paths contain no newlines, so "." is as good
+			// as "(?s:.)".
+			anyChar := sub.Sub[0].Op == syntax.OpAnyChar || sub.Sub[0].Op == syntax.OpAnyCharNotNL
+			return prefix.String(), anyChar && i == len(subs)-1
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// Returns warnings about likely mistakes in the interaction of PathRE and
+// PathExcludeRE, for a pattern that has already been validated. Both are
+// full-match regexps on the escaped path, which always begins with "/", so
+// patterns written as if they were unanchored or prefix matches may
+// silently exclude nothing, or everything.
+//
+// This is a heuristic, based on the patterns' literal prefixes; it has no
+// false positives, but many false negatives.
+func PathREWarnings(pattern *URLPattern) []string {
+	var warnings []string
+	pathRE := defaultPathRegexp
+	if pattern.PathRE != nil {
+		pathRE = *pattern.PathRE
+	}
+	pathPrefix, _ := regexp.MustCompile(pathRE).LiteralPrefix()
+	if pathPrefix != "" && !strings.HasPrefix(pathPrefix, "/") {
+		warnings = append(warnings, fmt.Sprintf(
+			"PathRE %q matches no paths, as paths begin with \"/\"", pathRE))
+	}
+	for _, exclude := range pattern.PathExcludeRE {
+		excludePrefix, complete := regexp.MustCompile(exclude).LiteralPrefix()
+		if allPrefix, ok := prefixOnly(exclude); exclude == pathRE || ok && strings.HasPrefix(pathPrefix, allPrefix) {
+			warnings = append(warnings, fmt.Sprintf(
+				"PathExcludeRE %q excludes every path matched by PathRE %q, so the URLSet matches nothing", exclude, pathRE))
+		} else if excludePrefix != "" && !strings.HasPrefix(excludePrefix, "/") {
+			warnings = append(warnings, fmt.Sprintf(
+				"PathExcludeRE %q excludes nothing, as it must match the whole path, which begins with \"/\"", exclude))
+		} else if !strings.HasPrefix(excludePrefix, pathPrefix) && !strings.HasPrefix(pathPrefix, excludePrefix) {
+			warnings = append(warnings, fmt.Sprintf(
+				"PathExcludeRE %q excludes nothing, as no path matched by PathRE %q begins with %q", exclude, pathRE, excludePrefix))
+		} else if complete && strings.HasSuffix(excludePrefix, "/") {
+			warnings = append(warnings, fmt.Sprintf(
+				"PathExcludeRE %q excludes only that exact path, not the paths under it; did you mean %q?", exclude, exclude+".*"))
+		}
+	}
+	return warnings
+}
+
+// Returns warnings about likely misconfigurations that aren't errors.
+func (config *Config) Warnings() []string {
+	var warnings []string
+	maxOriginRequests := config.MaxOriginRequests
+	if maxOriginRequests == 0 {
+		maxOriginRequests = DefaultMaxOriginRequests
+	}
+	for i, urlSet := range config.URLSet {
+		if urlSet.Fetch != nil {
+			for _, w := range PathREWarnings(urlSet.Fetch) {
+				warnings = append(warnings, fmt.Sprintf("URLSet.%d.Fetch: %s", i, w))
+			}
+		}
+		if urlSet.Sign != nil {
+			for _, w := range PathREWarnings(urlSet.Sign) {
+				warnings = append(warnings, fmt.Sprintf("URLSet.%d.Sign: %s", i, w))
+			}
+		}
+		if urlSet.LargeDocumentMaxLength > 0 && urlSet.LargeDocumentMaxLength <= urlSet.BodyLength() {
+			warnings = append(warnings, fmt.Sprintf(
+				"URLSet.%d.LargeDocumentMaxLength (%d) has no effect, as it's not above MaxBodyLength (%d)",
+				i, urlSet.LargeDocumentMaxLength, urlSet.BodyLength()))
+		}
+		if urlSet.MaxRedirects >= maxOriginRequests {
+			warnings = append(warnings, fmt.Sprintf(
+				"URLSet.%d.MaxRedirects (%d) is unreachable; MaxOriginRequests (%d) allows at most %d redirects",
+				i, urlSet.MaxRedirects, maxOriginRequests, maxOriginRequests-1))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"github.com/pkg/errors"
+)
+
+// A named set of overrides to the top-level config, e.g. for staging
+// instances that share a config file with production, selected with the
+// -profile flag.
+//
+// The cert and key fields are never inherited from the top level, so that a
+// profile can't accidentally sign with the production key: CertFile and
+// KeyFile must be specified, and NextCert, SecondaryCert, and ACMEConfig apply
+// only if specified here. OCSPCache defaults to the top-level one with "." and
+// the profile name appended. The remaining fields override the top level only
+// if set.
+type ProfileConfig struct {
+	CertFile      string
+	KeyFile       string
+	KeyPassphrase string
+	CSRFile       string
+	NewCertFile   string
+	OCSPCache     string
+	NextCert      *NextCertConfig
+	SecondaryCert *SecondaryCertConfig
+	ACMEConfig    *ACMEConfig
+
+	SignatureLifetime string
+	ReadOnlyFile      string
+	URLSet            []URLSet
+}
+
+func validateProfile(name string, profile *ProfileConfig) error {
+	if profile == nil {
+		return errors.Errorf("Profile.%s must not be empty", name)
+	}
+	if profile.CertFile == "" {
+		return errors.Errorf("Profile.%s must specify CertFile", name)
+	}
+	if profile.KeyFile == "" {
+		return errors.Errorf("Profile.%s must specify KeyFile", name)
+	}
+	return nil
+}
+
+// Overrides the top-level fields of config with those of the named profile.
+func (config *Config) applyProfile(name string) error {
+	profile, ok := config.Profile[name]
+	if !ok {
+		return errors.Errorf("no such profile %q", name)
+	}
+	config.CertFile = profile.CertFile
+	config.KeyFile = profile.KeyFile
+	config.KeyPassphrase = profile.KeyPassphrase
+	config.CSRFile = profile.CSRFile
+	config.NewCertFile = profile.NewCertFile
+	config.NextCert = profile.NextCert
+	config.SecondaryCert = profile.SecondaryCert
+	config.ACMEConfig = profile.ACMEConfig
+	if profile.OCSPCache != "" {
+		config.OCSPCache = profile.OCSPCache
+	} else {
+		config.OCSPCache += "." + name
+	}
+	if profile.SignatureLifetime != "" {
+		config.SignatureLifetime = profile.SignatureLifetime
+	}
+	if profile.ReadOnlyFile != "" {
+		config.ReadOnlyFile = profile.ReadOnlyFile
+	}
+	if len(profile.URLSet) > 0 {
+		config.URLSet = profile.URLSet
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// Identifies a request across the frontend, the packager, and the origin, so
+// that their logs can be correlated. The packager forwards it to the origin,
+// echoes it in responses, and includes it in error pages.
+const RequestIDHeader = "X-AmpPkg-Request-Id"
+
+// Valid request IDs are tokens, per
+// https://tools.ietf.org/html/rfc7230#section-3.2.6, optionally with slashes,
+// of at most maxRequestIDLength. Others are replaced, so that they can't
+// inject into logs or headers.
+var requestIDPattern = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9a-zA-Z/]+$")
+
+const maxRequestIDLength = 128
+
+type requestIDKeyType struct{}
+
+var requestIDKey = requestIDKeyType{}
+
+// Returns the ID assigned to the request by WithRequestID, else the value of
+// its RequestIDHeader if valid, else a newly generated one.
+func RequestID(req *http.Request) string {
+	if id, ok := req.Context().Value(requestIDKey).(string); ok {
+		return id
+	}
+	if id := req.Header.Get(RequestIDHeader); id != "" && requestIDPattern.MatchString(id) && len(id) <= maxRequestIDLength {
+		return id
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		log.Println("Error generating request ID:", err)
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// Returns a copy of req annotated with its RequestID, so that later calls
+// return the same one. Returns req itself if it's already annotated.
+func WithRequestID(req *http.Request) *http.Request {
+	if _, ok := req.Context().Value(requestIDKey).(string); ok {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey, RequestID(req)))
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The X.509v3 extension containing a SignedCertificateTimestampList, per
+// https://tools.ietf.org/html/rfc6962#section-3.3.
+var sctListExtensionID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// Chrome requires at least 2 SCTs from distinct logs for certs with a
+// lifetime under 180 days, which covers all certs that can sign SXGs.
+const DefaultMinSCTs = 2
+
+// The length of a CT log ID, the SHA-256 of the log's public key.
+const ctLogIDLength = 32
+
+// Reads a TLS-style vector with a 2-byte length prefix from the front of
+// data, returning it and the remainder.
+func readVector16(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated length")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return nil, nil, errors.New("truncated vector")
+	}
+	return data[2 : 2+length], data[2+length:], nil
+}
+
+// Returns the log IDs of the SCTs embedded in the cert, in order. Their
+// signatures are not verified; a browser will do that.
+func EmbeddedSCTLogIDs(cert *x509.Certificate) ([][]byte, error) {
+	var ext []byte
+	for _, e := range cert.Extensions {
+		if e.Id.Equal(sctListExtensionID) {
+			ext = e.Value
+			break
+		}
+	}
+	if ext == nil {
+		return nil, nil
+	}
+	var list []byte
+	if rest, err := asn1.Unmarshal(ext, &list); err != nil || len(rest) > 0 {
+		return nil, errors.New("SCT list extension is not an OCTET STRING")
+	}
+	scts, rest, err := readVector16(list)
+	if err != nil || len(rest) > 0 {
+		return nil, errors.New("malformed SCT list")
+	}
+	var logIDs [][]byte
+	for len(scts) > 0 {
+		var sct []byte
+		if sct, scts, err = readVector16(scts); err != nil {
+			return nil, errors.Wrap(err, "malformed SCT list")
+		}
+		// Version (1 byte), then log ID.
+		if len(sct) < 1+ctLogIDLength {
+			return nil, errors.New("malformed SCT")
+		}
+		if sct[0] != 0 {
+			return nil, errors.Errorf("unknown SCT version %d", sct[0])
+		}
+		logIDs = append(logIDs, sct[1:1+ctLogIDLength])
+	}
+	return logIDs, nil
+}
+
+// Returns nil if the cert has embedded SCTs from at least minSCTs distinct
+// logs among those in qualifying (base64 log IDs), or from any logs if
+// qualifying is empty; otherwise the appropriate error. Chrome enforces CT
+// when verifying SXGs, so a cert that fails this will likely produce SXGs
+// that fail verification.
+func CheckEmbeddedSCTs(cert *x509.Certificate, qualifying []string, minSCTs int) error {
+	logIDs, err := EmbeddedSCTLogIDs(cert)
+	if err != nil {
+		return errors.Wrap(err, "parsing embedded SCTs")
+	}
+	allowed := map[string]bool{}
+	for _, id := range qualifying {
+		allowed[id] = true
+	}
+	logs := map[string]bool{}
+	var unknown []string
+	for _, id := range logIDs {
+		encoded := base64.StdEncoding.EncodeToString(id)
+		if len(allowed) > 0 && !allowed[encoded] {
+			unknown = append(unknown, encoded)
+			continue
+		}
+		logs[encoded] = true
+	}
+	if len(logs) < minSCTs {
+		msg := "Certificate has embedded SCTs from %d qualifying CT log(s), but at least %d are required"
+		if len(unknown) > 0 {
+			return errors.Errorf(msg+"; SCTs from unlisted logs: [%s]", len(logs), minSCTs, strings.Join(unknown, ", "))
+		}
+		return errors.Errorf(msg, len(logs), minSCTs)
+	}
+	return nil
+}
@@ -18,11 +18,17 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
+	"math/big"
 	"time"
 
 	"github.com/WICG/webpackage/go/signedexchange"
@@ -31,6 +37,10 @@ import (
 
 const CertURLPrefix = "/amppkg/cert"
 
+// Served under CertURLPrefix, an alias for the cert chain currently used for
+// signing, for tooling that doesn't want to compute its CertName.
+const CurrentCertAlias = "current"
+
 // CertName returns the basename for the given cert, as served by this
 // packager's cert cache. Should be stable and unique (e.g.
 // content-addressing). Clients should url.PathEscape this, just in case its
@@ -40,12 +50,53 @@ func CertName(cert *x509.Certificate) string {
 	return base64.RawURLEncoding.EncodeToString(sum[:])
 }
 
+// Identifies a signing key by the SHA-256 of its public key's
+// SubjectPublicKeyInfo, as in HPKP and `openssl pkey -pubout -outform DER |
+// sha256sum`, so that it's the same for every cert issued for the key.
+func KeyID(pub crypto.PublicKey) (string, error) {
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling public key")
+	}
+	sum := sha256.Sum256(spki)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
 const ValidityMapPath = "/amppkg/validity"
 const HealthzPath = "/healthz"
+const MetricsPath = "/metrics"
+const VersionPath = "/version"
+
+// Served by the signer, to re-sign recently signed exchanges. Like /priv/doc,
+// it's not meant to be exposed to the public.
+const ResignPath = "/priv/resign"
+
+// The admin endpoints are served under this prefix.
+const AdminPathPrefix = "/priv-amppkg/"
 
 // ParsePrivateKey returns the first PEM block that looks like a private key.
 func ParsePrivateKey(keyPem []byte) (crypto.PrivateKey, error) {
+	return ParseEncryptedPrivateKey(keyPem, nil)
+}
+
+// ParseEncryptedPrivateKey is like ParsePrivateKey, but also supports
+// encrypted PEM blocks, both legacy ("Proc-Type: 4,ENCRYPTED") and PKCS#8
+// ("ENCRYPTED PRIVATE KEY"). passphrase is called at most once, and only if
+// an encrypted block is found. If nil, encrypted blocks are an error.
+func ParseEncryptedPrivateKey(keyPem []byte, passphrase func() ([]byte, error)) (crypto.PrivateKey, error) {
 	var privkey crypto.PrivateKey
+	var password []byte
+	getPassword := func() ([]byte, error) {
+		if password != nil {
+			return password, nil
+		}
+		if passphrase == nil {
+			return nil, errors.New("private key is encrypted, but no passphrase was given")
+		}
+		var err error
+		password, err = passphrase()
+		return password, errors.Wrap(err, "getting passphrase")
+	}
 	for {
 		var pemBlock *pem.Block
 		pemBlock, keyPem = pem.Decode(keyPem)
@@ -53,8 +104,24 @@ func ParsePrivateKey(keyPem []byte) (crypto.PrivateKey, error) {
 			return nil, errors.New("invalid PEM block in private key file")
 		}
 
+		der := pemBlock.Bytes
+		if pemBlock.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(pemBlock) {
+			password, err := getPassword()
+			if err != nil {
+				return nil, err
+			}
+			if pemBlock.Type == "ENCRYPTED PRIVATE KEY" {
+				der, err = decryptPKCS8(der, password)
+			} else {
+				der, err = x509.DecryptPEMBlock(pemBlock, password)
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "decrypting private key")
+			}
+		}
+
 		var err error
-		privkey, err = signedexchange.ParsePrivateKey(pemBlock.Bytes)
+		privkey, err = parsePrivateKeyDER(der)
 		if err == nil {
 			return privkey, nil
 		}
@@ -66,17 +133,148 @@ func ParsePrivateKey(keyPem []byte) (crypto.PrivateKey, error) {
 	}
 }
 
+// Like signedexchange.ParsePrivateKey, but returns PKCS#8 keys of any type,
+// so that ValidateSigningKey can explain why unsupported ones are rejected.
+func parsePrivateKeyDER(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return signedexchange.ParsePrivateKey(der)
+}
+
+// How to obtain a key that browsers accept, appended to key type errors.
+const signingKeyAdvice = "signed exchanges must be signed with an ECDSA P-256 key (the only kind browsers currently verify) or, per the spec, P-384. " +
+	"To generate one, along with a CSR for it: amppkg gencsr -domains example.com"
+
+// Returns nil if the key can sign exchanges, i.e. it is an ECDSA key on
+// curve P-256 or P-384, per
+// https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#signature-algorithm.
+// Otherwise, returns an error that explains what is supported.
+func ValidateSigningKey(key crypto.PrivateKey) error {
+	// All private keys in the standard library implement crypto.Signer.
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.Errorf("unsupported private key type %T; %s", key, signingKeyAdvice)
+	}
+	switch pub := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256(), elliptic.P384():
+			return nil
+		}
+		return errors.Errorf("ECDSA keys on curve %s are not supported; %s", pub.Curve.Params().Name, signingKeyAdvice)
+	case *rsa.PublicKey:
+		return errors.Errorf("RSA keys (this one is %d-bit) are not supported; %s", pub.N.BitLen(), signingKeyAdvice)
+	case ed25519.PublicKey:
+		return errors.Errorf("Ed25519 keys are not supported; %s", signingKeyAdvice)
+	default:
+		return errors.Errorf("%T keys are not supported; %s", pub, signingKeyAdvice)
+	}
+}
+
+// The CanSignHttpExchanges extension, per
+// https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#cross-origin-cert-req.
+// 0x05, 0x00 is the DER encoding of NULL.
+var canSignHttpExchangesExtension = pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 22}, Value: []byte{0x05, 0x00}}
+
 func hasCanSignHttpExchangesExtension(cert *x509.Certificate) bool {
-	// https://wicg.github.io/webpackage/draft-yasskin-httpbis-origin-signed-exchanges-impl.html#cross-origin-cert-req
 	for _, ext := range cert.Extensions {
-		// 0x05, 0x00 is the DER encoding of NULL.
-		if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 22}) && bytes.Equal(ext.Value, []byte{0x05, 0x00}) {
+		if ext.Id.Equal(canSignHttpExchangesExtension.Id) && bytes.Equal(ext.Value, canSignHttpExchangesExtension.Value) {
 			return true
 		}
 	}
 	return false
 }
 
+// Returns a DER-encoded certificate signing request for an SXG cert covering
+// the given domains, signed by key. It requests the CanSignHttpExchanges
+// extension, and uses the first domain as the subject's CommonName, as most
+// CAs expect.
+func CreateSXGCertificateRequest(key crypto.Signer, domains []string) ([]byte, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("must specify at least one domain")
+	}
+	if err := ValidateSigningKey(key); err != nil {
+		return nil, err
+	}
+	template := x509.CertificateRequest{
+		Subject:         pkix.Name{CommonName: domains[0]},
+		DNSNames:        domains,
+		ExtraExtensions: []pkix.Extension{canSignHttpExchangesExtension},
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating CSR")
+	}
+	return csr, nil
+}
+
+// The lifetime of a cert from CreateSelfSignedSXGCertificate; the maximum
+// allowed by CanSignHttpExchanges.
+const selfSignedCertLifetime = 90 * 24 * time.Hour
+
+// Returns a self-signed SXG cert covering the given domains, for local
+// development. Browsers reject it unless told to ignore cert errors for its
+// public key (e.g. Chrome's --ignore-certificate-errors-spki-list). It has no
+// OCSP responder URL, so the packager generates its OCSP responses.
+func CreateSelfSignedSXGCertificate(key crypto.Signer, domains []string, now time.Time) (*x509.Certificate, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("must specify at least one domain")
+	}
+	if err := ValidateSigningKey(key); err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, errors.Wrap(err, "generating serial number")
+	}
+	template := x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: domains[0], Organization: []string{"amppkg development"}},
+		DNSNames:        domains,
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(-time.Hour).Add(selfSignedCertLifetime),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: []pkix.Extension{canSignHttpExchangesExtension},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cert")
+	}
+	return x509.ParseCertificate(der)
+}
+
+// The TLS Feature extension, per https://tools.ietf.org/html/rfc7633#section-6.
+var tlsFeatureExtensionID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// The status_request TLS extension, per https://tools.ietf.org/html/rfc6066#section-8.
+const statusRequestFeature = 5
+
+// Returns true if the cert has the OCSP must-staple extension, i.e. a TLS
+// Feature extension including status_request. Clients may reject such a cert
+// if it comes without a valid OCSP response. False if cert is nil.
+func HasMustStaple(cert *x509.Certificate) bool {
+	if cert == nil {
+		return false
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(tlsFeatureExtensionID) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false
+		}
+		for _, feature := range features {
+			if feature == statusRequestFeature {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Returns the Duration of time before cert expires with given deadline.
 // Note that the certExpiryDeadline should be the expected SXG expiration time.
 // Returns error if cert is already expired. This will be used to periodically check if cert
@@ -106,18 +304,55 @@ func CanSignHttpExchanges(cert *x509.Certificate) error {
 	return nil
 }
 
-// Returns nil if the certificate matches the private key and domain, else the appropriate error.
-func CertificateMatches(cert *x509.Certificate, priv crypto.PrivateKey, domain string) error {
-	certPubKey := cert.PublicKey.(*ecdsa.PublicKey)
-	pubKey := priv.(*ecdsa.PrivateKey).PublicKey
-	if certPubKey.Curve != pubKey.Curve {
-		return errors.New("PublicKey.Curve not match")
+// Returns the subset of domains that are not covered by the cert's
+// subjectAltNames (or, for legacy certs, its CommonName), in the same order.
+func UncoveredDomains(cert *x509.Certificate, domains []string) []string {
+	var uncovered []string
+	for _, domain := range domains {
+		if err := cert.VerifyHostname(domain); err != nil {
+			uncovered = append(uncovered, domain)
+		}
 	}
-	if certPubKey.X.Cmp(pubKey.X) != 0 {
-		return errors.New("PublicKey.X not match")
+	return uncovered
+}
+
+// Returns nil if the private key corresponds to the certificate's public key,
+// else the appropriate error. Without this check, the packager would produce
+// exchanges that fail verification in the browser.
+func KeyMatchesCertificate(cert *x509.Certificate, priv crypto.PrivateKey) error {
+	switch certPubKey := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		privKey, ok := priv.(*ecdsa.PrivateKey)
+		if !ok {
+			return errors.Errorf("PrivateKey type %T not match ECDSA PublicKey", priv)
+		}
+		if certPubKey.Curve != privKey.Curve {
+			return errors.New("PublicKey.Curve not match")
+		}
+		if certPubKey.X.Cmp(privKey.X) != 0 {
+			return errors.New("PublicKey.X not match")
+		}
+		if certPubKey.Y.Cmp(privKey.Y) != 0 {
+			return errors.New("PublicKey.Y not match")
+		}
+	case *rsa.PublicKey:
+		privKey, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return errors.Errorf("PrivateKey type %T not match RSA PublicKey", priv)
+		}
+		if certPubKey.N.Cmp(privKey.N) != 0 || certPubKey.E != privKey.E {
+			return errors.New("PublicKey.N or PublicKey.E not match")
+		}
+	default:
+		return errors.Errorf("Unsupported PublicKey type %T", cert.PublicKey)
 	}
-	if certPubKey.Y.Cmp(pubKey.Y) != 0 {
-		return errors.New("PublicKey.Y not match")
+	return nil
+}
+
+// Returns nil if the certificate matches the private key and domain, else the appropriate error.
+func CertificateMatches(cert *x509.Certificate, priv crypto.PrivateKey, domain string) error {
+	if err := KeyMatchesCertificate(cert, priv); err != nil {
+		return err
 	}
 	if err := cert.VerifyHostname(domain); err != nil {
 		return err
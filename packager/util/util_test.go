@@ -2,7 +2,19 @@ package util_test
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"testing"
 	"time"
 
@@ -56,6 +68,56 @@ func TestParsePrivateKey(t *testing.T) {
 	assert.Equal(t, elliptic.P256(), pkgt.B3Key.(*ecdsa.PrivateKey).PublicKey.Curve)
 }
 
+func TestParseEncryptedPrivateKey(t *testing.T) {
+	passphrase := func() ([]byte, error) { return []byte("amppkg"), nil }
+	wrongPassphrase := func() ([]byte, error) { return []byte("wrong"), nil }
+	for _, file := range []string{"server_encrypted.privkey", "server_pkcs8_encrypted.privkey"} {
+		keyPem, err := ioutil.ReadFile("../../testdata/b3/" + file)
+		require.NoError(t, err)
+
+		key, err := util.ParseEncryptedPrivateKey(keyPem, passphrase)
+		require.NoError(t, err, file)
+		assert.Equal(t, pkgt.B3Key, key, file)
+
+		_, err = util.ParseEncryptedPrivateKey(keyPem, wrongPassphrase)
+		assert.Contains(t, errorFrom(err), "decrypting private key", file)
+
+		_, err = util.ParsePrivateKey(keyPem)
+		assert.Contains(t, errorFrom(err), "no passphrase was given", file)
+	}
+}
+
+func TestValidateSigningKey(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384()} {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		require.NoError(t, err)
+		assert.NoError(t, util.ValidateSigningKey(key), curve.Params().Name)
+	}
+
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	require.NoError(t, err)
+	assert.Contains(t, errorFrom(util.ValidateSigningKey(p224Key)), "ECDSA keys on curve P-224 are not supported")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	assert.Contains(t, errorFrom(util.ValidateSigningKey(rsaKey)), "RSA keys (this one is 1024-bit) are not supported; signed exchanges must be signed with an ECDSA P-256 key")
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	assert.Contains(t, errorFrom(util.ValidateSigningKey(ed25519Key)), "Ed25519 keys are not supported")
+}
+
+func TestParsePKCS8PrivateKeyOfAnyType(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	require.NoError(t, err)
+
+	key, err := util.ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	assert.Equal(t, ed25519Key, key)
+}
+
 func TestCanSignHttpExchangesExtension(t *testing.T) {
 	// Leaf node has the extension.
 	assert.Nil(t, util.CanSignHttpExchanges(pkgt.B3Certs[0]))
@@ -63,6 +125,137 @@ func TestCanSignHttpExchangesExtension(t *testing.T) {
 	assert.EqualError(t, util.CanSignHttpExchanges(pkgt.B3Certs[1]), "Certificate is missing CanSignHttpExchanges extension")
 }
 
+// Returns a TLS-style vector of data with a 2-byte length prefix.
+func vector16(data []byte) []byte {
+	return append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+// Returns a self-signed cert with embedded SCTs from the given logs. The SCT
+// signatures are garbage, as they aren't checked.
+func certWithSCTs(t *testing.T, logIDs ...[]byte) *x509.Certificate {
+	var scts []byte
+	for _, logID := range logIDs {
+		sct := append([]byte{0}, logID...)
+		sct = append(sct, make([]byte, 8)...)     // timestamp
+		sct = append(sct, 0, 0)                   // extensions
+		sct = append(sct, 4, 3)                   // SHA-256, ECDSA
+		sct = append(sct, vector16([]byte{1})...) // signature
+		scts = append(scts, vector16(sct)...)
+	}
+	ext, err := asn1.Marshal(vector16(scts))
+	require.NoError(t, err)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "example.com"},
+		NotBefore:       time.Now(),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestCheckEmbeddedSCTs(t *testing.T) {
+	logID := func(n uint32) []byte {
+		id := make([]byte, 32)
+		binary.BigEndian.PutUint32(id, n)
+		return id
+	}
+	encoded := func(n uint32) string { return base64.StdEncoding.EncodeToString(logID(n)) }
+
+	cert := certWithSCTs(t, logID(1), logID(2), logID(2))
+	logIDs, err := util.EmbeddedSCTLogIDs(cert)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{logID(1), logID(2), logID(2)}, logIDs)
+
+	assert.NoError(t, util.CheckEmbeddedSCTs(cert, nil, 2))
+	assert.NoError(t, util.CheckEmbeddedSCTs(cert, []string{encoded(1), encoded(2)}, 2))
+	// SCTs from the same log count once.
+	assert.EqualError(t, util.CheckEmbeddedSCTs(cert, nil, 3),
+		"Certificate has embedded SCTs from 2 qualifying CT log(s), but at least 3 are required")
+	assert.EqualError(t, util.CheckEmbeddedSCTs(cert, []string{encoded(1), encoded(3)}, 2),
+		"Certificate has embedded SCTs from 1 qualifying CT log(s), but at least 2 are required; SCTs from unlisted logs: ["+encoded(2)+", "+encoded(2)+"]")
+
+	// The test certs have no SCTs.
+	logIDs, err = util.EmbeddedSCTLogIDs(pkgt.B3Certs[0])
+	require.NoError(t, err)
+	assert.Empty(t, logIDs)
+	assert.EqualError(t, util.CheckEmbeddedSCTs(pkgt.B3Certs[0], nil, 2),
+		"Certificate has embedded SCTs from 0 qualifying CT log(s), but at least 2 are required")
+}
+
+func TestHasMustStaple(t *testing.T) {
+	assert.False(t, util.HasMustStaple(pkgt.B3Certs[0]))
+	assert.False(t, util.HasMustStaple(nil))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	for _, test := range []struct {
+		features []byte
+		expected bool
+	}{
+		{[]byte{0x30, 0x03, 0x02, 0x01, 0x05}, true},                   // status_request
+		{[]byte{0x30, 0x03, 0x02, 0x01, 0x11}, false},                  // status_request_v2 only
+		{[]byte{0x30, 0x06, 0x02, 0x01, 0x11, 0x02, 0x01, 0x05}, true}, // both
+	} {
+		template := x509.Certificate{
+			SerialNumber:    big.NewInt(1),
+			NotBefore:       time.Now(),
+			NotAfter:        time.Now().Add(24 * time.Hour),
+			ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}, Value: test.features}},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, util.HasMustStaple(cert), "%x", test.features)
+	}
+}
+
+func TestCreateSXGCertificateRequest(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := util.CreateSXGCertificateRequest(key, []string{"example.com", "www.example.com"})
+	require.NoError(t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	require.NoError(t, err)
+	require.NoError(t, csr.CheckSignature())
+	assert.Equal(t, "example.com", csr.Subject.CommonName)
+	assert.Equal(t, []string{"example.com", "www.example.com"}, csr.DNSNames)
+	assert.Contains(t, csr.Extensions, pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 22}, Value: []byte{0x05, 0x00}})
+
+	_, err = util.CreateSXGCertificateRequest(key, nil)
+	assert.EqualError(t, err, "must specify at least one domain")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = util.CreateSXGCertificateRequest(rsaKey, []string{"example.com"})
+	assert.Contains(t, errorFrom(err), "RSA keys (this one is 2048-bit) are not supported")
+}
+
+func TestCreateSelfSignedSXGCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	now := time.Now()
+	cert, err := util.CreateSelfSignedSXGCertificate(key, []string{"example.com", "localhost"}, now)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", cert.Subject.CommonName)
+	assert.NoError(t, util.CertificateMatches(cert, key, "localhost"))
+	assert.NoError(t, cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature))
+	// It's usable, other than lacking an OCSP responder, for which the
+	// packager generates responses.
+	problems := util.CheckCertificate([]*x509.Certificate{cert}, key, []string{"example.com"}, now)
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0].Error(), "no OCSP responder URL")
+
+	_, err = util.CreateSelfSignedSXGCertificate(key, nil, now)
+	assert.EqualError(t, err, "must specify at least one domain")
+}
+
 func TestParseCertificate(t *testing.T) {
 	assert.Nil(t, util.CertificateMatches(pkgt.B3Certs[0], pkgt.B3Key, "amppackageexample.com"))
 }
@@ -90,3 +283,88 @@ func TestParse91DaysCertificate(t *testing.T) {
 	assert.Contains(t, errorFrom(util.CanSignHttpExchanges(pkgt.B3Certs91Days[0])),
 		"Certificate MUST have a Validity Period no greater than 90 days")
 }
+
+func TestUncoveredDomains(t *testing.T) {
+	assert.Empty(t, util.UncoveredDomains(pkgt.B3Certs[0], []string{"amppackageexample.com", "www.amppackageexample.com"}))
+	assert.Equal(t, []string{"example.com", "amppackageexample2.com"},
+		util.UncoveredDomains(pkgt.B3Certs[0], []string{"example.com", "amppackageexample.com", "amppackageexample2.com"}))
+}
+
+func TestKeyMatchesCertificate(t *testing.T) {
+	assert.Nil(t, util.KeyMatchesCertificate(pkgt.B3Certs[0], pkgt.B3Key))
+	assert.Contains(t, errorFrom(util.KeyMatchesCertificate(pkgt.B3Certs[0], pkgt.B3Key2)), "PublicKey.X not match")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	assert.Contains(t, errorFrom(util.KeyMatchesCertificate(pkgt.B3Certs[0], rsaKey)), "PrivateKey type *rsa.PrivateKey not match ECDSA PublicKey")
+}
+
+func TestCheckCertChainOrder(t *testing.T) {
+	leaf, ca := pkgt.B3Certs[0], pkgt.B3Certs[1]
+	assert.NoError(t, util.CheckCertChainOrder([]*x509.Certificate{leaf, ca}))
+	assert.NoError(t, util.CheckCertChainOrder([]*x509.Certificate{ca}))
+	assert.EqualError(t, util.CheckCertChainOrder(nil), "Cert chain is empty")
+	assert.Contains(t, errorFrom(util.CheckCertChainOrder([]*x509.Certificate{ca, leaf})),
+		`Cert chain is out of order: cert 1 ("amppackageexample.com") is issued by cert 0 ("Fake CA")`)
+	assert.Contains(t, errorFrom(util.CheckCertChainOrder([]*x509.Certificate{leaf, pkgt.B3Certs2[0]})),
+		`Cert chain is broken: cert 0 ("amppackageexample.com") is not issued by cert 1 ("amppackageexample2.com")`)
+	assert.NoError(t, util.CheckCertChainOrder([]*x509.Certificate{leaf}))
+	assert.Contains(t, errorFrom(util.CheckCertChainOrder([]*x509.Certificate{leaf, ca, pkgt.B3Certs2[0]})),
+		`Cert chain is out of order: cert 2 ("amppackageexample2.com") is issued by cert 1 ("Fake CA")`)
+}
+
+func TestCheckValidityWindow(t *testing.T) {
+	cert := pkgt.B3Certs[0]
+	assert.NoError(t, util.CheckValidityWindow(cert, cert.NotBefore.Add(24*time.Hour)))
+	assert.EqualError(t, util.CheckValidityWindow(cert, cert.NotBefore.Add(-time.Second)),
+		"Certificate is not valid until 2019-05-09T05:43:32Z; if it should be, check the system clock")
+	assert.EqualError(t, util.CheckValidityWindow(cert, cert.NotAfter.Add(time.Second)),
+		"Certificate expired at 2019-08-07T05:43:32Z; renew it")
+}
+
+func TestCheckCertChainComplete(t *testing.T) {
+	leaf, ca := pkgt.B3Certs[0], pkgt.B3Certs[1]
+	assert.NoError(t, util.CheckCertChainComplete([]*x509.Certificate{leaf, ca}))
+	assert.NoError(t, util.CheckCertChainComplete([]*x509.Certificate{ca}))
+	assert.Contains(t, errorFrom(util.CheckCertChainComplete([]*x509.Certificate{leaf})),
+		`Cert chain contains only the leaf; append its issuer ("Fake CA")`)
+}
+
+func TestCheckCertificate(t *testing.T) {
+	now := pkgt.B3Certs[0].NotBefore.Add(24 * time.Hour)
+	// The test certs lack an OCSP responder URL.
+	problems := util.CheckCertificate(pkgt.B3Certs, pkgt.B3Key, []string{"amppackageexample.com"}, now)
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0].Error(), "Cert has no OCSP responder URL")
+
+	problems = util.CheckCertificate(pkgt.B3Certs[:1], pkgt.B3Key2, []string{"amppackageexample.com", "example.com"}, pkgt.B3Certs[0].NotAfter.Add(time.Hour))
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	require.Len(t, messages, 4)
+	assert.Contains(t, messages[0], "Certificate expired")
+	assert.Contains(t, messages[1], "Key does not match the cert")
+	assert.Contains(t, messages[2], "Cert does not cover [example.com]")
+	assert.Contains(t, messages[3], "Cert has no OCSP responder URL")
+
+	problems = util.CheckCertificate(pkgt.B3Certs, pkgt.B3KeyP521, []string{"amppackageexample.com"}, now)
+	require.Len(t, problems, 2)
+	assert.Contains(t, problems[0].Error(), "ECDSA keys on curve P-521 are not supported")
+
+	assert.Contains(t, util.CheckCertificate(pkgt.B3Certs91Days, pkgt.B3Key, []string{"amppackageexample.com"}, now)[0].Error(),
+		"Validity Period no greater than 90 days")
+}
+
+func TestKeyID(t *testing.T) {
+	id, err := util.KeyID(pkgt.B3Certs[0].PublicKey)
+	require.NoError(t, err)
+	sum := sha256.Sum256(pkgt.B3Certs[0].RawSubjectPublicKeyInfo)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(sum[:]), id)
+
+	keyID, err := util.KeyID(pkgt.B3Key.(*ecdsa.PrivateKey).Public())
+	require.NoError(t, err)
+	assert.Equal(t, id, keyID)
+
+	_, err = util.KeyID("not a key")
+	assert.Error(t, err)
+}
@@ -16,12 +16,52 @@ package validitymap
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
+
+	"github.com/WICG/webpackage/go/signedexchange/cbor"
+	"github.com/ampproject/amppackager/packager/util"
+	"github.com/pkg/errors"
+)
+
+// The query params of a validity URL that name the exchange's sign URL and
+// the Digest header value of its payload.
+const (
+	signParam   = "sign"
+	digestParam = "digest"
 )
 
+// The most exchanges whose signatures are remembered. Each takes roughly a
+// kilobyte.
+const DefaultMaxEntries = 10000
+
+// How long clients may cache the validity data for a known exchange, so that
+// they see newer signatures reasonably soon.
+const maxAge = time.Hour
+
+// Identifies an exchange. A signature covers the payload via its digest, so a
+// newer signature for the same sign URL but a different payload is of no use
+// to a client holding the older one.
+type exchangeKey struct {
+	signURL string
+	digest  string
+}
+
+type validity struct {
+	signature string
+	expires   time.Time
+}
+
 type ValidityMap struct {
 	validityMap []byte
+	clock       util.Clock
+	maxEntries  int
+	lk          sync.Mutex
+	// The latest signatures, by exchange.
+	entries map[exchangeKey]validity
 }
 
 func New() (*ValidityMap, error) {
@@ -29,12 +69,110 @@ func New() (*ValidityMap, error) {
 	// https://tools.ietf.org/html/draft-yasskin-httpbis-origin-signed-exchanges-impl-00#section-3.6
 	// This is an empty validity map `{}`.
 	this.validityMap = []byte("\xA0")
+	this.clock = util.SystemClock{}
+	this.maxEntries = DefaultMaxEntries
+	this.entries = map[exchangeKey]validity{}
 	return this, nil
 }
 
+// Returns the validity URL for the exchange with the given sign URL and Digest
+// header value. It's on the signing domain, as required by the spec, so the
+// publisher's frontend must route it to the packager, as with the cert URLs.
+func ValidityURL(signURL *url.URL, digest string) *url.URL {
+	return signURL.ResolveReference(&url.URL{
+		Path:     util.ValidityMapPath,
+		RawQuery: url.Values{signParam: {signURL.String()}, digestParam: {digest}}.Encode(),
+	})
+}
+
+// Remembers signature, the Signature header value of the latest exchange for
+// signURL with the given Digest header value, until expires, to serve from
+// its ValidityURL. This lets clients holding an older exchange for signURL
+// with the same payload update its signature without refetching it.
+func (this *ValidityMap) Record(signURL string, digest string, signature string, expires time.Time) {
+	this.lk.Lock()
+	defer this.lk.Unlock()
+	key := exchangeKey{signURL, digest}
+	if _, ok := this.entries[key]; !ok && len(this.entries) >= this.maxEntries {
+		this.evict()
+	}
+	this.entries[key] = validity{signature, expires}
+}
+
+// Makes room for one more entry: removes any that have expired, or if none
+// have, an arbitrary one. Must be called with lk held.
+func (this *ValidityMap) evict() {
+	now := this.clock.Now()
+	for key, entry := range this.entries {
+		if !entry.expires.After(now) {
+			delete(this.entries, key)
+		}
+	}
+	if len(this.entries) < this.maxEntries {
+		return
+	}
+	for key := range this.entries {
+		delete(this.entries, key)
+		return
+	}
+}
+
+// Returns the unexpired entry for the exchange, if any.
+func (this *ValidityMap) lookup(signURL string, digest string) (validity, bool) {
+	this.lk.Lock()
+	defer this.lk.Unlock()
+	entry, ok := this.entries[exchangeKey{signURL, digest}]
+	if !ok || !entry.expires.After(this.clock.Now()) {
+		return validity{}, false
+	}
+	return entry, true
+}
+
+// Encodes the validity data `{"signatures": [signature]}`, per
+// https://tools.ietf.org/html/draft-yasskin-http-origin-signed-responses-05#section-3.6.
+func EncodeSignatures(signature string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := cbor.NewEncoder(&buf).EncodeMap([]*cbor.MapEntryEncoder{
+		cbor.GenerateMapEntry(func(keyE *cbor.Encoder, valueE *cbor.Encoder) {
+			keyE.EncodeTextString("signatures")
+			valueE.EncodeArrayHeader(1)
+			valueE.EncodeByteString([]byte(signature))
+		}),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding validity data")
+	}
+	return buf.Bytes(), nil
+}
+
 func (this *ValidityMap) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	resp.Header().Set("Content-Type", "application/cbor")
-	resp.Header().Set("Cache-Control", "public, max-age=604800")
 	resp.Header().Set("X-Content-Type-Options", "nosniff")
-	http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(this.validityMap))
+	signURL := req.URL.Query().Get(signParam)
+	if signURL == "" {
+		// The validity URL of exchanges signed before there were
+		// per-exchange validity URLs.
+		resp.Header().Set("Cache-Control", "public, max-age=604800")
+		http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(this.validityMap))
+		return
+	}
+	entry, ok := this.lookup(signURL, req.URL.Query().Get(digestParam))
+	if !ok {
+		// A signature may be recorded soon, so don't let this be
+		// cached.
+		resp.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(this.validityMap))
+		return
+	}
+	body, err := EncodeSignatures(entry.signature)
+	if err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, err).LogAndRespond(resp, req)
+		return
+	}
+	age := maxAge
+	if remaining := entry.expires.Sub(this.clock.Now()); remaining < age {
+		age = remaining
+	}
+	resp.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(age.Seconds())))
+	http.ServeContent(resp, req, "", time.Time{}, bytes.NewReader(body))
 }
@@ -1,9 +1,13 @@
 package validitymap
 
 import (
+	"bytes"
 	"io/ioutil"
+	"net/url"
 	"testing"
+	"time"
 
+	"github.com/WICG/webpackage/go/signedexchange/cbor"
 	"github.com/ampproject/amppackager/packager/mux"
 	pkgt "github.com/ampproject/amppackager/packager/testing"
 	"github.com/stretchr/testify/assert"
@@ -14,7 +18,7 @@ func TestValidityMap(t *testing.T) {
 	handler, err := New()
 	require.NoError(t, err)
 
-	resp := pkgt.Get(t, mux.New(nil, nil, handler, nil), "/amppkg/validity")
+	resp := pkgt.Get(t, mux.New(mux.Handlers{ValidityMap: handler}), "/amppkg/validity")
 	defer resp.Body.Close()
 	assert.Equal(t, "application/cbor", resp.Header.Get("Content-Type"))
 	assert.Equal(t, "public, max-age=604800", resp.Header.Get("Cache-Control"))
@@ -24,3 +28,92 @@ func TestValidityMap(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, []byte("\xA0"), body)
 }
+
+func TestValidityURL(t *testing.T) {
+	signURL, err := url.Parse("https://example.com/amp/page.html?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/amppkg/validity?digest=mi-sha256-03%3DAAAA&sign=https%3A%2F%2Fexample.com%2Famp%2Fpage.html%3Fx%3D1", ValidityURL(signURL, "mi-sha256-03=AAAA").String())
+}
+
+// Decodes validity data of the form {"signatures": [signature]}.
+func decodeSignature(t *testing.T, body []byte) string {
+	decoder := cbor.NewDecoder(bytes.NewReader(body))
+	n, err := decoder.DecodeMapHeader()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n)
+	key, err := decoder.DecodeTextString()
+	require.NoError(t, err)
+	require.Equal(t, "signatures", key)
+	n, err = decoder.DecodeArrayHeader()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n)
+	signature, err := decoder.DecodeByteString()
+	require.NoError(t, err)
+	return string(signature)
+}
+
+func TestRecordedSignature(t *testing.T) {
+	handler, err := New()
+	require.NoError(t, err)
+	clock := pkgt.NewFakeClock(time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC))
+	handler.clock = clock
+	signURL, err := url.Parse("https://example.com/amp/page.html")
+	require.NoError(t, err)
+	target := ValidityURL(signURL, "mi-sha256-03=AAAA").RequestURI()
+
+	// Unknown exchanges get an empty validity map.
+	resp := pkgt.Get(t, mux.New(mux.Handlers{ValidityMap: handler}), target)
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("\xA0"), body)
+
+	handler.Record(signURL.String(), "mi-sha256-03=AAAA", "sig1; sig=*AAAA*", clock.Now().Add(30*time.Minute))
+	handler.Record(signURL.String(), "mi-sha256-03=AAAA", "sig2; sig=*BBBB*", clock.Now().Add(7*24*time.Hour))
+	// A signature for a different payload doesn't replace it.
+	handler.Record(signURL.String(), "mi-sha256-03=CCCC", "sig3; sig=*CCCC*", clock.Now().Add(7*24*time.Hour))
+	resp = pkgt.Get(t, mux.New(mux.Handlers{ValidityMap: handler}), target)
+	assert.Equal(t, "application/cbor", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "public, max-age=3600", resp.Header.Get("Cache-Control"))
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "sig2; sig=*BBBB*", decodeSignature(t, body))
+
+	// The cache lifetime doesn't outlast the signature.
+	clock.Advance(7*24*time.Hour - 10*time.Minute)
+	resp = pkgt.Get(t, mux.New(mux.Handlers{ValidityMap: handler}), target)
+	assert.Equal(t, "public, max-age=600", resp.Header.Get("Cache-Control"))
+
+	clock.Advance(10 * time.Minute)
+	resp = pkgt.Get(t, mux.New(mux.Handlers{ValidityMap: handler}), target)
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+}
+
+func TestEviction(t *testing.T) {
+	handler, err := New()
+	require.NoError(t, err)
+	clock := pkgt.NewFakeClock(time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC))
+	handler.clock = clock
+	handler.maxEntries = 2
+
+	handler.Record("https://example.com/1", "d", "sig1", clock.Now().Add(time.Minute))
+	handler.Record("https://example.com/2", "d", "sig2", clock.Now().Add(time.Hour))
+	clock.Advance(2 * time.Minute)
+	// The expired entry makes room.
+	handler.Record("https://example.com/3", "d", "sig3", clock.Now().Add(time.Hour))
+	assert.Len(t, handler.entries, 2)
+	_, ok := handler.lookup("https://example.com/2", "d")
+	assert.True(t, ok)
+	_, ok = handler.lookup("https://example.com/3", "d")
+	assert.True(t, ok)
+
+	// Otherwise, an arbitrary one does.
+	handler.Record("https://example.com/4", "d", "sig4", clock.Now().Add(time.Hour))
+	assert.Len(t, handler.entries, 2)
+	_, ok = handler.lookup("https://example.com/4", "d")
+	assert.True(t, ok)
+
+	// Re-recording an existing entry evicts nothing.
+	handler.Record("https://example.com/4", "d", "sig4'", clock.Now().Add(time.Hour))
+	assert.Len(t, handler.entries, 2)
+}
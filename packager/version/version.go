@@ -0,0 +1,102 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Identifies the running build of amppkg, for correlating behavior changes
+// across a fleet with specific builds. The variables below are meant to be
+// set at link time, e.g.:
+//
+//	go build -ldflags "-X github.com/ampproject/amppackager/packager/version.Version=v1.2.3 ..."
+//
+// as build.sh does. Served at util.VersionPath.
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/ampproject/amppackager/packager/util"
+)
+
+// Set via -ldflags -X; see the package doc.
+var (
+	// The release, e.g. "v1.2.3", or the output of `git describe`. If
+	// unset, the module version recorded by `go get`, if any, is used.
+	Version = ""
+	// The full git commit hash.
+	Commit = ""
+	// The time of the build, in RFC 3339 format. For reproducible builds,
+	// build.sh uses the commit time.
+	BuildDate = ""
+)
+
+// A description of the running build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+// Describes the running build.
+func Get() Info {
+	version := Version
+	if version == "" {
+		version = "unknown"
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+			// "(devel)" if built from a source checkout.
+			version = info.Main.Version
+		}
+	}
+	return Info{
+		Version:   version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// A one-line description, for logs.
+func (this Info) String() string {
+	s := fmt.Sprintf("amppkg %s", this.Version)
+	if this.Commit != "" {
+		s += " (" + this.Commit + ")"
+	}
+	if this.BuildDate != "" {
+		s += " built " + this.BuildDate
+	}
+	return s + fmt.Sprintf(" with %s for %s", this.GoVersion, this.Platform)
+}
+
+type handler struct{}
+
+// Serves the result of Get as JSON.
+func Handler() http.Handler {
+	return handler{}
+}
+
+func (this handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(Get())
+	if err != nil {
+		util.NewHTTPError(http.StatusInternalServerError, "Error encoding version: ", err).LogAndRespond(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.Write(body)
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Sets the link-time variables, returning a func that restores them.
+func stamp(version, commit, buildDate string) func() {
+	oldVersion, oldCommit, oldBuildDate := Version, Commit, BuildDate
+	Version, Commit, BuildDate = version, commit, buildDate
+	return func() { Version, Commit, BuildDate = oldVersion, oldCommit, oldBuildDate }
+}
+
+func TestGet(t *testing.T) {
+	defer stamp("v1.2.3", "abc123", "2019-05-01T00:00:00Z")()
+	info := Get()
+	assert.Equal(t, "v1.2.3", info.Version)
+	assert.Equal(t, "abc123", info.Commit)
+	assert.Equal(t, "2019-05-01T00:00:00Z", info.BuildDate)
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.Equal(t, runtime.GOOS+"/"+runtime.GOARCH, info.Platform)
+	assert.Equal(t, "amppkg v1.2.3 (abc123) built 2019-05-01T00:00:00Z with "+runtime.Version()+" for "+info.Platform, info.String())
+}
+
+func TestGetUnstamped(t *testing.T) {
+	defer stamp("", "", "")()
+	info := Get()
+	assert.NotEmpty(t, info.Version)
+	assert.Equal(t, "amppkg "+info.Version+" with "+runtime.Version()+" for "+info.Platform, info.String())
+}
+
+func TestHandler(t *testing.T) {
+	defer stamp("v1.2.3", "abc123", "")()
+	resp := httptest.NewRecorder()
+	Handler().ServeHTTP(resp, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	var body map[string]string
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+	assert.Equal(t, "v1.2.3", body["version"])
+	assert.Equal(t, "abc123", body["commit"])
+	_, ok := body["buildDate"]
+	assert.False(t, ok)
+}